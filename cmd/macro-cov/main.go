@@ -0,0 +1,203 @@
+// 统计多个配置下条件分支的覆盖，找出从未执行的分支
+//
+//	macro-cov [-I dir] [-isystem dir] [-D name[=value]] [-U name] [-config 'A B=2' ...] [-merge file.json ...] [-format text|json|source] [-o outfile] file ...
+//
+// 每个 -config 为一个配置，包含空格分隔的 NAME、NAME=VALUE 或 -NAME（取消定义），依次对每个文件执行；没有 -config 时只执行一次。
+// -D -U 对全部配置生效，-merge 合并之前输出的 JSON 结果。出错时退出码为 2
+package main
+
+import (
+	"bytes"
+	"dxkite.cn/language/macro/ast"
+	"dxkite.cn/language/macro/interpreter"
+	"dxkite.cn/language/macro/parser"
+	"dxkite.cn/language/macro/token"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+func main() {
+	os.Exit(run(os.Args[1:], os.Stdin, os.Stdout, os.Stderr))
+}
+
+// 命令行参数
+type options struct {
+	dirs       []string
+	systemDirs []string
+	defines    []string   // -D -U，-U 的值以 - 开头
+	configs    [][]string // -config
+	merges     []string   // -merge
+	format     string
+	output     string
+	files      []string
+}
+
+// 执行命令，返回退出码
+func run(args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	opts := &options{format: "text"}
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		// 参数值，-Dname、-D name 或 -format=text
+		value := func(flag string) (string, bool) {
+			if len(arg) > len(flag) {
+				return strings.TrimPrefix(arg[len(flag):], "="), true
+			}
+			if i+1 >= len(args) {
+				fmt.Fprintf(stderr, "macro-cov: missing argument to '%s'\n", flag)
+				return "", false
+			}
+			i++
+			return args[i], true
+		}
+		var v string
+		ok := true
+		switch {
+		case arg == "-" || !strings.HasPrefix(arg, "-"):
+			opts.files = append(opts.files, arg)
+		case arg == "-config" || strings.HasPrefix(arg, "-config="):
+			if v, ok = value("-config"); ok {
+				opts.configs = append(opts.configs, strings.Fields(v))
+			}
+		case arg == "-merge" || strings.HasPrefix(arg, "-merge="):
+			if v, ok = value("-merge"); ok {
+				opts.merges = append(opts.merges, v)
+			}
+		case arg == "-format" || strings.HasPrefix(arg, "-format="):
+			if opts.format, ok = value("-format"); ok && opts.format != "text" && opts.format != "json" && opts.format != "source" {
+				fmt.Fprintf(stderr, "macro-cov: invalid value '%s' for '-format'\n", opts.format)
+				ok = false
+			}
+		case strings.HasPrefix(arg, "-isystem"):
+			if v, ok = value("-isystem"); ok {
+				opts.systemDirs = append(opts.systemDirs, v)
+			}
+		case strings.HasPrefix(arg, "-I"):
+			if v, ok = value("-I"); ok {
+				opts.dirs = append(opts.dirs, v)
+			}
+		case strings.HasPrefix(arg, "-D"):
+			if v, ok = value("-D"); ok {
+				opts.defines = append(opts.defines, v)
+			}
+		case strings.HasPrefix(arg, "-U"):
+			if v, ok = value("-U"); ok {
+				opts.defines = append(opts.defines, "-"+v)
+			}
+		case strings.HasPrefix(arg, "-o"):
+			opts.output, ok = value("-o")
+		default:
+			fmt.Fprintf(stderr, "macro-cov: unrecognized option '%s'\n", arg)
+			ok = false
+		}
+		if !ok {
+			return 2
+		}
+	}
+	if len(opts.files) == 0 && len(opts.merges) == 0 {
+		fmt.Fprintln(stderr, "macro-cov: no input files")
+		return 2
+	}
+	cov, err := opts.coverage(stdin, stderr)
+	if err != nil {
+		fmt.Fprintf(stderr, "macro-cov: %s\n", err)
+		return 2
+	}
+	var b bytes.Buffer
+	switch opts.format {
+	case "json":
+		err = cov.WriteJSON(&b)
+	case "source":
+		err = cov.WriteSource(&b)
+	default:
+		err = cov.WriteText(&b)
+	}
+	if err == nil {
+		if opts.output == "" || opts.output == "-" {
+			_, err = stdout.Write(b.Bytes())
+		} else {
+			err = ioutil.WriteFile(opts.output, b.Bytes(), 0644)
+		}
+	}
+	if err != nil {
+		fmt.Fprintf(stderr, "macro-cov: %s\n", err)
+		return 2
+	}
+	return 0
+}
+
+// 执行全部配置并合并结果
+func (opts *options) coverage(stdin io.Reader, stderr io.Writer) (*interpreter.Coverage, error) {
+	cov := &interpreter.Coverage{Sources: map[string][]byte{}}
+	for _, name := range opts.merges {
+		f, err := os.Open(name)
+		if err != nil {
+			return nil, err
+		}
+		c, err := interpreter.ReadCoverage(f)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", name, err)
+		}
+		cov.Merge(c)
+	}
+	configs := opts.configs
+	if len(configs) == 0 {
+		configs = [][]string{nil}
+	}
+	for _, file := range opts.files {
+		name, src := file, []byte(nil)
+		var err error
+		if file == "-" {
+			name = "<stdin>"
+			src, err = ioutil.ReadAll(stdin)
+			cov.Sources[name] = src
+		} else {
+			src, err = ioutil.ReadFile(file)
+		}
+		if err != nil {
+			return nil, err
+		}
+		for i, config := range configs {
+			predefined, err := predefined(append(append([]string{}, opts.defines...), config...))
+			if err != nil {
+				return nil, err
+			}
+			it := &interpreter.Interpreter{
+				Includer:   &interpreter.FileIncluder{Dirs: opts.dirs, SystemDirs: opts.systemDirs},
+				Predefined: predefined,
+				Coverage:   cov,
+			}
+			label := strings.Join(config, " ")
+			if label == "" {
+				label = fmt.Sprintf("#%d", i+1)
+			}
+			it.ErrorHandler = func(pos token.Position, msg string) {
+				fmt.Fprintf(stderr, "%s:%d:%d: %s [%s]\n", it.Filename(), pos.Line, pos.Column+1, msg, label)
+			}
+			node, errs := parser.Parse(src)
+			for _, err := range errs {
+				fmt.Fprintf(stderr, "%s:%d:%d: %s\n", name, err.Pos.Line, err.Pos.Column+1, err.Message())
+			}
+			var pos token.FilePos
+			pos.Init(src)
+			it.Eval(node, name, pos)
+		}
+	}
+	return cov, nil
+}
+
+// 宏定义，NAME、NAME=VALUE 或 -NAME（取消定义）
+func predefined(defines []string) ([]ast.DefineStmt, error) {
+	var p interpreter.Predefines
+	for _, d := range defines {
+		if strings.HasPrefix(d, "-") {
+			p.Undef(d[1:])
+		} else if err := p.Define(d); err != nil {
+			return nil, err
+		}
+	}
+	return p, nil
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRun(t *testing.T) {
+	tests := []struct {
+		name   string
+		args   []string
+		stdin  string
+		stdout string
+		stderr string
+		code   int
+	}{
+		{"configs", []string{"-config", "NET", "-config=NET IPV6", "testdata/main.c"}, "",
+			"testdata/main.c:6: #else: never taken\ntestdata/config.h:3: #ifdef DEBUG: never taken\n2 runs, 3 of 5 branches taken\n", "", 0},
+		{"defines", []string{"-DNET", "-D", "DEBUG", "-config", "-NET", "testdata/main.c"}, "",
+			"testdata/main.c:2: #if defined(NET) && defined(IPV6): never taken\ntestdata/main.c:4: #elif defined(NET): never taken\n1 runs, 3 of 5 branches taken\n", "", 0},
+		{"source", []string{"-format", "source", "-config", "A", "-config=", "-"}, "#ifdef A\na\n#endif\n#error stop\n",
+			"<stdin>:\n      1 | #ifdef A\n        | a\n        | #endif\n        | #error stop\n",
+			"<stdin>:4:1: #error stop [A]\n<stdin>:4:1: #error stop [#2]\n", 0},
+		{"no input", []string{"-DA"}, "", "", "macro-cov: no input files\n", 2},
+		{"missing file", []string{"testdata/none.c"}, "", "", "macro-cov: open testdata/none.c: no such file or directory\n", 2},
+		{"invalid format", []string{"-format=html"}, "", "", "macro-cov: invalid value 'html' for '-format'\n", 2},
+		{"unknown option", []string{"-x"}, "", "", "macro-cov: unrecognized option '-x'\n", 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var stdout, stderr bytes.Buffer
+			code := run(tt.args, strings.NewReader(tt.stdin), &stdout, &stderr)
+			if code != tt.code || stdout.String() != tt.stdout || stderr.String() != tt.stderr {
+				t.Errorf("run(%q) = %d, %q, %q, want %d, %q, %q", tt.args, code, stdout.String(), stderr.String(), tt.code, tt.stdout, tt.stderr)
+			}
+		})
+	}
+}
+
+func TestRun_merge(t *testing.T) {
+	dir, err := ioutil.TempDir("", "macro-cov")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	name := filepath.Join(dir, "net.json")
+	var stdout, stderr bytes.Buffer
+	if code := run([]string{"-format", "json", "-o", name, "-config", "NET", "testdata/main.c"}, nil, &stdout, &stderr); code != 0 || stdout.Len() > 0 {
+		t.Fatalf("run(-o) = %d, %q, %q", code, stdout.String(), stderr.String())
+	}
+	code := run([]string{"-merge", name, "-config", "NET IPV6", "-config", "", "testdata/main.c"}, nil, &stdout, &stderr)
+	want := "testdata/config.h:3: #ifdef DEBUG: never taken\n3 runs, 4 of 5 branches taken\n"
+	if code != 0 || stdout.String() != want {
+		t.Errorf("run(-merge) = %d, %q, %q, want %q", code, stdout.String(), stderr.String(), want)
+	}
+}
@@ -0,0 +1,6 @@
+#ifndef CONFIG_H
+#define CONFIG_H
+#ifdef DEBUG
+#define LOG 1
+#endif
+#endif
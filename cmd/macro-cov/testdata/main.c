@@ -0,0 +1,8 @@
+#include "config.h"
+#if defined(NET) && defined(IPV6)
+int ipv6;
+#elif defined(NET)
+int ipv4;
+#else
+int none;
+#endif
@@ -0,0 +1,140 @@
+// 格式化预处理指令
+//
+//	macro-fmt [-w] [-check] [-indent n] [-indent-guard] [-column n] [-defined paren|plain] [file ...]
+//
+// 没有文件时格式化标准输入。-w 写回文件，-check 只列出未格式化的文件，有未格式化的文件时退出码为 1，出错时为 2
+package main
+
+import (
+	"bytes"
+	"dxkite.cn/language/macro/format"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+)
+
+func main() {
+	os.Exit(run(os.Args[1:], os.Stdin, os.Stdout, os.Stderr))
+}
+
+// 执行命令，返回退出码
+func run(args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	style := format.DefaultStyle
+	write, check := false, false
+	var files []string
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		// 参数值，-indent=2 或 -indent 2
+		value := func(flag string) (string, bool) {
+			if strings.HasPrefix(arg, flag+"=") {
+				return arg[len(flag)+1:], true
+			}
+			if i+1 >= len(args) {
+				fmt.Fprintf(stderr, "macro-fmt: missing argument to '%s'\n", flag)
+				return "", false
+			}
+			i++
+			return args[i], true
+		}
+		number := func(flag string) (int, bool) {
+			v, ok := value(flag)
+			if !ok {
+				return 0, false
+			}
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 0 {
+				fmt.Fprintf(stderr, "macro-fmt: invalid value '%s' for '%s'\n", v, flag)
+				return 0, false
+			}
+			return n, true
+		}
+		ok := true
+		switch {
+		case arg == "-" || !strings.HasPrefix(arg, "-"):
+			files = append(files, arg)
+		case arg == "-w":
+			write = true
+		case arg == "-check":
+			check = true
+		case arg == "-indent-guard":
+			style.IndentGuard = true
+		case arg == "-indent" || strings.HasPrefix(arg, "-indent="):
+			style.Indent, ok = number("-indent")
+		case arg == "-column" || strings.HasPrefix(arg, "-column="):
+			style.BackslashColumn, ok = number("-column")
+		case arg == "-defined" || strings.HasPrefix(arg, "-defined="):
+			var v string
+			if v, ok = value("-defined"); ok {
+				switch v {
+				case "paren":
+					style.DefinedParen = true
+				case "plain":
+					style.DefinedParen = false
+				default:
+					fmt.Fprintf(stderr, "macro-fmt: invalid value '%s' for '-defined'\n", v)
+					ok = false
+				}
+			}
+		default:
+			fmt.Fprintf(stderr, "macro-fmt: unrecognized option '%s'\n", arg)
+			ok = false
+		}
+		if !ok {
+			return 2
+		}
+	}
+	if len(files) == 0 {
+		files = []string{"-"}
+	}
+	code := 0
+	for _, name := range files {
+		var src []byte
+		var err error
+		if name == "-" {
+			src, err = ioutil.ReadAll(stdin)
+		} else {
+			src, err = ioutil.ReadFile(name)
+		}
+		if err != nil {
+			fmt.Fprintf(stderr, "macro-fmt: %s\n", err)
+			code = 2
+			continue
+		}
+		display := name
+		if name == "-" {
+			display = "<stdin>"
+		}
+		out, errs := style.Format(src)
+		if len(errs) > 0 {
+			for _, err := range errs {
+				fmt.Fprintf(stderr, "%s:%d:%d: %s\n", display, err.Pos.Line, err.Pos.Column+1, err.Message())
+			}
+			code = 2
+			continue
+		}
+		changed := !bytes.Equal(src, out)
+		switch {
+		case check:
+			if changed {
+				fmt.Fprintln(stdout, display)
+				if code == 0 {
+					code = 1
+				}
+			}
+		case write && name != "-":
+			if changed {
+				err = ioutil.WriteFile(name, out, 0644)
+			}
+		default:
+			_, err = stdout.Write(out)
+		}
+		if err != nil {
+			fmt.Fprintf(stderr, "macro-fmt: %s\n", err)
+			code = 2
+		}
+	}
+	return code
+}
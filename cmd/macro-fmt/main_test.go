@@ -0,0 +1,60 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRun(t *testing.T) {
+	tests := []struct {
+		name   string
+		args   []string
+		stdin  string
+		stdout string
+		stderr string
+		code   int
+	}{
+		{"stdin", nil, "#if defined ( A )\n#define B\n#endif\n", "#if defined(A)\n#  define B\n#endif\n", "", 0},
+		{"style", []string{"-indent=1", "-defined", "plain", "-column", "12"}, "#if defined(A)\n#define B \\\n 1\n#endif\n",
+			"#if defined A\n# define B  \\\n 1\n#endif\n", "", 0},
+		{"check", []string{"-check", "testdata/ok.h", "testdata/bad.c"}, "", "testdata/bad.c\n", "", 1},
+		{"check formatted", []string{"-check", "testdata/ok.h"}, "", "", "", 0},
+		{"syntax error", []string{"-check"}, "#if A\n", "", "<stdin>:1:1: unterminated #if, expected #endif before end of file at 2:0\n", 2},
+		{"missing file", []string{"testdata/none.c"}, "", "", "macro-fmt: open testdata/none.c: no such file or directory\n", 2},
+		{"invalid indent", []string{"-indent", "x"}, "", "", "macro-fmt: invalid value 'x' for '-indent'\n", 2},
+		{"unknown option", []string{"-l"}, "", "", "macro-fmt: unrecognized option '-l'\n", 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var stdout, stderr bytes.Buffer
+			code := run(tt.args, strings.NewReader(tt.stdin), &stdout, &stderr)
+			if code != tt.code || stdout.String() != tt.stdout || stderr.String() != tt.stderr {
+				t.Errorf("run(%q) = %d, %q, %q, want %d, %q, %q", tt.args, code, stdout.String(), stderr.String(), tt.code, tt.stdout, tt.stderr)
+			}
+		})
+	}
+}
+
+func TestRun_write(t *testing.T) {
+	dir, err := ioutil.TempDir("", "macro-fmt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	name := filepath.Join(dir, "a.c")
+	if err := ioutil.WriteFile(name, []byte("#ifdef A\n#define B 1\n#endif\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	var stdout, stderr bytes.Buffer
+	if code := run([]string{"-w", name}, nil, &stdout, &stderr); code != 0 || stdout.Len() > 0 {
+		t.Fatalf("run(-w) = %d, %q, %q", code, stdout.String(), stderr.String())
+	}
+	got, _ := ioutil.ReadFile(name)
+	if want := "#ifdef A\n#  define B 1\n#endif\n"; string(got) != want {
+		t.Errorf("file = %q, want %q", got, want)
+	}
+}
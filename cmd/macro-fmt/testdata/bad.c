@@ -0,0 +1,3 @@
+#ifdef A
+#define B 1
+#endif
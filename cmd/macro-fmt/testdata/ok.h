@@ -0,0 +1,6 @@
+#ifndef OK_H
+#define OK_H
+#ifdef A
+#  define B 1
+#endif
+#endif
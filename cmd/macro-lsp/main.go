@@ -0,0 +1,78 @@
+// 宏预处理语言服务器，通过标准输入输出通信
+//
+//	macro-lsp [-D name[=value]] [-U name] [-I dir] [-isystem dir]
+//
+// 未执行的区域通过 textDocument/inactiveRegions 通知发送，与 clangd 相同
+package main
+
+import (
+	"dxkite.cn/language/macro/interpreter"
+	"dxkite.cn/language/macro/lsp"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+func main() {
+	stdout := os.Stdout
+	// 解释器的调试输出不能写入协议数据
+	os.Stdout = os.Stderr
+	os.Exit(run(os.Args[1:], os.Stdin, stdout, os.Stderr))
+}
+
+// 执行命令，返回退出码
+func run(args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	s := &lsp.Server{}
+	var predefines interpreter.Predefines
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		// 参数值，-Dname 或 -D name
+		value := func(flag string) (string, bool) {
+			if len(arg) > len(flag) {
+				return arg[len(flag):], true
+			}
+			if i+1 >= len(args) {
+				fmt.Fprintf(stderr, "macro-lsp: missing argument to '%s'\n", flag)
+				return "", false
+			}
+			i++
+			return args[i], true
+		}
+		var v string
+		ok := true
+		switch {
+		case strings.HasPrefix(arg, "-isystem"):
+			if v, ok = value("-isystem"); ok {
+				s.SystemDirs = append(s.SystemDirs, v)
+			}
+		case strings.HasPrefix(arg, "-I"):
+			if v, ok = value("-I"); ok {
+				s.Dirs = append(s.Dirs, v)
+			}
+		case strings.HasPrefix(arg, "-D"):
+			if v, ok = value("-D"); ok {
+				if err := predefines.Define(v); err != nil {
+					fmt.Fprintf(stderr, "macro-lsp: %s\n", err)
+					ok = false
+				}
+			}
+		case strings.HasPrefix(arg, "-U"):
+			if v, ok = value("-U"); ok {
+				predefines.Undef(v)
+			}
+		default:
+			fmt.Fprintf(stderr, "macro-lsp: unrecognized option '%s'\n", arg)
+			ok = false
+		}
+		if !ok {
+			return 2
+		}
+	}
+	s.Predefined = predefines
+	if err := s.Serve(stdin, stdout); err != nil {
+		fmt.Fprintf(stderr, "macro-lsp: %s\n", err)
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"bytes"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestRun(t *testing.T) {
+	// 悬停在第 1 行的 X 上
+	hover := `{"jsonrpc":"2.0","id":1,"method":"textDocument/hover","params":{"textDocument":{"uri":"untitled:a.c"},"position":{"line":0,"character":0}}}`
+	open := `{"jsonrpc":"2.0","method":"textDocument/didOpen","params":{"textDocument":{"uri":"untitled:a.c","version":1,"text":"X\n"}}}`
+	shutdown := `{"jsonrpc":"2.0","id":2,"method":"shutdown"}`
+	exit := `{"jsonrpc":"2.0","method":"exit"}`
+	tests := []struct {
+		name   string
+		args   []string
+		msgs   []string
+		stdout string // 包含的输出
+		stderr string
+		code   int
+	}{
+		{"predefined", []string{"-DX=Y", "-D", "Y=2"}, []string{open, hover, shutdown, exit},
+			`Expands to:\n` + "```c\\n2\\n```", "", 0},
+		{"undef", []string{"-DX=Y", "-UX"}, []string{open, hover, shutdown, exit},
+			`{"jsonrpc":"2.0","id":1,"result":null}`, "", 0},
+		{"exit without shutdown", nil, []string{exit}, "", "macro-lsp: exit without shutdown\n", 1},
+		{"invalid define", []string{"-D1"}, nil, "", "macro-lsp: invalid macro definition '1'\n", 2},
+		{"missing argument", []string{"-I"}, nil, "", "macro-lsp: missing argument to '-I'\n", 2},
+		{"unknown option", []string{"-W"}, nil, "", "macro-lsp: unrecognized option '-W'\n", 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var stdin, stdout, stderr bytes.Buffer
+			for _, msg := range tt.msgs {
+				stdin.WriteString("Content-Length: " + strconv.Itoa(len(msg)) + "\r\n\r\n" + msg)
+			}
+			code := run(tt.args, &stdin, &stdout, &stderr)
+			if code != tt.code || !strings.Contains(stdout.String(), tt.stdout) || stderr.String() != tt.stderr {
+				t.Errorf("run(%q) = %d, %q, %q, want %d, %q, %q", tt.args, code, stdout.String(), stderr.String(), tt.code, tt.stdout, tt.stderr)
+			}
+		})
+	}
+}
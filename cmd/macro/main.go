@@ -0,0 +1,416 @@
+// 宏预处理命令行工具，参数与 cpp 兼容
+//
+//	macro [-D name[=value]] [-U name] [-I dir] [-isystem dir] [-include file] [-P] [-C] [-CC] [-std=std] [-o outfile] [infile [outfile]]
+//
+// -C 保留注释，-CC 同时保留宏展开中的注释。
+//
+// 依赖文件：
+//
+//	-M, -MM          只输出依赖，-MM 不包含系统头文件
+//	-MD, -MMD        预处理的同时输出依赖文件
+//	-MF file         依赖文件名
+//	-MT, -MQ target  依赖的目标，-MQ 转义特殊字符
+//	-MP              为头文件生成空目标
+//	-Mjson           输出 JSON 格式
+//	-Mprobes         包含 __has_include 检查的文件
+//
+// 包含图：
+//
+//	-graph=dot|json  输出包含图代替预处理结果
+//
+// 可变性分析：
+//
+//	-S name          将配置宏作为符号处理，以 * 结尾时匹配前缀，输出每行的存在条件
+//	-Sjson           输出 JSON 格式
+package main
+
+import (
+	"bytes"
+	"dxkite.cn/language/macro/ast"
+	"dxkite.cn/language/macro/interpreter"
+	"dxkite.cn/language/macro/parser"
+	"dxkite.cn/language/macro/token"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// 命令行参数
+type options struct {
+	defines    []define                // -D -U，按出现顺序
+	dirs       []string                // -I
+	systemDirs []string                // -isystem
+	includes   []string                // -include
+	output     string                  // -o
+	noLines    bool                    // -P
+	comments   interpreter.CommentMode // -C -CC
+	stdVersion string                  // -std 对应的 __STDC_VERSION__，为空时不定义
+	input      string
+	deps       depMode  // -M -MD
+	depSystem  bool     // 包含系统头文件，-MM -MMD 时为 false
+	depFile    string   // -MF
+	depTargets []string // -MT -MQ
+	depPhony   bool     // -MP
+	depJSON    bool     // -Mjson
+	depProbes  bool     // -Mprobes
+	graph      string   // -graph
+	symbols    []string // -S
+	symJSON    bool     // -Sjson
+}
+
+// 依赖输出模式
+type depMode int
+
+const (
+	noDeps   depMode = iota
+	onlyDeps         // -M -MM
+	withDeps         // -MD -MMD
+)
+
+// 宏定义，undef 为 -U
+type define struct {
+	arg   string // -D 的 name[=value] 或 -U 的 name
+	undef bool
+}
+
+func main() {
+	os.Exit(run(os.Args[1:], os.Stdin, os.Stdout, os.Stderr))
+}
+
+// 执行命令，返回退出码
+func run(args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	opts, err := parseArgs(args)
+	if err != nil {
+		fmt.Fprintf(stderr, "macro: error: %s\n", err)
+		return 1
+	}
+	predefined, err := opts.predefined()
+	if err != nil {
+		fmt.Fprintf(stderr, "macro: error: %s\n", err)
+		return 1
+	}
+	name, src, err := readInput(opts.input, stdin)
+	if err != nil {
+		fmt.Fprintf(stderr, "macro: error: %s\n", err)
+		return 1
+	}
+	failed := false
+	it := &interpreter.Interpreter{
+		Includer:    &interpreter.FileIncluder{Dirs: opts.dirs, SystemDirs: opts.systemDirs},
+		Predefined:  predefined,
+		Preinclude:  opts.includes,
+		LineMarkers: !opts.noLines,
+		Comments:    opts.comments,
+	}
+	report := func(file string, pos token.Position, msg string, warning bool) {
+		if warning {
+			msg = "warning: " + msg
+		} else {
+			failed = true
+		}
+		if pos.IsValid() {
+			fmt.Fprintf(stderr, "%s:%d:%d: %s\n", file, pos.Line, pos.Column+1, msg)
+		} else {
+			fmt.Fprintf(stderr, "%s: %s\n", file, msg)
+		}
+	}
+	it.ErrorHandler = func(pos token.Position, msg string) {
+		report(it.Filename(), pos, msg, false)
+	}
+	it.WarningHandler = func(pos token.Position, msg string) {
+		report(it.Filename(), pos, msg, true)
+	}
+	if opts.deps != noDeps {
+		it.Deps = &interpreter.Deps{Probes: opts.depProbes}
+		if opts.input != "" && opts.input != "-" {
+			it.Deps.Source = opts.input
+		}
+	}
+	if opts.graph != "" {
+		it.Graph = &interpreter.IncludeGraph{}
+	}
+	node, errs := parser.Parse(src)
+	for _, err := range errs {
+		report(name, err.Pos, err.Msg, err.Warning)
+	}
+	var pos token.FilePos
+	pos.Init(src)
+	if len(opts.symbols) > 0 {
+		return opts.variants(it, node, name, pos, stdout, stderr, failed)
+	}
+	out := it.Eval(node, name, pos)
+	if opts.graph != "" {
+		err = opts.writeGraph(it.Graph, stdout)
+	} else if opts.deps != onlyDeps {
+		err = writeOutput(opts.output, stdout, out)
+	}
+	if err == nil && opts.deps != noDeps {
+		err = opts.writeDeps(it.Deps, stdout)
+	}
+	if err != nil {
+		fmt.Fprintf(stderr, "macro: error: %s\n", err)
+		return 1
+	}
+	if failed {
+		return 1
+	}
+	return 0
+}
+
+// 解析命令行参数
+func parseArgs(args []string) (*options, error) {
+	opts := &options{}
+	var files []string
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		// 参数值，-Dname 或 -D name
+		value := func(flag string) (string, error) {
+			if len(arg) > len(flag) {
+				return arg[len(flag):], nil
+			}
+			if i+1 >= len(args) {
+				return "", fmt.Errorf("missing argument to '%s'", flag)
+			}
+			i++
+			return args[i], nil
+		}
+		var err error
+		var v string
+		switch {
+		case arg == "-" || !strings.HasPrefix(arg, "-"):
+			files = append(files, arg)
+		case arg == "-P":
+			opts.noLines = true
+		case arg == "-C":
+			opts.comments = interpreter.KeepComments
+		case arg == "-CC":
+			opts.comments = interpreter.KeepMacroComments
+		case arg == "-M" || arg == "-MM":
+			opts.deps, opts.depSystem = onlyDeps, arg == "-M"
+		case arg == "-MD" || arg == "-MMD":
+			opts.deps, opts.depSystem = withDeps, arg == "-MD"
+		case arg == "-MP":
+			opts.depPhony = true
+		case arg == "-Mjson":
+			opts.depJSON = true
+		case arg == "-Mprobes":
+			opts.depProbes = true
+		case arg == "-Sjson":
+			opts.symJSON = true
+		case strings.HasPrefix(arg, "-S"):
+			if v, err = value("-S"); err == nil {
+				opts.symbols = append(opts.symbols, v)
+			}
+		case strings.HasPrefix(arg, "-MF"):
+			opts.depFile, err = value("-MF")
+		case strings.HasPrefix(arg, "-MT"):
+			if v, err = value("-MT"); err == nil {
+				opts.depTargets = append(opts.depTargets, v)
+			}
+		case strings.HasPrefix(arg, "-MQ"):
+			if v, err = value("-MQ"); err == nil {
+				opts.depTargets = append(opts.depTargets, interpreter.MakeQuote(v))
+			}
+		case strings.HasPrefix(arg, "-graph="):
+			opts.graph = arg[len("-graph="):]
+			if opts.graph != "dot" && opts.graph != "json" {
+				err = fmt.Errorf("unrecognized graph format '%s'", opts.graph)
+			}
+		case strings.HasPrefix(arg, "-std="):
+			var ok bool
+			if opts.stdVersion, ok = stdVersions[arg[len("-std="):]]; !ok {
+				err = fmt.Errorf("unrecognized command-line option '%s'", arg)
+			}
+		case strings.HasPrefix(arg, "-isystem"):
+			if v, err = value("-isystem"); err == nil {
+				opts.systemDirs = append(opts.systemDirs, v)
+			}
+		case strings.HasPrefix(arg, "-include"):
+			if v, err = value("-include"); err == nil {
+				opts.includes = append(opts.includes, v)
+			}
+		case strings.HasPrefix(arg, "-I"):
+			if v, err = value("-I"); err == nil {
+				opts.dirs = append(opts.dirs, v)
+			}
+		case strings.HasPrefix(arg, "-D"):
+			if v, err = value("-D"); err == nil {
+				opts.defines = append(opts.defines, define{arg: v})
+			}
+		case strings.HasPrefix(arg, "-U"):
+			if v, err = value("-U"); err == nil {
+				opts.defines = append(opts.defines, define{arg: v, undef: true})
+			}
+		case strings.HasPrefix(arg, "-o"):
+			opts.output, err = value("-o")
+		default:
+			err = fmt.Errorf("unrecognized command-line option '%s'", arg)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	switch len(files) {
+	case 0:
+	case 2:
+		if opts.output != "" {
+			return nil, errors.New("output filename specified twice")
+		}
+		opts.output = files[1]
+		fallthrough
+	case 1:
+		opts.input = files[0]
+	default:
+		return nil, errors.New("too many input files")
+	}
+	return opts, nil
+}
+
+// -std 支持的标准及其 __STDC_VERSION__，C90 不定义
+var stdVersions = map[string]string{
+	"c89": "", "c90": "", "gnu89": "", "gnu90": "", "iso9899:1990": "",
+	"iso9899:199409": "199409L", "c99": "199901L", "c9x": "199901L", "gnu99": "199901L", "gnu9x": "199901L", "iso9899:1999": "199901L",
+	"c11": "201112L", "c1x": "201112L", "gnu11": "201112L", "gnu1x": "201112L", "iso9899:2011": "201112L",
+	"c17": "201710L", "c18": "201710L", "gnu17": "201710L", "gnu18": "201710L", "iso9899:2017": "201710L", "iso9899:2018": "201710L",
+	"c23": "202311L", "c2x": "202311L", "gnu23": "202311L", "gnu2x": "202311L",
+}
+
+// 命令行宏定义
+func (opts *options) predefined() ([]ast.DefineStmt, error) {
+	var p interpreter.Predefines
+	if opts.stdVersion != "" {
+		p.Define("__STDC_VERSION__=" + opts.stdVersion)
+	}
+	for _, d := range opts.defines {
+		if d.undef {
+			p.Undef(d.arg)
+		} else if err := p.Define(d.arg); err != nil {
+			return nil, err
+		}
+	}
+	return p, nil
+}
+
+// 输出依赖文件
+// -M 时写入 -MF、-o 或标准输出，-MD 时写入 -MF 或与输出同名的 .d 文件
+func (opts *options) writeDeps(deps *interpreter.Deps, stdout io.Writer) error {
+	targets := opts.depTargets
+	if len(targets) == 0 {
+		targets = []string{interpreter.MakeQuote(replaceExt(filepath.Base(opts.inputName()), ".o"))}
+	}
+	name := opts.depFile
+	if name == "" && opts.deps == onlyDeps {
+		name = opts.output
+	}
+	if name == "" && opts.deps == withDeps {
+		if opts.output != "" && opts.output != "-" {
+			name = replaceExt(opts.output, ".d")
+		} else {
+			name = replaceExt(filepath.Base(opts.inputName()), ".d")
+		}
+	}
+	var b bytes.Buffer
+	var err error
+	if opts.depJSON {
+		err = deps.WriteJSON(&b, targets, opts.depSystem)
+	} else {
+		err = deps.WriteMake(&b, targets, opts.depSystem, opts.depPhony)
+	}
+	if err != nil {
+		return err
+	}
+	return writeOutput(name, stdout, b.Bytes())
+}
+
+// 可变性分析，输出带存在条件的结果
+// 只在恒真的条件下出现的错误使命令失败
+func (opts *options) variants(it *interpreter.Interpreter, node ast.Node, name string, pos token.FilePos, stdout, stderr io.Writer, failed bool) int {
+	r := it.EvalVariants(node, name, pos, interpreter.MatchSymbols(opts.symbols))
+	for _, e := range r.Errors {
+		msg := e.Msg
+		if e.Warning {
+			msg = "warning: " + msg
+		}
+		if !e.Cond.IsTrue() {
+			msg += " [if " + e.Cond.String() + "]"
+		} else if !e.Warning {
+			failed = true
+		}
+		if e.Pos.IsValid() {
+			fmt.Fprintf(stderr, "%s:%d:%d: %s\n", e.File, e.Pos.Line, e.Pos.Column+1, msg)
+		} else {
+			fmt.Fprintf(stderr, "%s: %s\n", e.File, msg)
+		}
+	}
+	var b bytes.Buffer
+	var err error
+	if opts.symJSON {
+		err = r.WriteJSON(&b)
+	} else {
+		err = r.WriteText(&b)
+	}
+	if err == nil {
+		err = writeOutput(opts.output, stdout, b.Bytes())
+	}
+	if err != nil {
+		fmt.Fprintf(stderr, "macro: error: %s\n", err)
+		return 1
+	}
+	if failed {
+		return 1
+	}
+	return 0
+}
+
+// 输出包含图，写入 -o 或标准输出
+func (opts *options) writeGraph(graph *interpreter.IncludeGraph, stdout io.Writer) error {
+	var b bytes.Buffer
+	var err error
+	if opts.graph == "json" {
+		err = graph.WriteJSON(&b)
+	} else {
+		err = graph.WriteDOT(&b)
+	}
+	if err != nil {
+		return err
+	}
+	return writeOutput(opts.output, stdout, b.Bytes())
+}
+
+func (opts *options) inputName() string {
+	if opts.input == "" {
+		return "-"
+	}
+	return opts.input
+}
+
+// 替换扩展名
+func replaceExt(name, ext string) string {
+	return strings.TrimSuffix(name, filepath.Ext(name)) + ext
+}
+
+// 读取输入，文件名为空或 - 时读取标准输入
+func readInput(name string, stdin io.Reader) (string, []byte, error) {
+	if name == "" || name == "-" {
+		src, err := ioutil.ReadAll(stdin)
+		return "<stdin>", src, err
+	}
+	src, err := ioutil.ReadFile(name)
+	if os.IsNotExist(err) {
+		err = fmt.Errorf("%s: No such file or directory", name)
+	}
+	return name, src, err
+}
+
+// 写入输出，文件名为空或 - 时写入标准输出
+func writeOutput(name string, stdout io.Writer, out []byte) error {
+	if name == "" || name == "-" {
+		_, err := stdout.Write(out)
+		return err
+	}
+	return ioutil.WriteFile(name, out, 0644)
+}
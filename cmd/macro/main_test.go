@@ -0,0 +1,66 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestRun(t *testing.T) {
+	tests := []struct {
+		name   string
+		args   []string
+		stdin  string
+		stdout string
+		stderr string
+		code   int
+	}{
+		{"file", []string{"-P", "-I", "testdata/inc", "-DY=3", "-std=c99", "testdata/main.c"}, "",
+			"\n\n\n\nint v = 2 + 3;\n", "", 0},
+		{"line markers", []string{"-Itestdata/inc", "testdata/main.c"}, "",
+			"# 1 \"testdata/main.c\"\n# 1 \"testdata/config.h\" 1\n\n# 2 \"testdata/main.c\" 2\n# 1 \"testdata/inc/sys.h\" 1\n\n# 3 \"testdata/main.c\" 2\nint v = 2 + Y;\n", "", 0},
+		{"stdin", []string{"-P", "-DA", "-D", "B=2", "-UA", "-"}, "A B\n", "A 2\n", "", 0},
+		{"function macro", []string{"-P", "-DF(x)=x*2"}, "F(3)\n", "3*2\n", "", 0},
+		{"comments", []string{"-P", "-C"}, "#define M 1 /* m */ + 2\na /* x */ M\n", "\na /* x */ 1  + 2\n", "", 0},
+		{"macro comments", []string{"-P", "-CC"}, "#define M 1 /* m */ + 2\na /* x */ M\n", "\na /* x */ 1 /* m */ + 2\n", "", 0},
+		{"error", []string{"-P"}, "a\n#error stop\n", "a\n", "<stdin>:2:1: #error stop\n", 1},
+		{"warning", []string{"-P"}, "#define A 1\n#define A 2\na \\ \nA\n", "\n\na 2\n",
+			"<stdin>:3:3: warning: backslash and newline separated by space\n<stdin>:2:1: warning: A redefined\n", 0},
+		{"missing include", []string{"-P", "testdata/main.c"}, "", "\n\n\nint v = 2 + X;\n",
+			"testdata/main.c:2:1: sys.h: No such file or directory\n", 1},
+		{"deps", []string{"-M", "-MP", "-isystem", "testdata/inc", "testdata/main.c"}, "",
+			"main.o: testdata/main.c testdata/config.h testdata/inc/sys.h\n\ntestdata/config.h:\n\ntestdata/inc/sys.h:\n", "", 0},
+		{"user deps", []string{"-MM", "-MT", "$(OBJ)", "-MQ", "a b.o", "-isystem", "testdata/inc", "testdata/main.c"}, "",
+			"$(OBJ) a\\ b.o: testdata/main.c testdata/config.h\n", "", 0},
+		{"json deps", []string{"-MM", "-Mjson", "-Mprobes", "-Itestdata/inc", "-"}, "#if __has_include(<sys.h>)\n#endif\n",
+			"{\n  \"targets\": [\n    \"-.o\"\n  ],\n  \"files\": [\n    {\n      \"name\": \"testdata/inc/sys.h\",\n      \"system\": false,\n      \"probe\": true\n    }\n  ]\n}\n", "", 0},
+		{"graph", []string{"-graph=dot", "-isystem", "testdata/inc", "testdata/main.c"}, "",
+			"digraph includes {\n  \"testdata/main.c\" [shape=box];\n  \"testdata/config.h\";\n  \"testdata/inc/sys.h\" [color=gray];\n" +
+				"  \"testdata/main.c\" -> \"testdata/config.h\";\n  \"testdata/main.c\" -> \"testdata/inc/sys.h\";\n}\n", "", 0},
+		{"json graph", []string{"-graph=json", "-"}, "",
+			"{\n  \"root\": \"<stdin>\",\n  \"files\": [\n    {\n      \"name\": \"<stdin>\",\n      \"system\": false,\n      \"once\": false,\n      \"count\": 0\n    }\n  ],\n  \"edges\": [],\n  \"cycles\": []\n}\n", "", 0},
+		{"unknown graph format", []string{"-graph=svg"}, "", "", "macro: error: unrecognized graph format 'svg'\n", 1},
+		{"variants", []string{"-S", "CONFIG_*", "-Itestdata/inc", "testdata/main.c"}, "", "int v = 2 + Y;\n", "", 0},
+		{"variants stdin", []string{"-SCONFIG_*", "-"}, "#ifdef CONFIG_A\n#error a\n#endif\n#if CONFIG_B\nb\n#endif\n",
+			"#if CONFIG_B\nb\n#endif\n", "<stdin>:2:1: #error a [if defined(CONFIG_A)]\n", 0},
+		{"variants json", []string{"-SCONFIG_A", "-Sjson", "-"}, "#error x\n",
+			"{\n  \"macros\": [],\n  \"lines\": [],\n  \"errors\": [\n    {\n      \"cond\": \"1\",\n      \"file\": \"<stdin>\",\n      \"line\": 1,\n      \"msg\": \"#error x\"\n    }\n  ]\n}\n",
+			"<stdin>:1:1: #error x\n", 1},
+		{"std", []string{"-P", "-std=gnu11"}, "__STDC_VERSION__\n", "201112L\n", "", 0},
+		{"std c90", []string{"-P", "-std=c90"}, "__STDC_VERSION__\n", "__STDC_VERSION__\n", "", 0},
+		{"unknown std", []string{"-std=c++17"}, "", "", "macro: error: unrecognized command-line option '-std=c++17'\n", 1},
+		{"invalid directive", []string{"-P"}, "a\n#foo\nb\n#endif\nc\n", "a\n\nb\n\nc\n",
+			"<stdin>:2:2: invalid preprocessing directive #foo\n<stdin>:4:1: #endif without #if\n", 1},
+		{"unknown option", []string{"-W"}, "", "", "macro: error: unrecognized command-line option '-W'\n", 1},
+		{"missing argument", []string{"-I"}, "", "", "macro: error: missing argument to '-I'\n", 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var stdout, stderr bytes.Buffer
+			code := run(tt.args, strings.NewReader(tt.stdin), &stdout, &stderr)
+			if code != tt.code || stdout.String() != tt.stdout || stderr.String() != tt.stderr {
+				t.Errorf("run(%q) = %d, %q, %q, want %d, %q, %q", tt.args, code, stdout.String(), stderr.String(), tt.code, tt.stdout, tt.stderr)
+			}
+		})
+	}
+}
@@ -0,0 +1 @@
+#define X Y
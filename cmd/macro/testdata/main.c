@@ -0,0 +1,3 @@
+#include "config.h"
+#include <sys.h>
+int v = VERSION + X;
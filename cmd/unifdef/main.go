@@ -0,0 +1,109 @@
+// 按已知的宏化简条件编译，参数与 unifdef 兼容
+//
+//	unifdef [-D name[=value]] [-U name] [-o outfile] [infile]
+//
+// 输出未改变时退出码为 0，改变时为 1，出错时为 2
+package main
+
+import (
+	"bytes"
+	"dxkite.cn/language/macro/unifdef"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+func main() {
+	os.Exit(run(os.Args[1:], os.Stdin, os.Stdout, os.Stderr))
+}
+
+// 执行命令，返回退出码
+func run(args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	cfg := &unifdef.Config{Defined: map[string]string{}, Undefined: map[string]bool{}}
+	input, output := "", ""
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		// 参数值，-Dname 或 -D name
+		value := func(flag string) (string, bool) {
+			if len(arg) > len(flag) {
+				return arg[len(flag):], true
+			}
+			if i+1 >= len(args) {
+				fmt.Fprintf(stderr, "unifdef: missing argument to '%s'\n", flag)
+				return "", false
+			}
+			i++
+			return args[i], true
+		}
+		switch {
+		case arg == "-" || !strings.HasPrefix(arg, "-"):
+			if input != "" {
+				fmt.Fprintln(stderr, "unifdef: too many input files")
+				return 2
+			}
+			input = arg
+		case strings.HasPrefix(arg, "-D"):
+			v, ok := value("-D")
+			if !ok {
+				return 2
+			}
+			name, val := v, "1"
+			if n := strings.IndexByte(v, '='); n >= 0 {
+				name, val = v[:n], v[n+1:]
+			}
+			cfg.Defined[name] = val
+			delete(cfg.Undefined, name)
+		case strings.HasPrefix(arg, "-U"):
+			name, ok := value("-U")
+			if !ok {
+				return 2
+			}
+			cfg.Undefined[name] = true
+			delete(cfg.Defined, name)
+		case strings.HasPrefix(arg, "-o"):
+			v, ok := value("-o")
+			if !ok {
+				return 2
+			}
+			output = v
+		default:
+			fmt.Fprintf(stderr, "unifdef: unrecognized option '%s'\n", arg)
+			return 2
+		}
+	}
+	name := input
+	var src []byte
+	var err error
+	if input == "" || input == "-" {
+		name = "<stdin>"
+		src, err = ioutil.ReadAll(stdin)
+	} else {
+		src, err = ioutil.ReadFile(input)
+	}
+	if err != nil {
+		fmt.Fprintf(stderr, "unifdef: %s\n", err)
+		return 2
+	}
+	out, errs := cfg.Process(src)
+	if len(errs) > 0 {
+		for _, err := range errs {
+			fmt.Fprintf(stderr, "%s:%d:%d: %s\n", name, err.Pos.Line, err.Pos.Column+1, err.Message())
+		}
+		return 2
+	}
+	if output == "" || output == "-" {
+		_, err = stdout.Write(out)
+	} else {
+		err = ioutil.WriteFile(output, out, 0644)
+	}
+	if err != nil {
+		fmt.Fprintf(stderr, "unifdef: %s\n", err)
+		return 2
+	}
+	if bytes.Equal(out, src) {
+		return 0
+	}
+	return 1
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestRun(t *testing.T) {
+	src := "#ifdef A\na\n#elif defined(B) && C\nb\n#endif\n"
+	tests := []struct {
+		name   string
+		args   []string
+		stdout string
+		stderr string
+		code   int
+	}{
+		{"unchanged", nil, src, "", 0},
+		{"defined", []string{"-DA"}, "a\n", "", 1},
+		{"undefined", []string{"-UA", "-D", "B=1"}, "#if C\nb\n#endif\n", "", 1},
+		{"last wins", []string{"-DA", "-UA", "-UB"}, "", "", 1},
+		{"unknown option", []string{"-k"}, "", "unifdef: unrecognized option '-k'\n", 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var stdout, stderr bytes.Buffer
+			code := run(tt.args, strings.NewReader(src), &stdout, &stderr)
+			if code != tt.code || stdout.String() != tt.stdout || stderr.String() != tt.stderr {
+				t.Errorf("run(%q) = %d, %q, %q, want %d, %q, %q", tt.args, code, stdout.String(), stderr.String(), tt.code, tt.stdout, tt.stderr)
+			}
+		})
+	}
+}
@@ -0,0 +1,3 @@
+module dxkite.cn/language
+
+go 1.16
@@ -42,32 +42,33 @@ type CondStmt interface {
 const (
 	IncludeInner IncludeType = iota // 系统内
 	IncludeOuter                    // 相对
+	IncludeMacro                    // 宏展开后得到文件名
 )
 
 type (
 	// 错误表达式
 	BadExpr struct {
-		Offset token.Pos // 标识符位置
-		Token  token.Token
-		Lit    string
+		Offset token.Pos   `json:"offset"` // 标识符位置
+		Token  token.Token `json:"token"`
+		Lit    string      `json:"lit"`
 	}
 
 	// 标识符
 	Ident struct {
-		Offset token.Pos // 标识符位置
-		Name   string    // 名称
+		Offset token.Pos `json:"offset"` // 标识符位置
+		Name   string    `json:"name"`   // 名称
 	}
 	// 普通文本（宏中的代码块）
 	Text struct {
-		Offset token.Pos   // 标识符位置
-		Kind   token.Token // 类型
-		Text   string      // 文本内容
+		Offset token.Pos   `json:"offset"` // 标识符位置
+		Kind   token.Token `json:"kind"`   // 类型
+		Text   string      `json:"text"`   // 文本内容
 	}
 	// 注释
 	Comment struct {
-		Offset token.Pos   // 标识符位置
-		Kind   token.Token // 注释类型
-		Text   string      // 文本内容
+		Offset token.Pos   `json:"offset"` // 标识符位置
+		Kind   token.Token `json:"kind"`   // 注释类型
+		Text   string      `json:"text"`   // 文本内容
 	}
 
 	// 语句块
@@ -75,48 +76,56 @@ type CondStmt interface {
 
 	// 值定义
 	ValDefineStmt struct {
-		From, To token.Pos      // 标识符位置
-		Name     *Ident         // 定义的标识符
-		Body     *MacroLitArray // 定义的语句
+		From    token.Pos      `json:"from"` // 标识符位置
+		To      token.Pos      `json:"to"`
+		Name    *Ident         `json:"name"`    // 定义的标识符
+		Body    *MacroLitArray `json:"body"`    // 定义的语句
+		Comment *Text          `json:"comment"` // 行尾注释，不属于定义体
 	}
 
 	// 取消定义指令
 	UnDefineStmt struct {
-		From, To token.Pos // 标识符位置
-		Name     *Ident    // 定义的标识符
+		From token.Pos `json:"from"` // 标识符位置
+		To   token.Pos `json:"to"`
+		Name *Ident    `json:"name"` // 定义的标识符
 	}
 
 	// 函数定义
 	FuncDefineStmt struct {
-		From, To  token.Pos      // 标识符位置
-		Name      *Ident         // 定义的标识符
-		Lparen    token.Pos      // (
-		IdentList []*Ident       // 定义的参数
-		Rparen    token.Pos      // )
-		Body      *MacroLitArray // 定义的语句
+		From      token.Pos      `json:"from"` // 标识符位置
+		To        token.Pos      `json:"to"`
+		Name      *Ident         `json:"name"`      // 定义的标识符
+		Lparen    token.Pos      `json:"lparen"`    // (
+		IdentList []*Ident       `json:"identList"` // 定义的参数
+		Rparen    token.Pos      `json:"rparen"`    // )
+		Body      *MacroLitArray `json:"body"`      // 定义的语句
+		Comment   *Text          `json:"comment"`   // 行尾注释，不属于定义体
 	}
 
 	// 文件包含语句
 	IncludeStmt struct {
-		From, To token.Pos   // 标识符位置
-		Path     string      // 文件路径
-		Type     IncludeType // 文件包含类型
+		From token.Pos      `json:"from"` // 标识符位置
+		To   token.Pos      `json:"to"`
+		Path string         `json:"path"` // 文件路径
+		Type IncludeType    `json:"type"` // 文件包含类型
+		Name *MacroLitArray `json:"name"` // 文件名宏（IncludeMacro）
 	}
 
 	// 宏调用
 	MacroCallExpr struct {
-		From, To  token.Pos      // 标识符位置
-		Name      *Ident         // 定义的标识符
-		Lparen    token.Pos      // (
-		ParamList *MacroLitArray // 调用的参数列表
-		Rparen    token.Pos      // )
+		From      token.Pos      `json:"from"` // 标识符位置
+		To        token.Pos      `json:"to"`
+		Name      *Ident         `json:"name"`      // 定义的标识符
+		Lparen    token.Pos      `json:"lparen"`    // (
+		ParamList *MacroLitArray `json:"paramList"` // 调用的参数列表
+		Rparen    token.Pos      `json:"rparen"`    // )
 	}
 
 	// 括号表达式
 	ParenExpr struct {
-		Lparen token.Pos  // "("
-		X      MacroLiter // 表达式值
-		Rparen token.Pos  // ")"
+		Lparen token.Pos  `json:"lparen"` // "("
+		X      MacroLiter `json:"x"`      // 表达式值
+		Rparen token.Pos  `json:"rparen"` // ")"
 	}
 
 	// 字面量数组
@@ -126,79 +135,112 @@ type CondStmt interface {
 	// 数值/字符串字面量
 	// token.INT token.FLOAT token.STRING token.CHAR
 	LitExpr struct {
-		Offset token.Pos // 标识符位置
-		Kind   token.Token
-		Value  string // 值
+		Offset token.Pos   `json:"offset"` // 标识符位置
+		Kind   token.Token `json:"kind"`
+		Value  string      `json:"value"` // 值
 	}
 
 	// 报错表达式
 	MacroCmdStmt struct {
-		Offset token.Pos   // 标识符位置
-		Kind   token.Token // 类型
-		Cmd    string      // 报错文本内容
+		Offset token.Pos   `json:"offset"` // 标识符位置
+		Kind   token.Token `json:"kind"`   // 类型
+		Cmd    string      `json:"cmd"`    // 报错文本内容
 	}
 
 	// 行语句
 	LineStmt struct {
-		From, To token.Pos // 标识符位置
-		Line     string    // 文件行
-		Path     string    // 文件名
+		From token.Pos `json:"from"` // 标识符位置
+		To   token.Pos `json:"to"`
+		Line string    `json:"line"` // 文件行
+		Path string    `json:"path"` // 文件名
 	}
 
 	// 非法宏
 	InvalidStmt struct {
-		Offset token.Pos // 标识符位置
-		Text   string    // 报错文本内容
+		Offset token.Pos `json:"offset"` // 标识符位置
+		Text   string    `json:"text"`   // 报错文本内容
 	}
 
 	// if语句
 	IfStmt struct {
-		From, To token.Pos  // 标识符位置
-		X        MacroLiter // 条件
-		Then     Stmt       // 正确
-		Else     Stmt       // 错误
+		From       token.Pos    `json:"from"` // 标识符位置
+		To         token.Pos    `json:"to"`
+		X          MacroLiter   `json:"x"`          // 条件
+		Then       Stmt         `json:"then"`       // 正确
+		Else       Stmt         `json:"else"`       // 错误
+		Directives []*Directive `json:"directives"` // 条件链中的指令
 	}
 
 	ElseIfStmt struct {
-		From, To token.Pos  // 标识符位置
-		X        MacroLiter // 条件
-		Then     Stmt       // 正确
-		Else     Stmt       // 错误
+		From token.Pos  `json:"from"` // 标识符位置
+		To   token.Pos  `json:"to"`
+		X    MacroLiter `json:"x"`    // 条件
+		Then Stmt       `json:"then"` // 正确
+		Else Stmt       `json:"else"` // 错误
 	}
 
 	// ifdef语句
 	IfDefStmt struct {
-		From, To token.Pos // 标识符位置
-		Name     *Ident    // 定义的标识符
-		Then     Stmt      // 正确
-		Else     Stmt      // 错误
+		From       token.Pos    `json:"from"` // 标识符位置
+		To         token.Pos    `json:"to"`
+		Name       *Ident       `json:"name"`       // 定义的标识符
+		Then       Stmt         `json:"then"`       // 正确
+		Else       Stmt         `json:"else"`       // 错误
+		Directives []*Directive `json:"directives"` // 条件链中的指令
 	}
 
 	// ifndef语句
 	IfNoDefStmt struct {
-		From, To token.Pos // 标识符位置
-		Name     *Ident    // 定义的标识符
-		Then     Stmt      // 正确
-		Else     Stmt      // 错误
+		From       token.Pos    `json:"from"` // 标识符位置
+		To         token.Pos    `json:"to"`
+		Name       *Ident       `json:"name"`       // 定义的标识符
+		Then       Stmt         `json:"then"`       // 正确
+		Else       Stmt         `json:"else"`       // 错误
+		Directives []*Directive `json:"directives"` // 条件链中的指令
+	}
+
+	// 未解析的条件分支体
+	// parser.LazyGroups 模式下只扫描其中条件指令的嵌套，由解释器按需解析
+	RawGroup struct {
+		From token.Pos `json:"from"` // 分支体范围
+		To   token.Pos `json:"to"`
+		Text string    `json:"text"` // 原始文本
+	}
+
+	// 条件指令
+	// #if #ifdef #ifndef #elif #else #endif 所在的行
+	Directive struct {
+		Kind token.Token `json:"kind"` // 指令类型
+		From token.Pos   `json:"from"` // 从 # 到下一行开始
+		To   token.Pos   `json:"to"`
 	}
 
 	// 一元运算
 	UnaryExpr struct {
-		Offset token.Pos   // 标识符位置
-		Op     token.Token // 操作类型
-		X      MacroLiter  // 操作的表达式
+		Offset token.Pos   `json:"offset"` // 标识符位置
+		Op     token.Token `json:"op"`     // 操作类型
+		X      MacroLiter  `json:"x"`      // 操作的表达式
 	}
 
 	// 二元运算
 	BinaryExpr struct {
-		X      MacroLiter  // 左值
-		Offset token.Pos   // 操作符位置
-		Op     token.Token // 操作类型
-		Y      MacroLiter  // 右值
+		X      MacroLiter  `json:"x"`      // 左值
+		Offset token.Pos   `json:"offset"` // 操作符位置
+		Op     token.Token `json:"op"`     // 操作类型
+		Y      MacroLiter  `json:"y"`      // 右值
+	}
+
+	// 条件运算 Cond ? X : Y
+	CondExpr struct {
+		Cond     MacroLiter `json:"cond"`     // 条件
+		Question token.Pos  `json:"question"` // ? 位置
+		X        MacroLiter `json:"x"`        // 条件成立时的值
+		Colon    token.Pos  `json:"colon"`    // : 位置
+		Y        MacroLiter `json:"y"`        // 条件不成立时的值
 	}
 )
 
-//------ Node
+// ------ Node
 func (t *BadExpr) Pos() token.Pos { return t.Offset }
 func (t *BadExpr) End() token.Pos { return token.Pos(int(t.Offset) + len(t.Lit)) }
 func (*BadExpr) stmtNode()        {}
@@ -299,6 +341,13 @@ func (t *InvalidStmt) Pos() token.Pos { return t.Offset }
 func (t *InvalidStmt) End() token.Pos { return token.Pos(int(t.Offset) + len(t.Text)) }
 func (*InvalidStmt) stmtNode()        {}
 
+func (t *RawGroup) Pos() token.Pos { return t.From }
+func (t *RawGroup) End() token.Pos { return t.To }
+func (*RawGroup) stmtNode()        {}
+
+func (d *Directive) Pos() token.Pos { return d.From }
+func (d *Directive) End() token.Pos { return d.To }
+
 func (stmt *IfStmt) Pos() token.Pos { return stmt.From }
 func (stmt *IfStmt) End() token.Pos { return stmt.To }
 func (*IfStmt) stmtNode()           {}
@@ -359,6 +408,10 @@ func (t *BinaryExpr) Pos() token.Pos { return t.X.Pos() }
 func (t *BinaryExpr) End() token.Pos { return t.Y.End() }
 func (*BinaryExpr) litNode()         {}
 
+func (t *CondExpr) Pos() token.Pos { return t.Cond.Pos() }
+func (t *CondExpr) End() token.Pos { return t.Y.End() }
+func (*CondExpr) litNode()         {}
+
 func (t MacroLitArray) Pos() token.Pos {
 	if len(t) > 0 {
 		return t[0].Pos()
@@ -0,0 +1,210 @@
+package astutil
+
+import (
+	"dxkite.cn/language/macro/ast"
+	"reflect"
+)
+
+// 遍历回调
+// 返回 false 时：pre 跳过子节点，post 终止遍历
+type ApplyFunc func(*Cursor) bool
+
+// 遍历并改写语法树
+// 对每个节点先调用 pre，遍历子节点后调用 post，返回改写后的根节点
+// pre 中替换的节点会继续遍历其子节点，插入的节点不会被遍历
+func Apply(root ast.Node, pre, post ApplyFunc) (result ast.Node) {
+	parent := &struct{ ast.Node }{root}
+	defer func() {
+		if r := recover(); r != nil && r != abort {
+			panic(r)
+		}
+		result = parent.Node
+	}()
+	a := &application{pre: pre, post: post}
+	a.apply(parent, "Node", nil, root)
+	return
+}
+
+var abort = new(int)
+
+// 当前遍历位置
+type Cursor struct {
+	parent ast.Node
+	name   string
+	iter   *iterator // 位于列表中时不为空
+	node   ast.Node
+}
+
+// 当前节点
+func (c *Cursor) Node() ast.Node { return c.node }
+
+// 父节点
+func (c *Cursor) Parent() ast.Node { return c.parent }
+
+// 当前节点在父节点中的字段名
+// 位于 BlockStmt、MacroLitArray 中时为空
+func (c *Cursor) Name() string { return c.name }
+
+// 当前节点在列表中的下标，不在列表中时为 -1
+func (c *Cursor) Index() int {
+	if c.iter != nil {
+		return c.iter.index
+	}
+	return -1
+}
+
+// 所在的字段
+func (c *Cursor) field() reflect.Value {
+	v := reflect.Indirect(reflect.ValueOf(c.parent))
+	if c.name == "" {
+		return v
+	}
+	return v.FieldByName(c.name)
+}
+
+// 替换当前节点
+func (c *Cursor) Replace(n ast.Node) {
+	v := c.field()
+	if i := c.Index(); i >= 0 {
+		v = v.Index(i)
+	}
+	v.Set(reflect.ValueOf(n))
+	c.node = n
+}
+
+// 删除当前节点，只能用于列表中的节点
+func (c *Cursor) Delete() {
+	i := c.Index()
+	if i < 0 {
+		panic("Delete node not contained in list")
+	}
+	v := c.field()
+	l := v.Len()
+	reflect.Copy(v.Slice(i, l), v.Slice(i+1, l))
+	v.Index(l - 1).Set(reflect.Zero(v.Type().Elem()))
+	v.SetLen(l - 1)
+	c.iter.step--
+}
+
+// 在当前节点后插入，插入的节点不会被遍历
+func (c *Cursor) InsertAfter(n ast.Node) {
+	i := c.Index()
+	if i < 0 {
+		panic("InsertAfter node not contained in list")
+	}
+	v := c.field()
+	v.Set(reflect.Append(v, reflect.Zero(v.Type().Elem())))
+	l := v.Len()
+	reflect.Copy(v.Slice(i+2, l), v.Slice(i+1, l))
+	v.Index(i + 1).Set(reflect.ValueOf(n))
+	c.iter.step++
+}
+
+// 在当前节点前插入，插入的节点不会被遍历
+func (c *Cursor) InsertBefore(n ast.Node) {
+	i := c.Index()
+	if i < 0 {
+		panic("InsertBefore node not contained in list")
+	}
+	v := c.field()
+	v.Set(reflect.Append(v, reflect.Zero(v.Type().Elem())))
+	l := v.Len()
+	reflect.Copy(v.Slice(i+1, l), v.Slice(i, l))
+	v.Index(i).Set(reflect.ValueOf(n))
+	c.iter.index++
+}
+
+// 列表遍历位置
+type iterator struct {
+	index, step int
+}
+
+type application struct {
+	pre, post ApplyFunc
+	cursor    Cursor
+	iter      iterator
+}
+
+func (a *application) apply(parent ast.Node, name string, iter *iterator, n ast.Node) {
+	if n == nil {
+		return
+	}
+	if v := reflect.ValueOf(n); v.Kind() == reflect.Ptr && v.IsNil() {
+		return
+	}
+	saved := a.cursor
+	a.cursor = Cursor{parent: parent, name: name, iter: iter, node: n}
+	if a.pre != nil && !a.pre(&a.cursor) {
+		a.cursor = saved
+		return
+	}
+	switch n := a.cursor.node.(type) {
+	case *ast.ValDefineStmt:
+		a.apply(n, "Name", nil, n.Name)
+		a.apply(n, "Body", nil, n.Body)
+	case *ast.UnDefineStmt:
+		a.apply(n, "Name", nil, n.Name)
+	case *ast.IncludeStmt:
+		a.apply(n, "Name", nil, n.Name)
+	case *ast.FuncDefineStmt:
+		a.apply(n, "Name", nil, n.Name)
+		a.applyList(n, "IdentList")
+		a.apply(n, "Body", nil, n.Body)
+	case *ast.MacroCallExpr:
+		a.apply(n, "Name", nil, n.Name)
+		a.apply(n, "ParamList", nil, n.ParamList)
+	case *ast.ParenExpr:
+		a.apply(n, "X", nil, n.X)
+	case *ast.BlockStmt, *ast.MacroLitArray:
+		a.applyList(n, "")
+	case *ast.IfStmt:
+		a.apply(n, "X", nil, n.X)
+		a.apply(n, "Then", nil, n.Then)
+		a.apply(n, "Else", nil, n.Else)
+	case *ast.ElseIfStmt:
+		a.apply(n, "X", nil, n.X)
+		a.apply(n, "Then", nil, n.Then)
+		a.apply(n, "Else", nil, n.Else)
+	case *ast.IfDefStmt:
+		a.apply(n, "Name", nil, n.Name)
+		a.apply(n, "Then", nil, n.Then)
+		a.apply(n, "Else", nil, n.Else)
+	case *ast.IfNoDefStmt:
+		a.apply(n, "Name", nil, n.Name)
+		a.apply(n, "Then", nil, n.Then)
+		a.apply(n, "Else", nil, n.Else)
+	case *ast.UnaryExpr:
+		a.apply(n, "X", nil, n.X)
+	case *ast.BinaryExpr:
+		a.apply(n, "X", nil, n.X)
+		a.apply(n, "Y", nil, n.Y)
+	case *ast.CondExpr:
+		a.apply(n, "Cond", nil, n.Cond)
+		a.apply(n, "X", nil, n.X)
+		a.apply(n, "Y", nil, n.Y)
+	}
+	if a.post != nil && !a.post(&a.cursor) {
+		panic(abort)
+	}
+	a.cursor = saved
+}
+
+// 遍历列表中的节点
+func (a *application) applyList(parent ast.Node, name string) {
+	saved := a.iter
+	a.iter.index = 0
+	for {
+		v := reflect.Indirect(reflect.ValueOf(parent))
+		if name != "" {
+			v = v.FieldByName(name)
+		}
+		if a.iter.index >= v.Len() {
+			break
+		}
+		x, _ := v.Index(a.iter.index).Interface().(ast.Node)
+		a.iter.step = 1
+		a.apply(parent, name, &a.iter, x)
+		a.iter.index += a.iter.step
+	}
+	a.iter = saved
+}
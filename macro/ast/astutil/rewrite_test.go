@@ -0,0 +1,101 @@
+package astutil
+
+import (
+	"dxkite.cn/language/macro/ast"
+	"dxkite.cn/language/macro/parser"
+	"dxkite.cn/language/macro/printer"
+	"testing"
+)
+
+func TestApply(t *testing.T) {
+	tests := []struct {
+		name string
+		src  string
+		pre  ApplyFunc
+		want string
+	}{
+		{
+			"replace",
+			"#define A x\n#ifdef A\nA\n#endif\n",
+			func(c *Cursor) bool {
+				if id, ok := c.Node().(*ast.Ident); ok && id.Name == "A" {
+					c.Replace(&ast.Ident{Name: "B"})
+				}
+				return true
+			},
+			"#define B x\n#ifdef B\nB\n#endif\n",
+		},
+		{
+			"delete",
+			"#define A 1\n#undef A\n#define B 2\n",
+			func(c *Cursor) bool {
+				if _, ok := c.Node().(*ast.UnDefineStmt); ok {
+					c.Delete()
+				}
+				return true
+			},
+			"#define A 1\n#define B 2\n",
+		},
+		{
+			"insert",
+			"#define A 1\n",
+			func(c *Cursor) bool {
+				if _, ok := c.Node().(*ast.ValDefineStmt); ok {
+					c.InsertBefore(&ast.UnDefineStmt{Name: &ast.Ident{Name: "A"}})
+					c.InsertAfter(&ast.UnDefineStmt{Name: &ast.Ident{Name: "B"}})
+				}
+				return true
+			},
+			"#undef A\n#define A 1\n#undef B\n",
+		},
+		{
+			"skip children",
+			"#define F(a) a\n",
+			func(c *Cursor) bool {
+				if id, ok := c.Node().(*ast.Ident); ok {
+					c.Replace(&ast.Ident{Name: id.Name + "_"})
+				}
+				_, ok := c.Node().(*ast.FuncDefineStmt)
+				return !ok
+			},
+			"#define F(a) a\n",
+		},
+		{
+			"param list",
+			"#define F(a, b) a b\n",
+			func(c *Cursor) bool {
+				if id, ok := c.Node().(*ast.Ident); ok && id.Name == "a" && c.Name() == "IdentList" {
+					c.Delete()
+				}
+				return true
+			},
+			"#define F(b) a b\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			node, _ := parser.Parse([]byte(tt.src))
+			got := printer.Sprint(Apply(node, tt.pre, nil))
+			if got != tt.want {
+				t.Errorf("Apply() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestApply_root(t *testing.T) {
+	node, _ := parser.Parse([]byte("a\n"))
+	var stmts int
+	got := Apply(node, func(c *Cursor) bool {
+		if c.Index() < 0 && c.Name() == "Node" {
+			c.Replace(&ast.BlockStmt{})
+		}
+		return true
+	}, func(c *Cursor) bool {
+		stmts++
+		return false
+	})
+	if blk, ok := got.(*ast.BlockStmt); !ok || len(*blk) != 0 || stmts != 1 {
+		t.Errorf("Apply() = %#v", got)
+	}
+}
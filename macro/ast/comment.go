@@ -0,0 +1,137 @@
+package ast
+
+import (
+	"dxkite.cn/language/macro/token"
+	"sort"
+	"strings"
+)
+
+// 注释组
+// 相邻行之间没有代码与空行的注释
+type CommentGroup struct {
+	List []*Comment
+}
+
+func (g *CommentGroup) Pos() token.Pos { return g.List[0].Pos() }
+func (g *CommentGroup) End() token.Pos { return g.List[len(g.List)-1].End() }
+
+// 注释文本（去除注释标记）
+func (g *CommentGroup) Text() string {
+	var lines []string
+	for _, c := range g.List {
+		text := c.Text
+		if c.Kind == token.COMMENT {
+			text = strings.TrimPrefix(text, "//")
+		} else {
+			text = strings.TrimSuffix(strings.TrimPrefix(text, "/*"), "*/")
+		}
+		for _, line := range strings.Split(text, "\n") {
+			lines = append(lines, strings.TrimSpace(strings.TrimSuffix(line, "\r")))
+		}
+	}
+	for len(lines) > 0 && lines[0] == "" {
+		lines = lines[1:]
+	}
+	for len(lines) > 0 && lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	if len(lines) == 0 {
+		return ""
+	}
+	return strings.Join(lines, "\n") + "\n"
+}
+
+// 注释映射
+// 将注释组关联到宏定义、条件语句与文件包含语句
+type CommentMap map[Node][]*CommentGroup
+
+// 创建注释映射
+// 同一指令行上的注释为尾随注释，紧邻指令上一行（中间无空行）的注释为前导注释
+func NewCommentMap(src []byte, node Node, comments []*CommentGroup) CommentMap {
+	var targets []Node
+	Inspect(node, func(n Node) bool {
+		switch n.(type) {
+		case *ValDefineStmt, *FuncDefineStmt, *IncludeStmt, *IfStmt, *IfDefStmt, *IfNoDefStmt:
+			targets = append(targets, n)
+		}
+		return true
+	})
+	sort.SliceStable(targets, func(i, j int) bool { return targets[i].Pos() < targets[j].Pos() })
+
+	var pos token.FilePos
+	pos.Init(src)
+	line := func(p token.Pos) int {
+		if int(p) >= len(src) {
+			p = token.Pos(len(src) - 1)
+		}
+		return pos.CreatePosition(p).Line
+	}
+
+	cmap := CommentMap{}
+	for _, g := range comments {
+		if t := trailingTarget(targets, g, line); t != nil {
+			cmap[t] = append(cmap[t], g)
+		} else if t := leadingTarget(src, targets, g); t != nil {
+			cmap[t] = append(cmap[t], g)
+		}
+	}
+	return cmap
+}
+
+// 注释所在行为指令行
+func trailingTarget(targets []Node, g *CommentGroup, line func(token.Pos) int) Node {
+	l := line(g.Pos())
+	var found Node
+	for _, t := range targets {
+		if t.Pos() > g.Pos() {
+			break
+		}
+		switch t.(type) {
+		case *IfStmt, *IfDefStmt, *IfNoDefStmt:
+			// #if 行与 #endif 行
+			if l == line(t.Pos()) || (t.End() > t.Pos() && l == line(t.End()-1)) {
+				found = t
+			}
+		default:
+			if line(t.Pos()) <= l && l <= line(t.End()) {
+				found = t
+			}
+		}
+	}
+	return found
+}
+
+// 注释独占一行，之后只有空白，并且下一行即为指令
+func leadingTarget(src []byte, targets []Node, g *CommentGroup) Node {
+	if int(g.Pos()) > len(src) {
+		return nil
+	}
+	before := src[:g.Pos()]
+	if i := strings.LastIndexByte(string(before), '\n'); strings.TrimLeft(string(before[i+1:]), " \t") != "" {
+		return nil
+	}
+	for _, t := range targets {
+		if t.Pos() < g.End() {
+			continue
+		}
+		if int(t.Pos()) > len(src) || int(g.End()) > int(t.Pos()) {
+			return nil
+		}
+		between := string(src[g.End():t.Pos()])
+		if strings.TrimLeft(between, " \t\r\n") != "" || strings.Count(between, "\n") > 1 {
+			return nil
+		}
+		return t
+	}
+	return nil
+}
+
+// 全部注释组，按位置排序
+func (cmap CommentMap) Comments() []*CommentGroup {
+	var list []*CommentGroup
+	for _, groups := range cmap {
+		list = append(list, groups...)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Pos() < list[j].Pos() })
+	return list
+}
@@ -0,0 +1,73 @@
+package ast
+
+import "dxkite.cn/language/macro/token"
+
+// 条件分支
+type CondBranch struct {
+	Stmt             CondStmt   // 分支对应的条件语句，#else 为空
+	Directive        *Directive // 分支指令，手动构造的语法树中为空
+	Cond             MacroLiter // #if #elif 为条件表达式，#ifdef #ifndef 为 *Ident，#else 为空
+	Body             Stmt       // 分支体
+	BodyFrom, BodyTo token.Pos  // 分支体范围，指令位置未知时为 token.NoPos
+}
+
+// 条件块
+// 将 #elif 嵌套的条件链展开为平铺的分支列表
+type CondBlock struct {
+	From, To token.Pos     // 条件块范围
+	Branches []*CondBranch // 全部分支
+	Endif    *Directive    // #endif 指令，缺少时为空
+}
+
+// 展开条件语句
+// stmt 为 *IfStmt、*IfDefStmt 或 *IfNoDefStmt，其他类型返回 nil
+func Branches(stmt Stmt) *CondBlock {
+	var dirs []*Directive
+	var cond MacroLiter
+	var then, els Stmt
+	switch n := stmt.(type) {
+	case *IfStmt:
+		dirs, cond, then, els = n.Directives, n.X, n.Then, n.Else
+	case *IfDefStmt:
+		dirs, cond, then, els = n.Directives, n.Name, n.Then, n.Else
+	case *IfNoDefStmt:
+		dirs, cond, then, els = n.Directives, n.Name, n.Then, n.Else
+	default:
+		return nil
+	}
+	block := &CondBlock{From: stmt.Pos(), To: stmt.End()}
+	block.Branches = append(block.Branches, &CondBranch{Stmt: stmt.(CondStmt), Cond: cond, Body: then})
+	for els != nil {
+		if eif, ok := els.(*ElseIfStmt); ok {
+			block.Branches = append(block.Branches, &CondBranch{Stmt: eif, Cond: eif.X, Body: eif.Then})
+			els = eif.Else
+			continue
+		}
+		block.Branches = append(block.Branches, &CondBranch{Body: els})
+		break
+	}
+	if n := len(dirs); n > 0 && dirs[n-1].Kind == token.ENDIF {
+		block.Endif = dirs[n-1]
+		dirs = dirs[:n-1]
+	}
+	if len(dirs) != len(block.Branches) {
+		dirs = nil
+	}
+	for i, b := range block.Branches {
+		b.BodyFrom, b.BodyTo = token.NoPos, token.NoPos
+		if dirs == nil {
+			continue
+		}
+		b.Directive = dirs[i]
+		b.BodyFrom = dirs[i].To
+		switch {
+		case i+1 < len(dirs):
+			b.BodyTo = dirs[i+1].From
+		case block.Endif != nil:
+			b.BodyTo = block.Endif.From
+		default:
+			b.BodyTo = block.To
+		}
+	}
+	return block
+}
@@ -0,0 +1,67 @@
+package ast
+
+import (
+	"dxkite.cn/language/macro/token"
+	"strings"
+)
+
+// 包含保护
+// 文件中除空白和注释外只有一个没有 #else 的 #ifndef X 块，且块中第一条语句为 #define X 时返回该块
+func IncludeGuard(file Node) *IfNoDefStmt {
+	block, ok := file.(*BlockStmt)
+	if !ok || block == nil {
+		return nil
+	}
+	var guard *IfNoDefStmt
+	for _, stmt := range *block {
+		if IsBlank(stmt) {
+			continue
+		}
+		n, ok := stmt.(*IfNoDefStmt)
+		if !ok || guard != nil || n.Else != nil {
+			return nil
+		}
+		guard = n
+	}
+	if guard == nil {
+		return nil
+	}
+	then, _ := guard.Then.(*BlockStmt)
+	if then == nil {
+		return nil
+	}
+	for _, stmt := range *then {
+		if IsBlank(stmt) {
+			continue
+		}
+		if def, ok := stmt.(*ValDefineStmt); ok && def.Name.Name == guard.Name.Name {
+			return guard
+		}
+		return nil
+	}
+	return nil
+}
+
+// 只有空白和注释的语句
+func IsBlank(stmt Stmt) bool {
+	switch n := stmt.(type) {
+	case *Comment:
+		return true
+	case *MacroLitArray:
+		for _, item := range *n {
+			text, ok := item.(*Text)
+			if !ok {
+				return false
+			}
+			switch text.Kind {
+			case token.BLOCK_COMMENT, token.COMMENT, token.NEWLINE, token.BACKSLASH_NEWLINE:
+				continue
+			}
+			if strings.TrimSpace(text.Text) != "" {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
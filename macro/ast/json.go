@@ -0,0 +1,199 @@
+package ast
+
+import (
+	"dxkite.cn/language/macro/token"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+)
+
+// JSON 编码版本，节点类型或字段变化时递增
+const JSONVersion = 1
+
+// JSON 文档
+type jsonFile struct {
+	Version int             `json:"version"`
+	Root    json.RawMessage `json:"root"`
+}
+
+// JSON 位置
+type jsonPos struct {
+	Offset token.Pos `json:"offset"`
+	Line   int       `json:"line"`
+	Column int       `json:"column"`
+}
+
+// 节点类型
+var nodeTypes = map[string]reflect.Type{}
+
+func init() {
+	for _, n := range []Node{
+		&BadExpr{}, &Ident{}, &Text{}, &Comment{}, &BlockStmt{},
+		&ValDefineStmt{}, &UnDefineStmt{}, &FuncDefineStmt{}, &IncludeStmt{},
+		&MacroCallExpr{}, &ParenExpr{}, &MacroLitArray{}, &LitExpr{},
+		&MacroCmdStmt{}, &LineStmt{}, &InvalidStmt{}, &RawGroup{},
+		&IfStmt{}, &ElseIfStmt{}, &IfDefStmt{}, &IfNoDefStmt{},
+		&UnaryExpr{}, &BinaryExpr{}, &CondExpr{}, &Directive{},
+	} {
+		t := reflect.TypeOf(n).Elem()
+		nodeTypes[t.Name()] = t
+	}
+}
+
+var (
+	nodeType = reflect.TypeOf((*Node)(nil)).Elem()
+	posType  = reflect.TypeOf(token.Pos(0))
+)
+
+// 编码为 JSON
+// 每个节点带有 node 类型标签，位置转换为行列
+func EncodeJSON(node Node, pos token.FilePos) ([]byte, error) {
+	root, err := json.Marshal(encodeValue(reflect.ValueOf(node), pos))
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(jsonFile{Version: JSONVersion, Root: root})
+}
+
+// 从 JSON 解码
+func DecodeJSON(data []byte) (Node, error) {
+	var f jsonFile
+	if err := json.Unmarshal(data, &f); err != nil {
+		return nil, err
+	}
+	if f.Version != JSONVersion {
+		return nil, fmt.Errorf("unsupported ast json version %d", f.Version)
+	}
+	v, err := decodeValue(f.Root, nodeType)
+	if err != nil {
+		return nil, err
+	}
+	if !v.IsValid() || v.IsNil() {
+		return nil, nil
+	}
+	return v.Interface().(Node), nil
+}
+
+// 字段名
+// 取自 json 标签，与 Go 字段名无关
+func fieldName(f reflect.StructField) string {
+	return f.Tag.Get("json")
+}
+
+func encodeValue(v reflect.Value, pos token.FilePos) interface{} {
+	switch v.Kind() {
+	case reflect.Interface, reflect.Ptr:
+		if v.IsNil() {
+			return nil
+		}
+		return encodeValue(v.Elem(), pos)
+	case reflect.Slice:
+		list := make([]interface{}, v.Len())
+		for i := range list {
+			list[i] = encodeValue(v.Index(i), pos)
+		}
+		if _, ok := nodeTypes[v.Type().Name()]; ok {
+			return map[string]interface{}{"node": v.Type().Name(), "list": list}
+		}
+		if v.IsNil() {
+			return nil
+		}
+		return list
+	case reflect.Struct:
+		obj := map[string]interface{}{"node": v.Type().Name()}
+		for i := 0; i < v.NumField(); i++ {
+			f := v.Field(i)
+			obj[fieldName(v.Type().Field(i))] = encodeValue(f, pos)
+		}
+		return obj
+	}
+	if v.Type() == posType {
+		p := token.Pos(v.Int())
+		if p == token.NoPos {
+			return nil
+		}
+		at := pos.CreatePosition(p)
+		return jsonPos{Offset: p, Line: at.Line, Column: at.Column}
+	}
+	return v.Interface()
+}
+
+func decodeValue(data json.RawMessage, typ reflect.Type) (reflect.Value, error) {
+	if string(data) == "null" {
+		if typ == posType {
+			return reflect.ValueOf(token.NoPos), nil
+		}
+		return reflect.Zero(typ), nil
+	}
+	switch {
+	case typ == posType:
+		var p jsonPos
+		if err := json.Unmarshal(data, &p); err != nil {
+			return reflect.Value{}, err
+		}
+		return reflect.ValueOf(p.Offset), nil
+	case typ.Kind() == reflect.Interface, typ.Kind() == reflect.Ptr && typ.Implements(nodeType):
+		return decodeNode(data, typ)
+	case typ.Kind() == reflect.Slice:
+		var list []json.RawMessage
+		if err := json.Unmarshal(data, &list); err != nil {
+			return reflect.Value{}, err
+		}
+		v := reflect.MakeSlice(typ, len(list), len(list))
+		for i, item := range list {
+			e, err := decodeValue(item, typ.Elem())
+			if err != nil {
+				return reflect.Value{}, err
+			}
+			v.Index(i).Set(e)
+		}
+		return v, nil
+	}
+	v := reflect.New(typ)
+	if err := json.Unmarshal(data, v.Interface()); err != nil {
+		return reflect.Value{}, err
+	}
+	return v.Elem(), nil
+}
+
+// 按 node 类型标签解码节点
+func decodeNode(data json.RawMessage, typ reflect.Type) (reflect.Value, error) {
+	var obj map[string]json.RawMessage
+	if err := json.Unmarshal(data, &obj); err != nil {
+		return reflect.Value{}, err
+	}
+	var name string
+	if err := json.Unmarshal(obj["node"], &name); err != nil {
+		return reflect.Value{}, errors.New("ast json: missing node tag")
+	}
+	t, ok := nodeTypes[name]
+	if !ok {
+		return reflect.Value{}, fmt.Errorf("ast json: unknown node type %q", name)
+	}
+	v := reflect.New(t)
+	if t.Kind() == reflect.Slice {
+		list, err := decodeValue(obj["list"], t)
+		if err != nil {
+			return reflect.Value{}, err
+		}
+		v.Elem().Set(list)
+	} else {
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			raw, ok := obj[fieldName(f)]
+			if !ok {
+				continue
+			}
+			fv, err := decodeValue(raw, f.Type)
+			if err != nil {
+				return reflect.Value{}, fmt.Errorf("ast json: %s.%s: %v", name, f.Name, err)
+			}
+			v.Elem().Field(i).Set(fv)
+		}
+	}
+	if !v.Type().AssignableTo(typ) {
+		return reflect.Value{}, fmt.Errorf("ast json: %s is not a %v", name, typ)
+	}
+	return v, nil
+}
@@ -0,0 +1,187 @@
+package ast
+
+import (
+	"bytes"
+	"dxkite.cn/language/macro/token"
+	"encoding/json"
+	"io/ioutil"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// #if defined(A)
+// #define F(a) a##b
+// #else
+// f(x)
+// #endif
+// #include H
+// #ifdef B
+// b
+// #endif
+var jsonSrc = []byte("#if defined(A)\n#define F(a) a##b\n#else\nf(x)\n#endif\n#include H\n#ifdef B\nb\n#endif\n")
+
+func jsonNode() Node {
+	return &BlockStmt{
+		&IfStmt{
+			From: 0, To: 55,
+			X: &MacroLitArray{
+				&Text{Offset: 3, Kind: token.TEXT, Text: " "},
+				&UnaryExpr{
+					Offset: 4,
+					Op:     token.DEFINED,
+					X:      &ParenExpr{Lparen: 11, X: &Ident{Offset: 12, Name: "A"}, Rparen: 13},
+				},
+			},
+			Then: &BlockStmt{
+				&FuncDefineStmt{
+					From: 15, To: 32,
+					Name:      &Ident{Offset: 23, Name: "F"},
+					Lparen:    24,
+					IdentList: []*Ident{{Offset: 25, Name: "a"}},
+					Rparen:    26,
+					Body: &MacroLitArray{
+						&BinaryExpr{
+							X:      &Ident{Offset: 28, Name: "a"},
+							Offset: 29,
+							Op:     token.DOUBLE_SHARP,
+							Y:      &Ident{Offset: 31, Name: "b"},
+						},
+					},
+				},
+			},
+			Else: &BlockStmt{
+				&MacroLitArray{
+					&MacroCallExpr{
+						From: 39, To: 43,
+						Name:      &Ident{Offset: 39, Name: "f"},
+						Lparen:    40,
+						ParamList: &MacroLitArray{&Ident{Offset: 41, Name: "x"}},
+						Rparen:    42,
+					},
+					&Text{Offset: 43, Kind: token.NEWLINE, Text: "\n"},
+				},
+			},
+			Directives: []*Directive{
+				{Kind: token.IF, From: 0, To: 15},
+				{Kind: token.ELSE, From: 33, To: 39},
+				{Kind: token.ENDIF, From: 44, To: 51},
+			},
+		},
+		&IncludeStmt{From: 50, To: token.NoPos, Path: "<a.h>", Type: IncludeInner},
+		&IncludeStmt{From: 51, To: 61, Type: IncludeMacro, Name: &MacroLitArray{&Ident{Offset: 60, Name: "H"}}},
+		&IfDefStmt{
+			From: 62, To: 80,
+			Name: &Ident{Offset: 69, Name: "B"},
+			Then: &RawGroup{From: 71, To: 73, Text: "b\n"},
+			Directives: []*Directive{
+				{Kind: token.IFDEF, From: 62, To: 71},
+				{Kind: token.ENDIF, From: 73, To: 80},
+			},
+		},
+	}
+}
+
+func TestEncodeJSON(t *testing.T) {
+	node := jsonNode()
+	var pos token.FilePos
+	pos.Init(jsonSrc)
+	data, err := EncodeJSON(node, pos)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var doc struct {
+		Version int `json:"version"`
+		Root    struct {
+			Node string `json:"node"`
+			List []struct {
+				Node string  `json:"node"`
+				From jsonPos `json:"from"`
+				Then struct {
+					List []struct {
+						Node   string  `json:"node"`
+						Lparen jsonPos `json:"lparen"`
+					} `json:"list"`
+				} `json:"then"`
+			} `json:"list"`
+		} `json:"root"`
+	}
+	if err := json.Unmarshal(data, &doc); err != nil {
+		t.Fatal(err)
+	}
+	if doc.Version != JSONVersion || doc.Root.Node != "BlockStmt" || doc.Root.List[0].Node != "IfStmt" {
+		t.Errorf("EncodeJSON() = %s", data)
+	}
+	if got, want := doc.Root.List[0].Then.List[0].Lparen, (jsonPos{Offset: 24, Line: 2, Column: 9}); got != want {
+		t.Errorf("EncodeJSON() position = %+v, want %+v", got, want)
+	}
+
+	got, err := DecodeJSON(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, node) {
+		gotS, _ := json.Marshal(got)
+		wantS, _ := json.Marshal(node)
+		t.Errorf("DecodeJSON() = \ngot \t%s\nwant\t%s", gotS, wantS)
+	}
+}
+
+// 编码结果与 testdata/ast.json 一致，修改该文件时需要递增 JSONVersion
+func TestEncodeJSON_golden(t *testing.T) {
+	var pos token.FilePos
+	pos.Init(jsonSrc)
+	data, err := EncodeJSON(jsonNode(), pos)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got bytes.Buffer
+	if err := json.Indent(&got, data, "", "  "); err != nil {
+		t.Fatal(err)
+	}
+	got.WriteByte('\n')
+	want, err := ioutil.ReadFile("testdata/ast.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.String() != string(want) {
+		t.Errorf("EncodeJSON() = \n%s\nwant\n%s", got.String(), want)
+	}
+}
+
+func TestJSONFieldNames(t *testing.T) {
+	for name, typ := range nodeTypes {
+		if typ.Kind() != reflect.Struct {
+			continue
+		}
+		for i := 0; i < typ.NumField(); i++ {
+			if f := typ.Field(i); fieldName(f) == "" {
+				t.Errorf("%s.%s has no json name", name, f.Name)
+			}
+		}
+	}
+}
+
+func TestDecodeJSON_error(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+	}{
+		{"version", `{"version":0,"root":null}`},
+		{"type", `{"version":1,"root":{"node":"Unknown"}}`},
+		{"assign", `{"version":1,"root":{"node":"IfStmt","x":{"node":"BlockStmt","list":[]}}}`},
+		{"token", `{"version":1,"root":{"node":"Text","kind":"NOPE"}}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := DecodeJSON([]byte(tt.data))
+			if err == nil {
+				t.Fatalf("DecodeJSON() expected error")
+			}
+			if tt.name != "version" && strings.Contains(err.Error(), "version") {
+				t.Errorf("DecodeJSON() error = %v", err)
+			}
+		})
+	}
+}
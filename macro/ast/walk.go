@@ -1,59 +1,62 @@
 package ast
 
-import "fmt"
+import "reflect"
 
 type Visitor interface {
 	Visit(node Node) (w Visitor)
 }
 
 // Walk
+// 按源码顺序遍历语法树，每个节点只访问一次
+// 子节点遍历完成后调用 w.Visit(nil)，未知节点作为叶子节点处理
 func Walk(v Visitor, node Node) {
-	if node == nil {
+	if isNil(node) {
 		return
 	}
 	if v = v.Visit(node); v == nil {
 		return
 	}
 	switch n := node.(type) {
-	case *BadExpr, *Text, *Ident, *Comment:
-	case *BlockStmt:
-		for _, stmt := range *n {
-			Walk(v, stmt)
-		}
 	case *ValDefineStmt:
-		v.Visit(n)
+		Walk(v, n.Name)
+		Walk(v, n.Body)
 	case *UnDefineStmt:
-		v.Visit(n)
-	case *FuncDefineStmt:
-		v.Visit(n)
-		v.Visit(n.Body)
+		Walk(v, n.Name)
 	case *IncludeStmt:
-		v.Visit(n)
+		Walk(v, n.Name)
+	case *FuncDefineStmt:
+		Walk(v, n.Name)
+		for _, id := range n.IdentList {
+			Walk(v, id)
+		}
+		Walk(v, n.Body)
 	case *MacroCallExpr:
-		v.Visit(n)
+		Walk(v, n.Name)
 		Walk(v, n.ParamList)
+	case *ParenExpr:
+		Walk(v, n.X)
+	case *BlockStmt:
+		for _, stmt := range *n {
+			Walk(v, stmt)
+		}
 	case *MacroLitArray:
 		for _, item := range *n {
 			Walk(v, item)
 		}
-	case *LitExpr:
-		// non-visit
-	case *MacroCmdStmt, *LineStmt, *InvalidStmt:
-		v.Visit(n)
 	case *IfStmt:
-		v.Visit(n)
+		Walk(v, n.X)
 		Walk(v, n.Then)
 		Walk(v, n.Else)
 	case *ElseIfStmt:
-		v.Visit(n)
+		Walk(v, n.X)
 		Walk(v, n.Then)
 		Walk(v, n.Else)
 	case *IfDefStmt:
-		v.Visit(n)
+		Walk(v, n.Name)
 		Walk(v, n.Then)
 		Walk(v, n.Else)
 	case *IfNoDefStmt:
-		v.Visit(n)
+		Walk(v, n.Name)
 		Walk(v, n.Then)
 		Walk(v, n.Else)
 	case *UnaryExpr:
@@ -61,12 +64,23 @@ func Walk(v Visitor, node Node) {
 	case *BinaryExpr:
 		Walk(v, n.X)
 		Walk(v, n.Y)
-	default:
-		panic(fmt.Sprintf("ast.Walk: unexpected node type %T", n))
+	case *CondExpr:
+		Walk(v, n.Cond)
+		Walk(v, n.X)
+		Walk(v, n.Y)
 	}
 	v.Visit(nil)
 }
 
+// 空节点（含类型化的空指针）
+func isNil(node Node) bool {
+	if node == nil {
+		return true
+	}
+	v := reflect.ValueOf(node)
+	return v.Kind() == reflect.Ptr && v.IsNil()
+}
+
 type inspector func(Node) bool
 
 func (f inspector) Visit(node Node) Visitor {
@@ -0,0 +1,89 @@
+package ast
+
+import (
+	"dxkite.cn/language/macro/token"
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+func TestInspect(t *testing.T) {
+	// #define A x
+	// #if defined B
+	// f(y)
+	// #endif
+	node := &BlockStmt{
+		&ValDefineStmt{
+			Name: &Ident{Name: "A"},
+			Body: &MacroLitArray{&Ident{Name: "x"}},
+		},
+		&IfStmt{
+			X: &MacroLitArray{
+				&Text{Kind: token.TEXT, Text: " "},
+				&UnaryExpr{Op: token.DEFINED, X: &Ident{Name: "B"}},
+			},
+			Then: &BlockStmt{
+				&MacroLitArray{
+					&MacroCallExpr{
+						Name:      &Ident{Name: "f"},
+						ParamList: &MacroLitArray{&Ident{Name: "y"}},
+					},
+				},
+			},
+			Else: (*BlockStmt)(nil),
+		},
+		&InvalidStmt{Text: "#x"},
+	}
+	var got []string
+	Inspect(node, func(n Node) bool {
+		switch n := n.(type) {
+		case nil:
+		case *Ident:
+			got = append(got, n.Name)
+		default:
+			got = append(got, fmt.Sprintf("%T", n))
+		}
+		return true
+	})
+	want := []string{
+		"*ast.BlockStmt",
+		"*ast.ValDefineStmt", "A", "*ast.MacroLitArray", "x",
+		"*ast.IfStmt", "*ast.MacroLitArray", "*ast.Text", "*ast.UnaryExpr", "B",
+		"*ast.BlockStmt", "*ast.MacroLitArray", "*ast.MacroCallExpr", "f", "*ast.MacroLitArray", "y",
+		"*ast.InvalidStmt",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Inspect() = %v, want %v", got, want)
+	}
+}
+
+type countVisitor map[Node]int
+
+func (c countVisitor) Visit(n Node) Visitor {
+	if n != nil {
+		c[n]++
+	}
+	return c
+}
+
+func TestWalk_once(t *testing.T) {
+	node := &BlockStmt{
+		&FuncDefineStmt{
+			Name:      &Ident{Name: "F"},
+			IdentList: []*Ident{{Name: "a"}},
+			Body:      &MacroLitArray{&BinaryExpr{X: &Ident{Name: "a"}, Op: token.DOUBLE_SHARP, Y: &Ident{Name: "b"}}},
+		},
+		&IncludeStmt{Path: "<a.h>"},
+		&LineStmt{Line: "1"},
+	}
+	c := countVisitor{}
+	Walk(c, node)
+	if len(c) != 10 {
+		t.Errorf("Walk() visited %d nodes, want 10", len(c))
+	}
+	for n, i := range c {
+		if i != 1 {
+			t.Errorf("Walk() visited %T %d times", n, i)
+		}
+	}
+}
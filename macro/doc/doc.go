@@ -0,0 +1,292 @@
+package doc
+
+import (
+	"dxkite.cn/language/macro/ast"
+	"dxkite.cn/language/macro/interpreter"
+	"dxkite.cn/language/macro/parser"
+	"dxkite.cn/language/macro/printer"
+	"dxkite.cn/language/macro/scanner"
+	"dxkite.cn/language/macro/token"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// 宏文档
+type Macro struct {
+	Name       string         // 宏名
+	Func       bool           // 是否为函数宏
+	Params     []string       // 函数宏参数
+	Doc        string         // 文档注释
+	Pos        token.Position // 定义位置
+	Conditions []string       // 定义所需的条件，全部成立时定义
+	Definition string         // 定义语句
+	Value      string         // 展开后的值（对象宏）
+	Const      string         // 常量值（对象宏展开为常量表达式时）
+	Dependent  bool           // 展开结果取决于条件编译，此时没有 Value 和 Const
+	Anchor     string         // 文档锚点，同名宏依次添加序号
+	node       ast.DefineStmt
+	path       []branch
+}
+
+// 定义所在的条件分支
+type branch struct {
+	stmt  ast.CondStmt // 条件语句
+	index int          // 第几个分支，#elif #else 依次递增
+}
+
+// 签名
+func (m *Macro) Signature() string {
+	if m.Func {
+		return m.Name + "(" + strings.Join(m.Params, ", ") + ")"
+	}
+	return m.Name
+}
+
+// 定义条件
+func (m *Macro) Condition() string {
+	return strings.Join(m.Conditions, " && ")
+}
+
+// 文件文档
+type File struct {
+	Name   string   // 文件名
+	Macros []*Macro // 宏列表，按名称排序
+}
+
+// 生成文件文档
+func New(name string, src []byte) (*File, scanner.ErrorList) {
+	node, errs := parser.Parse(src)
+	cmap := ast.NewCommentMap(src, node, parser.ParseComments(src))
+	var pos token.FilePos
+	pos.Init(src)
+
+	f := &File{Name: name}
+	c := &collector{file: f, cmap: cmap, pos: pos}
+	c.stmt(node, nil, nil)
+
+	// 只使用对象宏定义处生效的定义展开
+	for _, m := range f.Macros {
+		if m.Func {
+			continue
+		}
+		defs, ok := effective(f.Macros, m)
+		if !ok {
+			m.Dependent = true
+			continue
+		}
+		it := &interpreter.Interpreter{ErrorHandler: func(token.Position, string) {}}
+		for _, d := range defs {
+			it.Define(d.node)
+		}
+		m.Value, _ = it.ExpandMacro(m.Name)
+		if v, ok := it.EvalConst(m.Value); ok {
+			m.Const = fmt.Sprint(v)
+		}
+	}
+	sort.SliceStable(f.Macros, func(i, j int) bool { return f.Macros[i].Name < f.Macros[j].Name })
+	count := map[string]int{}
+	for _, m := range f.Macros {
+		count[m.Name]++
+		m.Anchor = m.Name
+		if n := count[m.Name]; n > 1 {
+			m.Anchor = fmt.Sprintf("%s-%d", m.Name, n)
+		}
+	}
+	return f, errs
+}
+
+// 宏 m 定义处生效的定义，按名称
+// 同名的宏取 m 之前最后一个定义，没有时取 m 之后第一个定义，与 m 互斥的分支中的定义不生效
+// m 展开用到的宏只在部分配置下生效时返回 false
+func effective(macros []*Macro, m *Macro) (map[string]*Macro, bool) {
+	defs := map[string]*Macro{}
+	before := true
+	for _, d := range macros {
+		if d == m {
+			before = false
+		}
+		if !compatible(d.path, m.path) {
+			continue
+		}
+		if _, ok := defs[d.Name]; before || !ok {
+			defs[d.Name] = d
+		}
+	}
+	defs[m.Name] = m
+	seen := map[string]bool{}
+	queue := []*Macro{m}
+	for len(queue) > 0 {
+		d := queue[0]
+		queue = queue[1:]
+		if !within(d.path, m.path) {
+			return nil, false
+		}
+		for _, name := range refs(d.node) {
+			if ref, ok := defs[name]; ok && !seen[name] {
+				seen[name] = true
+				queue = append(queue, ref)
+			}
+		}
+	}
+	return defs, true
+}
+
+// 两个分支是否可能同时成立：同一条件语句中必须位于同一分支
+func compatible(x, y []branch) bool {
+	for _, a := range x {
+		for _, b := range y {
+			if a.stmt == b.stmt && a.index != b.index {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// 分支 x 是否在 y 成立时一定成立
+func within(x, y []branch) bool {
+	for _, a := range x {
+		found := false
+		for _, b := range y {
+			if a == b {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// 宏定义体中引用的标识符
+func refs(n ast.DefineStmt) []string {
+	var body ast.Node
+	switch n := n.(type) {
+	case *ast.ValDefineStmt:
+		body = n.Body
+	case *ast.FuncDefineStmt:
+		body = n.Body
+	}
+	var names []string
+	if body == nil {
+		return names
+	}
+	ast.Inspect(body, func(node ast.Node) bool {
+		if id, ok := node.(*ast.Ident); ok {
+			names = append(names, id.Name)
+		}
+		return true
+	})
+	return names
+}
+
+type collector struct {
+	file *File
+	cmap ast.CommentMap
+	pos  token.FilePos
+}
+
+// 收集宏定义，cond 为当前所在的条件，path 为所在的分支
+func (c *collector) stmt(node ast.Node, cond []string, path []branch) {
+	switch n := node.(type) {
+	case *ast.BlockStmt:
+		for _, stmt := range *n {
+			c.stmt(stmt, cond, path)
+		}
+	case *ast.ValDefineStmt:
+		c.define(n, n.Name.Name, cond, path)
+	case *ast.FuncDefineStmt:
+		m := c.define(n, n.Name.Name, cond, path)
+		m.Func = true
+		m.Params = []string{}
+		for _, id := range n.IdentList {
+			m.Params = append(m.Params, id.Name)
+		}
+	case *ast.IfStmt:
+		c.branch(n, 0, expr(n.X), n.Then, n.Else, cond, path)
+	case *ast.IfDefStmt:
+		c.branch(n, 0, "defined("+n.Name.Name+")", n.Then, n.Else, cond, path)
+	case *ast.IfNoDefStmt:
+		c.branch(n, 0, "!defined("+n.Name.Name+")", n.Then, n.Else, cond, path)
+	}
+}
+
+// 条件分支，stmt 为条件语句，index 为当前分支的序号
+func (c *collector) branch(stmt ast.CondStmt, index int, x string, then, els ast.Stmt, cond []string, path []branch) {
+	c.stmt(then, with(cond, x), withBranch(path, branch{stmt, index}))
+	cond = with(cond, negate(x))
+	if eif, ok := els.(*ast.ElseIfStmt); ok {
+		c.branch(stmt, index+1, expr(eif.X), eif.Then, eif.Else, cond, path)
+		return
+	}
+	c.stmt(els, cond, withBranch(path, branch{stmt, index + 1}))
+}
+
+func (c *collector) define(n ast.DefineStmt, name string, cond []string, path []branch) *Macro {
+	m := &Macro{
+		Name:       name,
+		Doc:        c.doc(n),
+		Pos:        c.pos.CreatePosition(n.Pos()),
+		Conditions: cond,
+		Definition: strings.TrimSpace(printer.Sprint(n)),
+		node:       n,
+		path:       path,
+	}
+	c.file.Macros = append(c.file.Macros, m)
+	return m
+}
+
+// 文档注释，没有前导注释时使用行尾注释
+func (c *collector) doc(n ast.Node) string {
+	var leading, trailing []string
+	for _, g := range c.cmap[n] {
+		if g.End() <= n.Pos() {
+			leading = append(leading, g.Text())
+		} else {
+			trailing = append(trailing, g.Text())
+		}
+	}
+	if len(leading) == 0 {
+		leading = trailing
+	}
+	return strings.TrimSpace(strings.Join(leading, "\n"))
+}
+
+func with(cond []string, x string) []string {
+	return append(cond[:len(cond):len(cond)], x)
+}
+
+func withBranch(path []branch, b branch) []branch {
+	return append(path[:len(path):len(path)], b)
+}
+
+// 条件表达式文本
+func expr(x ast.MacroLiter) string {
+	return strings.Join(strings.Fields(printer.Sprint(x)), " ")
+}
+
+// 条件取反
+func negate(x string) string {
+	if strings.HasPrefix(x, "!defined(") && strings.Count(x, "(") == 1 && strings.HasSuffix(x, ")") {
+		return x[1:]
+	}
+	if isSimple(x) {
+		return "!" + x
+	}
+	return "!(" + x + ")"
+}
+
+// 标识符或 defined(X)
+func isSimple(x string) bool {
+	x = strings.TrimPrefix(x, "defined(")
+	x = strings.TrimSuffix(x, ")")
+	for _, ch := range x {
+		if !(ch == '_' || 'a' <= ch && ch <= 'z' || 'A' <= ch && ch <= 'Z' || '0' <= ch && ch <= '9') {
+			return false
+		}
+	}
+	return len(x) > 0
+}
@@ -0,0 +1,134 @@
+package doc
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const header = `// Buffer size in bytes.
+#define BUF_SIZE (4 * 1024)
+#define TOTAL BUF_SIZE * 2 // total memory
+#ifdef USE_LOG
+/* Log a message. */
+#define LOG(fmt) printf(fmt)
+#elif LEVEL > 2
+#define LOG(fmt) debug(fmt)
+#else
+#define LOG(x)
+#endif
+#define NAME "sdk<1>"
+`
+
+func TestNew(t *testing.T) {
+	f, errs := New("sdk.h", []byte(header))
+	if len(errs) > 0 {
+		t.Fatal(errs)
+	}
+	type macro struct {
+		Anchor, Doc, Cond, Value, Const string
+		Params                          []string
+		Line                            int
+	}
+	var got []macro
+	for _, m := range f.Macros {
+		got = append(got, macro{m.Anchor, m.Doc, m.Condition(), m.Value, m.Const, m.Params, m.Pos.Line})
+	}
+	want := []macro{
+		{"BUF_SIZE", "Buffer size in bytes.", "", "(4 * 1024)", "4096", nil, 2},
+		{"LOG", "Log a message.", "defined(USE_LOG)", "", "", []string{"fmt"}, 6},
+		{"LOG-2", "", "!defined(USE_LOG) && LEVEL > 2", "", "", []string{"fmt"}, 8},
+		{"LOG-3", "", "!defined(USE_LOG) && !(LEVEL > 2)", "", "", []string{"x"}, 10},
+		{"NAME", "", "", `"sdk<1>"`, "", nil, 12},
+		{"TOTAL", "total memory", "", "(4 * 1024) * 2", "8192", nil, 3},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("New() = \ngot \t%+v\nwant\t%+v", got, want)
+	}
+}
+
+func TestFile_render(t *testing.T) {
+	f, _ := New("sdk.h", []byte(header))
+	var md, html bytes.Buffer
+	if err := f.Markdown(&md); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.HTML(&html); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		"| [`LOG(fmt)`](#LOG-2) |  |",
+		"## TOTAL\n\n```c\n#define TOTAL BUF_SIZE * 2\n```\n\ntotal memory\n",
+		"- Defined when: `!defined(USE_LOG) && LEVEL > 2`",
+		"- Expands to: `(4 * 1024) * 2`\n- Value: `8192`",
+	} {
+		if !strings.Contains(md.String(), want) {
+			t.Errorf("Markdown() missing %q in\n%s", want, md.String())
+		}
+	}
+	for _, want := range []string{
+		`<section id="LOG-3">`,
+		`<code>#define NAME &#34;sdk&lt;1&gt;&#34;</code>`,
+		`<dd><code>!defined(USE_LOG) &amp;&amp; !(LEVEL &gt; 2)</code></dd>`,
+	} {
+		if !strings.Contains(html.String(), want) {
+			t.Errorf("HTML() missing %q in\n%s", want, html.String())
+		}
+	}
+}
+
+const config = `#ifdef SMALL
+#define SIZE 16
+#define BUF (SIZE * 2)
+#else
+#define SIZE 64
+#define BUF (SIZE * 2)
+#endif
+#define TOTAL SIZE
+#define FLAGS (A | B)
+#define EARLY LATE
+#define LATE 1
+`
+
+// 只使用定义处生效的定义展开
+func TestNew_conditional(t *testing.T) {
+	f, errs := New("config.h", []byte(config))
+	if len(errs) > 0 {
+		t.Fatal(errs)
+	}
+	type macro struct {
+		Anchor, Value, Const string
+		Dependent            bool
+	}
+	var got []macro
+	for _, m := range f.Macros {
+		got = append(got, macro{m.Anchor, m.Value, m.Const, m.Dependent})
+	}
+	want := []macro{
+		{"BUF", "(16 * 2)", "32", false},
+		{"BUF-2", "(64 * 2)", "128", false},
+		{"EARLY", "1", "1", false},
+		{"FLAGS", "(A | B)", "", false},
+		{"LATE", "1", "1", false},
+		{"SIZE", "16", "16", false},
+		{"SIZE-2", "64", "64", false},
+		{"TOTAL", "", "", true},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("New() = \ngot \t%+v\nwant\t%+v", got, want)
+	}
+	var md bytes.Buffer
+	if err := f.Markdown(&md); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		"| [`FLAGS`](#FLAGS) | `(A \\| B)` |",
+		"| [`TOTAL`](#TOTAL) | *conditional* |",
+		"- Expands to: depends on conditional definitions",
+	} {
+		if !strings.Contains(md.String(), want) {
+			t.Errorf("Markdown() missing %q in\n%s", want, md.String())
+		}
+	}
+}
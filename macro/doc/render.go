@@ -0,0 +1,95 @@
+package doc
+
+import (
+	htmltemplate "html/template"
+	"io"
+	"strings"
+	"text/template"
+)
+
+var funcs = map[string]interface{}{
+	"join": strings.Join,
+	"code": func(s string) string {
+		// 行内代码中的反引号
+		if strings.Contains(s, "`") {
+			return "`` " + s + " ``"
+		}
+		return "`" + s + "`"
+	},
+	// 表格单元格中的竖线和换行
+	"cell": func(s string) string {
+		return cellReplacer.Replace(s)
+	},
+}
+
+var cellReplacer = strings.NewReplacer("|", "\\|", "\r\n", " ", "\n", " ", "\r", " ")
+
+var markdownTemplate = template.Must(template.New("markdown").Funcs(funcs).Parse(`# {{.Name}}
+
+| Macro | Value |
+| --- | --- |
+{{range .Macros}}| [{{code .Signature | cell}}](#{{.Anchor | urlquery}}) | {{if .Const}}{{code .Const | cell}}{{else if .Value}}{{code .Value | cell}}{{else if .Dependent}}*conditional*{{end}} |
+{{end}}{{range .Macros}}
+<a id="{{.Anchor}}"></a>
+## {{.Signature}}
+
+` + "```c" + `
+{{.Definition}}
+` + "```" + `
+{{if .Doc}}
+{{.Doc}}
+{{end}}
+- Location: {{code (printf "%s:%d" $.Name .Pos.Line)}}
+{{- if .Conditions}}
+- Defined when: {{code .Condition}}
+{{- end}}
+{{- if .Func}}
+- Parameters: {{if .Params}}{{range $i, $p := .Params}}{{if $i}}, {{end}}{{code $p}}{{end}}{{else}}none{{end}}
+{{- end}}
+{{- if .Dependent}}
+- Expands to: depends on conditional definitions
+{{- else if and .Value (ne .Value .Const)}}
+- Expands to: {{code .Value}}
+{{- end}}
+{{- if .Const}}
+- Value: {{code .Const}}
+{{- end}}
+{{end}}`))
+
+var htmlTemplate = htmltemplate.Must(htmltemplate.New("html").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{.Name}}</title>
+</head>
+<body>
+<h1>{{.Name}}</h1>
+<ul>
+{{range .Macros}}<li><a href="#{{.Anchor}}"><code>{{.Signature}}</code></a></li>
+{{end}}</ul>
+{{range .Macros}}<section id="{{.Anchor}}">
+<h2><code>{{.Signature}}</code></h2>
+<pre><code>{{.Definition}}</code></pre>
+{{if .Doc}}<p>{{.Doc}}</p>
+{{end}}<dl>
+<dt>Location</dt><dd>{{$.Name}}:{{.Pos.Line}}</dd>
+{{if .Conditions}}<dt>Defined when</dt><dd><code>{{.Condition}}</code></dd>
+{{end}}{{if .Func}}<dt>Parameters</dt><dd>{{range $i, $p := .Params}}{{if $i}}, {{end}}<code>{{$p}}</code>{{else}}none{{end}}</dd>
+{{end}}{{if .Dependent}}<dt>Expands to</dt><dd>depends on conditional definitions</dd>
+{{else if and .Value (ne .Value .Const)}}<dt>Expands to</dt><dd><code>{{.Value}}</code></dd>
+{{end}}{{if .Const}}<dt>Value</dt><dd><code>{{.Const}}</code></dd>
+{{end}}</dl>
+</section>
+{{end}}</body>
+</html>
+`))
+
+// 输出 Markdown 文档
+func (f *File) Markdown(w io.Writer) error {
+	return markdownTemplate.Execute(w, f)
+}
+
+// 输出 HTML 文档
+func (f *File) HTML(w io.Writer) error {
+	return htmlTemplate.Execute(w, f)
+}
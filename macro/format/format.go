@@ -0,0 +1,349 @@
+// 指令格式化
+// 按样式改写预处理指令所在的行，其他文本保持不变
+package format
+
+import (
+	"bytes"
+	"dxkite.cn/language/macro/ast"
+	"dxkite.cn/language/macro/parser"
+	"dxkite.cn/language/macro/scanner"
+	"dxkite.cn/language/macro/token"
+	"strings"
+)
+
+// 制表符宽度，计算续行反斜杠的列时使用
+const tabWidth = 8
+
+// 格式化样式
+type Style struct {
+	Indent          int  // 每层条件嵌套在 # 之后缩进的空格数
+	IndentGuard     bool // 头文件的包含保护是否增加嵌套层数
+	BackslashColumn int  // 多行 #define 续行反斜杠的最小列，至少位于最长的行之后一个空格
+	DefinedParen    bool // 为 true 时写作 defined(X)，否则写作 defined X
+}
+
+// 默认样式
+var DefaultStyle = Style{Indent: 2, DefinedParen: true}
+
+// 按默认样式格式化
+func Source(src []byte) ([]byte, scanner.ErrorList) {
+	return DefaultStyle.Format(src)
+}
+
+// 格式化源码中的指令，有语法错误时返回原始源码
+func (s *Style) Format(src []byte) ([]byte, scanner.ErrorList) {
+	node, errs := parser.Parse(src)
+	if len(errs) > 0 {
+		return src, errs
+	}
+	f := &formatter{Style: s, src: src}
+	if block, ok := node.(*ast.BlockStmt); ok {
+		list := *block
+		if guard := ast.IncludeGuard(block); guard != nil && !s.IndentGuard {
+			// 包含保护的指令及其内容不缩进
+			block := ast.Branches(guard)
+			if d := block.Branches[0].Directive; d != nil {
+				f.add(d.From, 0)
+			}
+			f.stmts(*guard.Then.(*ast.BlockStmt), 0)
+			if block.Endif != nil {
+				f.add(block.Endif.From, 0)
+			}
+			list = nil
+		}
+		f.stmts(list, 0)
+	}
+	var out bytes.Buffer
+	from := 0
+	for _, d := range f.dirs {
+		start, end := f.line(int(d.pos))
+		if start < from {
+			continue
+		}
+		out.Write(src[from:start])
+		out.WriteString(f.directive(string(src[d.pos:end]), d.depth))
+		from = end
+	}
+	out.Write(src[from:])
+	return out.Bytes(), nil
+}
+
+type formatter struct {
+	*Style
+	src  []byte
+	dirs []directive
+}
+
+// 指令位置及嵌套层数
+type directive struct {
+	pos   token.Pos
+	depth int
+}
+
+func (f *formatter) add(pos token.Pos, depth int) {
+	if int(pos) < len(f.src) && f.src[pos] == '#' {
+		f.dirs = append(f.dirs, directive{pos, depth})
+	}
+}
+
+// 记录语句中的指令
+func (f *formatter) stmts(list ast.BlockStmt, depth int) {
+	for _, stmt := range list {
+		switch stmt.(type) {
+		case *ast.ValDefineStmt, *ast.FuncDefineStmt, *ast.UnDefineStmt,
+			*ast.IncludeStmt, *ast.LineStmt, *ast.MacroCmdStmt:
+			f.add(stmt.Pos(), depth)
+			continue
+		}
+		block := ast.Branches(stmt)
+		if block == nil {
+			continue
+		}
+		for _, b := range block.Branches {
+			if b.Directive != nil {
+				f.add(b.Directive.From, depth)
+			}
+			if body, ok := b.Body.(*ast.BlockStmt); ok && body != nil {
+				f.stmts(*body, depth+1)
+			} else if b.Body != nil {
+				f.stmts(ast.BlockStmt{b.Body}, depth+1)
+			}
+		}
+		if block.Endif != nil {
+			f.add(block.Endif.From, depth)
+		}
+	}
+}
+
+// 指令所在的行，从行首到续行结束（不含换行）
+func (f *formatter) line(pos int) (start, end int) {
+	start = pos
+	for start > 0 && (f.src[start-1] == ' ' || f.src[start-1] == '\t') {
+		start--
+	}
+	if start > 0 && f.src[start-1] != '\n' {
+		// # 之前有其他内容
+		start = pos
+	}
+	end = pos
+	for end < len(f.src) {
+		n := bytes.IndexByte(f.src[end:], '\n')
+		if n < 0 {
+			return start, len(f.src)
+		}
+		end += n
+		if !bytes.HasSuffix(bytes.TrimRight(f.src[pos:end], "\r"), []byte("\\")) {
+			break
+		}
+		end++
+	}
+	return start, end
+}
+
+// 格式化一条指令，text 从 # 开始
+func (f *formatter) directive(text string, depth int) string {
+	i := 1
+	for i < len(text) && (text[i] == ' ' || text[i] == '\t') {
+		i++
+	}
+	j := i
+	for j < len(text) && isIdentChar(text[j]) {
+		j++
+	}
+	keyword, rest := text[i:j], text[j:]
+	if keyword == "if" || keyword == "elif" {
+		rest = f.defined(rest)
+	}
+	if trimmed := strings.TrimLeft(rest, " \t"); trimmed != rest && trimmed != "" && trimmed[0] != '\r' && trimmed[0] != '\n' {
+		rest = " " + trimmed
+	}
+	out := "#" + rest
+	if keyword != "" {
+		out = "#" + strings.Repeat(" ", depth*f.Indent) + keyword + rest
+	}
+	lines := strings.Split(out, "\n")
+	last := len(lines) - 1
+	lines[last] = trimRightSpace(lines[last])
+	if keyword == "define" && last > 0 {
+		f.align(lines[:last])
+	}
+	return strings.Join(lines, "\n")
+}
+
+// 对齐续行反斜杠
+// 结束于未闭合的字符串或字符字面量的行保持不变，其中的空白属于字面量
+func (f *formatter) align(lines []string) {
+	col := f.BackslashColumn
+	keep := make([]bool, len(lines))
+	var state byte
+	for i, l := range lines {
+		state = lineState(l, state)
+		if keep[i] = state == '"' || state == '\''; keep[i] {
+			continue
+		}
+		cr := strings.HasSuffix(l, "\r")
+		l = trimRightSpace(strings.TrimSuffix(strings.TrimSuffix(l, "\r"), "\\"))
+		if w := width(l) + 1; w > col {
+			col = w
+		}
+		lines[i] = l
+		if cr {
+			lines[i] += "\r"
+		}
+	}
+	for i, l := range lines {
+		if keep[i] {
+			continue
+		}
+		cr := ""
+		if strings.HasSuffix(l, "\r") {
+			l, cr = l[:len(l)-1], "\r"
+		}
+		lines[i] = l + strings.Repeat(" ", col-width(l)) + "\\" + cr
+	}
+}
+
+// 行尾所处的字面量或注释，state 为行首的状态
+// 引号表示未闭合的字符串或字符，'*' 为块注释，'/' 为续行的行注释
+func lineState(l string, state byte) byte {
+	if state == '/' {
+		return state
+	}
+	for i := 0; i < len(l); i++ {
+		switch state {
+		case '"', '\'':
+			if l[i] == '\\' {
+				i++
+			} else if l[i] == state {
+				state = 0
+			}
+		case '*':
+			if strings.HasPrefix(l[i:], "*/") {
+				state = 0
+				i++
+			}
+		default:
+			switch {
+			case l[i] == '"' || l[i] == '\'':
+				state = l[i]
+			case strings.HasPrefix(l[i:], "/*"):
+				state = '*'
+				i++
+			case strings.HasPrefix(l[i:], "//"):
+				return '/'
+			}
+		}
+	}
+	return state
+}
+
+// 显示宽度，制表符对齐到 tabWidth
+func width(s string) int {
+	w := 0
+	for _, r := range s {
+		if r == '\t' {
+			w += tabWidth - w%tabWidth
+		} else {
+			w++
+		}
+	}
+	return w
+}
+
+func trimRightSpace(s string) string {
+	cr := strings.HasSuffix(s, "\r")
+	s = strings.TrimRight(strings.TrimSuffix(s, "\r"), " \t")
+	if cr {
+		s += "\r"
+	}
+	return s
+}
+
+// 改写条件中的 defined
+// 跳过字符串和注释，defined 与参数之间有注释时保持不变
+func (f *formatter) defined(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); {
+		switch {
+		case s[i] == '"' || s[i] == '\'':
+			j := i + 1
+			for j < len(s) && s[j] != s[i] && s[j] != '\n' {
+				if s[j] == '\\' {
+					j++
+				}
+				j++
+			}
+			if j < len(s) {
+				j++
+			}
+			b.WriteString(s[i:j])
+			i = j
+		case strings.HasPrefix(s[i:], "/*"):
+			j := len(s)
+			if n := strings.Index(s[i+2:], "*/"); n >= 0 {
+				j = i + 2 + n + 2
+			}
+			b.WriteString(s[i:j])
+			i = j
+		case strings.HasPrefix(s[i:], "//"):
+			b.WriteString(s[i:])
+			i = len(s)
+		case isIdentChar(s[i]) && (s[i] < '0' || s[i] > '9'):
+			j := i
+			for j < len(s) && isIdentChar(s[j]) {
+				j++
+			}
+			if name, k, ok := definedOperand(s, j); s[i:j] == "defined" && ok {
+				if f.DefinedParen {
+					b.WriteString("defined(" + name + ")")
+				} else {
+					b.WriteString("defined " + name)
+				}
+				i = k
+				continue
+			}
+			b.WriteString(s[i:j])
+			i = j
+		default:
+			b.WriteByte(s[i])
+			i++
+		}
+	}
+	return b.String()
+}
+
+// defined 的参数，X 或 (X)
+func definedOperand(s string, i int) (name string, end int, ok bool) {
+	i = skipSpace(s, i)
+	paren := i < len(s) && s[i] == '('
+	if paren {
+		i = skipSpace(s, i+1)
+	}
+	j := i
+	for j < len(s) && isIdentChar(s[j]) {
+		j++
+	}
+	if j == i || s[i] >= '0' && s[i] <= '9' {
+		return "", 0, false
+	}
+	name, end = s[i:j], j
+	if paren {
+		end = skipSpace(s, j)
+		if end >= len(s) || s[end] != ')' {
+			return "", 0, false
+		}
+		end++
+	}
+	return name, end, true
+}
+
+func skipSpace(s string, i int) int {
+	for i < len(s) && (s[i] == ' ' || s[i] == '\t') {
+		i++
+	}
+	return i
+}
+
+func isIdentChar(b byte) bool {
+	return b == '_' || 'a' <= b && b <= 'z' || 'A' <= b && b <= 'Z' || '0' <= b && b <= '9'
+}
@@ -0,0 +1,79 @@
+package format
+
+import (
+	"testing"
+)
+
+func TestStyle_Format(t *testing.T) {
+	guard := Style{Indent: 1, IndentGuard: true, BackslashColumn: 20}
+	plain := Style{Indent: 2}
+	tests := []struct {
+		name  string
+		style Style
+		src   string
+		want  string
+	}{
+		{"nested", DefaultStyle,
+			"#ifdef A\n  #if B\n#define C 1\n #   endif\n#else\n#include <a.h>\n#endif\n",
+			"#ifdef A\n#  if B\n#    define C 1\n#  endif\n#else\n#  include <a.h>\n#endif\n"},
+		{"text unchanged", DefaultStyle,
+			"#if A\n   int  x ;  \n\tdefined ( A )\n#endif\n",
+			"#if A\n   int  x ;  \n\tdefined ( A )\n#endif\n"},
+		{"keyword spacing", DefaultStyle,
+			"#define   A    1  \n#  pragma   once\n#error  stop\n",
+			"#define A    1\n#pragma once\n#error stop\n"},
+		{"defined", DefaultStyle,
+			"#if defined A && defined ( B ) || !defined(C) && X(defined)\n#elif defined  /* c */ D || \"defined E\"\n#endif\n",
+			"#if defined(A) && defined(B) || !defined(C) && X(defined)\n#elif defined  /* c */ D || \"defined E\"\n#endif\n"},
+		{"defined plain", plain,
+			"#if defined(A) || defined ( B )\n#endif\n",
+			"#if defined A || defined B\n#endif\n"},
+		{"backslash", DefaultStyle,
+			"#if 1\n#define F(x) \\\n  do { \\\n    g(x);\\\n  } while (0)\n#endif\n",
+			"#if 1\n#  define F(x) \\\n  do {         \\\n    g(x);      \\\n  } while (0)\n#endif\n"},
+		{"backslash in string", DefaultStyle,
+			"#define S \"abc   \\\ndef\"\n",
+			"#define S \"abc   \\\ndef\"\n"},
+		{"backslash after string", guard,
+			"#define S(x) \\\n  \"a  \\\nb\" x \\\n  'c'\n",
+			"#define S(x)        \\\n  \"a  \\\nb\" x                \\\n  'c'\n"},
+		{"backslash column", guard,
+			"#define F(x) \\\r\n\tx\r\n",
+			"#define F(x)        \\\r\n\tx\r\n"},
+		{"include guard", DefaultStyle,
+			"/* a.h */\n#ifndef A_H\n#define A_H\n#ifdef B\n#define C\n#endif\n#endif\n",
+			"/* a.h */\n#ifndef A_H\n#define A_H\n#ifdef B\n#  define C\n#endif\n#endif\n"},
+		{"indent guard", guard,
+			"#ifndef A_H\n#define A_H\n#ifdef B\n#define C\n#endif\n#endif\n",
+			"#ifndef A_H\n# define A_H\n# ifdef B\n#  define C\n# endif\n#endif\n"},
+		{"not a guard", DefaultStyle,
+			"#ifndef A_H\n#define B_H\n#endif\n",
+			"#ifndef A_H\n#  define B_H\n#endif\n"},
+		{"no newline at end", DefaultStyle,
+			"#ifdef A\n#endif\n  #define B 1  ",
+			"#ifdef A\n#endif\n#define B 1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, errs := tt.style.Format([]byte(tt.src))
+			if len(errs) > 0 {
+				t.Fatalf("Format() errors = %v", errs)
+			}
+			if string(got) != tt.want {
+				t.Errorf("Format() = %q, want %q", got, tt.want)
+			}
+			// 格式化结果不再改变
+			if again, _ := tt.style.Format(got); string(again) != string(got) {
+				t.Errorf("Format() again = %q, want %q", again, got)
+			}
+		})
+	}
+}
+
+func TestSource_errors(t *testing.T) {
+	src := "#if A\n  #define B\n"
+	got, errs := Source([]byte(src))
+	if len(errs) == 0 || string(got) != src {
+		t.Errorf("Source() = %q, %v, want source unchanged with errors", got, errs)
+	}
+}
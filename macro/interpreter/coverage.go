@@ -0,0 +1,315 @@
+package interpreter
+
+import (
+	"bufio"
+	"dxkite.cn/language/macro/ast"
+	"dxkite.cn/language/macro/printer"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"strings"
+)
+
+// 条件分支覆盖
+// 同一个对象可用于多次执行，结果按文件和行合并
+type Coverage struct {
+	Runs    int               `json:"runs"`  // 执行次数
+	Conds   []*CondCoverage   `json:"conds"` // 条件块，按首次出现的顺序
+	Sources map[string][]byte `json:"-"`     // 注释源码时使用的文件内容，没有时读取文件
+	index   map[string]*CondCoverage
+}
+
+// 条件块的覆盖
+type CondCoverage struct {
+	File     string            `json:"file"`
+	Line     int               `json:"line"`
+	Reached  int               `json:"reached"` // 执行到条件块的次数
+	Branches []*BranchCoverage `json:"branches"`
+}
+
+// 分支的覆盖
+type BranchCoverage struct {
+	Line      int    `json:"line"`      // 分支指令所在行
+	End       int    `json:"end"`       // 分支体的最后一行
+	Directive string `json:"directive"` // 分支指令，如 #elif defined(A)
+	Count     int    `json:"count"`     // 执行分支的次数
+}
+
+// 读取 JSON 格式的覆盖结果
+func ReadCoverage(r io.Reader) (*Coverage, error) {
+	c := &Coverage{}
+	if err := json.NewDecoder(r).Decode(c); err != nil {
+		return nil, err
+	}
+	list := c.Conds
+	c.Conds = nil
+	for _, cond := range list {
+		c.add(cond)
+	}
+	return c, nil
+}
+
+func coverKey(file string, line int) string {
+	return file + "\x00" + strconv.Itoa(line)
+}
+
+// 添加条件块，已存在时返回已有的条件块
+func (c *Coverage) add(cond *CondCoverage) *CondCoverage {
+	if c.index == nil {
+		c.index = map[string]*CondCoverage{}
+	}
+	key := coverKey(cond.File, cond.Line)
+	if old, ok := c.index[key]; ok {
+		return old
+	}
+	c.index[key] = cond
+	c.Conds = append(c.Conds, cond)
+	return cond
+}
+
+// 合并另一次执行的结果
+// 同一位置的条件块分支数不同时（源码已修改）保留原有结果
+func (c *Coverage) Merge(o *Coverage) {
+	c.Runs += o.Runs
+	for _, cond := range o.Conds {
+		cp := &CondCoverage{File: cond.File, Line: cond.Line}
+		for _, b := range cond.Branches {
+			nb := *b
+			nb.Count = 0
+			cp.Branches = append(cp.Branches, &nb)
+		}
+		old := c.add(cp)
+		if len(old.Branches) != len(cond.Branches) {
+			continue
+		}
+		old.Reached += cond.Reached
+		for i, b := range cond.Branches {
+			old.Branches[i].Count += b.Count
+		}
+	}
+	for name, src := range o.Sources {
+		if c.Sources == nil {
+			c.Sources = map[string][]byte{}
+		}
+		if _, ok := c.Sources[name]; !ok {
+			c.Sources[name] = src
+		}
+	}
+}
+
+// 从未执行的分支
+type UncoveredBranch struct {
+	*CondCoverage
+	*BranchCoverage
+}
+
+// 从未执行的分支，按条件块的顺序
+func (c *Coverage) Uncovered() []UncoveredBranch {
+	var list []UncoveredBranch
+	for _, cond := range c.Conds {
+		for _, b := range cond.Branches {
+			if b.Count == 0 {
+				list = append(list, UncoveredBranch{cond, b})
+			}
+		}
+	}
+	return list
+}
+
+// 输出文本格式，列出从未执行的分支
+func (c *Coverage) WriteText(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	total, taken := 0, 0
+	for _, cond := range c.Conds {
+		for _, b := range cond.Branches {
+			total++
+			if b.Count > 0 {
+				taken++
+				continue
+			}
+			reason := "never taken"
+			if cond.Reached == 0 {
+				reason = "never reached"
+			}
+			fmt.Fprintf(bw, "%s:%d: %s: %s\n", cond.File, b.Line, b.Directive, reason)
+		}
+	}
+	fmt.Fprintf(bw, "%d runs, %d of %d branches taken\n", c.Runs, taken, total)
+	return bw.Flush()
+}
+
+// 输出 JSON 格式
+func (c *Coverage) WriteJSON(w io.Writer) error {
+	out := *c
+	if out.Conds == nil {
+		out.Conds = []*CondCoverage{}
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.SetEscapeHTML(false)
+	return enc.Encode(&out)
+}
+
+// 输出注释的源码
+// 分支指令所在行标注执行次数，从未执行为 #####，从未执行的分支体标注 -
+func (c *Coverage) WriteSource(w io.Writer) error {
+	var files []string
+	lines := map[string]map[int]string{}
+	for _, cond := range c.Conds {
+		marks := lines[cond.File]
+		if marks == nil {
+			marks = map[int]string{}
+			lines[cond.File] = marks
+			files = append(files, cond.File)
+		}
+		for _, b := range cond.Branches {
+			if b.Count == 0 {
+				for i := b.Line + 1; i <= b.End; i++ {
+					marks[i] = "-"
+				}
+			}
+		}
+	}
+	for _, cond := range c.Conds {
+		for _, b := range cond.Branches {
+			mark := strconv.Itoa(b.Count)
+			if b.Count == 0 {
+				mark = "#####"
+			}
+			lines[cond.File][b.Line] = mark
+		}
+	}
+	bw := bufio.NewWriter(w)
+	for i, name := range files {
+		src, ok := c.Sources[name]
+		if !ok {
+			var err error
+			if src, err = ioutil.ReadFile(name); err != nil {
+				return err
+			}
+		}
+		if i > 0 {
+			bw.WriteString("\n")
+		}
+		bw.WriteString(name + ":\n")
+		text := strings.TrimSuffix(string(src), "\n")
+		for n, line := range strings.Split(text, "\n") {
+			fmt.Fprintf(bw, "%7s | %s\n", lines[name][n+1], strings.TrimSuffix(line, "\r"))
+		}
+	}
+	return bw.Flush()
+}
+
+// 执行到条件语句时的记录位置
+type coverStmt struct {
+	cond *CondCoverage
+	then int // Then 分支的序号
+	els  int // Else 分支的序号，没有 #else 或 Else 为 #elif 时为 -1
+}
+
+// 记录文件中的全部条件块，包括未执行的分支中的条件块
+func (it *Interpreter) coverFile(node ast.Node) {
+	if it.Coverage == nil {
+		return
+	}
+	if it.covered == nil {
+		it.covered = map[ast.CondStmt]*coverStmt{}
+	}
+	var walk func(node ast.Node)
+	walk = func(node ast.Node) {
+		if list, ok := node.(*ast.BlockStmt); ok {
+			if list != nil {
+				for _, stmt := range *list {
+					walk(stmt)
+				}
+			}
+			return
+		}
+		stmt, ok := node.(ast.Stmt)
+		if !ok {
+			return
+		}
+		block := ast.Branches(stmt)
+		if block == nil {
+			return
+		}
+		it.coverBlock(stmt, block)
+		for _, b := range block.Branches {
+			if b.Body != nil {
+				walk(b.Body)
+			}
+		}
+	}
+	walk(node)
+}
+
+// 记录条件块，并关联条件链中的每个条件语句
+func (it *Interpreter) coverBlock(stmt ast.Stmt, block *ast.CondBlock) {
+	line := it.pos.CreatePosition(block.From).Line
+	cond := &CondCoverage{File: it.file, Line: line}
+	for i, b := range block.Branches {
+		bc := &BranchCoverage{Line: line, Directive: branchDirective(stmt, i, b)}
+		if b.Directive != nil {
+			bc.Line = it.pos.CreatePosition(b.Directive.From).Line
+		}
+		bc.End = bc.Line
+		if b.BodyTo > b.BodyFrom {
+			bc.End = it.pos.CreatePosition(b.BodyTo - 1).Line
+		}
+		cond.Branches = append(cond.Branches, bc)
+	}
+	cond = it.Coverage.add(cond)
+	if len(cond.Branches) != len(block.Branches) {
+		return
+	}
+	var rec *coverStmt
+	for i, b := range block.Branches {
+		if b.Stmt == nil {
+			rec.els = i
+			continue
+		}
+		rec = &coverStmt{cond: cond, then: i, els: -1}
+		it.covered[b.Stmt] = rec
+	}
+}
+
+// 分支指令的文本
+func branchDirective(stmt ast.Stmt, i int, b *ast.CondBranch) string {
+	switch {
+	case i > 0 && b.Cond == nil:
+		return "#else"
+	case i > 0 && isEmptyExpr(b.Cond):
+		return "#elif"
+	case i > 0:
+		return "#elif " + strings.TrimSpace(printer.Sprint(b.Cond))
+	}
+	switch n := stmt.(type) {
+	case *ast.IfDefStmt:
+		return "#ifdef " + n.Name.Name
+	case *ast.IfNoDefStmt:
+		return "#ifndef " + n.Name.Name
+	}
+	if isEmptyExpr(b.Cond) {
+		return "#if"
+	}
+	return "#if " + strings.TrimSpace(printer.Sprint(b.Cond))
+}
+
+// 记录执行的分支
+func (it *Interpreter) coverBranch(stmt ast.CondStmt, v bool) {
+	rec, ok := it.covered[stmt]
+	if !ok {
+		return
+	}
+	if rec.then == 0 {
+		rec.cond.Reached++
+	}
+	switch {
+	case v:
+		rec.cond.Branches[rec.then].Count++
+	case rec.els >= 0:
+		rec.cond.Branches[rec.els].Count++
+	}
+}
@@ -0,0 +1,156 @@
+package interpreter
+
+import (
+	"bufio"
+	"dxkite.cn/language/macro/ast"
+	"encoding/json"
+	"io"
+	"strings"
+)
+
+// 依赖的文件
+type Dependency struct {
+	Name   string `json:"name"`   // 文件名
+	System bool   `json:"system"` // 系统头文件
+	Probe  bool   `json:"probe"`  // 只被 __has_include 检查过
+}
+
+// 依赖记录
+type Deps struct {
+	Source string       // 源文件，为空时不输出
+	Probes bool         // 是否记录 __has_include 检查的文件
+	Files  []Dependency // 包含的文件，按首次打开的顺序
+	index  map[string]int
+}
+
+// 区分系统头文件的文件包含
+type SystemIncluder interface {
+	Includer
+	// 找到的文件是否为系统头文件
+	IsSystem(name string) bool
+}
+
+// 添加依赖，重复的文件只记录一次
+func (d *Deps) Add(dep Dependency) {
+	if d.index == nil {
+		d.index = map[string]int{}
+	}
+	if i, ok := d.index[dep.Name]; ok {
+		d.Files[i].Probe = d.Files[i].Probe && dep.Probe
+		return
+	}
+	d.index[dep.Name] = len(d.Files)
+	d.Files = append(d.Files, dep)
+}
+
+// 包含的文件名
+// system 为 false 时不包含系统头文件 (-MM)
+func (d *Deps) Names(system bool) []string {
+	var names []string
+	for _, f := range d.Files {
+		if system || !f.System {
+			names = append(names, f.Name)
+		}
+	}
+	return names
+}
+
+// 输出 Make/Ninja 格式的依赖文件
+// phony 为包含的文件生成空目标 (-MP)
+func (d *Deps) WriteMake(w io.Writer, targets []string, system, phony bool) error {
+	bw := bufio.NewWriter(w)
+	names := d.Names(system)
+	if d.Source != "" {
+		names = append([]string{d.Source}, names...)
+	}
+	col := 0
+	for i, t := range targets {
+		if i > 0 {
+			bw.WriteString(" ")
+			col++
+		}
+		bw.WriteString(t)
+		col += len(t)
+	}
+	bw.WriteString(":")
+	col++
+	for _, name := range names {
+		name = MakeQuote(name)
+		if col > 1 && col+len(name)+1 > 75 {
+			bw.WriteString(" \\\n")
+			col = 0
+		}
+		bw.WriteString(" " + name)
+		col += len(name) + 1
+	}
+	bw.WriteString("\n")
+	if phony {
+		for _, name := range d.Names(system) {
+			bw.WriteString("\n" + MakeQuote(name) + ":\n")
+		}
+	}
+	return bw.Flush()
+}
+
+// 输出 JSON 格式的依赖文件
+func (d *Deps) WriteJSON(w io.Writer, targets []string, system bool) error {
+	files := []Dependency{}
+	for _, f := range d.Files {
+		if system || !f.System {
+			files = append(files, f)
+		}
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(struct {
+		Targets []string     `json:"targets"`
+		Source  string       `json:"source,omitempty"`
+		Files   []Dependency `json:"files"`
+	}{targets, d.Source, files})
+}
+
+// 转义 Make 规则中的文件名 (-MQ)
+func MakeQuote(name string) string {
+	var b strings.Builder
+	for i := 0; i < len(name); i++ {
+		switch name[i] {
+		case ' ', '\t':
+			// 空白前的反斜杠需要转义
+			for j := i - 1; j >= 0 && name[j] == '\\'; j-- {
+				b.WriteByte('\\')
+			}
+			b.WriteByte('\\')
+		case '$':
+			b.WriteByte('$')
+		case '#':
+			b.WriteByte('\\')
+		}
+		b.WriteByte(name[i])
+	}
+	return b.String()
+}
+
+// 记录依赖
+func (it *Interpreter) depend(name string, probe bool) {
+	if it.Deps == nil || probe && !it.Deps.Probes {
+		return
+	}
+	system := false
+	if s, ok := it.Includer.(SystemIncluder); ok {
+		system = s.IsSystem(name)
+	}
+	it.Deps.Add(Dependency{Name: name, System: system, Probe: probe})
+}
+
+// 检查包含的文件是否存在
+func (it *Interpreter) probe(path string, typ ast.IncludeType) bool {
+	if it.Includer == nil {
+		return false
+	}
+	name, _, err := it.Includer.Include(path, typ, it.file)
+	if err != nil {
+		return false
+	}
+	it.depend(name, true)
+	return true
+}
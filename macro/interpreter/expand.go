@@ -0,0 +1,246 @@
+package interpreter
+
+import (
+	"dxkite.cn/language/macro/ast"
+	"dxkite.cn/language/macro/token"
+	"fmt"
+	"strings"
+)
+
+// 指定位置的宏展开
+type Expansion struct {
+	Macro    string        // 展开的宏
+	From, To token.Pos     // 宏使用在文件中的范围
+	Text     string        // 宏使用的原文
+	Result   string        // 完全展开后的文本
+	Steps    []*ExpandStep // 展开过程，按开始展开的顺序
+}
+
+// 展开过程中的一次宏展开
+type ExpandStep struct {
+	Depth  int    // 嵌套深度，位置处的宏为 0
+	Macro  string // 展开的宏
+	Text   string // 宏使用，函数宏的参数为实际参数
+	Result string // 展开后的文本，已展开其中的宏
+}
+
+// 展开请求
+type expandRequest struct {
+	offset token.Pos
+	values bool // 只执行到 offset，不展开
+	exp    *Expansion
+	err    error
+}
+
+// 找到位置后终止执行
+var stopExpand = new(int)
+
+// 展开 offset 处的宏
+// 执行文件到包含 offset 的文本行、#if #elif 条件或 #include 宏，按当时的宏定义展开包含 offset 的最内层宏使用
+func (it *Interpreter) ExpandAt(node ast.Node, name string, pos token.FilePos, offset token.Pos) (*Expansion, error) {
+	req := &expandRequest{offset: offset}
+	it.expanding = req
+	func() {
+		defer func() {
+			if r := recover(); r != nil && r != stopExpand {
+				panic(r)
+			}
+		}()
+		it.EvalTokens(node, name, pos)
+	}()
+	it.expanding = nil
+	if req.exp == nil && req.err == nil {
+		if uses := macroUses(node, offset); len(uses) > 0 {
+			req.err = fmt.Errorf("%s at offset %d is in an inactive branch", useName(uses[len(uses)-1]), offset)
+		} else {
+			req.err = fmt.Errorf("no macro use at offset %d", offset)
+		}
+	}
+	return req.exp, req.err
+}
+
+// 执行到 offset 时的宏定义
+// 执行文件中 offset 之前的语句，包含 offset 的条件语句只执行其中 offset 之前的部分
+func (it *Interpreter) ValuesAt(node ast.Node, name string, pos token.FilePos, offset token.Pos) map[string]MacroValue {
+	it.expanding = &expandRequest{offset: offset, values: true}
+	func() {
+		defer func() {
+			if r := recover(); r != nil && r != stopExpand {
+				panic(r)
+			}
+		}()
+		it.EvalTokens(node, name, pos)
+	}()
+	it.expanding = nil
+	return it.Val
+}
+
+// 执行语句前检查是否已经到达 offset
+func (it *Interpreter) stopAt(node ast.Node) {
+	req := it.expanding
+	if req == nil || !req.values || it.depth > 0 {
+		return
+	}
+	switch node.(type) {
+	case *ast.BlockStmt, *ast.IfStmt, *ast.ElseIfStmt, *ast.IfDefStmt, *ast.IfNoDefStmt, *ast.RawGroup:
+		return
+	}
+	if node.End() > req.offset {
+		panic(stopExpand)
+	}
+}
+
+// 执行到 x 时检查是否包含展开的位置
+func (it *Interpreter) expandIn(x ast.MacroLiter) {
+	req := it.expanding
+	if req == nil || req.values || it.depth > 0 || x == nil {
+		return
+	}
+	uses := macroUses(x, req.offset)
+	if len(uses) == 0 {
+		return
+	}
+	var use ast.MacroLiter
+	for i := len(uses) - 1; i >= 0 && use == nil; i-- {
+		if it.isMacroUse(uses[i]) {
+			use = uses[i]
+		}
+	}
+	if use == nil {
+		req.err = fmt.Errorf("%s is not a macro", useName(uses[len(uses)-1]))
+		panic(stopExpand)
+	}
+	e := &MacroExtractor{it: it, trace: &expandTrace{}}
+	req.exp = &Expansion{
+		Macro: useName(use),
+		From:  use.Pos(),
+		To:    use.End(),
+		Text:  e.String(use),
+	}
+	req.exp.Result = strings.TrimSpace(e.Extract(use, NewGlobalEnv(use.Pos())).String())
+	req.exp.Steps = e.trace.steps
+	panic(stopExpand)
+}
+
+// 是否按宏展开
+// 没有参数列表的函数宏不展开
+func (it *Interpreter) isMacroUse(use ast.MacroLiter) bool {
+	switch n := use.(type) {
+	case *ast.Ident:
+		v, ok := it.Val[n.Name]
+		if _, fn := v.(*MacroFuncValue); fn {
+			return false
+		}
+		return ok || n.Name == "__LINE__"
+	case *ast.MacroCallExpr:
+		_, ok := it.Val[n.Name.Name]
+		return ok
+	}
+	return false
+}
+
+// 包含 offset 的标识符和宏调用，由外到内
+// 宏调用的名称算作宏调用，不包括宏定义、defined 的操作数及 #ifdef #ifndef 的名称
+func macroUses(node ast.Node, offset token.Pos) []ast.MacroLiter {
+	var uses []ast.MacroLiter
+	skip := map[*ast.Ident]bool{}
+	ast.Inspect(node, func(node ast.Node) bool {
+		switch n := node.(type) {
+		case *ast.ValDefineStmt, *ast.FuncDefineStmt, *ast.UnDefineStmt:
+			return false
+		case *ast.UnaryExpr:
+			return n.Op != token.DEFINED
+		case *ast.IfDefStmt:
+			skip[n.Name] = true
+		case *ast.IfNoDefStmt:
+			skip[n.Name] = true
+		case *ast.MacroCallExpr:
+			skip[n.Name] = true
+			if n.Pos() <= offset && offset < n.End() {
+				uses = append(uses, n)
+			}
+		case *ast.Ident:
+			if !skip[n] && n.Pos() <= offset && offset <= n.End() {
+				uses = append(uses, n)
+			}
+		}
+		return true
+	})
+	return uses
+}
+
+// 宏使用的名称
+func useName(use ast.MacroLiter) string {
+	switch n := use.(type) {
+	case *ast.Ident:
+		return n.Name
+	case *ast.MacroCallExpr:
+		return n.Name.Name
+	}
+	return ""
+}
+
+// 展开过程的记录
+type expandTrace struct {
+	steps []*ExpandStep
+	depth int
+}
+
+// 开始记录一次展开
+func (e *MacroExtractor) begin(use ast.MacroLiter, env *ExtractEnv) *ExpandStep {
+	if e.trace == nil {
+		return nil
+	}
+	step := &ExpandStep{Depth: e.trace.depth, Macro: useName(use), Text: useName(use)}
+	if call, ok := use.(*ast.MacroCallExpr); ok {
+		step.Text = e.callText(call, env)
+	}
+	e.trace.steps = append(e.trace.steps, step)
+	e.trace.depth++
+	return step
+}
+
+// 记录展开结果
+func (e *MacroExtractor) end(step *ExpandStep, t fragments) {
+	if step == nil {
+		return
+	}
+	e.trace.depth--
+	step.Result = strings.TrimSpace(t.String())
+}
+
+// 宏调用的文本，参数中的形参替换为实际参数
+func (e *MacroExtractor) callText(call *ast.MacroCallExpr, env *ExtractEnv) string {
+	var args []string
+	if call.ParamList != nil {
+		for _, item := range *call.ParamList {
+			args = append(args, strings.TrimSpace(e.argText(item, env)))
+		}
+	}
+	return call.Name.Name + "(" + strings.Join(args, ", ") + ")"
+}
+
+func (e *MacroExtractor) argText(v ast.MacroLiter, env *ExtractEnv) string {
+	switch n := v.(type) {
+	case *ast.Ident:
+		if x, ok := env.GetValue(n.Name); ok {
+			return e.String(x)
+		}
+	case *ast.MacroLitArray:
+		s := ""
+		for _, item := range *n {
+			s += e.argText(item, env)
+		}
+		return s
+	case *ast.ParenExpr:
+		return "(" + e.argText(n.X, env) + ")"
+	case *ast.UnaryExpr:
+		if n.Op == token.DEFINED {
+			return e.definedStr(n)
+		}
+		return "#" + e.argText(n.X, env)
+	case *ast.BinaryExpr:
+		return e.argText(n.X, env) + "##" + e.argText(n.Y, env)
+	}
+	return e.String(v)
+}
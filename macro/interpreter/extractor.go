@@ -94,7 +94,8 @@ func (e *ExtractEnv) GetValue(name string) (v ast.MacroLiter, exist bool) {
 // 未定义函数：作为宏展开函数名称 => 展开函数参数列表；
 // 函数自调用：作为未定义函数展开；
 type MacroExtractor struct {
-	it *Interpreter
+	it    *Interpreter
+	trace *expandTrace // 展开过程，为空时不记录
 }
 
 // 创建宏展开对象
@@ -103,33 +104,38 @@ func NewExtractor(it *Interpreter) *MacroExtractor {
 }
 
 // 展开宏字面量
-func (e *MacroExtractor) Extract(v ast.MacroLiter, env *ExtractEnv) string {
+func (e *MacroExtractor) Extract(v ast.MacroLiter, env *ExtractEnv) fragments {
 	switch vv := v.(type) {
 	case *ast.LitExpr:
-		return vv.Value
+		return newFragments(vv.Value, vv.Offset)
 	case *ast.Text:
-		if parser.TokenNotIn(vv.Kind, token.BACKSLASH_NEWLINE, token.BLOCK_COMMENT) {
-			return vv.Text
+		if isComment(vv) {
+			return newFragments(e.comment(vv, env), vv.Offset)
+		}
+		if vv.Kind != token.BACKSLASH_NEWLINE {
+			return newFragments(vv.Text, vv.Offset)
 		}
 	case *ast.MacroCallExpr:
 		return e.ExtractFunc(vv, env)
 	case *ast.Ident:
 		return e.ExtractIdent(vv, env)
 	case *ast.MacroLitArray:
-		t := ""
+		var t fragments
 		for _, v := range *vv {
-			t += e.Extract(v, env)
+			t = append(t, e.Extract(v, env)...)
 		}
 		return t
 	case *ast.ParenExpr:
-		return "(" + e.Extract(vv.X, env) + ")"
+		t := newFragments("(", vv.Lparen)
+		t = append(t, e.Extract(vv.X, env)...)
+		return append(t, newFragments(")", vv.Rparen)...)
 	case *ast.UnaryExpr:
 		switch vv.Op {
 		case token.DEFINED:
-			return e.definedStr(vv)
+			return newFragments(e.definedStr(vv), vv.Offset)
 		case token.SHARP:
 			if v, ok := e.envParam(vv.X, env, "'#' is not followed by a macro parameter"); ok {
-				return strconv.QuoteToGraphic(v)
+				return newFragments(strconv.QuoteToGraphic(v), vv.Offset)
 			}
 		}
 	case *ast.BinaryExpr:
@@ -137,7 +143,7 @@ func (e *MacroExtractor) Extract(v ast.MacroLiter, env *ExtractEnv) string {
 	default:
 		e.it.errorf(v.Pos(), "unknown expr %s", reflect.TypeOf(v))
 	}
-	return ""
+	return nil
 }
 
 // 将字面量转换成字符串
@@ -167,28 +173,65 @@ func (e *MacroExtractor) String(v ast.MacroLiter) string {
 	return ""
 }
 
+// 是否是注释
+func isComment(t *ast.Text) bool {
+	return parser.TokenIn(t.Kind, token.COMMENT, token.BLOCK_COMMENT)
+}
+
+// 输出注释
+// 宏展开中的行注释转换为块注释，避免注释掉展开后同一行的代码
+func (e *MacroExtractor) comment(t *ast.Text, env *ExtractEnv) string {
+	if e.it.Comments == DiscardComments {
+		if t.Kind == token.COMMENT {
+			return t.Text
+		}
+		return ""
+	}
+	if t.Kind == token.COMMENT && !env.EmptyStack() {
+		return "/*" + strings.ReplaceAll(t.Text[2:], "*/", "* /") + " */"
+	}
+	return t.Text
+}
+
+// 展开宏定义体
+// 非 -CC 模式下宏定义体中的注释及定义的行尾注释不输出
+func (e *MacroExtractor) body(body *ast.MacroLitArray, comment *ast.Text, env *ExtractEnv) fragments {
+	var t fragments
+	for _, v := range *body {
+		if vv, ok := v.(*ast.Text); ok && isComment(vv) && e.it.Comments != KeepMacroComments {
+			continue
+		}
+		t = append(t, e.Extract(v, env)...)
+	}
+	if comment != nil && e.it.Comments == KeepMacroComments {
+		t = append(t, newFragments(" ", comment.Offset)...)
+		t = append(t, e.Extract(comment, env)...)
+	}
+	return t
+}
+
 func (e *MacroExtractor) envParam(v ast.MacroLiter, env *ExtractEnv, msg string) (string, bool) {
 	if x, ok := v.(*ast.Ident); ok {
 		if vv, ok := env.Val[x.Name]; ok {
 			return strings.TrimSpace(e.String(vv)), true
 		}
 	}
-	e.it.errorf(v.Pos(), msg)
+	e.it.error(v.Pos(), msg)
 	return "", false
 }
 
 // 展开宏标识符
 // 递归展开宏则返回字符串
 // 不存在的宏展开则返回字符串
-func (e *MacroExtractor) ExtractIdent(v *ast.Ident, env *ExtractEnv) string {
+func (e *MacroExtractor) ExtractIdent(v *ast.Ident, env *ExtractEnv) fragments {
 	// 已经展开过
 	if env.InStack(v.Name) {
-		return v.Name
+		return newFragments(v.Name, v.Offset)
 	}
 	defer env.Pop()
 	if env.EmptyStack() {
 		env.Push(v.Name)
-		return e.IdentStr(v, NewEnv(v.Pos(), v.Name, env.Val))
+		return e.IdentStr(v, NewEnv(v.Pos(), v.Name, env.Val)).expandAt(v.Pos())
 	}
 	env.Push(v.Name)
 	// 如果是环境中的参数参数
@@ -202,17 +245,25 @@ func (e *MacroExtractor) ExtractIdent(v *ast.Ident, env *ExtractEnv) string {
 // 已定义函数：展开形参（形参有#或##不进行宏参数的展开）=> 参数去除空白 => 展开当前宏；
 // 未定义函数：作为宏展开函数名称 => 展开函数参数列表；
 // 函数自调用：作为未定义函数展开；
-func (e *MacroExtractor) ExtractFunc(v *ast.MacroCallExpr, env *ExtractEnv) string {
+func (e *MacroExtractor) ExtractFunc(v *ast.MacroCallExpr, env *ExtractEnv) fragments {
+	if v.Name.Name == "__has_include" {
+		return newFragments(e.hasInclude(v, env), v.Pos())
+	}
 	if f, ok := e.it.GetFunc(v.Name.Name); ok && !env.InStack(v.Name.Name) {
 		// 已定义函数：展开形参（形参有#或##不进行宏参数的展开）=> 参数去除空白 => 展开当前宏；
 		defer env.Pop()
+		step := e.begin(v, env)
+		var t fragments
 		// 从全局调用的创建新的调用环境
 		if env.EmptyStack() {
 			env.Push(v.Name.Name)
-			return e.Func(v, f, NewEnv(v.Pos(), v.Name.Name, env.Val))
+			t = e.Func(v, f, NewEnv(v.Pos(), v.Name.Name, env.Val)).expandAt(v.Pos())
+		} else {
+			env.Push(v.Name.Name)
+			t = e.Func(v, f, env)
 		}
-		env.Push(v.Name.Name)
-		return e.Func(v, f, env)
+		e.end(step, t)
+		return t
 	} else {
 		// 函数自调用：作为未定义函数展开；
 		// 未定义函数：作为宏展开函数名称 => 展开函数参数列表；
@@ -221,16 +272,16 @@ func (e *MacroExtractor) ExtractFunc(v *ast.MacroCallExpr, env *ExtractEnv) stri
 }
 
 // 展开宏函数
-func (e *MacroExtractor) Func(expr *ast.MacroCallExpr, vv *MacroFuncValue, env *ExtractEnv) string {
+func (e *MacroExtractor) Func(expr *ast.MacroCallExpr, vv *MacroFuncValue, env *ExtractEnv) fragments {
 	if vv.IsEmptyBody() {
-		return ""
+		return nil
 	}
 	if params, err := buildMacroParameter(expr, vv, env); err == nil {
-		return e.Extract(vv.stmt.Body, NewExtractEnv(env.Pos(expr.Pos()), env.Stack, params))
+		return e.body(vv.stmt.Body, vv.stmt.Comment, NewExtractEnv(env.Pos(expr.Pos()), env.Stack, params))
 	} else {
 		e.it.error(expr.Pos(), err.Error())
 	}
-	return ""
+	return nil
 }
 
 // 构建函数参数
@@ -294,19 +345,18 @@ func bindParamIdent(v ast.MacroLiter, env *ExtractEnv) ast.MacroLiter {
 }
 
 // 将函数调转换成原始字符串，只展开参数，不展开函数
-func (e *MacroExtractor) FuncRawStr(expr *ast.MacroCallExpr, env *ExtractEnv) string {
+func (e *MacroExtractor) FuncRawStr(expr *ast.MacroCallExpr, env *ExtractEnv) fragments {
 	s := e.IdentStr(expr.Name, env)
-	s += strings.Repeat(" ", int(expr.Lparen-expr.Name.End()))
-	params := make([]string, 0)
+	s = append(s, newFragments(strings.Repeat(" ", int(expr.Lparen-expr.Name.End()))+"(", expr.Name.End())...)
 	if expr.ParamList != nil {
-		for _, item := range *expr.ParamList {
-			params = append(params, e.Extract(item, env))
+		for i, item := range *expr.ParamList {
+			if i > 0 {
+				s = append(s, newFragments(",", item.Pos())...)
+			}
+			s = append(s, e.Extract(item, env)...)
 		}
 	}
-	s += "("
-	s += strings.Join(params, ",")
-	s += ")"
-	return s
+	return append(s, newFragments(")", expr.Rparen)...)
 }
 
 // 不展开函数，不展开参数，只作为字符串（用于#表达式）
@@ -325,6 +375,38 @@ func (e *MacroExtractor) FuncRaw(expr *ast.MacroCallExpr) string {
 	return s
 }
 
+// __has_include("FILENAME") 或 __has_include(<FILENAME>)
+// 文件名不是字面量时展开宏
+func (e *MacroExtractor) hasInclude(expr *ast.MacroCallExpr, env *ExtractEnv) string {
+	path := ""
+	if expr.ParamList != nil {
+		for i, item := range *expr.ParamList {
+			if i > 0 {
+				path += ","
+			}
+			path += e.String(item)
+		}
+	}
+	path = strings.TrimSpace(path)
+	if !strings.HasPrefix(path, "\"") && !strings.HasPrefix(path, "<") && expr.ParamList != nil {
+		path = strings.TrimSpace(e.Extract(expr.ParamList, env).String())
+	}
+	var typ ast.IncludeType
+	switch {
+	case len(path) > 2 && path[0] == '"' && path[len(path)-1] == '"':
+		typ = ast.IncludeOuter
+	case len(path) > 2 && path[0] == '<' && path[len(path)-1] == '>':
+		typ = ast.IncludeInner
+	default:
+		e.it.errorf(expr.Pos(), "__has_include expects \"FILENAME\" or <FILENAME>, got %s", path)
+		return "0"
+	}
+	if e.it.probe(path[1:len(path)-1], typ) {
+		return "1"
+	}
+	return "0"
+}
+
 // 不展开 defined (表达式处理用)
 func (e *MacroExtractor) definedStr(v *ast.UnaryExpr) string {
 	return "defined " + e.parseDefinedValue(v.X)
@@ -343,59 +425,64 @@ func (e *MacroExtractor) parseDefinedValue(v ast.MacroLiter) string {
 }
 
 // 展开宏标识符为字符串
-func (e *MacroExtractor) IdentStr(id *ast.Ident, env *ExtractEnv) string {
+func (e *MacroExtractor) IdentStr(id *ast.Ident, env *ExtractEnv) fragments {
 	if v, ok := e.Ident(id, env); ok {
 		return v
 	}
 	if id.Name == "__LINE__" {
-		return strconv.Itoa(e.it.Position(env.Pos(id.Pos())).Line)
+		step := e.begin(id, env)
+		t := newFragments(strconv.Itoa(e.it.Position(env.Pos(id.Pos())).Line), id.Offset)
+		e.end(step, t)
+		return t
 	}
-	return id.Name
+	return newFragments(id.Name, id.Offset)
 }
 
 // 展开定义的标识符
-// str 展开后的字符串 exist 是否在全局宏中存在
-func (e *MacroExtractor) Ident(id *ast.Ident, env *ExtractEnv) (str string, exist bool) {
+// str 展开后的片段 exist 是否在全局宏中存在
+func (e *MacroExtractor) Ident(id *ast.Ident, env *ExtractEnv) (str fragments, exist bool) {
 	if v, ok := e.it.GetValue(id.Name); ok {
 		exist = true
+		if _, ok := v.(*MacroFuncValue); !ok {
+			step := e.begin(id, env)
+			defer func() { e.end(step, str) }()
+		}
 		if v.IsEmptyBody() {
-			str = ""
 			return
 		}
 		switch vv := v.(type) {
 		// 如果是宏定义函数，则返回名字
 		case *MacroFuncValue:
-			str = id.Name
+			str = newFragments(id.Name, id.Offset)
 		case *MacroLitValue:
-			str = e.Extract(vv.stmt.Body, env)
+			str = e.body(vv.stmt.Body, vv.stmt.Comment, env)
 		case MacroString:
-			str = string(vv)
+			str = newFragments(string(vv), id.Offset)
 		}
 		return
 	}
-	return "", false
+	return nil, false
 }
 
 // 参数连接
-func (e *MacroExtractor) concatOp(v *ast.BinaryExpr, env *ExtractEnv) string {
+func (e *MacroExtractor) concatOp(v *ast.BinaryExpr, env *ExtractEnv) fragments {
 	x, xok := e.getBinaryParam(v.X, env)
 	y, yok := e.getBinaryParam(v.Y, env)
 	if xok && yok {
-		return x + y
+		return newFragments(x+y, v.Pos())
 	}
 	s := x + "##" + y
 	stmt, errs := parser.ParseBodyLiter([]byte(s), v.Pos())
 	if len(errs) > 0 {
-		e.it.errorf(v.Pos(), errs.Error())
-		return e.Extract(v.X, env) + e.Extract(v.Y, env)
+		e.it.error(v.Pos(), errs.Error())
+		return append(e.Extract(v.X, env), e.Extract(v.Y, env)...)
 	}
-	t := ""
+	var t fragments
 	for _, v := range *stmt {
 		if vv, ok := v.(*ast.BinaryExpr); ok {
-			t += e.String(vv.X)
-			t += e.String(vv.Y)
+			t = append(t, newFragments(e.String(vv.X)+e.String(vv.Y), vv.Pos())...)
 		} else {
-			t += e.Extract(v, env)
+			t = append(t, e.Extract(v, env)...)
 		}
 	}
 	return t
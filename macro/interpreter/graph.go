@@ -0,0 +1,244 @@
+package interpreter
+
+import (
+	"bufio"
+	"dxkite.cn/language/macro/ast"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// 跳过包含的原因
+const (
+	SkipGuard   = "guard"   // 包含保护的宏已定义
+	SkipOnce    = "once"    // #pragma once 的文件已包含
+	SkipMissing = "missing" // 文件不存在
+	SkipDepth   = "depth"   // 包含过深
+)
+
+// 包含图中的文件
+type IncludeFile struct {
+	Name   string `json:"name"`            // 文件名
+	System bool   `json:"system"`          // 系统头文件
+	Guard  string `json:"guard,omitempty"` // 包含保护的宏
+	Once   bool   `json:"once"`            // 含有 #pragma once
+	Count  int    `json:"count"`           // 执行包含的次数，不含跳过的包含
+}
+
+// 一次 #include
+type IncludeEdge struct {
+	From    string `json:"from"`              // 包含所在的文件
+	To      string `json:"to"`                // 找到的文件，找不到时为包含的路径
+	Path    string `json:"path"`              // 包含的路径
+	Line    int    `json:"line"`              // 包含所在的行，-include 为 0
+	Dir     string `json:"dir,omitempty"`     // 找到文件的搜索目录
+	Skipped string `json:"skipped,omitempty"` // 跳过的原因
+}
+
+// 包含图
+type IncludeGraph struct {
+	Root  string         // 主文件
+	Files []*IncludeFile // 文件，按首次出现的顺序
+	Edges []*IncludeEdge // 包含，按执行的顺序
+	index map[string]*IncludeFile
+}
+
+// 获取或添加文件
+func (g *IncludeGraph) File(name string) *IncludeFile {
+	if g.index == nil {
+		g.index = map[string]*IncludeFile{}
+	}
+	if f, ok := g.index[name]; ok {
+		return f
+	}
+	f := &IncludeFile{Name: name}
+	g.index[name] = f
+	g.Files = append(g.Files, f)
+	return f
+}
+
+// 包含的环，每个环从最先进入的文件开始，并以该文件结束
+func (g *IncludeGraph) Cycles() [][]string {
+	next := map[string][]string{}
+	seen := map[[2]string]bool{}
+	for _, e := range g.Edges {
+		if e.Skipped == SkipMissing || seen[[2]string{e.From, e.To}] {
+			continue
+		}
+		seen[[2]string{e.From, e.To}] = true
+		next[e.From] = append(next[e.From], e.To)
+	}
+	var cycles [][]string
+	found := map[string]bool{}
+	state := map[string]int{} // 1 访问中 2 已完成
+	var stack []string
+	var visit func(name string)
+	visit = func(name string) {
+		state[name] = 1
+		stack = append(stack, name)
+		for _, to := range next[name] {
+			switch state[to] {
+			case 0:
+				visit(to)
+			case 1:
+				i := len(stack) - 1
+				for stack[i] != to {
+					i--
+				}
+				cycle := append(append([]string{}, stack[i:]...), to)
+				if key := strings.Join(cycle, "\x00"); !found[key] {
+					found[key] = true
+					cycles = append(cycles, cycle)
+				}
+			}
+		}
+		stack = stack[:len(stack)-1]
+		state[name] = 2
+	}
+	for _, f := range g.Files {
+		if state[f.Name] == 0 {
+			visit(f.Name)
+		}
+	}
+	return cycles
+}
+
+// 输出 DOT 格式
+// 相同的包含合并为一条边，标注次数；只有跳过的包含为虚线，环上的边为红色
+func (g *IncludeGraph) WriteDOT(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	bw.WriteString("digraph includes {\n")
+	for _, f := range g.Files {
+		attrs := []string{}
+		if f.Name == g.Root {
+			attrs = append(attrs, "shape=box")
+		}
+		if f.System {
+			attrs = append(attrs, "color=gray")
+		}
+		label := f.Name
+		if f.Guard != "" {
+			label += "\nguard " + f.Guard
+		}
+		if f.Once {
+			label += "\n#pragma once"
+		}
+		if label != f.Name {
+			attrs = append(attrs, "label="+strconv.Quote(label))
+		}
+		bw.WriteString("  " + strconv.Quote(f.Name) + dotAttrs(attrs) + ";\n")
+	}
+	inCycle := map[[2]string]bool{}
+	for _, cycle := range g.Cycles() {
+		for i := 0; i+1 < len(cycle); i++ {
+			inCycle[[2]string{cycle[i], cycle[i+1]}] = true
+		}
+	}
+	type edge struct {
+		count   int
+		skipped []string
+	}
+	var keys [][2]string
+	edges := map[[2]string]*edge{}
+	for _, e := range g.Edges {
+		key := [2]string{e.From, e.To}
+		if edges[key] == nil {
+			edges[key] = &edge{}
+			keys = append(keys, key)
+		}
+		if e.Skipped == "" {
+			edges[key].count++
+		} else if !contains(edges[key].skipped, e.Skipped) {
+			edges[key].skipped = append(edges[key].skipped, e.Skipped)
+		}
+	}
+	for _, key := range keys {
+		e := edges[key]
+		var attrs, label []string
+		if e.count > 1 {
+			label = append(label, fmt.Sprintf("x%d", e.count))
+		}
+		label = append(label, e.skipped...)
+		if len(label) > 0 {
+			attrs = append(attrs, "label="+strconv.Quote(strings.Join(label, ", ")))
+		}
+		if e.count == 0 {
+			attrs = append(attrs, "style=dashed")
+		}
+		if inCycle[key] {
+			attrs = append(attrs, "color=red")
+		}
+		bw.WriteString("  " + strconv.Quote(key[0]) + " -> " + strconv.Quote(key[1]) + dotAttrs(attrs) + ";\n")
+	}
+	bw.WriteString("}\n")
+	return bw.Flush()
+}
+
+func dotAttrs(attrs []string) string {
+	if len(attrs) == 0 {
+		return ""
+	}
+	return " [" + strings.Join(attrs, ", ") + "]"
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// 输出 JSON 格式
+func (g *IncludeGraph) WriteJSON(w io.Writer) error {
+	files, edges, cycles := g.Files, g.Edges, g.Cycles()
+	if files == nil {
+		files = []*IncludeFile{}
+	}
+	if edges == nil {
+		edges = []*IncludeEdge{}
+	}
+	if cycles == nil {
+		cycles = [][]string{}
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.SetEscapeHTML(false)
+	return enc.Encode(struct {
+		Root   string         `json:"root"`
+		Files  []*IncludeFile `json:"files"`
+		Edges  []*IncludeEdge `json:"edges"`
+		Cycles [][]string     `json:"cycles"`
+	}{g.Root, files, edges, cycles})
+}
+
+// 记录包含，name 为空时文件未找到，dir 为 Includer 报告的搜索目录
+func (it *Interpreter) includeEdge(line int, path, name, dir, skipped string) *IncludeFile {
+	if it.Graph == nil {
+		return nil
+	}
+	e := &IncludeEdge{From: it.file, To: name, Path: path, Line: line, Dir: dir, Skipped: skipped}
+	if name == "" {
+		e.To = path
+	}
+	it.Graph.Edges = append(it.Graph.Edges, e)
+	f := it.Graph.File(e.To)
+	if s, ok := it.Includer.(SystemIncluder); ok && name != "" {
+		f.System = s.IsSystem(name)
+	}
+	if skipped == "" {
+		f.Count++
+	}
+	return f
+}
+
+// 包含保护的宏名
+func guardName(node ast.Node) string {
+	if guard := ast.IncludeGuard(node); guard != nil {
+		return guard.Name.Name
+	}
+	return ""
+}
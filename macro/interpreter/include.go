@@ -0,0 +1,151 @@
+package interpreter
+
+import (
+	"dxkite.cn/language/macro/ast"
+	"dxkite.cn/language/macro/parser"
+	"dxkite.cn/language/macro/token"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// 最大包含深度
+const maxIncludeDepth = 200
+
+// 文件包含
+type Includer interface {
+	// 查找并读取包含的文件
+	// path 为去掉引号的文件名，from 为当前文件名，返回找到的文件名和内容
+	Include(path string, typ ast.IncludeType, from string) (name string, src []byte, err error)
+}
+
+// 报告搜索目录的文件包含
+type DirIncluder interface {
+	Includer
+	// 与 Include 相同，同时返回找到文件的搜索目录，绝对路径时为空
+	IncludeDir(path string, typ ast.IncludeType, from string) (name, dir string, src []byte, err error)
+}
+
+// 按目录查找包含文件
+// "FILENAME" 先查找当前文件所在目录
+type FileIncluder struct {
+	Dirs       []string // -I 目录
+	SystemDirs []string // -isystem 目录
+}
+
+func (fi *FileIncluder) Include(path string, typ ast.IncludeType, from string) (string, []byte, error) {
+	name, _, src, err := fi.IncludeDir(path, typ, from)
+	return name, src, err
+}
+
+func (fi *FileIncluder) IncludeDir(path string, typ ast.IncludeType, from string) (string, string, []byte, error) {
+	var dirs []string
+	if filepath.IsAbs(path) {
+		dirs = []string{""}
+	} else {
+		if typ == ast.IncludeOuter {
+			dirs = append(dirs, filepath.Dir(from))
+		}
+		dirs = append(dirs, fi.Dirs...)
+		dirs = append(dirs, fi.SystemDirs...)
+	}
+	for _, dir := range dirs {
+		name := filepath.Join(dir, path)
+		src, err := ioutil.ReadFile(name)
+		if err == nil {
+			return name, dir, src, nil
+		}
+		if !os.IsNotExist(err) {
+			return name, dir, nil, err
+		}
+	}
+	return path, "", nil, fmt.Errorf("%s: No such file or directory", path)
+}
+
+// 是否在 -isystem 目录下
+func (fi *FileIncluder) IsSystem(name string) bool {
+	for _, dir := range fi.SystemDirs {
+		if rel, err := filepath.Rel(dir, name); err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			return true
+		}
+	}
+	return false
+}
+
+// 执行包含的文件，resume 为返回后继续的行号
+// 文件不存在、包含过深或因 #pragma once 跳过时返回 false
+func (it *Interpreter) include(pos token.Pos, path string, typ ast.IncludeType, resume int) bool {
+	line := it.pos.CreatePosition(pos).Line
+	var name, dir string
+	var src []byte
+	var err error
+	if d, ok := it.Includer.(DirIncluder); ok {
+		name, dir, src, err = d.IncludeDir(path, typ, it.file)
+	} else {
+		name, src, err = it.Includer.Include(path, typ, it.file)
+	}
+	if err != nil {
+		it.includeEdge(line, path, "", "", SkipMissing)
+		it.error(pos, err.Error())
+		return false
+	}
+	if it.depth >= maxIncludeDepth {
+		it.includeEdge(line, path, name, dir, SkipDepth)
+		it.errorf(pos, "#include nested depth %d exceeds maximum of %d", it.depth, maxIncludeDepth)
+		return false
+	}
+	it.depend(name, false)
+	if it.once[name] {
+		it.includeEdge(line, path, name, dir, SkipOnce)
+		return false
+	}
+	node, errs := parser.ParseMode(src, it.Mode)
+	guard, skipped := guardName(node), ""
+	if _, ok := it.Val[guard]; ok && guard != "" {
+		// 仍然执行文件，结果与跳过相同
+		skipped = SkipGuard
+	}
+	if f := it.includeEdge(line, path, name, dir, skipped); f != nil {
+		f.Guard = guard
+	}
+	parent, parentPos := it.file, it.pos
+	var filePos token.FilePos
+	filePos.Init(src)
+	it.setFile(name, filePos)
+	it.depth++
+	it.parseErrors(errs)
+	it.lineMarker(1, name, " 1")
+	it.coverFile(node)
+	it.evalStmt(node)
+	it.depth--
+	it.setFile(parent, parentPos)
+	it.lineMarker(resume, parent, " 2")
+	return true
+}
+
+// 记录 #pragma once
+func (it *Interpreter) pragmaOnce() {
+	if it.once == nil {
+		it.once = map[string]bool{}
+	}
+	it.once[it.file] = true
+	if it.Graph != nil {
+		it.Graph.File(it.file).Once = true
+	}
+}
+
+// 是否为 #pragma once
+func isPragmaOnce(cmd string) bool {
+	fields := strings.Fields(strings.TrimPrefix(strings.TrimSpace(cmd), "#"))
+	return len(fields) == 2 && fields[0] == "pragma" && fields[1] == "once"
+}
+
+// 行标记
+func (it *Interpreter) lineMarker(line int, name, flags string) {
+	if it.LineMarkers {
+		it.out.writeLine(fmt.Sprintf("# %d %s%s\n", line, strconv.Quote(name), flags))
+	}
+}
@@ -1,33 +1,116 @@
 package interpreter
 
 import (
-	"bytes"
 	"dxkite.cn/language/macro/ast"
 	"dxkite.cn/language/macro/parser"
+	"dxkite.cn/language/macro/scanner"
 	"dxkite.cn/language/macro/token"
 	"fmt"
+	"os"
 	"strconv"
 	"strings"
 )
 
+// 注释输出模式
+type CommentMode int
+
+const (
+	DiscardComments   CommentMode = iota // 丢弃块注释（默认）
+	KeepComments                         // 保留普通文本中的注释 (-C)
+	KeepMacroComments                    // 同时保留宏展开中的注释 (-CC)
+)
+
 // 解释器
 type Interpreter struct {
 	// 已经定义的宏
 	Val map[string]MacroValue
+	// 注释输出模式
+	Comments CommentMode
+	// 错误处理，为空时输出错误信息
+	ErrorHandler func(pos token.Position, msg string)
+	// 警告处理，为空时加上 warning: 前缀交给错误处理
+	WarningHandler func(pos token.Position, msg string)
+	// 文件包含，为空时 #include 报告错误
+	Includer Includer
+	// 解析包含文件的模式
+	Mode parser.Mode
+	// 预定义的宏 (-D)，每次执行前定义
+	Predefined []ast.DefineStmt
+	// 执行前包含的文件 (-include)
+	Preinclude []string
+	// 输出行标记 # line "file" flags
+	LineMarkers bool
+	// 依赖记录，为空时不记录
+	Deps *Deps
+	// 包含图，为空时不记录
+	Graph *IncludeGraph
+	// 条件分支覆盖，为空时不记录
+	Coverage *Coverage
+	// 计算 #if #elif 条件前调用
+	CondHook func(expr ast.MacroLiter)
+	// 条件语句求值后调用，v 为是否执行 Then 分支
+	BranchHook func(stmt ast.CondStmt, v bool)
 	// 位置信息
 	pos token.FilePos
-	// 运行后的源码
-	src *bytes.Buffer
+	// 当前文件
+	file string
+	// 包含深度
+	depth int
+	// 含有 #pragma once 的文件
+	once map[string]bool
+	// 条件语句对应的覆盖记录
+	covered map[ast.CondStmt]*coverStmt
+	// 展开指定位置的宏，为空时不展开
+	expanding *expandRequest
+	// 运行后的 token
+	out *tokenWriter
 }
 
-// 执行ast
+// 执行ast，返回预处理后的源码
 func (it *Interpreter) Eval(node ast.Node, name string, pos token.FilePos) []byte {
+	return it.EvalTokens(node, name, pos).Bytes()
+}
+
+// 执行ast，返回预处理后的 token 流
+func (it *Interpreter) EvalTokens(node ast.Node, name string, pos token.FilePos) *TokenStream {
 	it.Val = map[string]MacroValue{}
-	it.Val["__FILE__"] = MacroString(strconv.QuoteToGraphic(name))
-	it.src = &bytes.Buffer{}
-	it.pos = pos
+	it.out = &tokenWriter{}
+	it.depth = 0
+	it.once = nil
+	it.covered = nil
+	it.setFile(name, pos)
+	if it.Graph != nil {
+		it.Graph.Root = name
+		it.Graph.File(name)
+	}
+	if it.Coverage != nil {
+		it.Coverage.Runs++
+	}
+	for _, stmt := range it.Predefined {
+		it.Define(stmt)
+	}
+	it.lineMarker(1, name, "")
+	if it.Includer != nil {
+		for _, path := range it.Preinclude {
+			it.include(token.NoPos, path, ast.IncludeOuter, 1)
+		}
+	}
+	it.coverFile(node)
 	it.evalStmt(node)
-	return it.src.Bytes()
+	return it.out.stream()
+}
+
+// 当前执行的文件名
+func (it *Interpreter) Filename() string {
+	return it.file
+}
+
+// 切换当前文件
+func (it *Interpreter) setFile(name string, pos token.FilePos) {
+	it.file = name
+	it.pos = pos
+	it.out.file = name
+	it.Val["__FILE__"] = MacroString(strconv.QuoteToGraphic(name))
 }
 
 // 设置宏参数
@@ -51,6 +134,74 @@ func (it *Interpreter) GetFunc(name string) (v *MacroFuncValue, exist bool) {
 	return nil, false
 }
 
+// 添加宏定义，不输出占位
+func (it *Interpreter) Define(stmt ast.DefineStmt) {
+	if it.Val == nil {
+		it.Val = map[string]MacroValue{}
+	}
+	switch n := stmt.(type) {
+	case *ast.ValDefineStmt:
+		it.Val[n.Name.Name] = &MacroLitValue{it, n}
+	case *ast.FuncDefineStmt:
+		it.Val[n.Name.Name] = &MacroFuncValue{it, n}
+	}
+}
+
+// 展开对象宏
+func (it *Interpreter) ExpandMacro(name string) (string, bool) {
+	if _, ok := it.Val[name]; !ok {
+		return "", false
+	}
+	id := &ast.Ident{Offset: token.NoPos, Name: name}
+	return strings.TrimSpace(NewExtractor(it).Extract(id, NewGlobalEnv(token.NoPos)).String()), true
+}
+
+// 计算常量表达式
+// 表达式中含有标识符或字符串，或求值出错时不是常量
+func (it *Interpreter) EvalConst(expr string) (interface{}, bool) {
+	exp, errs := parser.ParseExpr([]byte(expr), 0)
+	if len(errs) > 0 || exp == nil {
+		return nil, false
+	}
+	constant := true
+	ast.Inspect(exp, func(n ast.Node) bool {
+		switch v := n.(type) {
+		case *ast.Ident, *ast.MacroCallExpr, *ast.BadExpr:
+			constant = false
+		case *ast.LitExpr:
+			constant = constant && v.Kind != token.STRING
+		}
+		return constant
+	})
+	if !constant {
+		return nil, false
+	}
+	// 求值出错（如除零）时不是常量
+	failed := false
+	handler := it.ErrorHandler
+	it.ErrorHandler = func(token.Position, string) { failed = true }
+	v := it.evalValue(exp)
+	it.ErrorHandler = handler
+	if failed {
+		return nil, false
+	}
+	switch v := v.(type) {
+	case bool:
+		if v {
+			return int64(1), true
+		}
+		return int64(0), true
+	case uint8, int64, uint64, float64:
+		return v, true
+	}
+	return nil, false
+}
+
+// 按当前宏定义计算已解析的条件表达式，未定义的标识符为 0
+func (it *Interpreter) EvalCond(expr ast.MacroLiter) bool {
+	return isTrue(it.evalValue(expr))
+}
+
 // 转换成位置
 func (it *Interpreter) Position(pos token.Pos) token.Position {
 	return it.pos.CreatePosition(pos)
@@ -58,15 +209,18 @@ func (it *Interpreter) Position(pos token.Pos) token.Position {
 
 // 执行宏语句
 func (it *Interpreter) evalStmt(node ast.Node) {
+	it.stopAt(node)
 	switch n := node.(type) {
 	case *ast.BlockStmt:
 		for _, sub := range *n {
 			it.evalStmt(sub)
 		}
 	case *ast.MacroLitArray:
-		it.src.WriteString(NewExtractor(it).Extract(n, NewGlobalEnv(token.NoPos)))
+		it.expandIn(n)
+		it.out.write(NewExtractor(it).Extract(n, NewGlobalEnv(token.NoPos)))
 	case *ast.Ident:
-		it.src.WriteString(NewExtractor(it).Extract(n, NewGlobalEnv(token.NoPos)))
+		it.expandIn(n)
+		it.out.write(NewExtractor(it).Extract(n, NewGlobalEnv(token.NoPos)))
 	case *ast.ValDefineStmt:
 		it.evalDefineVal(n)
 	case *ast.UnDefineStmt:
@@ -83,16 +237,24 @@ func (it *Interpreter) evalStmt(node ast.Node) {
 		it.evalIfNoDefined(n)
 	case *ast.IncludeStmt:
 		it.evalIncludeStmt(n)
+	case *ast.RawGroup:
+		it.evalRawGroup(n)
 	case *ast.MacroCmdStmt:
+		if n.Kind == token.PRAGMA && isPragmaOnce(n.Cmd) {
+			it.pragmaOnce()
+		}
 		if n.Kind != token.ERROR {
 			it.writePlaceholder(n)
 		} else {
 			it.error(n.Pos(), n.Cmd)
 		}
 	case *ast.LineStmt:
-		fmt.Println("set line", n.Line)
+		it.evalLineStmt(n)
+	case *ast.BadExpr, *ast.InvalidStmt:
+		// 错误已由解析器报告
+		it.writePlaceholder(n)
 	default:
-		fmt.Println("unexpected cmd")
+		it.errorf(token.NoPos, "unexpected statement %T", node)
 	}
 }
 
@@ -100,7 +262,7 @@ func (it *Interpreter) evalStmt(node ast.Node) {
 func (it *Interpreter) evalDefineVal(stmt *ast.ValDefineStmt) {
 	n := stmt.Name.Name
 	if _, ok := it.Val[n]; ok || isInnerDefine(n) {
-		it.errorf(stmt.Pos(), "warning: %s redefined", n)
+		it.warningf(stmt.Pos(), "%s redefined", n)
 	}
 	it.Val[n] = &MacroLitValue{it, stmt}
 	it.writePlaceholder(stmt)
@@ -110,7 +272,7 @@ func (it *Interpreter) evalDefineVal(stmt *ast.ValDefineStmt) {
 func (it *Interpreter) evalDefineFunc(stmt *ast.FuncDefineStmt) {
 	n := stmt.Name.Name
 	if _, ok := it.Val[n]; ok || isInnerDefine(n) {
-		it.errorf(stmt.Pos(), "warning: %s redefined", n)
+		it.warningf(stmt.Pos(), "%s redefined", n)
 	}
 	it.Val[n] = &MacroFuncValue{it, stmt}
 	it.writePlaceholder(stmt)
@@ -141,30 +303,92 @@ func isInnerDefine(name string) bool {
 // 宏占位
 func (it *Interpreter) writePlaceholder(node ast.Node) {
 	f := it.pos.CreatePosition(node.Pos()).Line
-	t := it.pos.CreatePosition(node.End()).Line
-	it.src.WriteString(strings.Repeat("\n", t-f+1))
+	t := it.pos.CreatePosition(node.End())
+	if !t.IsValid() {
+		// 指令位于文件末尾，没有换行
+		t = it.pos.CreatePosition(node.End() - 1)
+	}
+	it.out.writeSpace(strings.Repeat("\n", t.Line-f+1))
+}
+
+// 按需解析选中的条件分支体
+func (it *Interpreter) evalRawGroup(group *ast.RawGroup) {
+	node, errs := parser.ParseGroup(group, it.pos, parser.LazyGroups)
+	it.parseErrors(errs)
+	it.coverFile(node)
+	it.evalStmt(node)
+}
+
+// #line
+func (it *Interpreter) evalLineStmt(stmt *ast.LineStmt) {
+	if !it.LineMarkers {
+		it.writePlaceholder(stmt)
+		return
+	}
+	path := stmt.Path
+	if path == "" {
+		path = strconv.Quote(it.file)
+	}
+	it.out.writeLine("# " + stmt.Line + " " + path + "\n")
 }
 
 // #include
 func (it *Interpreter) evalIncludeStmt(stmt *ast.IncludeStmt) {
-	fmt.Println("include", stmt.Path)
-	it.writePlaceholder(stmt)
+	path, typ, ok := it.IncludePath(stmt)
+	if ok && it.Includer == nil {
+		it.errorf(stmt.Pos(), "%s: file inclusion disabled", path[1:len(path)-1])
+	}
+	if !ok || it.Includer == nil {
+		it.writePlaceholder(stmt)
+		return
+	}
+	line := it.pos.CreatePosition(stmt.End()).Line
+	if line == 0 {
+		line = it.pos.CreatePosition(stmt.End() - 1).Line
+	}
+	if !it.include(stmt.Pos(), path[1:len(path)-1], typ, line+1) || !it.LineMarkers {
+		it.writePlaceholder(stmt)
+	}
+}
 
+// 包含的文件名，"FILENAME" 或 <FILENAME>
+// #include MACRO 展开后重新解释为文件名
+func (it *Interpreter) IncludePath(stmt *ast.IncludeStmt) (path string, typ ast.IncludeType, ok bool) {
+	if stmt.Type != ast.IncludeMacro {
+		return stmt.Path, stmt.Type, true
+	}
+	if stmt.Name == nil {
+		it.error(stmt.Pos(), "#include expects \"FILENAME\" or <FILENAME>")
+		return "", stmt.Type, false
+	}
+	it.expandIn(stmt.Name)
+	path = strings.TrimSpace(NewExtractor(it).Extract(stmt.Name, NewGlobalEnv(stmt.Name.Pos())).String())
+	switch {
+	case len(path) > 2 && path[0] == '"' && path[len(path)-1] == '"':
+		return path, ast.IncludeOuter, true
+	case len(path) > 2 && path[0] == '<' && path[len(path)-1] == '>':
+		return path, ast.IncludeInner, true
+	}
+	it.errorf(stmt.Name.Pos(), "#include expects \"FILENAME\" or <FILENAME>, got %s", path)
+	return "", stmt.Type, false
 }
 
 // #if
 func (it *Interpreter) evalIf(stmt *ast.IfStmt) {
-	v := it.evalIfBoolExpr(stmt.X)
+	v := it.evalIfBoolExpr(stmt.X, stmt.Pos(), "#if")
 	// #if
-	it.writePlaceholder(stmt.X)
-	it.evalCondition(v, stmt.Then, stmt.Else)
-	it.src.WriteString("\n") // #endif
+	if isEmptyExpr(stmt.X) {
+		it.out.writeSpace("\n")
+	} else {
+		it.writePlaceholder(stmt.X)
+	}
+	it.evalBranches(stmt, v, stmt.Then, stmt.Else)
 }
 
 // #elif
 func (it *Interpreter) evalElseIf(stmt *ast.ElseIfStmt) {
-	v := it.evalIfBoolExpr(stmt.X)
-	it.evalCondition(v, stmt.Then, stmt.Else)
+	v := it.evalIfBoolExpr(stmt.X, stmt.Pos(), "#elif")
+	it.evalCondition(stmt, v, stmt.Then, stmt.Else)
 }
 
 // #ifdef
@@ -172,8 +396,7 @@ func (it *Interpreter) evalIfDefined(stmt *ast.IfDefStmt) {
 	v := it.evalDefined(stmt.Name, "#ifdef")
 	// #ifdef
 	it.writePlaceholder(stmt.Name)
-	it.evalCondition(v, stmt.Then, stmt.Else)
-	it.src.WriteString("\n") // #endif
+	it.evalBranches(stmt, v, stmt.Then, stmt.Else)
 }
 
 // #ifndef
@@ -181,17 +404,85 @@ func (it *Interpreter) evalIfNoDefined(stmt *ast.IfNoDefStmt) {
 	v := it.evalDefined(stmt.Name, "#ifndef")
 	// #ifdef
 	it.writePlaceholder(stmt.Name)
-	it.evalCondition(!v, stmt.Then, stmt.Else)
-	it.src.WriteString("\n") // #endif
+	it.evalBranches(stmt, !v, stmt.Then, stmt.Else)
 }
 
-func (it *Interpreter) evalIfBoolExpr(expr ast.MacroLiter) bool {
-	ee := NewExtractor(it).Extract(expr, NewGlobalEnv(expr.Pos()))
-	//fmt.Println("expr", strconv.QuoteToGraphic(ee))
+// 执行条件块，v 为第一个分支的条件
+// #elif #else 指令与未选中的分支按源码中的行数输出空行
+func (it *Interpreter) evalBranches(stmt ast.CondStmt, v bool, ts, fs ast.Stmt) {
+	block := ast.Branches(stmt)
+	if block.Branches[0].Directive == nil {
+		// 手动构造的语法树没有指令位置
+		it.evalCondition(stmt, v, ts, fs)
+		it.out.writeSpace("\n") // #endif
+		return
+	}
+	taken := false
+	for i, b := range block.Branches {
+		if i > 0 && b.Stmt != nil && !taken {
+			eif := b.Stmt.(*ast.ElseIfStmt)
+			v = it.evalIfBoolExpr(eif.X, eif.Pos(), "#elif")
+		}
+		if i > 0 {
+			it.skipLines(b.Directive.From, b.Directive.To)
+		}
+		if b.Stmt != nil && !taken {
+			if it.BranchHook != nil {
+				it.BranchHook(b.Stmt, v)
+			}
+			it.coverBranch(b.Stmt, v)
+		}
+		if !taken && (b.Stmt == nil || v) {
+			taken = true
+			if b.Body != nil {
+				it.evalStmt(b.Body)
+			}
+			continue
+		}
+		it.skipLines(b.BodyFrom, b.BodyTo)
+	}
+	it.out.writeSpace("\n") // #endif
+}
+
+// 输出 [from, to) 之间的换行
+func (it *Interpreter) skipLines(from, to token.Pos) {
+	if to <= from {
+		return
+	}
+	f := it.pos.CreatePosition(from).Line
+	t := it.pos.CreatePosition(to)
+	if !t.IsValid() {
+		// 位于文件末尾
+		t = it.pos.CreatePosition(to - 1)
+		t.Line++
+	}
+	it.out.writeSpace(strings.Repeat("\n", t.Line-f))
+}
+
+func (it *Interpreter) evalIfBoolExpr(expr ast.MacroLiter, pos token.Pos, directive string) bool {
+	if isEmptyExpr(expr) {
+		it.errorf(pos, "%s with no expression", directive)
+		return false
+	}
+	if it.CondHook != nil {
+		it.CondHook(expr)
+	}
+	it.expandIn(expr)
+	ee := NewExtractor(it).Extract(expr, NewGlobalEnv(expr.Pos())).String()
 	return it.evalExpr(ee, expr.Pos())
 }
 
-func (it *Interpreter) evalCondition(v bool, ts, fs ast.Stmt) {
+// 条件表达式为空
+func isEmptyExpr(expr ast.MacroLiter) bool {
+	arr, ok := expr.(*ast.MacroLitArray)
+	return expr == nil || ok && (arr == nil || len(*arr) == 0)
+}
+
+func (it *Interpreter) evalCondition(stmt ast.CondStmt, v bool, ts, fs ast.Stmt) {
+	if it.BranchHook != nil {
+		it.BranchHook(stmt, v)
+	}
+	it.coverBranch(stmt, v)
 	if v {
 		it.evalStmt(ts)
 		if fs != nil {
@@ -204,46 +495,70 @@ func (it *Interpreter) evalCondition(v bool, ts, fs ast.Stmt) {
 }
 
 // 二元运算
+// && || 短路求值，不计算的运算数不报告错误
 func (it Interpreter) evalBinaryExpr(expr *ast.BinaryExpr) interface{} {
 	x := it.evalValue(expr.X)
+	if expr.Op == token.LAND || expr.Op == token.LOR {
+		if isTrue(x) == (expr.Op == token.LOR) {
+			return expr.Op == token.LOR
+		}
+		return isTrue(it.evalValue(expr.Y))
+	}
 	y := it.evalValue(expr.Y)
 	tx := typeOf(x)
 	ty := typeOf(y)
 	t := maxNumberType(tx, ty)
+	if expr.Op == token.REM || expr.Op == token.QUO && t != floatType {
+		if it.intValue(y) == 0 {
+			it.errorf(expr.Offset, "division by zero in #if")
+			return int64(0)
+		}
+	}
 	switch expr.Op {
 	case token.ADD, token.SUB, token.MUL, token.QUO,
-		token.GEQ, token.GTR, token.LSS, token.LEQ, token.EQL, token.NEQ,
-		token.LAND, token.LOR:
+		token.GEQ, token.GTR, token.LSS, token.LEQ, token.EQL, token.NEQ:
 		return it.evalOpCast(x, y, t, expr.Op)
 	case token.SHR, token.SHL, token.REM,
-		token.AND, token.OR:
+		token.AND, token.OR, token.XOR:
 		return it.evalOpInt(x, y, expr.X, expr.Y, tx, ty, expr.Op)
 	default:
 		it.errorf(expr.Pos(), "unknown operator %s", expr.Op)
 	}
-	return uint8(0)
+	return int64(0)
 }
 
-func maxNumberType(tx, ty token.Token) token.Token {
-	if tx == token.FLOAT || ty == token.FLOAT {
-		return token.FLOAT
-	}
-	if tx == token.CHAR || ty == token.CHAR {
-		return token.CHAR
+// 数值类型，按运算时的转换顺序排列
+type numberType int
+
+const (
+	intType   numberType = iota // int64，字符常量按 int64 计算
+	uintType                    // uint64，带 u 后缀或超出 int64 范围的整数
+	floatType                   // float64
+)
+
+func maxNumberType(tx, ty numberType) numberType {
+	if tx > ty {
+		return tx
 	}
-	return token.INT
+	return ty
 }
 
-func typeOf(x interface{}) token.Token {
-	_, xf := x.(float64)
-	if xf {
-		return token.FLOAT
+func typeOf(x interface{}) numberType {
+	switch x.(type) {
+	case float64:
+		return floatType
+	case uint64:
+		return uintType
 	}
-	_, ux := x.(uint8)
-	if ux {
-		return token.CHAR
+	return intType
+}
+
+// 条件运算，只计算选中的一边
+func (it Interpreter) evalCondExpr(expr *ast.CondExpr) interface{} {
+	if isTrue(it.evalValue(expr.Cond)) {
+		return it.evalValue(expr.X)
 	}
-	return token.INT
+	return it.evalValue(expr.Y)
 }
 
 // 运行表达式
@@ -252,15 +567,22 @@ func (it Interpreter) evalExpr(expr string, pos token.Pos) bool {
 	if len(errs) > 0 {
 		it.errorf(pos, "error parse expr %s", expr)
 	}
-	switch v := it.evalValue(exp).(type) {
+	return isTrue(it.evalValue(exp))
+}
+
+// 值是否为真，非零为真
+func isTrue(value interface{}) bool {
+	switch v := value.(type) {
 	case bool:
 		return v
 	case uint8:
-		return v > 0
-	case int32:
-		return v > 0
+		return v != 0
+	case int64:
+		return v != 0
+	case uint64:
+		return v != 0
 	case float64:
-		return v > 0
+		return v != 0
 	default:
 		return false
 	}
@@ -272,7 +594,7 @@ func (it Interpreter) evalExpr(expr string, pos token.Pos) bool {
 // 把展开的宏作为表达式解析并返回表达式的值
 func (it *Interpreter) evalValue(expr interface{}) interface{} {
 	switch xx := expr.(type) {
-	case uint8, int32, float64:
+	case uint8, int64, uint64, float64:
 		return xx
 	case *ast.Ident:
 		return it.evalIdent(xx)
@@ -281,7 +603,7 @@ func (it *Interpreter) evalValue(expr interface{}) interface{} {
 		case token.CHAR:
 			return it.expectedChar(xx)
 		case token.INT:
-			return it.intValue(xx)
+			return it.evalInt(xx)
 		case token.FLOAT:
 			return it.floatValue(xx)
 		}
@@ -291,8 +613,15 @@ func (it *Interpreter) evalValue(expr interface{}) interface{} {
 		return it.evalUnaryExpr(xx)
 	case *ast.BinaryExpr:
 		return it.evalBinaryExpr(xx)
+	case *ast.CondExpr:
+		return it.evalCondExpr(xx)
 	case *ast.MacroCallExpr:
-		return NewExtractor(it).Extract(xx, NewGlobalEnv(xx.Pos()))
+		v := NewExtractor(it).Extract(xx, NewGlobalEnv(xx.Pos())).String()
+		exp, errs := parser.ParseExpr([]byte(v), xx.Pos())
+		if len(errs) > 0 {
+			it.errorf(xx.Pos(), "error Extract macro call expr %s", v)
+		}
+		return it.evalValue(exp)
 	case ast.MacroLiter:
 		it.errorf(xx.Pos(), "unexpected token %v", xx)
 	}
@@ -310,48 +639,21 @@ func (it Interpreter) expectedIdent(expr ast.MacroLiter) *ast.Ident {
 	return nil
 }
 
-func (it Interpreter) evalOpInt(x, y interface{}, ex, ey ast.MacroLiter, tx, ty, op token.Token) interface{} {
-	var yy int32
-	if _, ok := y.(float64); ty == token.FLOAT && ok {
-		yy = it.intValue(y)
+// 整数运算，浮点数转换为整数
+// 移位的结果类型与左操作数相同
+func (it Interpreter) evalOpInt(x, y interface{}, ex, ey ast.MacroLiter, tx, ty numberType, op token.Token) interface{} {
+	if ty == floatType {
 		it.errorf(ey.Pos(), "float in y expression")
-	} else {
-		yy = it.intValue(y)
 	}
-	if tx == token.FLOAT {
-		xx := it.intValue(x)
+	if tx == floatType {
 		it.errorf(ex.Pos(), "float in x expression")
-		switch op {
-		case token.SHL:
-			return xx << yy
-		case token.SHR:
-			return xx >> yy
-		case token.REM:
-			return xx % yy
-		case token.AND:
-			return xx & yy
-		case token.OR:
-			return xx | yy
-		}
 	}
-	if tx == token.INT {
-		xx := it.intValue(x)
-		switch op {
-		case token.SHL:
-			return xx << yy
-		case token.SHR:
-			return xx >> yy
-		case token.REM:
-			return xx % yy
-		case token.AND:
-			return xx & yy
-		case token.OR:
-			return xx | yy
-		}
+	t := maxNumberType(tx, ty)
+	if op == token.SHL || op == token.SHR {
+		t = tx
 	}
-	if tx == token.CHAR {
-		xx := x.(uint8)
-		yy := uint8(yy)
+	if t == uintType {
+		xx, yy := it.uintValue(x), it.uintValue(y)
 		switch op {
 		case token.SHL:
 			return xx << yy
@@ -363,14 +665,31 @@ func (it Interpreter) evalOpInt(x, y interface{}, ex, ey ast.MacroLiter, tx, ty,
 			return xx & yy
 		case token.OR:
 			return xx | yy
+		case token.XOR:
+			return xx ^ yy
 		}
 	}
-	return uint8(0)
+	xx, yy := it.intValue(x), it.intValue(y)
+	switch op {
+	case token.SHL:
+		return xx << uint64(yy)
+	case token.SHR:
+		return xx >> uint64(yy)
+	case token.REM:
+		return xx % yy
+	case token.AND:
+		return xx & yy
+	case token.OR:
+		return xx | yy
+	case token.XOR:
+		return xx ^ yy
+	}
+	return int64(0)
 }
 
 // 自动转换成数据量高的类型进行运算
-func (it Interpreter) evalOpCast(x, y interface{}, t, op token.Token) interface{} {
-	if t == token.FLOAT {
+func (it Interpreter) evalOpCast(x, y interface{}, t numberType, op token.Token) interface{} {
+	if t == floatType {
 		xx, yy := it.floatValue(x), it.floatValue(y)
 		switch op {
 		case token.ADD:
@@ -393,14 +712,10 @@ func (it Interpreter) evalOpCast(x, y interface{}, t, op token.Token) interface{
 			return xx == yy
 		case token.NEQ:
 			return xx != yy
-		case token.LAND:
-			return (xx > 0) && (yy > 0)
-		case token.LOR:
-			return (xx > 0) && (yy > 0)
 		}
 	}
-	if t == token.INT {
-		xx, yy := it.intValue(x), it.intValue(y)
+	if t == uintType {
+		xx, yy := it.uintValue(x), it.uintValue(y)
 		switch op {
 		case token.ADD:
 			return xx + yy
@@ -422,15 +737,10 @@ func (it Interpreter) evalOpCast(x, y interface{}, t, op token.Token) interface{
 			return xx == yy
 		case token.NEQ:
 			return xx != yy
-		case token.LAND:
-			return (xx > 0) && (yy > 0)
-		case token.LOR:
-			return (xx > 0) && (yy > 0)
 		}
 	}
-	if t == token.CHAR {
-		xx, _ := x.(uint8)
-		yy, _ := y.(uint8)
+	if t == intType {
+		xx, yy := it.intValue(x), it.intValue(y)
 		switch op {
 		case token.ADD:
 			return xx + yy
@@ -452,38 +762,40 @@ func (it Interpreter) evalOpCast(x, y interface{}, t, op token.Token) interface{
 			return xx == yy
 		case token.NEQ:
 			return xx != yy
-		case token.LAND:
-			return (xx > 0) && (yy > 0)
-		case token.LOR:
-			return (xx > 0) && (yy > 0)
 		}
 	}
-	return uint8(0)
+	return int64(0)
 }
 
 // 表达式到整数
-func (it Interpreter) intValue(value interface{}) int32 {
+func (it Interpreter) intValue(value interface{}) int64 {
 	switch ex := value.(type) {
 	case *ast.LitExpr:
-		if ex.Kind == token.INT {
-			return it.evalInt(ex)
-		}
-		if ex.Kind == token.CHAR {
-			return int32(charValue(ex.Value))
-		}
-		if ex.Kind == token.FLOAT {
-			return int32(it.evalFloat(ex))
-		}
+		return it.intValue(it.expectedValue(ex))
 	case float64:
-		return int32(ex)
+		return int64(ex)
 	case uint8:
-		return int32(ex)
-	case int32:
+		return int64(ex)
+	case int64:
 		return ex
+	case uint64:
+		return int64(ex)
+	case bool:
+		if ex {
+			return 1
+		}
 	}
 	return 0
 }
 
+// 表达式到无符号整数
+func (it Interpreter) uintValue(value interface{}) uint64 {
+	if v, ok := value.(uint64); ok {
+		return v
+	}
+	return uint64(it.intValue(value))
+}
+
 func (it Interpreter) expectedChar(expr *ast.LitExpr) uint8 {
 	if expr.Kind != token.CHAR {
 		it.errorf(expr.Pos(), "unexpected token %v", expr)
@@ -500,21 +812,19 @@ func (it Interpreter) expectedChar(expr *ast.LitExpr) uint8 {
 func (it Interpreter) floatValue(value interface{}) float64 {
 	switch ex := value.(type) {
 	case *ast.LitExpr:
-		if ex.Kind == token.INT {
-			return it.evalFloat(ex)
-		}
-		if ex.Kind == token.INT {
-			return float64(it.evalInt(ex))
-		}
-		if ex.Kind == token.CHAR {
-			return float64(charValue(ex.Value))
-		}
+		return it.floatValue(it.expectedValue(ex))
 	case float64:
 		return ex
 	case uint8:
 		return float64(ex)
-	case int32:
+	case int64:
+		return float64(ex)
+	case uint64:
 		return float64(ex)
+	case bool:
+		if ex {
+			return 1
+		}
 	}
 	return 0
 }
@@ -585,46 +895,40 @@ func digitVal(ch rune) int {
 }
 
 // 一元运算
+// 字符常量按 int64 计算
 func (it Interpreter) evalUnaryExpr(expr *ast.UnaryExpr) interface{} {
 	switch expr.Op {
 	case token.NOT: // ~
 		v := it.expectedValue(it.evalValue(expr.X))
-		if vv, ok := v.(uint8); ok {
+		if vv, ok := v.(uint64); ok {
 			return ^vv
 		}
-		if vv, ok := v.(int32); ok {
-			return ^vv
+		if typeOf(v) == intType {
+			return ^it.intValue(v)
 		}
 	case token.LNOT: // !
 		v := it.expectedValue(it.evalValue(expr.X))
-		if vv, ok := v.(uint8); ok {
-			return !(vv > 0)
-		}
-		if vv, ok := v.(int32); ok {
-			return !(vv > 0)
-		}
 		if vv, ok := v.(float64); ok {
-			return !(vv > 0)
+			return vv == 0
 		}
+		return it.intValue(v) == 0
 	case token.SUB: // -
 		v := it.expectedValue(it.evalValue(expr.X))
-		if vv, ok := v.(uint8); ok {
-			return -vv
-		}
-		if vv, ok := v.(int32); ok {
+		if vv, ok := v.(uint64); ok {
 			return -vv
 		}
 		if vv, ok := v.(float64); ok {
 			return -vv
 		}
+		return -it.intValue(v)
 	case token.DEFINED: // defined ident
 		if it.evalDefined(expr.X, "defined") {
-			return uint8(1)
+			return int64(1)
 		}
-		return uint8(0)
+		return int64(0)
 	}
 	it.errorf(expr.X.Pos(), "unexpected value %v in %s expr", expr.X, expr.Op)
-	return uint8(0)
+	return int64(0)
 }
 
 // 定义指令
@@ -642,7 +946,8 @@ func (it Interpreter) evalDefined(expr ast.MacroLiter, typ string) bool {
 
 // 获取宏定义值
 func (it *Interpreter) evalIdent(id *ast.Ident) interface{} {
-	if v, ok := NewExtractor(it).Ident(id, NewGlobalEnv(id.Pos())); ok {
+	if f, ok := NewExtractor(it).Ident(id, NewGlobalEnv(id.Pos())); ok {
+		v := f.String()
 		exp, errs := parser.ParseExpr([]byte(v), id.Pos())
 		if len(errs) > 0 {
 			it.errorf(id.Pos(), "error Extract ident expr %s", v)
@@ -665,14 +970,14 @@ func (it *Interpreter) expectedValue(value interface{}) interface{} {
 		if v.Kind == token.CHAR {
 			return charValue(v.Value)
 		}
-	case float64, uint8, int32:
+	case float64, uint8, int64, uint64, bool:
 		return v
 	case *ast.Ident:
-		vv := NewExtractor(it).Extract(v, NewGlobalEnv(v.Pos()))
-		if v, err := strconv.ParseInt(vv, 0, 32); err == nil {
+		vv := NewExtractor(it).Extract(v, NewGlobalEnv(v.Pos())).String()
+		if v, err := intLiteral(vv); err == nil {
 			return v
 		}
-		if v, err := strconv.ParseFloat(vv, 64); err == nil {
+		if v, err := parseFloatLiteral(vv); err == nil {
 			return v
 		}
 		if v, ok := tryCharValue(vv); ok {
@@ -682,21 +987,21 @@ func (it *Interpreter) expectedValue(value interface{}) interface{} {
 	case ast.MacroLiter:
 		it.errorf(v.Pos(), "unexpected value %v", v)
 	}
-	return uint8(0)
+	return int64(0)
 }
 
-// 解析数字
-func (it Interpreter) evalInt(expr *ast.LitExpr) int32 {
-	v, err := strconv.ParseInt(expr.Value, 0, 32)
+// 解析数字，类型为 int64 或 uint64
+func (it Interpreter) evalInt(expr *ast.LitExpr) interface{} {
+	v, err := intLiteral(expr.Value)
 	if err != nil {
 		it.errorf(expr.Offset, "error parse int %s", err.Error())
 	}
-	return int32(v)
+	return v
 }
 
 // 解析数字（浮点数）
 func (it Interpreter) evalFloat(expr *ast.LitExpr) float64 {
-	v, err := strconv.ParseFloat(expr.Value, 64)
+	v, err := parseFloatLiteral(expr.Value)
 	if err != nil {
 		it.errorf(expr.Offset, "error parse float %s", err.Error())
 	}
@@ -704,9 +1009,33 @@ func (it Interpreter) evalFloat(expr *ast.LitExpr) float64 {
 }
 
 func (it Interpreter) error(pos token.Pos, msg string) {
-	fmt.Println("error", it.pos.CreatePosition(pos), msg)
+	if it.ErrorHandler != nil {
+		it.ErrorHandler(it.pos.CreatePosition(pos), msg)
+		return
+	}
+	fmt.Fprintln(os.Stderr, "error", it.pos.CreatePosition(pos), msg)
 }
 
 func (it Interpreter) errorf(pos token.Pos, format string, args ...interface{}) {
 	it.error(pos, fmt.Sprintf(format, args...))
 }
+
+func (it Interpreter) warningf(pos token.Pos, format string, args ...interface{}) {
+	msg := fmt.Sprintf(format, args...)
+	if it.WarningHandler != nil {
+		it.WarningHandler(it.pos.CreatePosition(pos), msg)
+		return
+	}
+	it.error(pos, "warning: "+msg)
+}
+
+// 报告解析错误，区分警告
+func (it Interpreter) parseErrors(errs scanner.ErrorList) {
+	for _, err := range errs {
+		if err.Warning {
+			it.warningf(token.Pos(err.Pos.Offset), "%s", err.Msg)
+		} else {
+			it.error(token.Pos(err.Pos.Offset), err.Msg)
+		}
+	}
+}
@@ -2,13 +2,18 @@
 
 import (
 	"bytes"
+	"dxkite.cn/language/macro/ast"
 	"dxkite.cn/language/macro/parser"
+	"dxkite.cn/language/macro/token"
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"os"
 	"path"
 	"path/filepath"
+	"reflect"
 	"strconv"
+	"strings"
 	"testing"
 )
 
@@ -39,7 +44,7 @@ func testFile(name, src, ext string, t *testing.T) {
 		t.Error(p.ErrorList())
 	}
 	it := Interpreter{}
-	it.Eval(stmts, name, p.FilePos())
+	out := it.Eval(stmts, name, p.FilePos())
 	pp := path.Join(".", src+".txt")
 	// .c 为正常测试
 	// .h 调试中
@@ -48,13 +53,13 @@ func testFile(name, src, ext string, t *testing.T) {
 		if err != nil {
 			t.Error(err)
 		}
-		if bytes.Equal(txt, it.src.Bytes()) == false {
+		if bytes.Equal(txt, out) == false {
 			t.Fatalf("macro evalStmt error\nwant:\n%s\ngot:\n%s\n",
-				strconv.QuoteToGraphic(string(txt)), strconv.QuoteToGraphic(it.src.String()))
+				strconv.QuoteToGraphic(string(txt)), strconv.QuoteToGraphic(string(out)))
 		}
 	} else {
 		fmt.Println("write evalStmt file", pp)
-		_ = ioutil.WriteFile(pp, it.src.Bytes(), os.ModePerm)
+		_ = ioutil.WriteFile(pp, out, os.ModePerm)
 	}
 }
 
@@ -111,3 +116,1045 @@ func Test_charValue(t *testing.T) {
 		})
 	}
 }
+
+func TestEval_comments(t *testing.T) {
+	src := "#define A 1 /* one */ // int\n" +
+		"/* text */ A // line\n"
+	tests := []struct {
+		name string
+		mode CommentMode
+		want string
+	}{
+		{"discard", DiscardComments, "\n 1  // line\n"},
+		{"keep -C", KeepComments, "\n/* text */ 1  // line\n"},
+		{"keep -CC", KeepMacroComments, "\n/* text */ 1 /* one */ /* int */ // line\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := parser.Parser{}
+			p.Init([]byte(src))
+			stmts := p.Parse()
+			if len(p.ErrorList()) > 0 {
+				t.Fatal(p.ErrorList())
+			}
+			it := Interpreter{Comments: tt.mode}
+			if got := string(it.Eval(stmts, "comments.c", p.FilePos())); got != tt.want {
+				t.Errorf("Eval() = %s, want %s", strconv.QuoteToGraphic(got), strconv.QuoteToGraphic(tt.want))
+			}
+		})
+	}
+}
+
+// 定义的行尾注释不参与展开
+func TestEval_defineComment(t *testing.T) {
+	src := "#define BUF 1024 // bytes\nBUF/2\n"
+	p := parser.Parser{}
+	p.Init([]byte(src))
+	stmts := p.Parse()
+	it := Interpreter{}
+	if got, want := string(it.Eval(stmts, "buf.c", p.FilePos())), "\n1024/2\n"; got != want {
+		t.Errorf("Eval() = %s, want %s", strconv.QuoteToGraphic(got), strconv.QuoteToGraphic(want))
+	}
+}
+
+func TestEval_logical(t *testing.T) {
+	tests := []struct {
+		expr string
+		want bool
+	}{
+		{"0 || 1", true},
+		{"1 || 0", true},
+		{"0 || 0", false},
+		{"1 && 0", false},
+		{"1 && 1", true},
+		{"-1 && 1", true},
+		{"0 || -1", true},
+		{"0.0 || 1.5", true},
+		{"0.5 && 0.0", false},
+		{"'a' || 0", true},
+		{"-1", true},
+		{"-0.5", true},
+		{"!-1", false},
+		{"!0", true},
+		{"!!2", true},
+		{"0 && (1/0)", false},
+		{"1 || 1 % 0", true},
+		{"0 ? 1/0 : 1", true},
+		{"1 ? 2 : 1/0", true},
+		{"0 ? 1 : 0 ? 1 : 2", true},
+		{"(1 ? 0 : 1) ? 1 : 0", false},
+		{"0 || 1 ? 0 : 1", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.expr, func(t *testing.T) {
+			if got := evalIf(t, tt.expr); got != tt.want {
+				t.Errorf("#if %s = %v, want %v", tt.expr, got, tt.want)
+			}
+		})
+	}
+}
+
+// 整数按 int64/uint64 计算
+func TestEval_integers(t *testing.T) {
+	tests := []struct {
+		expr string
+		want bool
+	}{
+		{"4294967296 == 0", false},
+		{"4294967296 > 0", true},
+		{"0x7fffffffffffffff > 0", true},
+		{"1 << 40 > 0", true},
+		{"-1 < 0", true},
+		{"-1 < 0u", false},
+		{"0xffffffffffffffff == -1", true},
+		{"18446744073709551615 / 2 > 0", true},
+		{"'a' - 'b' < 0", true},
+		{"'a' == 353", false},
+		{"(3 ^ 1) == 2", true},
+		{"~0u > 0", true},
+		{"(1 == 1) + 1 == 2", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.expr, func(t *testing.T) {
+			if got := evalIf(t, tt.expr); got != tt.want {
+				t.Errorf("#if %s = %v, want %v", tt.expr, got, tt.want)
+			}
+		})
+	}
+}
+
+// 除零报告错误，条件不成立
+func TestEval_divisionByZero(t *testing.T) {
+	tests := []struct {
+		expr string
+		want string
+	}{
+		{"1 / 0", "1:6: division by zero in #if"},
+		{"1 % (2 - 2)", "1:6: division by zero in #if"},
+		{"1 && 4 / 0u", "1:11: division by zero in #if"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.expr, func(t *testing.T) {
+			p := parser.Parser{}
+			p.Init([]byte("#if " + tt.expr + "\nyes\n#else\nno\n#endif\n"))
+			stmts := p.Parse()
+			var errs []string
+			it := Interpreter{ErrorHandler: func(pos token.Position, msg string) {
+				errs = append(errs, fmt.Sprintf("%d:%d: %s", pos.Line, pos.Column, msg))
+			}}
+			got := string(it.Eval(stmts, "div.c", p.FilePos()))
+			if !strings.Contains(got, "no") {
+				t.Errorf("#if %s = %s, want no", tt.expr, strconv.QuoteToGraphic(got))
+			}
+			if len(errs) != 1 || errs[0] != tt.want {
+				t.Errorf("errors = %q, want %q", errs, tt.want)
+			}
+		})
+	}
+}
+
+func TestInterpreter_EvalConst(t *testing.T) {
+	tests := []struct {
+		expr string
+		want interface{}
+		ok   bool
+	}{
+		{"1 + 2", int64(3), true},
+		{"1 < 2", int64(1), true},
+		{"0xffffffffffffffff", uint64(1<<64 - 1), true},
+		{"'a'", uint8('a'), true},
+		{"1 ? 2 : 1/0", int64(2), true},
+		{"A + 1", nil, false},
+		{"1 / 0", nil, false},
+		{"1 % (1 - 1)", nil, false},
+		{"1 << 1.5", nil, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.expr, func(t *testing.T) {
+			it := &Interpreter{}
+			got, ok := it.EvalConst(tt.expr)
+			if got != tt.want || ok != tt.ok {
+				t.Errorf("EvalConst(%q) = %#v, %v, want %#v, %v", tt.expr, got, ok, tt.want, tt.ok)
+			}
+		})
+	}
+}
+
+// #if 条件是否成立
+func evalIf(t *testing.T, expr string) bool {
+	p := parser.Parser{}
+	p.Init([]byte("#if " + expr + "\nyes\n#else\nno\n#endif\n"))
+	stmts := p.Parse()
+	if len(p.ErrorList()) > 0 {
+		t.Fatal(p.ErrorList())
+	}
+	it := Interpreter{ErrorHandler: func(pos token.Position, msg string) {
+		t.Errorf("#if %s: %s: %s", expr, pos, msg)
+	}}
+	got := string(it.Eval(stmts, "cond.c", p.FilePos()))
+	return strings.Contains(got, "yes")
+}
+
+// #elif 指令占据的行输出为空行
+func TestEval_elifLines(t *testing.T) {
+	tests := []struct {
+		name string
+		src  string
+		want string
+	}{
+		{"elif", "#if 0\na\n#elif 1 // c\nb\n#endif\nc\n", "\n\n\nb\n\nc\n"},
+		{"multi-line elif", "#if 0\na\n#elif 0 || \\\n  1\nb\n#endif\nc\n", "\n\n\n\nb\n\nc\n"},
+		{"skipped elif", "#if 1\na\n#elif 1\nb\n#endif\nc\n", "\na\n\n\n\nc\n"},
+		{"skipped elif else", "#if 1\na\n#elif 1\nb\n#else\nc\n#endif\nd\n", "\na\n\n\n\n\n\nd\n"},
+		{"elif chain", "#if 0\na\n#elif 0\nb\n#elif 1\nc\n#endif\nd\n", "\n\n\n\n\nc\n\nd\n"},
+		{"elif else", "#if 0\na\n#elif 0\nb\n#else\nc\n#endif\nd\n", "\n\n\n\n\nc\n\nd\n"},
+		{"ifdef elif", "#ifdef X\na\n#elif 1\nb\n#endif\nc\n", "\n\n\nb\n\nc\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := parser.Parser{}
+			p.Init([]byte(tt.src))
+			stmts := p.Parse()
+			if len(p.ErrorList()) > 0 {
+				t.Fatal(p.ErrorList())
+			}
+			it := Interpreter{}
+			if got := string(it.Eval(stmts, "elif.c", p.FilePos())); got != tt.want {
+				t.Errorf("Eval() = %s, want %s", strconv.QuoteToGraphic(got), strconv.QuoteToGraphic(tt.want))
+			}
+		})
+	}
+}
+
+// #else 之后的分支不输出，保留行数
+func TestEval_invalidBranch(t *testing.T) {
+	src := "#if 0\na\n#else\nb\n#else\nc\n#elif 1\nd\n#endif\ne\n"
+	for _, mode := range []parser.Mode{0, parser.LazyGroups} {
+		node, errs := parser.ParseMode([]byte(src), mode)
+		if len(errs) != 2 {
+			t.Fatalf("ParseMode() errors = %v", errs)
+		}
+		var pos token.FilePos
+		pos.Init([]byte(src))
+		it := Interpreter{ErrorHandler: func(token.Position, string) {}}
+		if got, want := string(it.Eval(node, "invalid.c", pos)), "\n\n\nb\n\n\n\n\n\ne\n"; got != want {
+			t.Errorf("mode %d: Eval() = %q, want %q", mode, got, want)
+		}
+	}
+}
+
+func TestEvalTokens(t *testing.T) {
+	src := "#define A 1 +x\nA y->z\n  B(A)"
+	want := []Token{
+		{Kind: token.INT, Lit: "1", Space: true, LineStart: true, Pos: 10, ExpandPos: 15},
+		{Kind: token.ADD, Lit: "+", Space: true, Pos: 12, ExpandPos: 15},
+		{Kind: token.IDENT, Lit: "x", Pos: 13, ExpandPos: 15},
+		{Kind: token.IDENT, Lit: "y", Space: true, Pos: 17, ExpandPos: 17},
+		{Kind: token.ARROW, Lit: "->", Pos: 18, ExpandPos: 18},
+		{Kind: token.IDENT, Lit: "z", Pos: 20, ExpandPos: 20},
+		{Kind: token.IDENT, Lit: "B", Space: true, LineStart: true, Pos: 24, ExpandPos: 24},
+		{Kind: token.LPAREN, Lit: "(", Pos: 25, ExpandPos: 25},
+		{Kind: token.INT, Lit: "1", Pos: 10, ExpandPos: 26},
+		{Kind: token.ADD, Lit: "+", Space: true, Pos: 12, ExpandPos: 26},
+		{Kind: token.IDENT, Lit: "x", Pos: 13, ExpandPos: 26},
+		{Kind: token.RPAREN, Lit: ")", Pos: 27, ExpandPos: 27},
+	}
+	for i := range want {
+		want[i].File = "tokens.c"
+	}
+	p := parser.Parser{}
+	p.Init([]byte(src))
+	stmts := p.Parse()
+	it := Interpreter{}
+	s := it.EvalTokens(stmts, "tokens.c", p.FilePos())
+	var got []Token
+	for {
+		tok, ok := s.Next()
+		if !ok {
+			break
+		}
+		tok.space = ""
+		got = append(got, tok)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("EvalTokens() = \ngot \t%+v\nwant\t%+v", got, want)
+	}
+	if out := string(s.Bytes()); out != "\n1 +x y->z\n  B(1 +x)" {
+		t.Errorf("Bytes() = %s", strconv.QuoteToGraphic(out))
+	}
+}
+
+// token 所在的文件
+func TestEvalTokens_file(t *testing.T) {
+	src := "#include \"a.h\"\nA b\n"
+	node, _ := parser.Parse([]byte(src))
+	var pos token.FilePos
+	pos.Init([]byte(src))
+	it := Interpreter{Includer: mapIncluder{"a.h": "#define A a\n-"}}
+	var got []string
+	for _, tok := range it.EvalTokens(node, "main.c", pos).Tokens() {
+		got = append(got, tok.Lit+" "+tok.File)
+	}
+	want := []string{"- a.h", "a main.c", "b main.c"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("EvalTokens() = %q, want %q", got, want)
+	}
+}
+
+func TestEvalTokens_punctuators(t *testing.T) {
+	tests := []struct {
+		src   string
+		kinds []token.Token
+		want  string
+	}{
+		{"#define P +\nint a = P+x;", []token.Token{token.IDENT, token.IDENT, token.EQU, token.ADD, token.ADD, token.IDENT, token.TEXT}, "\nint a = + +x;"},
+		{"#define M(x) -x\nM(>)", []token.Token{token.SUB, token.GTR}, "\n- >"},
+		{"a..b", []token.Token{token.IDENT, token.TEXT, token.TEXT, token.IDENT}, "a..b"},
+		{"f(...)", []token.Token{token.IDENT, token.LPAREN, token.ELLIPSIS, token.RPAREN}, "f(...)"},
+		{"p->q += x<<=2", []token.Token{token.IDENT, token.ARROW, token.IDENT, token.ADD_ASSIGN, token.IDENT, token.SHL_ASSIGN, token.INT}, "p->q += x<<=2"},
+		{"#define D p->q\nD++", []token.Token{token.IDENT, token.ARROW, token.IDENT, token.INC}, "\np->q++"},
+	}
+	for _, tt := range tests {
+		p := parser.Parser{}
+		p.Init([]byte(tt.src))
+		stmts := p.Parse()
+		it := Interpreter{}
+		s := it.EvalTokens(stmts, "tokens.c", p.FilePos())
+		var kinds []token.Token
+		for _, tok := range s.Tokens() {
+			kinds = append(kinds, tok.Kind)
+		}
+		if !reflect.DeepEqual(kinds, tt.kinds) {
+			t.Errorf("EvalTokens(%q) kinds = %v, want %v", tt.src, kinds, tt.kinds)
+		}
+		if out := string(s.Bytes()); out != tt.want {
+			t.Errorf("EvalTokens(%q).Bytes() = %q, want %q", tt.src, out, tt.want)
+		}
+	}
+}
+
+func TestInterpreter_IncludePath(t *testing.T) {
+	src := "#define CONFIG_HEADER \"config.h\"\n" +
+		"#define PLATFORM_HDR(x) <platform/x>\n" +
+		"#define STR(x) #x\n" +
+		"#define NUM 1\n" +
+		"#include CONFIG_HEADER\n" +
+		"#include PLATFORM_HDR(foo.h)\n" +
+		"#include STR(log.h)\n" +
+		"#include <stdio.h>\n" +
+		"#include NUM\n"
+	want := []struct {
+		path string
+		typ  ast.IncludeType
+		ok   bool
+	}{
+		{"\"config.h\"", ast.IncludeOuter, true},
+		{"<platform/foo.h>", ast.IncludeInner, true},
+		{"\"log.h\"", ast.IncludeOuter, true},
+		{"<stdio.h>", ast.IncludeInner, true},
+		{"", ast.IncludeMacro, false},
+	}
+	node, errs := parser.Parse([]byte(src))
+	if len(errs) > 0 {
+		t.Fatal(errs)
+	}
+	var msgs []string
+	it := Interpreter{ErrorHandler: func(pos token.Position, msg string) {
+		msgs = append(msgs, pos.String()+": "+msg)
+	}}
+	var pos token.FilePos
+	pos.Init([]byte(src))
+	it.Eval(node, "include.c", pos)
+	i := 0
+	for _, stmt := range *node.(*ast.BlockStmt) {
+		inc, ok := stmt.(*ast.IncludeStmt)
+		if !ok {
+			continue
+		}
+		path, typ, ok := it.IncludePath(inc)
+		if path != want[i].path || typ != want[i].typ || ok != want[i].ok {
+			t.Errorf("IncludePath(%d) = %q, %v, %v, want %q, %v, %v", i, path, typ, ok, want[i].path, want[i].typ, want[i].ok)
+		}
+		i++
+	}
+	// 没有 Includer 时包含文件报告错误
+	wantMsgs := []string{
+		"5:0: config.h: file inclusion disabled",
+		"6:0: platform/foo.h: file inclusion disabled",
+		"7:0: log.h: file inclusion disabled",
+		"8:0: stdio.h: file inclusion disabled",
+		"9:9: #include expects \"FILENAME\" or <FILENAME>, got 1",
+		"9:9: #include expects \"FILENAME\" or <FILENAME>, got 1",
+	}
+	if !reflect.DeepEqual(msgs, wantMsgs) {
+		t.Errorf("errors = %q, want %q", msgs, wantMsgs)
+	}
+}
+
+func TestEval_lazyGroups(t *testing.T) {
+	files, _ := filepath.Glob("testdata/*.c")
+	for _, name := range files {
+		if !exists(name + ".txt") {
+			continue
+		}
+		t.Run(name, func(t *testing.T) {
+			code, err := ioutil.ReadFile(name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want, err := ioutil.ReadFile(name + ".txt")
+			if err != nil {
+				t.Fatal(err)
+			}
+			node, errs := parser.ParseMode(code, parser.LazyGroups)
+			if len(errs) > 0 {
+				t.Fatal(errs)
+			}
+			var pos token.FilePos
+			pos.Init(code)
+			it := Interpreter{}
+			if got := it.Eval(node, filepath.Base(name), pos); !bytes.Equal(got, want) {
+				t.Errorf("Eval() = %s, want %s", strconv.QuoteToGraphic(string(got)), strconv.QuoteToGraphic(string(want)))
+			}
+		})
+	}
+
+	// 未选中的分支不报告错误
+	src := "#if 0\nIt's a \"quote\n#define F(\n#foo\n#else\n#define G(x) x\nG(1)\n#endif\n"
+	node, errs := parser.ParseMode([]byte(src), parser.LazyGroups)
+	if len(errs) > 0 {
+		t.Fatal(errs)
+	}
+	var msgs []string
+	it := Interpreter{ErrorHandler: func(pos token.Position, msg string) {
+		msgs = append(msgs, msg)
+	}}
+	var pos token.FilePos
+	pos.Init([]byte(src))
+	if got, want := string(it.Eval(node, "lazy.c", pos)), "\n\n\n\n\n\n1\n\n"; got != want || len(msgs) > 0 {
+		t.Errorf("Eval() = %q, want %q, errors %q", got, want, msgs)
+	}
+}
+
+// 内存中的包含文件
+type mapIncluder map[string]string
+
+func (m mapIncluder) Include(path string, typ ast.IncludeType, from string) (string, []byte, error) {
+	if src, ok := m[path]; ok {
+		return path, []byte(src), nil
+	}
+	return path, nil, fmt.Errorf("%s: No such file or directory", path)
+}
+
+func TestEval_include(t *testing.T) {
+	files := mapIncluder{
+		"config.h": "#define VER 2\nconst char *f = __FILE__;",
+		"pre.h":    "#define PRE 1\n",
+		"self.h":   "#include \"self.h\"\n",
+	}
+	tests := []struct {
+		name  string
+		src   string
+		lines bool
+		want  string
+		errs  []string
+	}{
+		{"include", "#include \"config.h\"\nint v = VER + PRE + D;\n", false,
+			"\n\nconst char *f = \"config.h\";\nint v = 2 + 1 + 3;\n", nil},
+		{"line markers", "#include \"config.h\"\nint v = VER;\n__FILE__\n", true,
+			"# 1 \"main.c\"\n# 1 \"pre.h\" 1\n\n# 1 \"main.c\" 2\n# 1 \"config.h\" 1\n\nconst char *f = \"config.h\";\n# 2 \"main.c\" 2\nint v = 2;\n\"main.c\"\n", nil},
+		{"line directive", "a\n#line 10 \"x.c\"\nb\n", true,
+			"# 1 \"main.c\"\n# 1 \"pre.h\" 1\n\n# 1 \"main.c\" 2\na\n# 10 \"x.c\"\nb\n", nil},
+		{"missing", "#include <none.h>\nx\n", false, "\n\nx\n",
+			[]string{"main.c:1:0: none.h: No such file or directory"}},
+		{"recursive", "#include \"self.h\"\n", false, "",
+			[]string{"self.h:1:0: #include nested depth 200 exceeds maximum of 200"}},
+	}
+	predefined, _ := parser.Parse([]byte("#define D 3\n"))
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			node, errs := parser.Parse([]byte(tt.src))
+			if len(errs) > 0 {
+				t.Fatal(errs)
+			}
+			var msgs []string
+			it := &Interpreter{
+				Includer:    files,
+				Predefined:  []ast.DefineStmt{(*predefined.(*ast.BlockStmt))[0].(ast.DefineStmt)},
+				Preinclude:  []string{"pre.h"},
+				LineMarkers: tt.lines,
+			}
+			it.ErrorHandler = func(pos token.Position, msg string) {
+				msgs = append(msgs, it.Filename()+":"+pos.String()+": "+msg)
+			}
+			var pos token.FilePos
+			pos.Init([]byte(tt.src))
+			got := string(it.Eval(node, "main.c", pos))
+			if tt.name != "recursive" && got != tt.want {
+				t.Errorf("Eval() = %q, want %q", got, tt.want)
+			}
+			if !reflect.DeepEqual(msgs, tt.errs) {
+				t.Errorf("errors = %q, want %q", msgs, tt.errs)
+			}
+		})
+	}
+}
+
+func TestDeps(t *testing.T) {
+	files := mapIncluder{
+		"a.h":       "#include <sys.h>\n#include \"a.h.inc\"\n",
+		"a.h.inc":   "",
+		"sys.h":     "",
+		"my file.h": "",
+	}
+	src := "#include \"a.h\"\n#if __has_include(\"my file.h\") && !__has_include(<none.h>)\n#include \"a.h\"\n#endif\n"
+	node, errs := parser.Parse([]byte(src))
+	if len(errs) > 0 {
+		t.Fatal(errs)
+	}
+	var pos token.FilePos
+	pos.Init([]byte(src))
+	deps := &Deps{Source: "main.c", Probes: true}
+	it := &Interpreter{Includer: systemIncluder{files}, Deps: deps}
+	it.Eval(node, "main.c", pos)
+	want := []Dependency{{"a.h", false, false}, {"sys.h", true, false}, {"a.h.inc", false, false}, {"my file.h", false, true}}
+	if !reflect.DeepEqual(deps.Files, want) {
+		t.Errorf("Files = %v, want %v", deps.Files, want)
+	}
+	var b bytes.Buffer
+	if err := deps.WriteMake(&b, []string{"main.o"}, false, true); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := b.String(), "main.o: main.c a.h a.h.inc my\\ file.h\n\na.h:\n\na.h.inc:\n\nmy\\ file.h:\n"; got != want {
+		t.Errorf("WriteMake() = %q, want %q", got, want)
+	}
+	b.Reset()
+	if err := deps.WriteJSON(&b, []string{"main.o"}, true); err != nil {
+		t.Fatal(err)
+	}
+	var got struct {
+		Targets []string
+		Source  string
+		Files   []Dependency
+	}
+	if err := json.Unmarshal(b.Bytes(), &got); err != nil || got.Source != "main.c" || !reflect.DeepEqual(got.Files, want) {
+		t.Errorf("WriteJSON() = %s", b.String())
+	}
+}
+
+func TestIncludeGraph(t *testing.T) {
+	files := mapIncluder{
+		"a.h":   "#ifndef A_H\n#define A_H\n#include \"b.h\"\n#endif\n",
+		"b.h":   "#pragma once\n#include \"a.h\"\n",
+		"sys.h": "",
+	}
+	src := "#include \"a.h\"\n#include \"a.h\"\n#include \"b.h\"\n#include <sys.h>\n#include \"none.h\"\n"
+	node, _ := parser.Parse([]byte(src))
+	var pos token.FilePos
+	pos.Init([]byte(src))
+	graph := &IncludeGraph{}
+	it := &Interpreter{Includer: systemIncluder{files}, Graph: graph, ErrorHandler: func(token.Position, string) {}}
+	it.Eval(node, "main.c", pos)
+	wantFiles := []*IncludeFile{
+		{Name: "main.c"},
+		{Name: "a.h", Guard: "A_H", Count: 1},
+		{Name: "b.h", Once: true, Count: 1},
+		{Name: "sys.h", System: true, Count: 1},
+		{Name: "none.h"},
+	}
+	if !reflect.DeepEqual(graph.Files, wantFiles) {
+		t.Errorf("Files = %v, want %v", graph.Files, wantFiles)
+	}
+	wantEdges := []*IncludeEdge{
+		{From: "main.c", To: "a.h", Path: "a.h", Line: 1, Dir: "."},
+		{From: "a.h", To: "b.h", Path: "b.h", Line: 3, Dir: "."},
+		{From: "b.h", To: "a.h", Path: "a.h", Line: 2, Dir: ".", Skipped: SkipGuard},
+		{From: "main.c", To: "a.h", Path: "a.h", Line: 2, Dir: ".", Skipped: SkipGuard},
+		{From: "main.c", To: "b.h", Path: "b.h", Line: 3, Dir: ".", Skipped: SkipOnce},
+		{From: "main.c", To: "sys.h", Path: "sys.h", Line: 4, Dir: "sys"},
+		{From: "main.c", To: "none.h", Path: "none.h", Line: 5, Skipped: SkipMissing},
+	}
+	if !reflect.DeepEqual(graph.Edges, wantEdges) {
+		for _, e := range graph.Edges {
+			t.Logf("%+v", *e)
+		}
+		t.Errorf("Edges differ")
+	}
+	if got, want := graph.Cycles(), [][]string{{"a.h", "b.h", "a.h"}}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Cycles() = %q, want %q", got, want)
+	}
+	var b bytes.Buffer
+	if err := graph.WriteDOT(&b); err != nil {
+		t.Fatal(err)
+	}
+	wantDOT := "digraph includes {\n" +
+		"  \"main.c\" [shape=box];\n" +
+		"  \"a.h\" [label=\"a.h\\nguard A_H\"];\n" +
+		"  \"b.h\" [label=\"b.h\\n#pragma once\"];\n" +
+		"  \"sys.h\" [color=gray];\n" +
+		"  \"none.h\";\n" +
+		"  \"main.c\" -> \"a.h\" [label=\"guard\"];\n" +
+		"  \"a.h\" -> \"b.h\" [color=red];\n" +
+		"  \"b.h\" -> \"a.h\" [label=\"guard\", style=dashed, color=red];\n" +
+		"  \"main.c\" -> \"b.h\" [label=\"once\", style=dashed];\n" +
+		"  \"main.c\" -> \"sys.h\";\n" +
+		"  \"main.c\" -> \"none.h\" [label=\"missing\", style=dashed];\n" +
+		"}\n"
+	if b.String() != wantDOT {
+		t.Errorf("WriteDOT() =\n%s\nwant\n%s", b.String(), wantDOT)
+	}
+	b.Reset()
+	if err := graph.WriteJSON(&b); err != nil {
+		t.Fatal(err)
+	}
+	var got struct {
+		Root   string
+		Files  []*IncludeFile
+		Edges  []*IncludeEdge
+		Cycles [][]string
+	}
+	if err := json.Unmarshal(b.Bytes(), &got); err != nil || got.Root != "main.c" ||
+		!reflect.DeepEqual(got.Files, wantFiles) || !reflect.DeepEqual(got.Edges, wantEdges) || len(got.Cycles) != 1 {
+		t.Errorf("WriteJSON() = %s", b.String())
+	}
+}
+
+func TestFileIncluder_IncludeDir(t *testing.T) {
+	root := t.TempDir()
+	files := map[string]string{
+		"src/main.c":     "",
+		"src/local.h":    "",
+		"inc/a.h":        "",
+		"inc/sys/b.h":    "",
+		"sysinc/c.h":     "",
+		"sysinc/inc/d.h": "",
+	}
+	for name, src := range files {
+		name = filepath.Join(root, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(name, []byte(src), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	fi := &FileIncluder{
+		Dirs:       []string{filepath.Join(root, "inc")},
+		SystemDirs: []string{filepath.Join(root, "sysinc")},
+	}
+	from := filepath.Join(root, "src", "main.c")
+	tests := []struct {
+		path string
+		typ  ast.IncludeType
+		dir  string // 相对 root，为空时不是搜索目录
+	}{
+		{"local.h", ast.IncludeOuter, "src"},
+		{"../inc/a.h", ast.IncludeOuter, "src"},
+		{"a.h", ast.IncludeInner, "inc"},
+		{"sys/b.h", ast.IncludeInner, "inc"},
+		{"c.h", ast.IncludeInner, "sysinc"},
+		{"inc/d.h", ast.IncludeInner, "sysinc"},
+		{filepath.Join(root, "inc", "a.h"), ast.IncludeInner, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			_, dir, _, err := fi.IncludeDir(tt.path, tt.typ, from)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := ""
+			if tt.dir != "" {
+				want = filepath.Join(root, tt.dir)
+			}
+			if dir != want {
+				t.Errorf("IncludeDir() dir = %q, want %q", dir, want)
+			}
+		})
+	}
+}
+
+// sys 开头的文件为系统头文件
+type systemIncluder struct {
+	mapIncluder
+}
+
+func (s systemIncluder) IsSystem(name string) bool {
+	return strings.HasPrefix(name, "sys")
+}
+
+// 系统头文件在 sys 目录中找到，其他文件在 . 中找到
+func (s systemIncluder) IncludeDir(path string, typ ast.IncludeType, from string) (string, string, []byte, error) {
+	name, src, err := s.Include(path, typ, from)
+	if err != nil {
+		return name, "", src, err
+	}
+	if s.IsSystem(name) {
+		return name, "sys", src, nil
+	}
+	return name, ".", src, nil
+}
+
+func TestMakeQuote(t *testing.T) {
+	tests := []struct{ name, want string }{
+		{"a.h", "a.h"},
+		{"my file.h", "my\\ file.h"},
+		{"a\\ b", "a\\\\\\ b"},
+		{"$x#", "$$x\\#"},
+	}
+	for _, tt := range tests {
+		if got := MakeQuote(tt.name); got != tt.want {
+			t.Errorf("MakeQuote(%q) = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestEval_branchHook(t *testing.T) {
+	src := "#define A 1\n#if !A\n#elif A\n#endif\n#ifndef A\n#endif\n#if\n#endif\n"
+	node, _ := parser.Parse([]byte(src))
+	var got, msgs []string
+	it := Interpreter{ErrorHandler: func(pos token.Position, msg string) {
+		msgs = append(msgs, pos.String()+": "+msg)
+	}}
+	it.BranchHook = func(stmt ast.CondStmt, v bool) {
+		got = append(got, fmt.Sprintf("%d:%v", it.Position(stmt.Pos()).Line, v))
+	}
+	var pos token.FilePos
+	pos.Init([]byte(src))
+	it.Eval(node, "branch.c", pos)
+	if want := "2:false 3:true 5:false 7:false"; strings.Join(got, " ") != want {
+		t.Errorf("BranchHook = %q, want %q", got, want)
+	}
+	if len(msgs) != 1 || msgs[0] != "7:0: #if with no expression" {
+		t.Errorf("errors = %q", msgs)
+	}
+}
+
+func TestEvalVariants(t *testing.T) {
+	files := mapIncluder{
+		"a.h":    "#ifndef A_H\n#define A_H\n#ifdef CONFIG_NET\n#define NET_SIZE 16\n#endif\nint a;\n#endif\n",
+		"once.h": "#pragma once\nint once;\n",
+	}
+	tests := []struct {
+		name   string
+		src    string
+		want   string
+		macros []string
+	}{
+		{
+			"concrete",
+			"#define N 2\n#if N > 1\nint a = N;\n#else\nint b;\n#endif\n",
+			"int a = 2;\n",
+			nil,
+		},
+		{
+			"elif chain",
+			"#ifdef CONFIG_A\na\n#elif CONFIG_LEVEL > 2\nb\n#else\nc\n#endif\nd\n",
+			"#if defined(CONFIG_A)\na\n#endif\n#if !defined(CONFIG_A) && (CONFIG_LEVEL > 2)\nb\n#endif\n" +
+				"#if !defined(CONFIG_A) && !(CONFIG_LEVEL > 2)\nc\n#endif\nd\n",
+			[]string{"CONFIG_A", "CONFIG_LEVEL"},
+		},
+		{
+			"nested",
+			"#if defined(CONFIG_A) && !defined(OTHER)\n#ifndef CONFIG_B\nx\n#endif\n#endif\n",
+			"#if defined(CONFIG_A) && !defined(CONFIG_B)\nx\n#endif\n",
+			[]string{"CONFIG_A", "CONFIG_B"},
+		},
+		{
+			"conditional macro",
+			"#ifdef CONFIG_A\n#define X 1\n#else\n#define X 0\n#endif\n#define Y X\n#if Y\nyes\n#endif\nint v = Y;\nint w;\n",
+			"#if defined(CONFIG_A)\nyes\n#endif\n#if !defined(CONFIG_A)\nint v = 0;\n#endif\n" +
+				"#if defined(CONFIG_A)\nint v = 1;\n#endif\nint w;\n",
+			[]string{"CONFIG_A"},
+		},
+		{
+			"define config macro",
+			"#ifdef CONFIG_A\n#define CONFIG_B\n#endif\n#ifdef CONFIG_B\nb\n#endif\n#undef CONFIG_A\n#ifdef CONFIG_A\na\n#endif\n",
+			"#if defined(CONFIG_A) || defined(CONFIG_B)\nb\n#endif\n",
+			[]string{"CONFIG_A", "CONFIG_B"},
+		},
+		{
+			"include guard",
+			"#include \"a.h\"\n#if CONFIG_X\n#include \"a.h\"\n#endif\n#ifdef NET_SIZE\nint n[NET_SIZE];\n#endif\n",
+			"int a;\n#if defined(CONFIG_NET)\nint n[16];\n#endif\n",
+			[]string{"CONFIG_NET", "CONFIG_X"},
+		},
+		{
+			"pragma once",
+			"#ifdef CONFIG_A\n#include \"once.h\"\n#endif\n#include \"once.h\"\n",
+			"#if defined(CONFIG_A)\nint once;\n#endif\n#if !defined(CONFIG_A)\nint once;\n#endif\n",
+			[]string{"CONFIG_A"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			src := []byte(tt.src)
+			node, _ := parser.Parse(src)
+			var pos token.FilePos
+			pos.Init(src)
+			it := &Interpreter{Includer: files}
+			r := it.EvalVariants(node, "main.c", pos, MatchSymbols([]string{"CONFIG_*"}))
+			var b bytes.Buffer
+			if err := r.WriteText(&b); err != nil {
+				t.Fatal(err)
+			}
+			if b.String() != tt.want {
+				t.Errorf("WriteText() =\n%s\nwant\n%s", b.String(), tt.want)
+			}
+			if !reflect.DeepEqual(r.Macros, tt.macros) {
+				t.Errorf("Macros = %q, want %q", r.Macros, tt.macros)
+			}
+			for _, err := range r.Errors {
+				t.Errorf("error %s:%d: %s", err.File, err.Line, err.Msg)
+			}
+		})
+	}
+}
+
+func TestEvalVariants_errors(t *testing.T) {
+	src := []byte("#if CONFIG_A\n#error a\n#elif\n#endif\n#include \"none.h\"\nint x;\n#include \"warn.h\"\n")
+	node, _ := parser.Parse(src)
+	var pos token.FilePos
+	pos.Init(src)
+	called := false
+	it := &Interpreter{Includer: mapIncluder{"warn.h": "#define W \\ \n1\n"}, ErrorHandler: func(token.Position, string) { called = true }}
+	r := it.EvalVariants(node, "main.c", pos, MatchSymbols([]string{"CONFIG_A"}))
+	var got []string
+	for _, err := range r.Errors {
+		got = append(got, fmt.Sprintf("%d %s: %s %v", err.Line, err.Cond, err.Msg, err.Warning))
+	}
+	want := []string{"2 CONFIG_A: #error a false", "3 !CONFIG_A: #elif with no expression false",
+		"5 1: none.h: No such file or directory false", "1 1: backslash and newline separated by space true"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Errors = %q, want %q", got, want)
+	}
+	if called {
+		t.Error("ErrorHandler called")
+	}
+	var b bytes.Buffer
+	if err := r.WriteJSON(&b); err != nil {
+		t.Fatal(err)
+	}
+	var out struct {
+		Macros []string
+		Lines  []struct {
+			Cond, File, Text string
+			Line             int
+		}
+	}
+	if err := json.Unmarshal(b.Bytes(), &out); err != nil {
+		t.Fatal(err)
+	}
+	if len(out.Lines) != 1 || out.Lines[0].Cond != "1" || out.Lines[0].Line != 6 || out.Lines[0].Text != "int x;" ||
+		!reflect.DeepEqual(out.Macros, []string{"CONFIG_A"}) {
+		t.Errorf("WriteJSON() = %s", b.String())
+	}
+}
+
+func TestCoverage(t *testing.T) {
+	files := mapIncluder{
+		"a.h": "#ifdef A\nint a;\n#endif\n",
+	}
+	src := "#include \"a.h\"\n#if defined(A) && defined(B)\nab\n#elif B > 1\n#ifndef C\nb\n#endif\n#else\nnone\n#endif\n"
+	cov := &Coverage{Sources: map[string][]byte{"main.c": []byte(src), "a.h": []byte(files["a.h"])}}
+	for _, config := range [][]string{{"A"}, {"A", "B=1"}, nil} {
+		var defines []ast.DefineStmt
+		for _, d := range config {
+			node, _ := parser.Parse([]byte("#define " + strings.Replace(d, "=", " ", 1) + "\n"))
+			defines = append(defines, (*node.(*ast.BlockStmt))[0].(ast.DefineStmt))
+		}
+		node, _ := parser.Parse([]byte(src))
+		var pos token.FilePos
+		pos.Init([]byte(src))
+		it := &Interpreter{Includer: files, Predefined: defines, Coverage: cov}
+		it.Eval(node, "main.c", pos)
+	}
+	var b bytes.Buffer
+	if err := cov.WriteText(&b); err != nil {
+		t.Fatal(err)
+	}
+	wantText := "main.c:4: #elif B > 1: never taken\n" +
+		"main.c:5: #ifndef C: never reached\n" +
+		"3 runs, 3 of 5 branches taken\n"
+	if b.String() != wantText {
+		t.Errorf("WriteText() =\n%s\nwant\n%s", b.String(), wantText)
+	}
+	b.Reset()
+	if err := cov.WriteSource(&b); err != nil {
+		t.Fatal(err)
+	}
+	wantSource := "main.c:\n" +
+		"        | #include \"a.h\"\n" +
+		"      1 | #if defined(A) && defined(B)\n" +
+		"        | ab\n" +
+		"  ##### | #elif B > 1\n" +
+		"  ##### | #ifndef C\n" +
+		"      - | b\n" +
+		"      - | #endif\n" +
+		"      2 | #else\n" +
+		"        | none\n" +
+		"        | #endif\n" +
+		"\n" +
+		"a.h:\n" +
+		"      2 | #ifdef A\n" +
+		"        | int a;\n" +
+		"        | #endif\n"
+	if b.String() != wantSource {
+		t.Errorf("WriteSource() =\n%s\nwant\n%s", b.String(), wantSource)
+	}
+
+	// 合并 JSON 格式的结果
+	b.Reset()
+	if err := cov.WriteJSON(&b); err != nil {
+		t.Fatal(err)
+	}
+	other, err := ReadCoverage(&b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other.Merge(cov)
+	if other.Runs != 6 || len(other.Conds) != 3 || other.Conds[0].Reached != 6 || other.Conds[0].Branches[2].Count != 4 {
+		t.Errorf("Merge() = %+v", other.Conds[0])
+	}
+	if got := len(other.Uncovered()); got != 2 {
+		t.Errorf("Uncovered() = %d branches, want 2", got)
+	}
+}
+
+func TestInterpreter_ExpandAt(t *testing.T) {
+	files := mapIncluder{
+		"a.h": "#define W 4\n#define SQ(x) ((x)*(x))\n",
+	}
+	src := "#include \"a.h\"\n#define AREA(w, h) SQ(w) * h\nint a = AREA(W + 1, 2);\n#undef W\n#define W 5\n" +
+		"#if W > 4\nint b = W + __LINE__;\n#else\nint c = W;\n#endif\n#ifdef W\nint d = printf(SQ);\n#endif\n"
+	tests := []struct {
+		name   string
+		at     string // 展开位置，为 src 中首次出现的位置
+		text   string
+		result string
+		steps  []string
+		err    string
+	}{
+		{"call", "AREA(W", "AREA(W + 1, 2)", "((4 + 1)*(4 + 1)) * 2",
+			[]string{"0 AREA(W + 1, 2) => ((4 + 1)*(4 + 1)) * 2", "1 SQ(W + 1) => ((4 + 1)*(4 + 1))", "2 W => 4", "2 W => 4"}, ""},
+		{"argument", "W + 1", "W", "4", []string{"0 W => 4"}, ""},
+		{"after undef", "W + __LINE__", "W", "5", []string{"0 W => 5"}, ""},
+		{"condition", "W > 4", "W", "5", []string{"0 W => 5"}, ""},
+		{"builtin", "__LINE__", "__LINE__", "7", []string{"0 __LINE__ => 7"}, ""},
+		{"not macro", "int a", "", "", nil, "int is not a macro"},
+		{"function name", "SQ);", "", "", nil, "SQ is not a macro"},
+		{"enclosing call", "printf", "", "", nil, "printf is not a macro"},
+		{"inactive", "W;", "", "", nil, "W at offset 135 is in an inactive branch"},
+		{"ifdef name", "W\nint d", "", "", nil, "no macro use at offset 152"},
+		{"definition", "SQ(w)", "", "", nil, "no macro use at offset 34"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			node, _ := parser.Parse([]byte(src))
+			var pos token.FilePos
+			pos.Init([]byte(src))
+			it := &Interpreter{Includer: files, ErrorHandler: func(pos token.Position, msg string) { t.Error(msg) }}
+			offset := strings.Index(src, tt.at)
+			exp, err := it.ExpandAt(node, "main.c", pos, token.Pos(offset))
+			if tt.err != "" {
+				if err == nil || err.Error() != tt.err {
+					t.Errorf("ExpandAt() error = %v, want %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			var steps []string
+			for _, s := range exp.Steps {
+				steps = append(steps, fmt.Sprintf("%d %s => %s", s.Depth, s.Text, s.Result))
+			}
+			if exp.Text != tt.text || exp.Result != tt.result || !reflect.DeepEqual(steps, tt.steps) ||
+				src[exp.From:exp.To] != tt.text {
+				t.Errorf("ExpandAt() = %q => %q %q, want %q => %q %q", exp.Text, exp.Result, steps, tt.text, tt.result, tt.steps)
+			}
+		})
+	}
+}
+
+func TestInterpreter_ValuesAt(t *testing.T) {
+	files := mapIncluder{
+		"a.h": "#define W 4\n#define SQ(x) ((x)*(x))\n",
+	}
+	src := "#include \"a.h\"\n#define AREA(w, h) SQ(w) * h\nint a = AREA(W + 1, 2);\n#undef W\n#define W 5\n" +
+		"#if W > 4\nint b = W;\n#else\nint c = W;\n#endif\n"
+	tests := []struct {
+		name string
+		at   string // 位置，为 src 中首次出现的位置
+		w    string // W 的展开，未定义时为空
+		area bool   // AREA 是否已定义
+	}{
+		{"include", "#include", "", false},
+		{"definition", "SQ(w)", "4", false},
+		{"text", "int a", "4", true},
+		{"undef", "#undef", "4", true},
+		{"after undef", "#define W 5", "", true},
+		{"active", "int b", "5", true},
+		{"inactive", "int c", "5", true},
+		{"end", "#endif\n", "5", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			node, _ := parser.Parse([]byte(src))
+			var pos token.FilePos
+			pos.Init([]byte(src))
+			it := &Interpreter{Includer: files, ErrorHandler: func(pos token.Position, msg string) { t.Error(msg) }}
+			val := it.ValuesAt(node, "main.c", pos, token.Pos(strings.Index(src, tt.at)))
+			w := ""
+			if _, ok := val["W"]; ok {
+				w = NewExtractor(it).Extract(&ast.Ident{Name: "W"}, NewGlobalEnv(token.NoPos)).String()
+			}
+			if _, area := val["AREA"]; strings.TrimSpace(w) != tt.w || area != tt.area {
+				t.Errorf("ValuesAt() W = %q AREA %v, want %q %v", w, area, tt.w, tt.area)
+			}
+		})
+	}
+}
+
+func TestPredefines(t *testing.T) {
+	tests := []struct {
+		name string
+		args []string // -U 以 - 开头
+		want []string
+		err  string
+	}{
+		{"define", []string{"A", "B=2", "F(x)=x+1"}, []string{"A", "B", "F"}, ""},
+		{"undef", []string{"A", "B", "-A"}, []string{"B"}, ""},
+		{"undef params", []string{"F(x)=x", "-F(x)"}, nil, ""},
+		{"redefine", []string{"A=1", "-A", "A=2"}, []string{"A"}, ""},
+		{"invalid", []string{"1=2"}, nil, "invalid macro definition '1'"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var p Predefines
+			var err error
+			for _, arg := range tt.args {
+				if strings.HasPrefix(arg, "-") {
+					p.Undef(arg[1:])
+				} else if err = p.Define(arg); err != nil {
+					break
+				}
+			}
+			if tt.err != "" {
+				if err == nil || err.Error() != tt.err {
+					t.Errorf("Define() error = %v, want %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			var names []string
+			for _, stmt := range p {
+				names = append(names, defineName(stmt))
+			}
+			if !reflect.DeepEqual(names, tt.want) {
+				t.Errorf("Predefines = %v, want %v", names, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,216 @@
+package interpreter
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// 整数后缀
+var intSuffix = map[string]bool{
+	"":    true,
+	"u":   true,
+	"l":   true,
+	"ul":  true,
+	"lu":  true,
+	"ll":  true,
+	"ull": true,
+	"llu": true,
+	"z":   true,
+	"uz":  true,
+	"zu":  true,
+	"wb":  true,
+	"uwb": true,
+	"wbu": true,
+}
+
+// 浮点数后缀
+var floatSuffix = map[string]bool{
+	"":     true,
+	"f":    true,
+	"l":    true,
+	"f16":  true,
+	"f32":  true,
+	"f64":  true,
+	"f128": true,
+	"bf16": true,
+	"f32x": true,
+	"f64x": true,
+	"df":   true,
+	"dd":   true,
+	"dl":   true,
+}
+
+// 检查后缀
+// ll/LL 与 wb/WB 必须大小写一致
+func validSuffix(suffix string, set map[string]bool) bool {
+	if !set[strings.ToLower(suffix)] {
+		return false
+	}
+	for _, pair := range []string{"ll", "wb"} {
+		if i := strings.Index(strings.ToLower(suffix), pair); i >= 0 {
+			if p := suffix[i : i+2]; p != pair && p != strings.ToUpper(pair) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// 扫描数字串（含数字分隔符）
+// 返回去除分隔符后的数字及结束位置
+func scanDigits(lit string, i int, isDigit func(byte) bool) (string, int, error) {
+	var b strings.Builder
+	for i < len(lit) {
+		ch := lit[i]
+		if ch == '\'' {
+			if b.Len() == 0 || i+1 >= len(lit) || !isDigit(lit[i+1]) {
+				return "", i, errors.New("invalid digit separator")
+			}
+			i++
+			continue
+		}
+		if !isDigit(ch) {
+			break
+		}
+		b.WriteByte(ch)
+		i++
+	}
+	return b.String(), i, nil
+}
+
+func isDecimalByte(ch byte) bool { return '0' <= ch && ch <= '9' }
+func isHexByte(ch byte) bool     { return digitVal(rune(ch)) < 16 }
+
+// 解析整数字面量
+// 支持 0x 0b 0 前缀、数字分隔符与 u/l/ll/z/wb 后缀
+func parseIntLiteral(lit string) (uint64, error) {
+	i, base := 0, 10
+	isDigit := isDecimalByte
+	if len(lit) > 1 && lit[0] == '0' {
+		switch lower(rune(lit[1])) {
+		case 'x':
+			i, base, isDigit = 2, 16, isHexByte
+		case 'b':
+			i, base = 2, 2
+		default:
+			base = 8
+		}
+	}
+	digits, end, err := scanDigits(lit, i, isDigit)
+	if err != nil {
+		return 0, err
+	}
+	if len(digits) == 0 {
+		return 0, fmt.Errorf("invalid integer constant %q", lit)
+	}
+	if suffix := lit[end:]; !validSuffix(suffix, intSuffix) {
+		return 0, fmt.Errorf("invalid suffix %q on integer constant", suffix)
+	}
+	for _, d := range digits {
+		if digitVal(d) >= base {
+			return 0, fmt.Errorf("invalid digit %q in %s constant", d, baseName(base))
+		}
+	}
+	v, err := strconv.ParseUint(digits, base, 64)
+	if err != nil {
+		return 0, fmt.Errorf("integer constant %s is too large", lit)
+	}
+	return v, nil
+}
+
+// 整数字面量的值
+// 带 u 后缀或超出 int64 范围时为 uint64，否则为 int64
+func intLiteral(lit string) (interface{}, error) {
+	v, err := parseIntLiteral(lit)
+	if err != nil {
+		return int64(0), err
+	}
+	if v > math.MaxInt64 || strings.ContainsAny(lit, "uU") {
+		return v, nil
+	}
+	return int64(v), nil
+}
+
+func baseName(base int) string {
+	switch base {
+	case 2:
+		return "binary"
+	case 8:
+		return "octal"
+	case 16:
+		return "hexadecimal"
+	}
+	return "decimal"
+}
+
+// 解析浮点数字面量
+// decimal: digits [ "." digits ] [ "e" [sign] digits ] suffix
+// hex:     "0x" digits [ "." digits ] "p" [sign] digits suffix
+func parseFloatLiteral(lit string) (float64, error) {
+	i := 0
+	hex := len(lit) > 1 && lit[0] == '0' && lower(rune(lit[1])) == 'x'
+	isDigit := isDecimalByte
+	exp := byte('e')
+	if hex {
+		i, isDigit, exp = 2, isHexByte, 'p'
+	}
+	intPart, i, err := scanDigits(lit, i, isDigit)
+	if err != nil {
+		return 0, err
+	}
+	var frac string
+	hasDot := i < len(lit) && lit[i] == '.'
+	if hasDot {
+		frac, i, err = scanDigits(lit, i+1, isDigit)
+		if err != nil {
+			return 0, err
+		}
+		if i < len(lit) && lit[i] == '.' {
+			return 0, errors.New("too many decimal points in number")
+		}
+	}
+	if len(intPart)+len(frac) == 0 {
+		return 0, fmt.Errorf("invalid floating constant %q", lit)
+	}
+	mantissa := intPart
+	if hasDot {
+		mantissa += "." + frac
+	}
+	var expPart string
+	if i < len(lit) && byte(lower(rune(lit[i]))) == exp {
+		i++
+		sign := ""
+		if i < len(lit) && (lit[i] == '+' || lit[i] == '-') {
+			sign = lit[i : i+1]
+			i++
+		}
+		var digits string
+		digits, i, err = scanDigits(lit, i, isDecimalByte)
+		if err != nil {
+			return 0, err
+		}
+		if len(digits) == 0 {
+			return 0, errors.New("exponent has no digits")
+		}
+		expPart = string(exp) + sign + digits
+	} else if hex {
+		return 0, errors.New("hexadecimal floating constants require an exponent")
+	}
+	if suffix := lit[i:]; !validSuffix(suffix, floatSuffix) {
+		return 0, fmt.Errorf("invalid suffix %q on floating constant", suffix)
+	}
+	if hex {
+		mantissa = "0x" + mantissa
+	}
+	v, err := strconv.ParseFloat(mantissa+expPart, 64)
+	if err != nil && !errors.Is(err, strconv.ErrRange) {
+		return 0, fmt.Errorf("invalid floating constant %q", lit)
+	}
+	if math.IsInf(v, 0) {
+		return v, errors.New("floating constant exceeds range of double")
+	}
+	return v, nil
+}
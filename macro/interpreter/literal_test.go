@@ -0,0 +1,80 @@
+package interpreter
+
+import (
+	"testing"
+)
+
+func Test_parseIntLiteral(t *testing.T) {
+	tests := []struct {
+		lit     string
+		want    uint64
+		wantErr bool
+	}{
+		{"123", 123, false},
+		{"123ull", 123, false},
+		{"123ULL", 123, false},
+		{"123uLL", 123, false},
+		{"123lL", 0, true},
+		{"1zu", 1, false},
+		{"1uwb", 1, false},
+		{"10'000", 10000, false},
+		{"10''000", 0, true},
+		{"10'", 0, true},
+		{"0b1010u", 10, false},
+		{"0b102", 0, true},
+		{"0x1F", 31, false},
+		{"0x'1F", 0, true},
+		{"017", 15, false},
+		{"018", 0, true},
+		{"0", 0, false},
+		{"0u", 0, false},
+		{"1f", 0, true},
+		{"123BCDE123", 0, true},
+		{"18446744073709551616", 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.lit, func(t *testing.T) {
+			got, err := parseIntLiteral(tt.lit)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseIntLiteral() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("parseIntLiteral() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_parseFloatLiteral(t *testing.T) {
+	tests := []struct {
+		lit     string
+		want    float64
+		wantErr bool
+	}{
+		{"1.5", 1.5, false},
+		{".5", 0.5, false},
+		{"1.", 1, false},
+		{"1e+5f", 1e5, false},
+		{"1E-2L", 0.01, false},
+		{"0x1p-3", 0.125, false},
+		{"0x1.8p1", 3, false},
+		{"0x1.8", 0, true},
+		{"1.2.3", 0, true},
+		{"1.0e", 0, true},
+		{"1.0e+", 0, true},
+		{"1'000.5", 1000.5, false},
+		{"1.5df", 1.5, false},
+		{"1.5x", 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.lit, func(t *testing.T) {
+			got, err := parseFloatLiteral(tt.lit)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseFloatLiteral() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("parseFloatLiteral() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,54 @@
+package interpreter
+
+import (
+	"dxkite.cn/language/macro/ast"
+	"dxkite.cn/language/macro/parser"
+	"fmt"
+	"strings"
+)
+
+// 命令行宏定义
+// 按 -D -U 出现的顺序处理，-U 删除之前的同名定义
+type Predefines []ast.DefineStmt
+
+// 定义宏
+// arg 为 name、name=value 或 name(params)=value，只有名称时定义为 1
+func (p *Predefines) Define(arg string) error {
+	name, value := arg, "1"
+	if n := strings.IndexByte(arg, '='); n >= 0 {
+		name, value = arg[:n], arg[n+1:]
+	}
+	node, errs := parser.Parse([]byte("#define " + name + " " + value + "\n"))
+	if block, ok := node.(*ast.BlockStmt); ok && len(errs) == 0 && len(*block) == 1 {
+		if stmt, ok := (*block)[0].(ast.DefineStmt); ok {
+			*p = append(*p, stmt)
+			return nil
+		}
+	}
+	return fmt.Errorf("invalid macro definition '%s'", name)
+}
+
+// 取消定义，name 可以带参数列表
+func (p *Predefines) Undef(name string) {
+	if n := strings.IndexByte(name, '('); n >= 0 {
+		name = name[:n]
+	}
+	list := (*p)[:0]
+	for _, stmt := range *p {
+		if defineName(stmt) != name {
+			list = append(list, stmt)
+		}
+	}
+	*p = list
+}
+
+// 定义的宏名
+func defineName(stmt ast.DefineStmt) string {
+	switch n := stmt.(type) {
+	case *ast.ValDefineStmt:
+		return n.Name.Name
+	case *ast.FuncDefineStmt:
+		return n.Name.Name
+	}
+	return ""
+}
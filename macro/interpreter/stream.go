@@ -0,0 +1,254 @@
+package interpreter
+
+import (
+	"dxkite.cn/language/macro/scanner"
+	"dxkite.cn/language/macro/token"
+	"strings"
+)
+
+// 展开片段
+// 记录展开后的文本及其来源位置
+type fragment struct {
+	text   string
+	pos    token.Pos // 拼写位置
+	expand token.Pos // 宏展开位置，非宏展开为 token.NoPos
+}
+
+type fragments []fragment
+
+func newFragments(text string, pos token.Pos) fragments {
+	if len(text) == 0 {
+		return nil
+	}
+	return fragments{{text: text, pos: pos, expand: token.NoPos}}
+}
+
+// 标记宏展开位置
+// 只记录最外层的展开
+func (f fragments) expandAt(pos token.Pos) fragments {
+	for i := range f {
+		if f[i].expand == token.NoPos {
+			f[i].expand = pos
+		}
+	}
+	return f
+}
+
+// 展开后的字符串
+func (f fragments) String() string {
+	var b strings.Builder
+	for _, v := range f {
+		b.WriteString(v.text)
+	}
+	return b.String()
+}
+
+// 预处理后的 token
+type Token struct {
+	Kind      token.Token // 类型
+	Lit       string      // 拼写
+	Space     bool        // 前面有空白
+	LineStart bool        // 位于行首
+	Pos       token.Pos   // 拼写位置
+	ExpandPos token.Pos   // 宏展开位置，非宏展开时与 Pos 相同
+	File      string      // 输出时所在的文件，即 ExpandPos 所在文件
+	space     string      // 前导空白原文
+}
+
+// 是否来自宏展开
+func (t Token) FromMacro() bool {
+	return t.Pos != t.ExpandPos
+}
+
+// 预处理后的 token 流
+type TokenStream struct {
+	tokens []Token
+	tail   string // 末尾空白
+	offset int
+}
+
+// 获取下一个 token
+func (s *TokenStream) Next() (tok Token, ok bool) {
+	if s.offset < len(s.tokens) {
+		tok = s.tokens[s.offset]
+		s.offset++
+		return tok, true
+	}
+	return Token{Kind: token.EOF, Pos: token.NoPos, ExpandPos: token.NoPos}, false
+}
+
+// 全部 token
+func (s *TokenStream) Tokens() []Token {
+	return s.tokens
+}
+
+// 输出文本
+// 来自不同拼写的相邻 token 若直接拼接会形成新的 token，则以空格分隔
+func (s *TokenStream) Bytes() []byte {
+	var b strings.Builder
+	for i, t := range s.tokens {
+		b.WriteString(t.space)
+		if i > 0 && t.space == "" {
+			if last := s.tokens[i-1]; !sameSpelling(last, t) && pastes(last.Lit, t.Lit) {
+				b.WriteByte(' ')
+			}
+		}
+		b.WriteString(t.Lit)
+	}
+	b.WriteString(s.tail)
+	return []byte(b.String())
+}
+
+// 多字符标点
+// 扫描器按单个运算符切分，输出时合并为 C 的标点
+var punctuators = map[string]token.Token{
+	"->": token.ARROW, "++": token.INC, "--": token.DEC,
+	"<<=": token.SHL_ASSIGN, ">>=": token.SHR_ASSIGN,
+	"+=": token.ADD_ASSIGN, "-=": token.SUB_ASSIGN, "*=": token.MUL_ASSIGN,
+	"/=": token.QUO_ASSIGN, "%=": token.REM_ASSIGN, "&=": token.AND_ASSIGN,
+	"^=": token.XOR_ASSIGN, "|=": token.OR_ASSIGN,
+	"::": token.TEXT, "<:": token.TEXT, ":>": token.TEXT,
+	"<%": token.TEXT, "%>": token.TEXT, "%:": token.TEXT,
+}
+
+// 相邻时会被词法分析为同一个 token 的字符对
+var pastePairs = map[string]bool{
+	"++": true, "--": true, "->": true, "+=": true, "-=": true, "*=": true,
+	"/=": true, "%=": true, "&=": true, "|=": true, "^=": true, "<<": true,
+	">>": true, "<=": true, ">=": true, "==": true, "!=": true, "&&": true,
+	"||": true, "##": true, "..": true, "//": true, "/*": true, "::": true,
+	"<:": true, ":>": true, "<%": true, "%>": true, "%:": true,
+}
+
+// 两段拼写直接拼接是否会改变 token 的切分
+func pastes(x, y string) bool {
+	if x == "" || y == "" {
+		return false
+	}
+	a, b := x[len(x)-1], y[0]
+	if isIdentChar(a) && isIdentChar(b) {
+		return true
+	}
+	if a == '.' && '0' <= b && b <= '9' {
+		return true
+	}
+	return pastePairs[string([]byte{a, b})]
+}
+
+func isIdentChar(ch byte) bool {
+	return ch == '_' || '0' <= ch && ch <= '9' || 'a' <= ch && ch <= 'z' || 'A' <= ch && ch <= 'Z' || ch >= 0x80
+}
+
+// 两个 token 是否来自同一段连续的拼写
+// 不跨越宏展开的边界
+func sameSpelling(x, y Token) bool {
+	if x.File != y.File || x.Pos+token.Pos(len(x.Lit)) != y.Pos || x.FromMacro() != y.FromMacro() {
+		return false
+	}
+	return !x.FromMacro() || x.ExpandPos == y.ExpandPos
+}
+
+// token 输出
+type tokenWriter struct {
+	tokens []Token
+	space  strings.Builder
+	file   string // 当前文件
+}
+
+// 写入空白（指令占位）
+func (w *tokenWriter) writeSpace(s string) {
+	w.space.WriteString(s)
+}
+
+// 写入独占一行的文本（行标记）
+func (w *tokenWriter) writeLine(s string) {
+	space := w.space.String()
+	if (len(w.tokens) > 0 || space != "") && !strings.HasSuffix(space, "\n") {
+		w.writeSpace("\n")
+	}
+	w.writeSpace(s)
+}
+
+// 写入展开片段
+func (w *tokenWriter) write(f fragments) {
+	for _, v := range f {
+		s := scanner.NewOffsetScanner([]byte(v.text), v.pos)
+		for {
+			pos, tok, lit := s.Scan()
+			if tok == token.EOF {
+				break
+			}
+			expand := v.expand
+			if expand == token.NoPos {
+				expand = pos
+			}
+			switch {
+			case tok == token.NEWLINE || tok == token.BACKSLASH_NEWLINE:
+				w.writeSpace(lit)
+			case tok == token.TEXT:
+				w.writeText(pos, expand, lit)
+			case tok == token.MACRO:
+				w.add(token.SHARP, pos, expand, lit)
+			case tok.IsKeyword():
+				w.add(token.IDENT, pos, expand, lit)
+			default:
+				w.add(tok, pos, expand, lit)
+			}
+		}
+	}
+}
+
+// 文本按空白切分，每个标点作为单独的 token
+func (w *tokenWriter) writeText(pos, expand token.Pos, text string) {
+	skip := 0
+	for i, ch := range text {
+		if skip > 0 {
+			skip--
+			continue
+		}
+		p := pos + token.Pos(i)
+		if ch == ' ' || ch == '\t' || ch == '\f' || ch == '\v' {
+			w.writeSpace(string(ch))
+			continue
+		}
+		e := expand
+		if e == pos {
+			e = p
+		}
+		if strings.HasPrefix(text[i:], "...") {
+			w.add(token.ELLIPSIS, p, e, "...")
+			skip = 2
+			continue
+		}
+		w.add(token.TEXT, p, e, string(ch))
+	}
+}
+
+func (w *tokenWriter) add(kind token.Token, pos, expand token.Pos, lit string) {
+	space := w.space.String()
+	w.space.Reset()
+	tok := Token{
+		Kind:      kind,
+		Lit:       lit,
+		Space:     len(space) > 0,
+		LineStart: len(w.tokens) == 0 || strings.ContainsAny(space, "\r\n"),
+		Pos:       pos,
+		ExpandPos: expand,
+		File:      w.file,
+		space:     space,
+	}
+	if n := len(w.tokens); n > 0 && space == "" {
+		last := &w.tokens[n-1]
+		if k, ok := punctuators[last.Lit+lit]; ok && sameSpelling(*last, tok) {
+			last.Kind = k
+			last.Lit += lit
+			return
+		}
+	}
+	w.tokens = append(w.tokens, tok)
+}
+
+// 输出结果
+func (w *tokenWriter) stream() *TokenStream {
+	return &TokenStream{tokens: w.tokens, tail: w.space.String()}
+}
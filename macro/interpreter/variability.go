@@ -0,0 +1,614 @@
+package interpreter
+
+import (
+	"dxkite.cn/language/macro/ast"
+	"dxkite.cn/language/macro/parser"
+	"dxkite.cn/language/macro/presence"
+	"dxkite.cn/language/macro/printer"
+	"dxkite.cn/language/macro/scanner"
+	"dxkite.cn/language/macro/token"
+	"encoding/json"
+	"io"
+	"sort"
+	"strings"
+)
+
+// 一行代码最多展开的定义组合数
+const maxVariants = 256
+
+// 可变性感知预处理的结果
+type Variants struct {
+	Lines  []*VariantLine  // 输出的行，按源码顺序
+	Macros []string        // 影响条件的配置宏，按名称排序
+	Errors []*VariantError // 错误，包括 #error
+}
+
+// 带存在条件的输出行
+type VariantLine struct {
+	Cond *presence.Cond `json:"cond"` // 存在条件
+	File string         `json:"file"` // 所在文件
+	Line int            `json:"line"` // 所在行
+	Text string         `json:"text"` // 展开后的文本
+}
+
+// 带存在条件的错误
+type VariantError struct {
+	Cond    *presence.Cond `json:"cond"`
+	File    string         `json:"file"`
+	Pos     token.Position `json:"-"`
+	Line    int            `json:"line"`
+	Msg     string         `json:"msg"`
+	Warning bool           `json:"warning,omitempty"`
+}
+
+// 按名称或前缀（以 * 结尾）匹配配置宏
+func MatchSymbols(patterns []string) func(name string) bool {
+	return func(name string) bool {
+		for _, p := range patterns {
+			if strings.HasSuffix(p, "*") && strings.HasPrefix(name, p[:len(p)-1]) || p == name {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// 可变性感知的预处理
+// symbolic 选中的配置宏不取具体值，依赖它们的条件的每个可能的分支都会执行，
+// 输出的每一行带有存在条件；条件分支中定义的宏按条件记录多个定义，展开时分别计算。
+// 错误记录在结果中，不调用 ErrorHandler
+func (it *Interpreter) EvalVariants(node ast.Node, name string, pos token.FilePos, symbolic func(name string) bool) *Variants {
+	v := &variability{
+		it:       it,
+		symbolic: symbolic,
+		table:    map[string][]macroEntry{},
+		undef:    map[string]bool{},
+		once:     map[string]*presence.Cond{},
+		macros:   map[string]bool{},
+		pc:       presence.True,
+		result:   &Variants{},
+	}
+	handler, warning := it.ErrorHandler, it.WarningHandler
+	defer func() { it.ErrorHandler, it.WarningHandler = handler, warning }()
+	it.ErrorHandler = func(pos token.Position, msg string) {
+		v.addError(pos, msg, false)
+	}
+	it.WarningHandler = func(pos token.Position, msg string) {
+		v.addError(pos, msg, true)
+	}
+	it.Val = map[string]MacroValue{}
+	it.out = &tokenWriter{}
+	it.depth = 0
+	it.setFile(name, pos)
+	for _, stmt := range it.Predefined {
+		it.Define(stmt)
+	}
+	if it.Includer != nil {
+		for _, path := range it.Preinclude {
+			v.include(token.NoPos, path, ast.IncludeOuter, presence.True)
+		}
+	}
+	v.stmt(node, presence.True)
+	for name := range v.macros {
+		v.result.Macros = append(v.result.Macros, name)
+	}
+	sort.Strings(v.result.Macros)
+	return v.result
+}
+
+// 条件定义的宏
+type macroEntry struct {
+	cond  *presence.Cond
+	value MacroValue // 未定义时为空
+	free  bool       // 未指定值的配置宏
+}
+
+type variability struct {
+	it       *Interpreter
+	symbolic func(name string) bool
+	table    map[string][]macroEntry   // 有多个条件定义的宏
+	undef    map[string]bool           // 已取消定义的配置宏
+	choice   map[string]*macroEntry    // 展开时选择的定义
+	once     map[string]*presence.Cond // #pragma once 的文件及包含时的条件
+	macros   map[string]bool           // 影响条件的配置宏
+	pc       *presence.Cond            // 当前的存在条件
+	result   *Variants
+}
+
+func (v *variability) stmt(node ast.Node, pc *presence.Cond) {
+	v.pc = pc
+	it := v.it
+	switch n := node.(type) {
+	case *ast.BlockStmt:
+		for _, sub := range *n {
+			v.stmt(sub, pc)
+		}
+	case *ast.MacroLitArray:
+		v.text(*n, pc)
+	case *ast.Ident:
+		v.text(ast.MacroLitArray{n}, pc)
+	case *ast.ValDefineStmt:
+		v.define(n.Name.Name, &MacroLitValue{it, n}, pc)
+	case *ast.FuncDefineStmt:
+		v.define(n.Name.Name, &MacroFuncValue{it, n}, pc)
+	case *ast.UnDefineStmt:
+		v.define(n.Name.Name, nil, pc)
+	case *ast.IncludeStmt:
+		path, typ, ok := it.IncludePath(n)
+		if ok && it.Includer != nil {
+			v.include(n.Pos(), path[1:len(path)-1], typ, pc)
+		}
+	case *ast.RawGroup:
+		group, errs := parser.ParseGroup(n, it.pos, parser.LazyGroups)
+		it.parseErrors(errs)
+		v.stmt(group, pc)
+	case *ast.MacroCmdStmt:
+		if n.Kind == token.PRAGMA && isPragmaOnce(n.Cmd) {
+			if c := v.once[it.file]; c != nil {
+				pc = presence.Or(c, pc)
+			}
+			v.once[it.file] = pc
+		}
+		if n.Kind == token.ERROR {
+			it.error(n.Pos(), n.Cmd)
+		}
+	case *ast.IfStmt, *ast.IfDefStmt, *ast.IfNoDefStmt:
+		v.cond(n.(ast.Stmt), pc)
+	}
+}
+
+// 执行条件块的每个可能的分支
+func (v *variability) cond(stmt ast.Stmt, pc *presence.Cond) {
+	rest := pc
+	for i, b := range ast.Branches(stmt).Branches {
+		var c *presence.Cond
+		v.pc = rest
+		switch {
+		case i > 0 && b.Cond == nil:
+			c = presence.True
+		case i == 0 && isIfDef(stmt):
+			c = v.defined(b.Cond, rest)
+		case i == 0 && isIfNoDef(stmt):
+			c = presence.Not(v.defined(b.Cond, rest))
+		case isEmptyExpr(b.Cond):
+			directive, pos := "#if", stmt.Pos()
+			if i > 0 {
+				directive = "#elif"
+			}
+			if b.Directive != nil {
+				pos = b.Directive.From
+			}
+			v.it.errorf(pos, "%s with no expression", directive)
+			c = presence.False
+		default:
+			c = v.expr(b.Cond, rest)
+		}
+		v.influence(c)
+		if taken := presence.And(rest, c); taken.Satisfiable() {
+			if b.Body != nil {
+				v.stmt(b.Body, taken)
+			}
+		}
+		rest = presence.And(rest, presence.Not(c))
+		if !rest.Satisfiable() {
+			break
+		}
+	}
+	v.pc = pc
+}
+
+func isIfDef(stmt ast.Stmt) bool {
+	_, ok := stmt.(*ast.IfDefStmt)
+	return ok
+}
+
+func isIfNoDef(stmt ast.Stmt) bool {
+	_, ok := stmt.(*ast.IfNoDefStmt)
+	return ok
+}
+
+// 记录条件中的配置宏
+func (v *variability) influence(c *presence.Cond) {
+	for _, atom := range c.Atoms() {
+		s := scanner.NewOffsetScanner([]byte(atom), 0)
+		for {
+			_, tok, lit := s.Scan()
+			if tok == token.EOF {
+				break
+			}
+			if tok == token.IDENT && v.symbolic(lit) {
+				v.macros[lit] = true
+			}
+		}
+	}
+}
+
+// #ifdef 的条件
+func (v *variability) defined(x ast.MacroLiter, pc *presence.Cond) *presence.Cond {
+	id := v.it.expectedIdent(x)
+	if id == nil {
+		v.it.errorf(x.Pos(), "'#ifdef' is not followed by a ident %v", x)
+		return presence.False
+	}
+	var list []*presence.Cond
+	for _, e := range v.entries(id.Name) {
+		switch {
+		case e.free:
+			list = append(list, presence.And(e.cond, presence.Defined(id.Name)))
+		case e.value != nil:
+			list = append(list, e.cond)
+		}
+	}
+	return presence.Or(list...)
+}
+
+// #if #elif 的条件，按引用的宏的每种定义分别计算
+func (v *variability) expr(x ast.MacroLiter, pc *presence.Cond) *presence.Cond {
+	var list []*presence.Cond
+	v.variants(x, pc, func(c *presence.Cond) {
+		text := NewExtractor(v.it).Extract(x, NewGlobalEnv(x.Pos())).String()
+		exp, errs := parser.ParseExpr([]byte(text), x.Pos())
+		if len(errs) > 0 || exp == nil {
+			v.it.errorf(x.Pos(), "error parse expr %s", text)
+			return
+		}
+		list = append(list, presence.And(c, v.value(exp).cond))
+	})
+	c := presence.Or(list...)
+	if pc.Implies(c) {
+		return presence.True
+	}
+	return c
+}
+
+// 部分求值的结果
+type symValue struct {
+	lit  string         // 常量值，不是常量时为空
+	cond *presence.Cond // 作为条件的值
+}
+
+func (v *variability) constant(lit string) symValue {
+	val, ok := v.it.EvalConst(lit)
+	if !ok {
+		return symValue{cond: presence.Atom(lit)}
+	}
+	s := symValue{lit: lit, cond: presence.False}
+	switch n := val.(type) {
+	case int64:
+		if n != 0 {
+			s.cond = presence.True
+		}
+	case uint64:
+		if n != 0 {
+			s.cond = presence.True
+		}
+	case uint8:
+		if n != 0 {
+			s.cond = presence.True
+		}
+	case float64:
+		if n != 0 {
+			s.cond = presence.True
+		}
+	}
+	return s
+}
+
+// 部分求值，配置宏保留为原子条件
+func (v *variability) value(x ast.MacroLiter) symValue {
+	switch n := x.(type) {
+	case *ast.LitExpr:
+		return v.constant(n.Value)
+	case *ast.Ident:
+		if v.isFree(n.Name) {
+			return symValue{cond: presence.Atom(n.Name)}
+		}
+		return v.constant("0")
+	case *ast.ParenExpr:
+		return v.value(n.X)
+	case *ast.UnaryExpr:
+		if n.Op == token.DEFINED {
+			id := v.it.expectedIdent(n.X)
+			if id == nil {
+				v.it.errorf(n.X.Pos(), "'defined' is not followed by a ident %v", n.X)
+				return v.constant("0")
+			}
+			if v.isFree(id.Name) {
+				return symValue{cond: presence.Defined(id.Name)}
+			}
+			if _, ok := v.it.Val[id.Name]; ok {
+				return v.constant("1")
+			}
+			return v.constant("0")
+		}
+		a := v.value(n.X)
+		if a.lit != "" {
+			return v.constant(n.Op.String() + "(" + a.lit + ")")
+		}
+		if n.Op == token.LNOT {
+			return symValue{cond: presence.Not(a.cond)}
+		}
+	case *ast.BinaryExpr:
+		a, b := v.value(n.X), v.value(n.Y)
+		if a.lit != "" && b.lit != "" {
+			return v.constant("(" + a.lit + ")" + n.Op.String() + "(" + b.lit + ")")
+		}
+		var c *presence.Cond
+		switch n.Op {
+		case token.LAND:
+			c = presence.And(a.cond, b.cond)
+		case token.LOR:
+			c = presence.Or(a.cond, b.cond)
+		default:
+			return symValue{cond: presence.Atom(printer.Sprint(x))}
+		}
+		switch {
+		case c.IsTrue():
+			return v.constant("1")
+		case c.IsFalse():
+			return v.constant("0")
+		}
+		return symValue{cond: c}
+	case *ast.CondExpr:
+		c := v.value(n.Cond)
+		switch {
+		case c.cond.IsTrue():
+			return v.value(n.X)
+		case c.cond.IsFalse():
+			return v.value(n.Y)
+		}
+	}
+	return symValue{cond: presence.Atom(printer.Sprint(x))}
+}
+
+// 宏的全部定义，条件互斥且覆盖全部配置
+func (v *variability) entries(name string) []macroEntry {
+	if list, ok := v.table[name]; ok {
+		return list
+	}
+	if val, ok := v.it.Val[name]; ok {
+		return []macroEntry{{cond: presence.True, value: val}}
+	}
+	return []macroEntry{{cond: presence.True, free: v.symbolic(name) && !v.undef[name]}}
+}
+
+// 是否为未指定值的配置宏
+func (v *variability) isFree(name string) bool {
+	if e, ok := v.choice[name]; ok {
+		return e.free
+	}
+	if _, ok := v.it.Val[name]; ok {
+		return false
+	}
+	return v.symbolic(name) && !v.undef[name]
+}
+
+// 在条件 pc 下定义或取消定义（value 为空）宏
+func (v *variability) define(name string, value MacroValue, pc *presence.Cond) {
+	list := []macroEntry{{cond: pc, value: value}}
+	if !pc.IsTrue() {
+		for _, e := range v.entries(name) {
+			c := presence.And(e.cond, presence.Not(pc))
+			if !c.Satisfiable() {
+				continue
+			}
+			if last := &list[len(list)-1]; e.value == nil && last.value == nil && e.free == last.free {
+				last.cond = presence.Or(last.cond, c)
+				continue
+			}
+			list = append(list, macroEntry{cond: c, value: e.value, free: e.free})
+		}
+	}
+	delete(v.it.Val, name)
+	delete(v.table, name)
+	delete(v.undef, name)
+	switch {
+	case len(list) > 1:
+		v.table[name] = list
+	case value != nil:
+		v.it.Val[name] = value
+	case v.symbolic(name):
+		v.undef[name] = true
+	}
+}
+
+// 按引用的条件定义的宏的每种组合执行 fn，c 为组合的条件（不含 pc）
+func (v *variability) variants(x ast.Node, pc *presence.Cond, fn func(c *presence.Cond)) {
+	names := v.references(x)
+	v.choice = map[string]*macroEntry{}
+	defer func() { v.choice = nil }()
+	count := 0
+	var walk func(i int, c *presence.Cond)
+	walk = func(i int, c *presence.Cond) {
+		if i == len(names) {
+			if count++; count > maxVariants {
+				if count == maxVariants+1 {
+					v.it.warningf(x.Pos(), "more than %d macro definition combinations", maxVariants)
+				}
+				return
+			}
+			v.pc = presence.And(pc, c)
+			fn(c)
+			return
+		}
+		name := names[i]
+		for j, e := range v.table[name] {
+			next := presence.And(c, e.cond)
+			if !presence.And(pc, next).Satisfiable() {
+				continue
+			}
+			v.choice[name] = &v.table[name][j]
+			if e.value != nil {
+				v.it.Val[name] = e.value
+			}
+			walk(i+1, next)
+			delete(v.it.Val, name)
+		}
+		delete(v.choice, name)
+	}
+	walk(0, presence.True)
+	v.pc = pc
+}
+
+// 引用的条件定义的宏，包括经由其他宏定义间接引用的宏
+func (v *variability) references(x ast.Node) []string {
+	var names []string
+	seen := map[string]bool{}
+	var visit func(node ast.Node)
+	use := func(name string) {
+		if seen[name] {
+			return
+		}
+		seen[name] = true
+		if _, ok := v.table[name]; ok {
+			names = append(names, name)
+		}
+		for _, e := range v.entries(name) {
+			switch val := e.value.(type) {
+			case *MacroLitValue:
+				if val.stmt.Body != nil {
+					visit(val.stmt.Body)
+				}
+			case *MacroFuncValue:
+				if val.stmt.Body != nil {
+					visit(val.stmt.Body)
+				}
+			}
+		}
+	}
+	visit = func(node ast.Node) {
+		ast.Inspect(node, func(n ast.Node) bool {
+			switch id := n.(type) {
+			case *ast.Ident:
+				use(id.Name)
+			case *ast.MacroCallExpr:
+				use(id.Name.Name)
+			}
+			return true
+		})
+	}
+	visit(x)
+	return names
+}
+
+// 输出文本，每行按引用的宏的定义组合分别展开，相同的结果合并条件
+func (v *variability) text(list ast.MacroLitArray, pc *presence.Cond) {
+	for len(list) > 0 {
+		n := 0
+		for n < len(list) {
+			n++
+			if t, ok := list[n-1].(*ast.Text); ok && t.Kind == token.NEWLINE {
+				break
+			}
+		}
+		line := list[:n]
+		list = list[n:]
+		v.line(line, pc)
+	}
+}
+
+// 输出一行
+func (v *variability) line(line ast.MacroLitArray, pc *presence.Cond) {
+	var lines []*VariantLine
+	v.variants(&line, pc, func(c *presence.Cond) {
+		c = presence.And(pc, c)
+		text := strings.TrimRight(NewExtractor(v.it).Extract(&line, NewGlobalEnv(token.NoPos)).String(), " \t\r\n")
+		if strings.TrimSpace(text) == "" {
+			return
+		}
+		for _, l := range lines {
+			if l.Text == text {
+				l.Cond = presence.Or(l.Cond, c)
+				return
+			}
+		}
+		lines = append(lines, &VariantLine{Cond: c, Text: text})
+	})
+	num := v.it.Position(line.Pos()).Line
+	for _, l := range lines {
+		if pc.Implies(l.Cond) {
+			l.Cond = pc
+		}
+		l.File, l.Line = v.it.file, num
+		v.result.Lines = append(v.result.Lines, l)
+	}
+}
+
+// 在条件 pc 下包含文件
+func (v *variability) include(pos token.Pos, path string, typ ast.IncludeType, pc *presence.Cond) {
+	it := v.it
+	name, src, err := it.Includer.Include(path, typ, it.file)
+	if err != nil {
+		it.error(pos, err.Error())
+		return
+	}
+	if it.depth >= maxIncludeDepth {
+		it.errorf(pos, "#include nested depth %d exceeds maximum of %d", it.depth, maxIncludeDepth)
+		return
+	}
+	if once := v.once[name]; once != nil {
+		if pc = presence.And(pc, presence.Not(once)); !pc.Satisfiable() {
+			return
+		}
+	}
+	node, errs := parser.ParseMode(src, it.Mode)
+	parent, parentPos := it.file, it.pos
+	var filePos token.FilePos
+	filePos.Init(src)
+	it.setFile(name, filePos)
+	it.depth++
+	it.parseErrors(errs)
+	v.stmt(node, pc)
+	it.depth--
+	it.setFile(parent, parentPos)
+	v.pc = pc
+}
+
+func (v *variability) addError(pos token.Position, msg string, warning bool) {
+	v.result.Errors = append(v.result.Errors, &VariantError{Cond: v.pc, File: v.it.file, Pos: pos, Line: pos.Line, Msg: msg, Warning: warning})
+}
+
+// 输出带存在条件的源码
+// 相邻的相同条件的行放在同一个 #if 块中，恒真的行直接输出
+func (r *Variants) WriteText(w io.Writer) error {
+	var b strings.Builder
+	var cur *presence.Cond
+	for _, l := range r.Lines {
+		if cur != nil && cur.String() != l.Cond.String() {
+			b.WriteString("#endif\n")
+			cur = nil
+		}
+		if cur == nil && !l.Cond.IsTrue() {
+			b.WriteString("#if " + l.Cond.String() + "\n")
+			cur = l.Cond
+		}
+		b.WriteString(l.Text + "\n")
+	}
+	if cur != nil {
+		b.WriteString("#endif\n")
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// 输出 JSON 格式
+func (r *Variants) WriteJSON(w io.Writer) error {
+	lines, macros, errs := r.Lines, r.Macros, r.Errors
+	if lines == nil {
+		lines = []*VariantLine{}
+	}
+	if macros == nil {
+		macros = []string{}
+	}
+	if errs == nil {
+		errs = []*VariantError{}
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.SetEscapeHTML(false)
+	return enc.Encode(struct {
+		Macros []string        `json:"macros"`
+		Lines  []*VariantLine  `json:"lines"`
+		Errors []*VariantError `json:"errors"`
+	}{macros, lines, errs})
+}
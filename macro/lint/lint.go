@@ -0,0 +1,191 @@
+// 宏检查
+// 检查器执行一次文件，按规则检查语法树及解释器状态，规则可以自定义
+package lint
+
+import (
+	"dxkite.cn/language/macro/ast"
+	"dxkite.cn/language/macro/interpreter"
+	"dxkite.cn/language/macro/parser"
+	"dxkite.cn/language/macro/printer"
+	"dxkite.cn/language/macro/scanner"
+	"dxkite.cn/language/macro/token"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sort"
+)
+
+// 检查结果
+type Diagnostic struct {
+	Pos  token.Position // 位置
+	Rule string         // 规则名
+	Msg  string         // 信息
+}
+
+func (d Diagnostic) String() string {
+	return fmt.Sprintf("%s: %s [%s]", d.Pos, d.Msg, d.Rule)
+}
+
+// 检查规则
+type Rule struct {
+	Name string      // 规则名
+	Doc  string      // 规则说明
+	Run  func(*Pass) // 检查文件，通过 Pass.Report 报告问题
+}
+
+// 检查的文件
+type Pass struct {
+	Name        string                   // 文件名
+	Src         []byte                   // 源码
+	File        *ast.BlockStmt           // 语法树
+	FilePos     token.FilePos            // 位置信息
+	Interpreter *interpreter.Interpreter // 执行后的解释器
+	Conds       []*Cond                  // 执行时计算过的 #if #elif 条件
+	rule        *Rule
+	diags       []Diagnostic
+}
+
+// 执行时计算的条件
+type Cond struct {
+	Expr      ast.MacroLiter // 条件表达式
+	Undefined []*ast.Ident   // 计算时未定义的标识符
+}
+
+// 报告问题
+func (p *Pass) Report(pos token.Pos, format string, args ...interface{}) {
+	p.diags = append(p.diags, Diagnostic{
+		Pos:  p.FilePos.CreatePosition(pos),
+		Rule: p.rule.Name,
+		Msg:  fmt.Sprintf(format, args...),
+	})
+}
+
+// 是否为头文件
+func (p *Pass) IsHeader() bool {
+	switch filepath.Ext(p.Name) {
+	case ".h", ".hh", ".hpp", ".hxx":
+		return true
+	}
+	return false
+}
+
+// 检查器
+type Linter struct {
+	Rules      []*Rule              // 启用的规则，为空时使用 DefaultRules
+	Includer   interpreter.Includer // 执行时的文件包含，为空时不包含文件
+	Predefined []ast.DefineStmt     // 预定义的宏
+}
+
+// 检查文件，返回按位置排序的问题
+func (l *Linter) Lint(name string, src []byte) ([]Diagnostic, scanner.ErrorList) {
+	node, errs := parser.Parse(src)
+	file, _ := node.(*ast.BlockStmt)
+	if file == nil {
+		file = &ast.BlockStmt{}
+	}
+	pass := &Pass{Name: name, Src: src, File: file}
+	pass.FilePos.Init(src)
+	includer := l.Includer
+	if includer == nil {
+		includer = noIncluder{}
+	}
+	it := &interpreter.Interpreter{
+		Includer:     includer,
+		Predefined:   l.Predefined,
+		ErrorHandler: func(token.Position, string) {},
+	}
+	it.CondHook = func(expr ast.MacroLiter) {
+		if it.Filename() == name {
+			pass.Conds = append(pass.Conds, &Cond{Expr: expr, Undefined: undefinedIdents(it, expr)})
+		}
+	}
+	it.Eval(file, name, pass.FilePos)
+	pass.Interpreter = it
+	rules := l.Rules
+	if rules == nil {
+		rules = DefaultRules
+	}
+	for _, rule := range rules {
+		pass.rule = rule
+		rule.Run(pass)
+	}
+	sort.SliceStable(pass.diags, func(i, j int) bool {
+		return pass.diags[i].Pos.Offset < pass.diags[j].Pos.Offset
+	})
+	return pass.diags, errs
+}
+
+// 条件中被计算且未定义的标识符
+// && || ?: 中不会计算的一边跳过，不包括 defined 和 __has_include 的参数
+func undefinedIdents(it *interpreter.Interpreter, expr ast.MacroLiter) []*ast.Ident {
+	idents := condIdents(expr)
+	var live []bool
+	if tree, errs := parser.ParseExpr([]byte(printer.Sprint(expr)), expr.Pos()); len(errs) == 0 && tree != nil {
+		evaluated(it, tree, true, &live)
+	}
+	var list []*ast.Ident
+	for i, id := range idents {
+		// 无法解析时全部视为计算
+		if len(live) == len(idents) && !live[i] {
+			continue
+		}
+		if _, ok := it.GetValue(id.Name); !ok && id.Name != "__LINE__" {
+			list = append(list, id)
+		}
+	}
+	return list
+}
+
+// 条件中按顺序出现的标识符
+func condIdents(expr ast.MacroLiter) []*ast.Ident {
+	var list []*ast.Ident
+	ast.Inspect(expr, func(node ast.Node) bool {
+		switch n := node.(type) {
+		case *ast.UnaryExpr:
+			return n.Op != token.DEFINED
+		case *ast.MacroCallExpr:
+			return n.Name.Name != "__has_include"
+		case *ast.Ident:
+			list = append(list, n)
+		}
+		return true
+	})
+	return list
+}
+
+// 按顺序记录表达式中每个标识符是否被计算
+func evaluated(it *interpreter.Interpreter, x ast.MacroLiter, live bool, list *[]bool) {
+	switch n := x.(type) {
+	case *ast.ParenExpr:
+		evaluated(it, n.X, live, list)
+	case *ast.UnaryExpr:
+		if n.Op != token.DEFINED {
+			evaluated(it, n.X, live, list)
+		}
+	case *ast.BinaryExpr:
+		evaluated(it, n.X, live, list)
+		switch n.Op {
+		case token.LAND:
+			live = live && it.EvalCond(n.X)
+		case token.LOR:
+			live = live && !it.EvalCond(n.X)
+		}
+		evaluated(it, n.Y, live, list)
+	case *ast.CondExpr:
+		evaluated(it, n.Cond, live, list)
+		cond := live && it.EvalCond(n.Cond)
+		evaluated(it, n.X, live && cond, list)
+		evaluated(it, n.Y, live && !cond, list)
+	default:
+		for range condIdents(x) {
+			*list = append(*list, live)
+		}
+	}
+}
+
+// 不包含文件
+type noIncluder struct{}
+
+func (noIncluder) Include(path string, typ ast.IncludeType, from string) (string, []byte, error) {
+	return path, nil, errors.New("include disabled")
+}
@@ -0,0 +1,84 @@
+package lint
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestLinter_Lint(t *testing.T) {
+	tests := []struct {
+		name string
+		file string
+		src  string
+		want []string
+	}{
+		{"unused", "a.c", "#define A 1\n#define B 2\n#define C 3\nint b = B;\n#ifdef C\n#endif\n",
+			[]string{"1:8: macro 'A' is not used [unused-macros]"}},
+		{"redefined", "a.c", "#define A 1\n#define A  1\n#define A 2\n#undef A\n#define A 3\n#ifdef X\n#define B 1\n#else\n#define B 2\n#endif\nA B\n",
+			[]string{"3:0: macro 'A' redefined with a different replacement list (previous definition at 2:0) [macro-redefined]"}},
+		{"parentheses", "a.c", "#define SQ(x) x*x\n#define ADD(a, b) ((a) + (b))\n#define N 1 + 2\n#define M -1\n#define S(x) do { x; } while (0)\nSQ(1) ADD(1, 2) N M S(1)\n",
+			[]string{
+				"1:14: replacement list of macro 'SQ' should be enclosed in parentheses [macro-parentheses]",
+				"1:14: macro parameter 'x' of 'SQ' should be enclosed in parentheses [macro-parentheses]",
+				"1:16: macro parameter 'x' of 'SQ' should be enclosed in parentheses [macro-parentheses]",
+				"3:10: replacement list of macro 'N' should be enclosed in parentheses [macro-parentheses]",
+			}},
+		{"multiple evaluation", "a.c", "#define MAX(a, b) ((a) > (b) ? (a) : (b))\n#define ID(a) (a)\nMAX(i++, j) MAX(f(x), 1) MAX(1, y = 1) ID(i++) MAX(i + 1, #a)\n",
+			[]string{
+				"3:4: argument 'i++' to 'MAX' has side effects and is evaluated 2 times [multiple-evaluation]",
+				"3:16: argument 'f(x)' to 'MAX' has side effects and is evaluated 2 times [multiple-evaluation]",
+				"3:32: argument 'y = 1' to 'MAX' has side effects and is evaluated 2 times [multiple-evaluation]",
+			}},
+		{"undef", "a.c", "#define A 1\n#if A && !defined(B) && C\n#elif D\n#endif\n#if 0\n#if E\n#endif\n#endif\n",
+			[]string{
+				"2:24: 'C' is not defined, evaluates to 0 [undef]",
+				"3:6: 'D' is not defined, evaluates to 0 [undef]",
+			}},
+		{"undef short circuit", "a.c", "#define ONE 1\n#if defined(FOO) && FOO > 1\n#endif\n#if ONE || BAR\n#endif\n#if 0 && (A || B)\n#endif\n#if !ONE || C\n#endif\n",
+			[]string{"8:12: 'C' is not defined, evaluates to 0 [undef]"}},
+		{"undef conditional", "a.c", "#define ONE 1\n#if ONE ? 1 : X\n#endif\n#if defined(Y) ? Y : 0\n#endif\n#if ONE ? Z : 0\n#endif\n",
+			[]string{"6:10: 'Z' is not defined, evaluates to 0 [undef]"}},
+		{"undef macro call", "a.c", "#define F(x) (x)\n#if F(0) && D\n#endif\n#if F(1) && E\n#endif\n",
+			[]string{"4:12: 'E' is not defined, evaluates to 0 [undef]"}},
+		{"reserved", "a.h", "#pragma once\n#define int long\n#define __X 1\n#define _Y 1\n#define _z 1\n",
+			[]string{
+				"2:8: macro name 'int' is a keyword [reserved-identifier]",
+				"3:8: macro name '__X' is a reserved identifier [reserved-identifier]",
+				"4:8: macro name '_Y' is a reserved identifier [reserved-identifier]",
+			}},
+		{"redefined comment", "a.c", "#define A 1 // one\n#define A 1 /* uno */\n#define A /* x */ 1\nA\n", nil},
+		{"include guard", "a.h", "// comment\n#ifndef A_H\n#define A_H\nint a;\n#endif\n", nil},
+		{"missing include guard", "a.h", "#ifndef A_H\n#define B_H\n#endif\n",
+			[]string{"1:0: header has no include guard [include-guard]"}},
+		{"code after guard", "a.h", "#ifndef A_H\n#define A_H\n#endif\nint a;\n",
+			[]string{"1:0: header has no include guard [include-guard]"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			diags, errs := (&Linter{}).Lint(tt.file, []byte(tt.src))
+			if len(errs) > 0 {
+				t.Fatal(errs)
+			}
+			var got []string
+			for _, d := range diags {
+				got = append(got, d.String())
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Lint() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// 自定义规则
+func TestLinter_customRule(t *testing.T) {
+	rule := &Rule{Name: "defined-at-end", Run: func(p *Pass) {
+		if _, ok := p.Interpreter.GetValue("A"); ok {
+			p.Report(0, "A defined after %d conditions", len(p.Conds))
+		}
+	}}
+	diags, _ := (&Linter{Rules: []*Rule{rule}}).Lint("a.c", []byte("#if 1\n#define A\n#endif\n"))
+	if len(diags) != 1 || diags[0].String() != "1:0: A defined after 1 conditions [defined-at-end]" {
+		t.Errorf("Lint() = %v", diags)
+	}
+}
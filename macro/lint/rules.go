@@ -0,0 +1,472 @@
+package lint
+
+import (
+	"dxkite.cn/language/macro/ast"
+	"dxkite.cn/language/macro/printer"
+	"dxkite.cn/language/macro/token"
+	"strings"
+)
+
+// 默认启用的规则
+var DefaultRules = []*Rule{
+	UnusedMacros,
+	Redefined,
+	Parentheses,
+	MultipleEvaluation,
+	Undef,
+	ReservedNames,
+	IncludeGuard,
+}
+
+// 未使用的宏
+var UnusedMacros = &Rule{
+	Name: "unused-macros",
+	Doc:  "macros defined in a source file but never expanded or tested (headers are skipped)",
+	Run: func(p *Pass) {
+		if p.IsHeader() {
+			return
+		}
+		names := map[*ast.Ident]bool{}
+		var defs []*ast.Ident
+		ast.Inspect(p.File, func(node ast.Node) bool {
+			switch n := node.(type) {
+			case *ast.ValDefineStmt:
+				names[n.Name] = true
+				defs = append(defs, n.Name)
+			case *ast.FuncDefineStmt:
+				names[n.Name] = true
+				defs = append(defs, n.Name)
+				for _, id := range n.IdentList {
+					names[id] = true
+				}
+			case *ast.UnDefineStmt:
+				names[n.Name] = true
+			}
+			return true
+		})
+		used := map[string]bool{}
+		ast.Inspect(p.File, func(node ast.Node) bool {
+			if id, ok := node.(*ast.Ident); ok && !names[id] {
+				used[id.Name] = true
+			}
+			return true
+		})
+		for _, id := range defs {
+			if !used[id.Name] {
+				p.Report(id.Pos(), "macro '%s' is not used", id.Name)
+			}
+		}
+	},
+}
+
+// 不同的重复定义
+var Redefined = &Rule{
+	Name: "macro-redefined",
+	Doc:  "macros redefined with a different replacement list without an #undef in between",
+	Run: func(p *Pass) {
+		type event struct {
+			stmt ast.Stmt
+			path []branchRef
+		}
+		events := map[string][]event{}
+		walkStmts(*p.File, nil, func(stmt ast.Stmt, path []branchRef) {
+			name := ""
+			switch n := stmt.(type) {
+			case *ast.ValDefineStmt:
+				name = n.Name.Name
+			case *ast.FuncDefineStmt:
+				name = n.Name.Name
+			case *ast.UnDefineStmt:
+				name = n.Name.Name
+			default:
+				return
+			}
+			list := events[name]
+			events[name] = append(list, event{stmt, path})
+			if _, ok := stmt.(*ast.UnDefineStmt); ok {
+				return
+			}
+			// 最近的不互斥的定义或取消定义
+			for i := len(list) - 1; i >= 0; i-- {
+				if exclusive(list[i].path, path) {
+					continue
+				}
+				if _, ok := list[i].stmt.(*ast.UnDefineStmt); !ok && replacement(list[i].stmt) != replacement(stmt) {
+					pos := p.FilePos.CreatePosition(list[i].stmt.Pos())
+					p.Report(stmt.Pos(), "macro '%s' redefined with a different replacement list (previous definition at %s)", name, pos)
+				}
+				break
+			}
+		})
+	},
+}
+
+// 缺少括号
+var Parentheses = &Rule{
+	Name: "macro-parentheses",
+	Doc:  "macro parameters and expression replacement lists that are not enclosed in parentheses",
+	Run: func(p *Pass) {
+		ast.Inspect(p.File, func(node ast.Node) bool {
+			switch n := node.(type) {
+			case *ast.ValDefineStmt:
+				checkBody(p, n.Name, n.Body)
+			case *ast.FuncDefineStmt:
+				checkBody(p, n.Name, n.Body)
+				checkParams(p, n)
+			}
+			return true
+		})
+	},
+}
+
+// 参数的副作用被多次计算
+var MultipleEvaluation = &Rule{
+	Name: "multiple-evaluation",
+	Doc:  "arguments with side effects passed to parameters that are expanded more than once",
+	Run: func(p *Pass) {
+		funcs := map[string]*ast.FuncDefineStmt{}
+		ast.Inspect(p.File, func(node ast.Node) bool {
+			if n, ok := node.(*ast.FuncDefineStmt); ok {
+				funcs[n.Name.Name] = n
+			}
+			return true
+		})
+		ast.Inspect(p.File, func(node ast.Node) bool {
+			switch n := node.(type) {
+			case *ast.ValDefineStmt, *ast.FuncDefineStmt:
+				return false
+			case *ast.MacroCallExpr:
+				def := funcs[n.Name.Name]
+				if def == nil || n.ParamList == nil {
+					return true
+				}
+				counts := paramUses(def)
+				for i, arg := range *n.ParamList {
+					if i >= len(def.IdentList) || counts[def.IdentList[i].Name] < 2 {
+						continue
+					}
+					if hasSideEffects(arg, funcs) {
+						p.Report(firstPos(arg), "argument '%s' to '%s' has side effects and is evaluated %d times",
+							strings.TrimSpace(printer.Sprint(arg)), n.Name.Name, counts[def.IdentList[i].Name])
+					}
+				}
+			}
+			return true
+		})
+	},
+}
+
+// #if 中使用未定义的标识符 (-Wundef)
+var Undef = &Rule{
+	Name: "undef",
+	Doc:  "undefined identifiers evaluated in #if and #elif conditions",
+	Run: func(p *Pass) {
+		for _, cond := range p.Conds {
+			for _, id := range cond.Undefined {
+				p.Report(id.Pos(), "'%s' is not defined, evaluates to 0", id.Name)
+			}
+		}
+	},
+}
+
+// 关键字或保留标识符作为宏名
+var ReservedNames = &Rule{
+	Name: "reserved-identifier",
+	Doc:  "macro names that are C keywords or reserved identifiers (__x, _X)",
+	Run: func(p *Pass) {
+		ast.Inspect(p.File, func(node ast.Node) bool {
+			var id *ast.Ident
+			switch n := node.(type) {
+			case *ast.ValDefineStmt:
+				id = n.Name
+			case *ast.FuncDefineStmt:
+				id = n.Name
+			default:
+				return true
+			}
+			switch {
+			case keywords[id.Name]:
+				p.Report(id.Pos(), "macro name '%s' is a keyword", id.Name)
+			case reserved(id.Name):
+				p.Report(id.Pos(), "macro name '%s' is a reserved identifier", id.Name)
+			}
+			return true
+		})
+	},
+}
+
+// 头文件缺少包含保护
+var IncludeGuard = &Rule{
+	Name: "include-guard",
+	Doc:  "headers not wrapped in #ifndef/#define/#endif and without #pragma once",
+	Run: func(p *Pass) {
+		if !p.IsHeader() || ast.IncludeGuard(p.File) != nil || pragmaOnce(*p.File) {
+			return
+		}
+		p.Report(0, "header has no include guard")
+	},
+}
+
+// 条件分支
+type branchRef struct {
+	block ast.Stmt // 条件语句
+	index int      // 分支下标
+}
+
+// 按源码顺序遍历语句，path 为所在的条件分支
+func walkStmts(list ast.BlockStmt, path []branchRef, fn func(ast.Stmt, []branchRef)) {
+	for _, stmt := range list {
+		fn(stmt, path)
+		block := ast.Branches(stmt)
+		if block == nil {
+			continue
+		}
+		for i, b := range block.Branches {
+			if body, ok := b.Body.(*ast.BlockStmt); ok && body != nil {
+				sub := append(append([]branchRef{}, path...), branchRef{stmt, i})
+				walkStmts(*body, sub, fn)
+			}
+		}
+	}
+}
+
+// 是否位于同一条件语句的不同分支
+func exclusive(a, b []branchRef) bool {
+	for i := 0; i < len(a) && i < len(b); i++ {
+		if a[i].block != b[i].block {
+			return false
+		}
+		if a[i].index != b[i].index {
+			return true
+		}
+	}
+	return false
+}
+
+// 参数与替换列表，忽略空白
+func replacement(stmt ast.Stmt) string {
+	switch n := stmt.(type) {
+	case *ast.ValDefineStmt:
+		return tokenString(n.Body)
+	case *ast.FuncDefineStmt:
+		var params []string
+		for _, id := range n.IdentList {
+			params = append(params, id.Name)
+		}
+		return "(" + strings.Join(params, ",") + ") " + tokenString(n.Body)
+	}
+	return ""
+}
+
+// 替换列表的 token 序列，注释视为空白，连续空白合并为一个空格
+func tokenString(body *ast.MacroLitArray) string {
+	var b strings.Builder
+	space := false
+	if body != nil {
+		for _, item := range *body {
+			if t, ok := item.(*ast.Text); ok && isSpace(t) {
+				space = b.Len() > 0
+				continue
+			}
+			if space {
+				b.WriteByte(' ')
+				space = false
+			}
+			b.WriteString(strings.TrimSpace(printer.Sprint(item)))
+		}
+	}
+	return b.String()
+}
+
+// 二元运算符
+var binaryOps = map[token.Token]bool{
+	token.ADD: true, token.SUB: true, token.MUL: true, token.QUO: true, token.REM: true,
+	token.AND: true, token.OR: true, token.XOR: true, token.SHL: true, token.SHR: true,
+	token.LAND: true, token.LOR: true, token.EQL: true, token.NEQ: true,
+	token.LSS: true, token.GTR: true, token.LEQ: true, token.GEQ: true,
+}
+
+// 替换列表中的 token，跳过空白和注释
+func bodyTokens(body *ast.MacroLitArray) []ast.MacroLiter {
+	var list []ast.MacroLiter
+	if body == nil {
+		return nil
+	}
+	for _, item := range *body {
+		if t, ok := item.(*ast.Text); ok && isSpace(t) {
+			continue
+		}
+		list = append(list, item)
+	}
+	return list
+}
+
+func isSpace(t *ast.Text) bool {
+	switch t.Kind {
+	case token.NEWLINE, token.BACKSLASH_NEWLINE, token.BLOCK_COMMENT, token.COMMENT:
+		return true
+	case token.TEXT:
+		return strings.TrimSpace(t.Text) == ""
+	}
+	return false
+}
+
+func kindOf(x ast.MacroLiter) token.Token {
+	switch n := x.(type) {
+	case *ast.Text:
+		if n.Kind == token.TEXT {
+			// 语句或其他符号
+			return token.ILLEGAL
+		}
+		return n.Kind
+	case *ast.Ident:
+		return token.IDENT
+	case *ast.LitExpr:
+		return n.Kind
+	}
+	return token.IDENT
+}
+
+// 替换列表为包含二元运算的表达式时，应该整体加上括号
+func checkBody(p *Pass, name *ast.Ident, body *ast.MacroLitArray) {
+	list := bodyTokens(body)
+	depth, binary := 0, false
+	for i, item := range list {
+		if id, ok := item.(*ast.Ident); ok && keywords[id.Name] {
+			return
+		}
+		switch k := kindOf(item); {
+		case k == token.ILLEGAL || k == token.EQU:
+			// 语句或赋值
+			return
+		case k == token.LPAREN:
+			depth++
+		case k == token.RPAREN:
+			depth--
+		case depth == 0 && i > 0 && binaryOps[k] && isOperand(list[i-1]):
+			binary = true
+		}
+	}
+	if binary {
+		p.Report(body.Pos(), "replacement list of macro '%s' should be enclosed in parentheses", name.Name)
+	}
+}
+
+// 运算数
+func isOperand(x ast.MacroLiter) bool {
+	switch kindOf(x) {
+	case token.IDENT, token.INT, token.FLOAT, token.CHAR, token.STRING, token.RPAREN:
+		return true
+	}
+	return false
+}
+
+// 与二元运算符相邻的参数应该加上括号
+func checkParams(p *Pass, def *ast.FuncDefineStmt) {
+	params := map[string]bool{}
+	for _, id := range def.IdentList {
+		params[id.Name] = true
+	}
+	list := bodyTokens(def.Body)
+	for i, item := range list {
+		id, ok := item.(*ast.Ident)
+		if !ok || !params[id.Name] {
+			continue
+		}
+		prev := i > 0 && binaryOps[kindOf(list[i-1])]
+		next := i+1 < len(list) && binaryOps[kindOf(list[i+1])]
+		if prev || next {
+			p.Report(id.Pos(), "macro parameter '%s' of '%s' should be enclosed in parentheses", id.Name, def.Name.Name)
+		}
+	}
+}
+
+// 参数在替换列表中被计算的次数，# 和 ## 的运算数不计算
+func paramUses(def *ast.FuncDefineStmt) map[string]int {
+	params := map[string]bool{}
+	for _, id := range def.IdentList {
+		params[id.Name] = true
+	}
+	counts := map[string]int{}
+	ast.Inspect(def.Body, func(node ast.Node) bool {
+		switch n := node.(type) {
+		case *ast.UnaryExpr:
+			return n.Op != token.SHARP
+		case *ast.BinaryExpr:
+			return n.Op != token.DOUBLE_SHARP
+		case *ast.Ident:
+			if params[n.Name] {
+				counts[n.Name]++
+			}
+		}
+		return true
+	})
+	return counts
+}
+
+// 跳过开头空白的位置
+func firstPos(x ast.MacroLiter) token.Pos {
+	if arr, ok := x.(*ast.MacroLitArray); ok {
+		if list := bodyTokens(arr); len(list) > 0 {
+			return list[0].Pos()
+		}
+	}
+	return x.Pos()
+}
+
+// 参数是否有副作用：自增、自减、赋值或函数调用
+func hasSideEffects(arg ast.MacroLiter, funcs map[string]*ast.FuncDefineStmt) bool {
+	effect := false
+	var last *ast.Text
+	ast.Inspect(arg, func(node ast.Node) bool {
+		switch n := node.(type) {
+		case *ast.MacroCallExpr:
+			if funcs[n.Name.Name] == nil {
+				effect = true
+			}
+		case *ast.Text:
+			switch {
+			case n.Kind == token.EQU:
+				effect = true
+			case (n.Kind == token.ADD || n.Kind == token.SUB) && last != nil && last.Kind == n.Kind && last.Offset+1 == n.Offset:
+				effect = true
+			}
+			last = n
+		}
+		return !effect
+	})
+	return effect
+}
+
+// 头文件开头是否为 #pragma once，只有空白和注释的文件也视为有保护
+func pragmaOnce(file ast.BlockStmt) bool {
+	for _, stmt := range file {
+		if ast.IsBlank(stmt) {
+			continue
+		}
+		cmd, ok := stmt.(*ast.MacroCmdStmt)
+		if !ok || cmd.Kind != token.PRAGMA {
+			return false
+		}
+		fields := strings.Fields(strings.TrimPrefix(strings.TrimSpace(cmd.Cmd), "#"))
+		return len(fields) >= 2 && fields[1] == "once"
+	}
+	return true
+}
+
+// 保留标识符：双下划线或下划线加大写字母开头
+func reserved(name string) bool {
+	return strings.HasPrefix(name, "__") ||
+		len(name) > 1 && name[0] == '_' && name[1] >= 'A' && name[1] <= 'Z'
+}
+
+// C 关键字
+var keywords = map[string]bool{}
+
+func init() {
+	for _, k := range strings.Fields(`auto break case char const continue default do double else enum extern
+		float for goto if inline int long register restrict return short signed sizeof static struct
+		switch typedef union unsigned void volatile while`) {
+		keywords[k] = true
+	}
+}
@@ -0,0 +1,470 @@
+package lsp
+
+import (
+	"dxkite.cn/language/macro/ast"
+	"dxkite.cn/language/macro/interpreter"
+	"dxkite.cn/language/macro/parser"
+	"dxkite.cn/language/macro/scanner"
+	"dxkite.cn/language/macro/token"
+	"net/url"
+	"path/filepath"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+// 解析后的文件
+type file struct {
+	uri   string
+	src   []byte
+	lines []int // 每行开始的偏移
+	root  *ast.BlockStmt
+	errs  scanner.ErrorList
+}
+
+func parseFile(uri string, src []byte) *file {
+	f := &file{uri: uri, src: src, lines: []int{0}}
+	for i, b := range src {
+		if b == '\n' {
+			f.lines = append(f.lines, i+1)
+		}
+	}
+	node, errs := parser.Parse(src)
+	f.errs = errs
+	if f.root, _ = node.(*ast.BlockStmt); f.root == nil {
+		f.root = &ast.BlockStmt{}
+	}
+	return f
+}
+
+// 偏移转换成文档位置
+func (f *file) position(offset int) Position {
+	if offset > len(f.src) {
+		offset = len(f.src)
+	}
+	if offset < 0 {
+		offset = 0
+	}
+	line := sort.Search(len(f.lines), func(i int) bool { return f.lines[i] > offset }) - 1
+	col := 0
+	for _, r := range string(f.src[f.lines[line]:offset]) {
+		col++
+		if r >= 0x10000 {
+			col++
+		}
+	}
+	return Position{Line: line, Character: col}
+}
+
+// 文档位置转换成偏移，超出范围时取行尾或文件尾
+func (f *file) offset(pos Position) int {
+	if pos.Line < 0 {
+		return 0
+	}
+	if pos.Line >= len(f.lines) {
+		return len(f.src)
+	}
+	i := f.lines[pos.Line]
+	for col := 0; col < pos.Character && i < len(f.src) && f.src[i] != '\n'; {
+		r, n := utf8.DecodeRune(f.src[i:])
+		i += n
+		col++
+		if r >= 0x10000 {
+			col++
+		}
+	}
+	return i
+}
+
+func (f *file) rangeOf(from, to token.Pos) Range {
+	return Range{Start: f.position(int(from)), End: f.position(int(to))}
+}
+
+// 行的结束位置（不含换行）
+func (f *file) lineEnd(line int) Position {
+	end := len(f.src)
+	if line+1 < len(f.lines) {
+		end = f.lines[line+1] - 1
+	}
+	return f.position(end)
+}
+
+// 标识符结束的偏移，不是标识符时为下一个字符
+func (f *file) wordEnd(offset int) int {
+	i := offset
+	for i < len(f.src) && isIdentByte(f.src[i]) {
+		i++
+	}
+	if i == offset && i < len(f.src) && f.src[i] != '\n' {
+		_, n := utf8.DecodeRune(f.src[i:])
+		i += n
+	}
+	return i
+}
+
+func isIdentByte(b byte) bool {
+	return b == '_' || 'a' <= b && b <= 'z' || 'A' <= b && b <= 'Z' || '0' <= b && b <= '9'
+}
+
+// 文件中的宏定义，包括未执行的分支中的定义
+func (f *file) defines() []ast.DefineStmt {
+	var list []ast.DefineStmt
+	ast.Inspect(f.root, func(node ast.Node) bool {
+		if stmt, ok := node.(ast.DefineStmt); ok {
+			list = append(list, stmt)
+			return false
+		}
+		return true
+	})
+	return list
+}
+
+// 宏定义的源码，去掉结尾的换行
+func (f *file) text(stmt ast.DefineStmt) string {
+	return strings.TrimRight(string(f.src[stmt.Pos():stmt.End()]), "\r\n")
+}
+
+// 光标处的标识符
+type symbol struct {
+	id     *ast.Ident
+	call   *ast.MacroCallExpr  // 以该标识符为名称的宏调用
+	define *ast.FuncDefineStmt // 所在的函数宏定义
+	param  bool                // 是否为所在宏的参数
+}
+
+// 查找光标处的标识符，光标在标识符末尾时也算在内
+func (f *file) symbolAt(offset int) *symbol {
+	var found *symbol
+	var define *ast.FuncDefineStmt
+	var call *ast.MacroCallExpr
+	ast.Inspect(f.root, func(node ast.Node) bool {
+		if node == nil || found != nil {
+			return false
+		}
+		if int(node.End()) < offset && !isBlock(node) || int(node.Pos()) > offset {
+			return false
+		}
+		switch n := node.(type) {
+		case *ast.FuncDefineStmt:
+			define = n
+		case *ast.MacroCallExpr:
+			call = n
+		case *ast.Ident:
+			found = &symbol{id: n, define: define}
+			if call != nil && call.Name == n {
+				found.call = call
+			}
+			found.param = define != nil && isParam(define, n.Name)
+		}
+		return true
+	})
+	return found
+}
+
+// 语句块的范围不可靠，总是进入
+func isBlock(node ast.Node) bool {
+	switch node.(type) {
+	case *ast.BlockStmt, *ast.MacroLitArray:
+		return true
+	}
+	return false
+}
+
+func isParam(stmt *ast.FuncDefineStmt, name string) bool {
+	for _, id := range stmt.IdentList {
+		if id.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// 名称为 name 的宏引用，不包括函数宏定义中同名的参数
+// declaration 为 false 时不包括宏定义的名称
+func (f *file) references(name string, declaration bool) []*ast.Ident {
+	var list []*ast.Ident
+	ast.Inspect(f.root, func(node ast.Node) bool {
+		switch n := node.(type) {
+		case *ast.FuncDefineStmt:
+			if n.Name.Name == name && declaration {
+				list = append(list, n.Name)
+			}
+			if isParam(n, name) {
+				return false
+			}
+			ast.Inspect(n.Body, func(node ast.Node) bool {
+				if id, ok := node.(*ast.Ident); ok && id.Name == name {
+					list = append(list, id)
+				}
+				return true
+			})
+			return false
+		case *ast.ValDefineStmt:
+			if n.Name.Name == name && declaration {
+				list = append(list, n.Name)
+			}
+			ast.Inspect(n.Body, func(node ast.Node) bool {
+				if id, ok := node.(*ast.Ident); ok && id.Name == name {
+					list = append(list, id)
+				}
+				return true
+			})
+			return false
+		case *ast.Ident:
+			if n.Name == name {
+				list = append(list, n)
+			}
+		}
+		return true
+	})
+	return list
+}
+
+// 打开的文档
+type document struct {
+	*file
+	name     string // 文件路径，不是本地文件时为 uri
+	version  int
+	it       *interpreter.Interpreter // 执行后的解释器
+	headers  []*file                  // 包含的文件
+	diags    []Diagnostic
+	inactive []Range
+}
+
+// 按服务器配置创建解释器
+func (s *Server) interpreter() *interpreter.Interpreter {
+	return &interpreter.Interpreter{
+		Includer:     &includer{FileIncluder: interpreter.FileIncluder{Dirs: s.Dirs, SystemDirs: s.SystemDirs}, s: s},
+		Predefined:   s.Predefined,
+		ErrorHandler: func(token.Position, string) {},
+	}
+}
+
+// 执行到 offset 时的宏定义
+func (s *Server) valuesAt(d *document, offset int) map[string]interpreter.MacroValue {
+	return s.interpreter().ValuesAt(d.root, d.name, d.filePos(), token.Pos(offset))
+}
+
+// 解析并执行文档
+func (s *Server) analyze(uri string, version int, src []byte) *document {
+	d := &document{file: parseFile(uri, src), name: uriToPath(uri), version: version}
+	for _, err := range d.errs {
+		d.addDiag(err.Pos, err.Msg, err.Warning)
+	}
+	d.it = s.interpreter()
+	d.it.Deps = &interpreter.Deps{}
+	d.it.ErrorHandler = func(pos token.Position, msg string) {
+		if d.it.Filename() == d.name {
+			d.addDiag(pos, msg, false)
+		}
+	}
+	d.it.WarningHandler = func(pos token.Position, msg string) {
+		if d.it.Filename() == d.name {
+			d.addDiag(pos, msg, true)
+		}
+	}
+	// 语句对象只属于本文档的语法树，包含的文件中的条件不会混入
+	taken := map[ast.Stmt]bool{}
+	d.it.BranchHook = func(stmt ast.CondStmt, v bool) {
+		taken[stmt] = v
+	}
+	d.it.Eval(d.root, d.name, d.filePos())
+	d.it.ErrorHandler, d.it.WarningHandler = func(token.Position, string) {}, nil
+	d.inactiveRegions(*d.root, taken)
+	for _, name := range d.it.Deps.Names(true) {
+		if h := s.header(name); h != nil {
+			d.headers = append(d.headers, h)
+		}
+	}
+	return d
+}
+
+func (d *document) addDiag(pos token.Position, msg string, warning bool) {
+	severity := SeverityError
+	if warning {
+		severity = SeverityWarning
+	}
+	offset := 0
+	if pos.IsValid() {
+		offset = pos.Offset
+	}
+	d.diags = append(d.diags, Diagnostic{
+		Range:    Range{Start: d.position(offset), End: d.position(d.wordEnd(offset))},
+		Severity: severity,
+		Source:   "macro",
+		Message:  msg,
+	})
+}
+
+// 记录未执行的分支，按行计算
+func (d *document) inactiveRegions(list ast.BlockStmt, taken map[ast.Stmt]bool) {
+	for _, stmt := range list {
+		block := ast.Branches(stmt)
+		if block == nil {
+			continue
+		}
+		if _, ok := taken[stmt]; !ok {
+			continue
+		}
+		active := -1
+		for i, b := range block.Branches {
+			if b.Stmt == nil {
+				active = i
+				break
+			}
+			v, ok := taken[b.Stmt]
+			if !ok {
+				break
+			}
+			if v {
+				active = i
+				break
+			}
+		}
+		for i, b := range block.Branches {
+			if i == active {
+				d.inactiveRegions(stmtList(b.Body), taken)
+				continue
+			}
+			if b.Directive == nil || b.BodyFrom >= b.BodyTo {
+				continue
+			}
+			from, to := d.position(int(b.BodyFrom)), d.position(int(b.BodyTo))
+			if to.Character == 0 || strings.TrimSpace(string(d.src[d.lines[to.Line]:b.BodyTo])) == "" {
+				to = d.lineEnd(to.Line - 1)
+			}
+			if from.Line <= to.Line {
+				d.inactive = append(d.inactive, Range{Start: from, End: to})
+			}
+		}
+	}
+}
+
+func stmtList(stmt ast.Stmt) ast.BlockStmt {
+	switch n := stmt.(type) {
+	case nil:
+		return nil
+	case *ast.BlockStmt:
+		return *n
+	}
+	return ast.BlockStmt{stmt}
+}
+
+// 宏定义及其所在的文件
+type definition struct {
+	*file
+	stmt ast.DefineStmt
+}
+
+func (def *definition) location() Location {
+	id := defineName(def.stmt)
+	return Location{URI: def.uri, Range: def.rangeOf(id.Pos(), id.End())}
+}
+
+func defineName(stmt ast.DefineStmt) *ast.Ident {
+	switch n := stmt.(type) {
+	case *ast.ValDefineStmt:
+		return n.Name
+	case *ast.FuncDefineStmt:
+		return n.Name
+	}
+	return nil
+}
+
+// 文档及包含的文件中名称为 name 的全部定义
+func (d *document) definitions(name string) []*definition {
+	var list []*definition
+	for _, f := range append([]*file{d.file}, d.headers...) {
+		for _, stmt := range f.defines() {
+			if defineName(stmt).Name == name {
+				list = append(list, &definition{f, stmt})
+			}
+		}
+	}
+	return list
+}
+
+// offset 处生效的定义
+// 优先取文档中之前最近的定义，其次为包含的文件中的定义，最后为文档中之后的定义
+func (d *document) definitionAt(name string, offset int) *definition {
+	var before, header, after *definition
+	for _, def := range d.definitions(name) {
+		switch {
+		case def.file != d.file:
+			header = def
+		case int(def.stmt.Pos()) <= offset:
+			before = def
+		case after == nil:
+			after = def
+		}
+	}
+	switch {
+	case before != nil:
+		return before
+	case header != nil:
+		return header
+	}
+	return after
+}
+
+// 文档的位置信息
+func (d *document) filePos() token.FilePos {
+	var pos token.FilePos
+	pos.Init(d.src)
+	return pos
+}
+
+// 按 val 中的定义展开宏，def 不为空时使用 def 的定义
+func (d *document) expand(x ast.MacroLiter, def ast.DefineStmt, val map[string]interpreter.MacroValue) string {
+	it := &interpreter.Interpreter{
+		Val:          map[string]interpreter.MacroValue{},
+		ErrorHandler: func(token.Position, string) {},
+	}
+	for name, v := range val {
+		it.Val[name] = v
+	}
+	if def != nil {
+		it.Define(def)
+	}
+	env := interpreter.NewGlobalEnv(x.Pos())
+	return strings.TrimSpace(interpreter.NewExtractor(it).Extract(x, env).String())
+}
+
+// 包含文件时优先使用打开的文档
+type includer struct {
+	interpreter.FileIncluder
+	s *Server
+}
+
+func (i *includer) Include(path string, typ ast.IncludeType, from string) (string, []byte, error) {
+	name, _, src, err := i.IncludeDir(path, typ, from)
+	return name, src, err
+}
+
+func (i *includer) IncludeDir(path string, typ ast.IncludeType, from string) (string, string, []byte, error) {
+	name, dir, src, err := i.FileIncluder.IncludeDir(path, typ, from)
+	if err != nil {
+		return name, dir, src, err
+	}
+	if d := i.s.docs[pathToURI(name)]; d != nil {
+		src = d.src
+	}
+	return name, dir, src, nil
+}
+
+// 文件路径转换成 uri，相对路径按当前目录计算
+func pathToURI(name string) string {
+	if abs, err := filepath.Abs(name); err == nil {
+		name = abs
+	}
+	return (&url.URL{Scheme: "file", Path: filepath.ToSlash(name)}).String()
+}
+
+// uri 转换成文件路径，不是本地文件时返回 uri
+func uriToPath(uri string) string {
+	u, err := url.Parse(uri)
+	if err != nil || u.Scheme != "file" {
+		return uri
+	}
+	return filepath.FromSlash(u.Path)
+}
@@ -0,0 +1,191 @@
+package lsp
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// 按顺序发送消息，返回服务器输出的全部消息
+func serve(t *testing.T, s *Server, msgs ...string) ([]string, error) {
+	var in, out bytes.Buffer
+	for _, msg := range msgs {
+		in.WriteString("Content-Length: " + strconv.Itoa(len(msg)) + "\r\n\r\n" + msg)
+	}
+	err := s.Serve(&in, &out)
+	var list []string
+	r := bufio.NewReader(&out)
+	for {
+		body, err := readMessage(r)
+		if err != nil {
+			break
+		}
+		var b bytes.Buffer
+		if err := json.Compact(&b, body); err != nil {
+			t.Fatalf("invalid message %s", body)
+		}
+		list = append(list, b.String())
+	}
+	return list, err
+}
+
+func TestServer(t *testing.T) {
+	main := pathToURI("testdata/main.c")
+	dir := strings.TrimSuffix(main, "main.c")
+	doc := `"textDocument":{"uri":"` + main + `"}`
+	src := `#include \"config.h\"\n#define SQ(x) ((x)*(x))\nint a = SQ(WIDTH);\n#if WIDTH > 10\nint big;\n#else\nint small;\n#endif\n#ifdef MISSING\nint m;\n#endif\n#error oops\n#define ONE 1\n#define ONE 2\n`
+	open := `{"jsonrpc":"2.0","method":"textDocument/didOpen","params":{"textDocument":{"uri":"` + main + `","languageId":"c","version":1,"text":"` + src + `"}}}`
+	at := func(line, char int) string {
+		return doc + `,"position":{"line":` + strconv.Itoa(line) + `,"character":` + strconv.Itoa(char) + `}`
+	}
+	tests := []struct {
+		name   string
+		method string
+		params string
+		want   string
+	}{
+		{"hover call", "textDocument/hover", at(2, 9),
+			`{"contents":{"kind":"markdown","value":"` + "```c\\n#define SQ(x) ((x)*(x))\\n```\\nExpands to:\\n```c\\n((4)*(4))\\n```\\n" + `"},"range":{"start":{"line":2,"character":8},"end":{"line":2,"character":10}}}`},
+		{"hover header macro", "textDocument/hover", at(2, 16),
+			`{"contents":{"kind":"markdown","value":"` + "```c\\n#define WIDTH 4\\n```\\nExpands to:\\n```c\\n4\\n```\\n" + `"},"range":{"start":{"line":2,"character":11},"end":{"line":2,"character":16}}}`},
+		{"hover parameter", "textDocument/hover", at(1, 21),
+			`{"contents":{"kind":"markdown","value":"` + "```c\\nx\\n```\\nparameter of `SQ`" + `"},"range":{"start":{"line":1,"character":20},"end":{"line":1,"character":21}}}`},
+		{"hover text", "textDocument/hover", at(2, 1), `null`},
+		{"definition", "textDocument/definition", at(3, 5),
+			`[{"uri":"$DIR/config.h","range":{"start":{"line":0,"character":8},"end":{"line":0,"character":13}}}]`},
+		{"definition parameter", "textDocument/definition", at(1, 21),
+			`[{"uri":"$DIR/main.c","range":{"start":{"line":1,"character":11},"end":{"line":1,"character":12}}}]`},
+		{"references", "textDocument/references", at(3, 5) + `,"context":{"includeDeclaration":true}`,
+			`[{"uri":"$DIR/main.c","range":{"start":{"line":2,"character":11},"end":{"line":2,"character":16}}},` +
+				`{"uri":"$DIR/main.c","range":{"start":{"line":3,"character":4},"end":{"line":3,"character":9}}},` +
+				`{"uri":"$DIR/config.h","range":{"start":{"line":0,"character":8},"end":{"line":0,"character":13}}}]`},
+		{"references without declaration", "textDocument/references", at(1, 9) + `,"context":{"includeDeclaration":false}`,
+			`[{"uri":"$DIR/main.c","range":{"start":{"line":2,"character":8},"end":{"line":2,"character":10}}}]`},
+		{"completion", "textDocument/completion", at(1, 20),
+			`{"isIncomplete":false,"items":[{"label":"x","kind":6,"detail":"parameter of SQ"},` +
+				`{"label":"ONE","kind":21,"detail":"#define ONE 1"},{"label":"SQ","kind":3,"detail":"#define SQ(x) ((x)*(x))"},{"label":"WIDTH","kind":21,"detail":"#define WIDTH 4"},{"label":"__FILE__","kind":21}]}`},
+		{"unknown method", "textDocument/rename", at(0, 0), `{"code":-32601,"message":"method not found: textDocument/rename"}`},
+	}
+	msgs := []string{open}
+	for i, tt := range tests {
+		msgs = append(msgs, `{"jsonrpc":"2.0","id":`+strconv.Itoa(i)+`,"method":"`+tt.method+`","params":{`+tt.params+`}}`)
+	}
+	out, err := serve(t, &Server{}, msgs...)
+	if err != nil {
+		t.Fatalf("Serve() error = %v", err)
+	}
+	if len(out) != len(tests)+2 {
+		t.Fatalf("Serve() got %d messages, want %d", len(out), len(tests)+2)
+	}
+	notifications := []string{
+		`{"jsonrpc":"2.0","method":"textDocument/publishDiagnostics","params":{"uri":"$DIR/main.c","version":1,"diagnostics":[` +
+			`{"range":{"start":{"line":11,"character":0},"end":{"line":11,"character":1}},"severity":1,"source":"macro","message":"#error oops"},` +
+			`{"range":{"start":{"line":13,"character":0},"end":{"line":13,"character":1}},"severity":2,"source":"macro","message":"ONE redefined"}]}}`,
+		`{"jsonrpc":"2.0","method":"textDocument/inactiveRegions","params":{"textDocument":{"uri":"$DIR/main.c"},"regions":[` +
+			`{"start":{"line":4,"character":0},"end":{"line":4,"character":8}},{"start":{"line":9,"character":0},"end":{"line":9,"character":6}}]}}`,
+	}
+	for i, want := range notifications {
+		if got := strings.ReplaceAll(out[i], dir, "$DIR/"); got != want {
+			t.Errorf("notification %d = %s, want %s", i, got, want)
+		}
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			key := `"result":`
+			if strings.HasPrefix(tt.want, `{"code"`) {
+				key = `"error":`
+			}
+			want := `{"jsonrpc":"2.0","id":` + strconv.Itoa(i) + `,` + key + tt.want + `}`
+			if got := strings.ReplaceAll(out[i+2], dir, "$DIR/"); got != want {
+				t.Errorf("%s = %s, want %s", tt.method, got, want)
+			}
+		})
+	}
+}
+
+func TestServer_lifecycle(t *testing.T) {
+	uri := "untitled:a.h"
+	tests := []struct {
+		name string
+		msgs []string
+		want []string
+		err  error
+	}{
+		{"shutdown", []string{
+			`{"jsonrpc":"2.0","id":1,"method":"initialize","params":{}}`,
+			`{"jsonrpc":"2.0","method":"initialized","params":{}}`,
+			`{"jsonrpc":"2.0","id":2,"method":"shutdown"}`,
+			`{"jsonrpc":"2.0","id":3,"method":"textDocument/hover","params":{}}`,
+			`{"jsonrpc":"2.0","method":"exit"}`,
+		}, []string{
+			`{"jsonrpc":"2.0","id":1,"result":{"capabilities":{"completionProvider":{},"definitionProvider":true,"hoverProvider":true,"inactiveRegionsProvider":true,"referencesProvider":true,"textDocumentSync":1},"serverInfo":{"name":"macro-lsp"}}}`,
+			`{"jsonrpc":"2.0","id":2,"result":null}`,
+			`{"jsonrpc":"2.0","id":3,"error":{"code":-32600,"message":"server is shut down"}}`,
+		}, nil},
+		{"exit without shutdown", []string{`{"jsonrpc":"2.0","method":"exit"}`}, nil, ErrNoShutdown},
+		{"change", []string{
+			`{"jsonrpc":"2.0","method":"textDocument/didOpen","params":{"textDocument":{"uri":"` + uri + `","version":1,"text":"#if\n"}}}`,
+			`{"jsonrpc":"2.0","method":"textDocument/didChange","params":{"textDocument":{"uri":"` + uri + `","version":2},"contentChanges":[{"text":"#define A 1\n#if !A\nx\n#endif\n"}]}}`,
+			`{"jsonrpc":"2.0","method":"textDocument/didClose","params":{"textDocument":{"uri":"` + uri + `"}}}`,
+		}, []string{
+			`{"jsonrpc":"2.0","method":"textDocument/publishDiagnostics","params":{"uri":"untitled:a.h","version":1,"diagnostics":[` +
+				`{"range":{"start":{"line":0,"character":0},"end":{"line":0,"character":1}},"severity":1,"source":"macro","message":"unterminated #if, expected #endif before end of file at 2:0"},` +
+				`{"range":{"start":{"line":0,"character":0},"end":{"line":0,"character":1}},"severity":1,"source":"macro","message":"#if with no expression"}]}}`,
+			`{"jsonrpc":"2.0","method":"textDocument/inactiveRegions","params":{"textDocument":{"uri":"untitled:a.h"},"regions":[]}}`,
+			`{"jsonrpc":"2.0","method":"textDocument/publishDiagnostics","params":{"uri":"untitled:a.h","version":2,"diagnostics":[]}}`,
+			`{"jsonrpc":"2.0","method":"textDocument/inactiveRegions","params":{"textDocument":{"uri":"untitled:a.h"},"regions":[` +
+				`{"start":{"line":2,"character":0},"end":{"line":2,"character":1}}]}}`,
+			`{"jsonrpc":"2.0","method":"textDocument/publishDiagnostics","params":{"uri":"untitled:a.h","version":0,"diagnostics":[]}}`,
+		}, nil},
+		{"hover uses definitions at position", []string{
+			`{"jsonrpc":"2.0","method":"textDocument/didOpen","params":{"textDocument":{"uri":"` + uri + `","version":1,"text":"#define W 4\n#define A W\nint a = A;\n#undef W\n#define W 8\nint b = A;\n"}}}`,
+			`{"jsonrpc":"2.0","id":1,"method":"textDocument/hover","params":{"textDocument":{"uri":"` + uri + `"},"position":{"line":2,"character":8}}}`,
+			`{"jsonrpc":"2.0","id":2,"method":"textDocument/hover","params":{"textDocument":{"uri":"` + uri + `"},"position":{"line":5,"character":8}}}`,
+		}, []string{
+			`{"jsonrpc":"2.0","method":"textDocument/publishDiagnostics","params":{"uri":"untitled:a.h","version":1,"diagnostics":[]}}`,
+			`{"jsonrpc":"2.0","method":"textDocument/inactiveRegions","params":{"textDocument":{"uri":"untitled:a.h"},"regions":[]}}`,
+			`{"jsonrpc":"2.0","id":1,"result":{"contents":{"kind":"markdown","value":"` + "```c\\n#define A W\\n```\\nExpands to:\\n```c\\n4\\n```\\n" + `"},"range":{"start":{"line":2,"character":8},"end":{"line":2,"character":9}}}}`,
+			`{"jsonrpc":"2.0","id":2,"result":{"contents":{"kind":"markdown","value":"` + "```c\\n#define A W\\n```\\nExpands to:\\n```c\\n8\\n```\\n" + `"},"range":{"start":{"line":5,"character":8},"end":{"line":5,"character":9}}}}`,
+		}, nil},
+		{"parse error", []string{`{`}, []string{
+			`{"jsonrpc":"2.0","id":null,"error":{"code":-32700,"message":"unexpected end of JSON input"}}`,
+		}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := serve(t, &Server{}, tt.msgs...)
+			if err != tt.err {
+				t.Errorf("Serve() error = %v, want %v", err, tt.err)
+			}
+			if strings.Join(got, "\n") != strings.Join(tt.want, "\n") {
+				t.Errorf("Serve() =\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(tt.want, "\n"))
+			}
+		})
+	}
+}
+
+func TestFile_position(t *testing.T) {
+	f := parseFile("", []byte("a\n中😀b\n"))
+	tests := []struct {
+		offset int
+		pos    Position
+	}{
+		{0, Position{0, 0}},
+		{2, Position{1, 0}},
+		{5, Position{1, 1}},
+		{9, Position{1, 3}},
+		{10, Position{1, 4}},
+		{11, Position{2, 0}},
+	}
+	for _, tt := range tests {
+		if got := f.position(tt.offset); got != tt.pos {
+			t.Errorf("position(%d) = %v, want %v", tt.offset, got, tt.pos)
+		}
+		if got := f.offset(tt.pos); got != tt.offset {
+			t.Errorf("offset(%v) = %d, want %d", tt.pos, got, tt.offset)
+		}
+	}
+}
@@ -0,0 +1,396 @@
+// 语言服务器
+// 基于解析器和解释器，为宏较多的代码提供悬停展开、跳转定义、查找引用、未执行区域、诊断及补全
+package lsp
+
+import (
+	"bufio"
+	"dxkite.cn/language/macro/ast"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"sort"
+	"strings"
+)
+
+// 未收到 shutdown 请求就收到 exit 通知
+var ErrNoShutdown = errors.New("exit without shutdown")
+
+// 语言服务器
+type Server struct {
+	Dirs       []string         // 包含文件的搜索目录 (-I)
+	SystemDirs []string         // 系统头文件目录 (-isystem)
+	Predefined []ast.DefineStmt // 预定义的宏 (-D)
+	docs       map[string]*document
+	w          io.Writer
+	err        error // 写入消息的错误
+	shutdown   bool
+}
+
+// 处理请求，收到 exit 通知或输入结束时返回
+func (s *Server) Serve(r io.Reader, w io.Writer) error {
+	s.docs = map[string]*document{}
+	s.w = w
+	br := bufio.NewReader(r)
+	for s.err == nil {
+		body, err := readMessage(br)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		var req request
+		if err := json.Unmarshal(body, &req); err != nil {
+			s.reply(json.RawMessage("null"), nil, &responseError{codeParseError, err.Error()})
+			continue
+		}
+		if req.Method == "exit" {
+			if !s.shutdown {
+				return ErrNoShutdown
+			}
+			return nil
+		}
+		result, rerr := s.handle(&req)
+		if len(req.ID) > 0 {
+			s.reply(req.ID, result, rerr)
+		}
+	}
+	return s.err
+}
+
+// 分发请求
+func (s *Server) handle(req *request) (interface{}, *responseError) {
+	if s.shutdown {
+		return nil, &responseError{codeInvalidRequest, "server is shut down"}
+	}
+	switch req.Method {
+	case "initialize":
+		return s.initialize(), nil
+	case "shutdown":
+		s.shutdown = true
+		return nil, nil
+	case "textDocument/didOpen":
+		var params didOpenParams
+		if err := decode(req.Params, &params); err != nil {
+			return nil, err
+		}
+		doc := params.TextDocument
+		s.update(doc.URI, doc.Version, []byte(doc.Text))
+		return nil, nil
+	case "textDocument/didChange":
+		var params didChangeParams
+		if err := decode(req.Params, &params); err != nil {
+			return nil, err
+		}
+		if n := len(params.ContentChanges); n > 0 {
+			// 只支持全量同步，取最后一次修改
+			s.update(params.TextDocument.URI, params.TextDocument.Version, []byte(params.ContentChanges[n-1].Text))
+		}
+		return nil, nil
+	case "textDocument/didClose":
+		var params didCloseParams
+		if err := decode(req.Params, &params); err != nil {
+			return nil, err
+		}
+		uri := params.TextDocument.URI
+		delete(s.docs, uri)
+		s.notify("textDocument/publishDiagnostics", publishDiagnosticsParams{URI: uri, Diagnostics: []Diagnostic{}})
+		return nil, nil
+	case "textDocument/hover":
+		var params positionParams
+		if err := decode(req.Params, &params); err != nil {
+			return nil, err
+		}
+		return s.hover(params), nil
+	case "textDocument/definition":
+		var params positionParams
+		if err := decode(req.Params, &params); err != nil {
+			return nil, err
+		}
+		return s.definition(params), nil
+	case "textDocument/references":
+		var params referenceParams
+		if err := decode(req.Params, &params); err != nil {
+			return nil, err
+		}
+		return s.references(params), nil
+	case "textDocument/completion":
+		var params positionParams
+		if err := decode(req.Params, &params); err != nil {
+			return nil, err
+		}
+		return s.completion(params), nil
+	}
+	if len(req.ID) == 0 {
+		// 忽略未知的通知
+		return nil, nil
+	}
+	return nil, &responseError{codeMethodNotFound, "method not found: " + req.Method}
+}
+
+func decode(params json.RawMessage, v interface{}) *responseError {
+	if err := json.Unmarshal(params, v); err != nil {
+		return &responseError{codeInvalidParams, err.Error()}
+	}
+	return nil
+}
+
+func (s *Server) initialize() interface{} {
+	return map[string]interface{}{
+		"capabilities": map[string]interface{}{
+			"textDocumentSync":        1, // 全量同步
+			"hoverProvider":           true,
+			"definitionProvider":      true,
+			"referencesProvider":      true,
+			"completionProvider":      map[string]interface{}{},
+			"inactiveRegionsProvider": true,
+		},
+		"serverInfo": map[string]interface{}{"name": "macro-lsp"},
+	}
+}
+
+func (s *Server) reply(id json.RawMessage, result interface{}, rerr *responseError) {
+	resp := response{JSONRPC: "2.0", ID: id, Error: rerr}
+	if rerr == nil {
+		resp.Result = json.RawMessage("null")
+		if result != nil {
+			b, err := json.Marshal(result)
+			if err != nil {
+				s.err = err
+				return
+			}
+			resp.Result = b
+		}
+	}
+	s.write(resp)
+}
+
+func (s *Server) notify(method string, params interface{}) {
+	s.write(notification{JSONRPC: "2.0", Method: method, Params: params})
+}
+
+func (s *Server) write(v interface{}) {
+	if s.err == nil {
+		s.err = writeMessage(s.w, v)
+	}
+}
+
+// 更新文档，同时重新分析包含该文档的其他文档
+func (s *Server) update(uri string, version int, src []byte) {
+	d := s.analyze(uri, version, src)
+	s.docs[uri] = d
+	s.publish(d)
+	for _, other := range s.uris() {
+		od := s.docs[other]
+		if other == uri || !od.includes(uri) {
+			continue
+		}
+		od = s.analyze(od.uri, od.version, od.src)
+		s.docs[other] = od
+		s.publish(od)
+	}
+}
+
+// 打开的文档，按 uri 排序
+func (s *Server) uris() []string {
+	var list []string
+	for uri := range s.docs {
+		list = append(list, uri)
+	}
+	sort.Strings(list)
+	return list
+}
+
+func (d *document) includes(uri string) bool {
+	for _, h := range d.headers {
+		if h.uri == uri {
+			return true
+		}
+	}
+	return false
+}
+
+// 发送诊断和未执行的区域
+func (s *Server) publish(d *document) {
+	diags := append([]Diagnostic{}, d.diags...)
+	s.notify("textDocument/publishDiagnostics", publishDiagnosticsParams{URI: d.uri, Version: d.version, Diagnostics: diags})
+	regions := append([]Range{}, d.inactive...)
+	s.notify("textDocument/inactiveRegions", inactiveRegionsParams{TextDocument: textDocumentIdentifier{d.uri}, Regions: regions})
+}
+
+// 包含的文件，打开时使用文档内容
+func (s *Server) header(name string) *file {
+	uri := pathToURI(name)
+	if d := s.docs[uri]; d != nil {
+		return d.file
+	}
+	src, err := ioutil.ReadFile(name)
+	if err != nil {
+		return nil
+	}
+	return parseFile(uri, src)
+}
+
+// 光标处的标识符
+func (s *Server) symbol(params positionParams) (*document, *symbol, int) {
+	d := s.docs[params.TextDocument.URI]
+	if d == nil {
+		return nil, nil, 0
+	}
+	offset := d.offset(params.Position)
+	return d, d.symbolAt(offset), offset
+}
+
+// 悬停显示宏定义及展开结果
+func (s *Server) hover(params positionParams) *Hover {
+	d, sym, offset := s.symbol(params)
+	if sym == nil {
+		return nil
+	}
+	name := sym.id.Name
+	rng := d.rangeOf(sym.id.Pos(), sym.id.End())
+	if sym.param {
+		text := "```c\n" + name + "\n```\nparameter of `" + sym.define.Name.Name + "`"
+		return &Hover{Contents: MarkupContent{Kind: "markdown", Value: text}, Range: &rng}
+	}
+	def := d.definitionAt(name, offset)
+	val := s.valuesAt(d, offset)
+	if _, ok := val[name]; def == nil && !ok {
+		return nil
+	}
+	var b strings.Builder
+	var stmt ast.DefineStmt
+	if def != nil {
+		stmt = def.stmt
+		b.WriteString("```c\n" + def.text(stmt) + "\n```\n")
+	}
+	var x ast.MacroLiter = sym.id
+	if sym.call != nil {
+		x = sym.call
+	}
+	orig := string(d.src[x.Pos():x.End()])
+	if exp := d.expand(x, stmt, val); exp != orig {
+		b.WriteString("Expands to:\n```c\n" + exp + "\n```\n")
+	}
+	if b.Len() == 0 {
+		return nil
+	}
+	return &Hover{Contents: MarkupContent{Kind: "markdown", Value: b.String()}, Range: &rng}
+}
+
+// 跳转到宏定义或参数
+func (s *Server) definition(params positionParams) []Location {
+	d, sym, _ := s.symbol(params)
+	if sym == nil {
+		return nil
+	}
+	if sym.param {
+		for _, id := range sym.define.IdentList {
+			if id.Name == sym.id.Name {
+				return []Location{{URI: d.uri, Range: d.rangeOf(id.Pos(), id.End())}}
+			}
+		}
+	}
+	var list []Location
+	for _, def := range d.definitions(sym.id.Name) {
+		list = append(list, def.location())
+	}
+	return list
+}
+
+// 查找宏在打开的文档及包含的文件中的引用
+func (s *Server) references(params referenceParams) []Location {
+	d, sym, _ := s.symbol(params.positionParams)
+	if sym == nil {
+		return nil
+	}
+	name := sym.id.Name
+	var list []Location
+	if sym.param {
+		if params.Context.IncludeDeclaration {
+			for _, id := range sym.define.IdentList {
+				if id.Name == name {
+					list = append(list, Location{URI: d.uri, Range: d.rangeOf(id.Pos(), id.End())})
+				}
+			}
+		}
+		ast.Inspect(sym.define.Body, func(node ast.Node) bool {
+			if id, ok := node.(*ast.Ident); ok && id.Name == name {
+				list = append(list, Location{URI: d.uri, Range: d.rangeOf(id.Pos(), id.End())})
+			}
+			return true
+		})
+		return list
+	}
+	var files []*file
+	seen := map[string]bool{}
+	for _, uri := range s.uris() {
+		files = append(files, s.docs[uri].file)
+		seen[uri] = true
+	}
+	for _, h := range d.headers {
+		if !seen[h.uri] {
+			files = append(files, h)
+			seen[h.uri] = true
+		}
+	}
+	for _, f := range files {
+		for _, id := range f.references(name, params.Context.IncludeDeclaration) {
+			list = append(list, Location{URI: f.uri, Range: f.rangeOf(id.Pos(), id.End())})
+		}
+	}
+	return list
+}
+
+// 补全宏名称，在函数宏定义中同时补全参数
+func (s *Server) completion(params positionParams) *CompletionList {
+	d := s.docs[params.TextDocument.URI]
+	if d == nil {
+		return nil
+	}
+	offset := d.offset(params.Position)
+	list := &CompletionList{Items: []CompletionItem{}}
+	seen := map[string]bool{}
+	for _, stmt := range d.defines() {
+		fn, ok := stmt.(*ast.FuncDefineStmt)
+		if !ok || int(fn.Pos()) >= offset || offset > int(fn.End()) {
+			continue
+		}
+		for _, id := range fn.IdentList {
+			if !seen[id.Name] {
+				seen[id.Name] = true
+				list.Items = append(list.Items, CompletionItem{Label: id.Name, Kind: CompletionVariable, Detail: "parameter of " + fn.Name.Name})
+			}
+		}
+	}
+	nparams := len(list.Items)
+	var names []string
+	for name := range d.it.Val {
+		names = append(names, name)
+	}
+	for _, f := range append([]*file{d.file}, d.headers...) {
+		for _, stmt := range f.defines() {
+			names = append(names, defineName(stmt).Name)
+		}
+	}
+	for _, name := range names {
+		if seen[name] {
+			continue
+		}
+		seen[name] = true
+		item := CompletionItem{Label: name, Kind: CompletionConstant}
+		if def := d.definitionAt(name, offset); def != nil {
+			item.Detail = def.text(def.stmt)
+			if _, ok := def.stmt.(*ast.FuncDefineStmt); ok {
+				item.Kind = CompletionFunction
+			}
+		} else if _, ok := d.it.GetFunc(name); ok {
+			item.Kind = CompletionFunction
+		}
+		list.Items = append(list.Items, item)
+	}
+	macros := list.Items[nparams:]
+	sort.Slice(macros, func(i, j int) bool { return macros[i].Label < macros[j].Label })
+	return list
+}
@@ -0,0 +1,12 @@
+#include "config.h"
+#define SQ(x) ((x)*(x))
+int a = SQ(WIDTH);
+#if WIDTH > 10
+int big;
+#else
+int small;
+#endif
+#ifdef MISSING
+int m;
+#endif
+#error oops
@@ -0,0 +1,420 @@
+package parser
+
+import (
+	"bytes"
+	"dxkite.cn/language/macro/ast"
+	"dxkite.cn/language/macro/scanner"
+	"dxkite.cn/language/macro/token"
+)
+
+// 文本修改
+type Edit struct {
+	From, To token.Pos // 被替换的范围 [From, To)
+	Text     string    // 替换后的文本
+}
+
+// 可增量解析的文件
+type File struct {
+	Src    []byte            // 源码
+	Node   *ast.BlockStmt    // 语法树
+	Errors scanner.ErrorList // 错误列表
+}
+
+// 解析文件
+func ParseFile(src []byte) *File {
+	node, errs := Parse(src)
+	return &File{Src: src, Node: node.(*ast.BlockStmt), Errors: errs}
+}
+
+// 应用修改并增量解析
+// 只重新解析修改所在的语句与条件分支，其余语句复用原节点（位置会被平移），结果与完整解析一致
+func (f *File) Update(edit Edit) {
+	if edit.From < 0 || edit.To < edit.From || int(edit.To) > len(f.Src) {
+		panic("Update edit out of range")
+	}
+	src := make([]byte, 0, len(f.Src)+len(edit.Text)-int(edit.To-edit.From))
+	src = append(src, f.Src[:edit.From]...)
+	src = append(src, edit.Text...)
+	src = append(src, f.Src[edit.To:]...)
+
+	levels := f.levels(edit)
+	for i := len(levels) - 1; i >= 0; i-- {
+		if r := levels[i].reparse(f.Src, src, edit); r != nil {
+			f.apply(src, edit, levels[i], r)
+			return
+		}
+	}
+}
+
+// 语句列表，body 为条件分支体
+type level struct {
+	list     *ast.BlockStmt
+	from, to token.Pos // 列表范围
+	body     bool
+	starts   []token.Pos // 语句开始位置
+	exact    []bool      // 开始位置是否确定
+}
+
+// 包含修改的语句列表，由外到内
+func (f *File) levels(edit Edit) []*level {
+	lv := newLevel(f.Src, f.Node, 0, token.Pos(len(f.Src)), false)
+	levels := []*level{lv}
+	for {
+		i := lv.index(edit.From)
+		if i < 0 || (i+1 < len(lv.starts) && edit.To >= lv.starts[i+1]) {
+			return levels
+		}
+		block := ast.Branches((*lv.list)[i])
+		if block == nil {
+			return levels
+		}
+		var next *level
+		for _, b := range block.Branches {
+			body, ok := b.Body.(*ast.BlockStmt)
+			if ok && b.BodyFrom != token.NoPos && b.BodyFrom <= edit.From && edit.To < b.BodyTo {
+				next = newLevel(f.Src, body, b.BodyFrom, b.BodyTo, true)
+			}
+		}
+		if next == nil {
+			return levels
+		}
+		lv = next
+		levels = append(levels, lv)
+	}
+}
+
+func newLevel(src []byte, list *ast.BlockStmt, from, to token.Pos, body bool) *level {
+	lv := &level{list: list, from: from, to: to, body: body}
+	for i, stmt := range *list {
+		start, exact := from, true
+		if i > 0 {
+			start, exact = stmtStart(src, stmt)
+		}
+		lv.starts = append(lv.starts, start)
+		lv.exact = append(lv.exact, exact)
+	}
+	return lv
+}
+
+// 位置所在的语句下标
+func (lv *level) index(pos token.Pos) int {
+	i := -1
+	for j, start := range lv.starts {
+		if start > pos {
+			break
+		}
+		i = j
+	}
+	return i
+}
+
+// 能否从语句 i 开始解析
+// 未结束的条件语句在文件末尾的 # 处结束，之后的修改可能使其继续
+func (lv *level) canStart(src []byte, i int) bool {
+	if !lv.exact[i] || !cleanStart(src, lv.starts[i]) {
+		return false
+	}
+	block := ast.Branches((*lv.list)[i-1])
+	return block == nil || block.Endif != nil
+}
+
+// 重新解析的结果
+type reparsed struct {
+	from, to token.Pos // 被替换的语句在原文件中的范围
+	first    int       // 被替换的第一条语句
+	last     int       // 复用的第一条语句
+	stmts    []ast.Stmt
+	errors   scanner.ErrorList
+	eof      bool // 解析到文件结尾
+}
+
+// 从修改前的语句开始重新解析，直到与原语句重新对齐
+// 条件分支体的结束位置改变时返回 nil，需要在外层重新解析
+func (lv *level) reparse(oldSrc, src []byte, edit Edit) *reparsed {
+	delta := token.Pos(len(edit.Text)) - (edit.To - edit.From)
+	newEnd := edit.From + token.Pos(len(edit.Text))
+	r := &reparsed{from: lv.from, last: len(*lv.list), to: lv.to}
+	if pos := edit.From - 1; pos >= lv.from {
+		i := lv.index(pos)
+		for i > 0 && !lv.canStart(oldSrc, i) {
+			i--
+		}
+		if i >= 0 {
+			r.first = i
+			r.from = lv.starts[i]
+		}
+	}
+	sync := map[token.Pos]int{}
+	for j := r.first + 1; j < len(*lv.list); j++ {
+		if pos := lv.starts[j]; lv.exact[j] && pos >= edit.To {
+			sync[pos+delta] = j
+		}
+	}
+
+	p := &Parser{}
+	p.initAt(src, r.from)
+	for p.tok != token.EOF && !(lv.body && p.atBodyEnd()) {
+		if j, ok := sync[p.pos]; ok && p.pos >= newEnd && cleanStart(src, p.pos) {
+			if _, text := (*lv.list)[j].(*ast.MacroLitArray); text == (p.tok != token.MACRO) {
+				r.last = j
+				r.to = lv.starts[j]
+				break
+			}
+		}
+		if node := p.parseStmt(); node != nil {
+			r.stmts = append(r.stmts, node)
+		}
+	}
+	end := p.pos
+	if r.last == len(*lv.list) {
+		if lv.body {
+			if p.tok == token.EOF || end != lv.to+delta {
+				return nil
+			}
+		} else {
+			r.eof = true
+		}
+	}
+	for _, err := range p.ErrorList() {
+		if err.Pos.IsValid() && token.Pos(err.Pos.Offset) < end || !err.Pos.IsValid() && r.eof {
+			r.errors = append(r.errors, err)
+		}
+	}
+	return r
+}
+
+// 替换重新解析的语句，平移之后的节点与错误位置
+func (f *File) apply(src []byte, edit Edit, lv *level, r *reparsed) {
+	delta := token.Pos(len(edit.Text)) - (edit.To - edit.From)
+	shiftList(f.Node, edit.To, delta)
+
+	list := *lv.list
+	stmts := make(ast.BlockStmt, 0, len(list)-(r.last-r.first)+len(r.stmts))
+	stmts = append(stmts, list[:r.first]...)
+	stmts = append(stmts, r.stmts...)
+	stmts = append(stmts, list[r.last:]...)
+	*lv.list = stmts
+
+	var pos token.FilePos
+	pos.Init(src)
+	errs := scanner.ErrorList{}
+	for _, err := range f.Errors {
+		switch off := token.Pos(err.Pos.Offset); {
+		case !err.Pos.IsValid():
+			if !r.eof {
+				errs = append(errs, shiftRefs(src, pos, err, edit.To, delta))
+			}
+		case off < r.from:
+			errs = append(errs, shiftRefs(src, pos, err, edit.To, delta))
+		case off >= r.to:
+			e := *shiftRefs(src, pos, err, edit.To, delta)
+			e.Pos = pos.CreatePosition(off + delta)
+			errs = append(errs, &e)
+		}
+	}
+	errs.Merge(r.errors)
+	errs.Sort()
+	f.Src = src
+	f.Errors = errs
+}
+
+// 平移错误引用的位置并重新生成信息
+func shiftRefs(src []byte, pos token.FilePos, err *scanner.Error, from, delta token.Pos) *scanner.Error {
+	if len(err.Refs) == 0 {
+		return err
+	}
+	e := *err
+	e.Refs = make([]token.Pos, len(err.Refs))
+	for i, ref := range err.Refs {
+		if ref >= from {
+			ref += delta
+		}
+		e.Refs[i] = ref
+	}
+	e.Msg = formatRefs(src, pos, e.Format, e.Refs)
+	return &e
+}
+
+// 位于行首（之前只有空白），并且不是续行
+func cleanStart(src []byte, pos token.Pos) bool {
+	i := int(pos)
+	for i > 0 && (src[i-1] == ' ' || src[i-1] == '\t') {
+		i--
+	}
+	if i == 0 {
+		return true
+	}
+	if src[i-1] != '\n' {
+		return false
+	}
+	line := bytes.TrimRight(src[:i-1], " \t\r")
+	return !bytes.HasSuffix(line, []byte{'\\'})
+}
+
+// 语句开始位置
+// 非法宏的位置可能为 # 之后的指令名，需要向前找到 #，无法确定时返回 false
+func stmtStart(src []byte, stmt ast.Stmt) (token.Pos, bool) {
+	pos := stmt.Pos()
+	if _, ok := stmt.(*ast.InvalidStmt); !ok {
+		return pos, true
+	}
+	if int(pos) > len(src) {
+		return pos, false
+	}
+	i := skipBack(src, int(pos))
+	if i > 0 && src[i-1] == '#' {
+		return token.Pos(i - 1), true
+	}
+	return pos, int(pos) < len(src) && src[pos] == '#' && (i == 0 || src[i-1] == '\n')
+}
+
+// 向前跳过空白与续行符
+func skipBack(src []byte, i int) int {
+	for i > 0 {
+		switch {
+		case src[i-1] == ' ' || src[i-1] == '\t':
+			i--
+		case src[i-1] == '\n' && i > 1 && src[i-2] == '\\':
+			i -= 2
+		case src[i-1] == '\n' && i > 2 && src[i-2] == '\r' && src[i-3] == '\\':
+			i -= 3
+		default:
+			return i
+		}
+	}
+	return i
+}
+
+// 平移列表中 from 之后的位置，跳过完全位于 from 之前的语句
+func shiftList(list *ast.BlockStmt, from, delta token.Pos) {
+	for i, stmt := range *list {
+		if i+1 < len(*list) && (*list)[i+1].Pos() <= from {
+			continue
+		}
+		shiftStmt(stmt, from, delta)
+	}
+}
+
+func shiftStmt(stmt ast.Stmt, from, delta token.Pos) {
+	var then, els ast.Stmt
+	switch n := stmt.(type) {
+	case *ast.IfStmt:
+		shiftPos(&n.From, from, delta)
+		shiftPos(&n.To, from, delta)
+		shiftDirectives(n.Directives, from, delta)
+		shiftNode(n.X, from, delta)
+		then, els = n.Then, n.Else
+	case *ast.IfDefStmt:
+		shiftPos(&n.From, from, delta)
+		shiftPos(&n.To, from, delta)
+		shiftDirectives(n.Directives, from, delta)
+		shiftNode(n.Name, from, delta)
+		then, els = n.Then, n.Else
+	case *ast.IfNoDefStmt:
+		shiftPos(&n.From, from, delta)
+		shiftPos(&n.To, from, delta)
+		shiftDirectives(n.Directives, from, delta)
+		shiftNode(n.Name, from, delta)
+		then, els = n.Then, n.Else
+	case *ast.ElseIfStmt:
+		shiftPos(&n.From, from, delta)
+		shiftPos(&n.To, from, delta)
+		shiftNode(n.X, from, delta)
+		then, els = n.Then, n.Else
+	case *ast.BlockStmt:
+		shiftList(n, from, delta)
+		return
+	default:
+		shiftNode(stmt, from, delta)
+		return
+	}
+	if then != nil {
+		shiftStmt(then, from, delta)
+	}
+	if els != nil {
+		shiftStmt(els, from, delta)
+	}
+}
+
+func shiftDirectives(dirs []*ast.Directive, from, delta token.Pos) {
+	for _, d := range dirs {
+		shiftPos(&d.From, from, delta)
+		// 在分支体开头插入时，指令的结束位置不变
+		if d.To > from {
+			d.To += delta
+		}
+	}
+}
+
+// 平移节点及其子节点中的位置
+func shiftNode(node ast.Node, from, delta token.Pos) {
+	ast.Inspect(node, func(node ast.Node) bool {
+		switch n := node.(type) {
+		case *ast.BadExpr:
+			shiftPos(&n.Offset, from, delta)
+		case *ast.Ident:
+			shiftPos(&n.Offset, from, delta)
+		case *ast.Text:
+			shiftPos(&n.Offset, from, delta)
+		case *ast.Comment:
+			shiftPos(&n.Offset, from, delta)
+		case *ast.LitExpr:
+			shiftPos(&n.Offset, from, delta)
+		case *ast.MacroCmdStmt:
+			shiftPos(&n.Offset, from, delta)
+		case *ast.InvalidStmt:
+			shiftPos(&n.Offset, from, delta)
+		case *ast.RawGroup:
+			shiftPos(&n.From, from, delta)
+			shiftPos(&n.To, from, delta)
+		case *ast.UnaryExpr:
+			shiftPos(&n.Offset, from, delta)
+		case *ast.BinaryExpr:
+			shiftPos(&n.Offset, from, delta)
+		case *ast.CondExpr:
+			shiftPos(&n.Question, from, delta)
+			shiftPos(&n.Colon, from, delta)
+		case *ast.ValDefineStmt:
+			shiftPos(&n.From, from, delta)
+			shiftPos(&n.To, from, delta)
+			if n.Comment != nil {
+				shiftPos(&n.Comment.Offset, from, delta)
+			}
+		case *ast.UnDefineStmt:
+			shiftPos(&n.From, from, delta)
+			shiftPos(&n.To, from, delta)
+		case *ast.IncludeStmt:
+			shiftPos(&n.From, from, delta)
+			shiftPos(&n.To, from, delta)
+		case *ast.LineStmt:
+			shiftPos(&n.From, from, delta)
+			shiftPos(&n.To, from, delta)
+		case *ast.FuncDefineStmt:
+			shiftPos(&n.From, from, delta)
+			shiftPos(&n.To, from, delta)
+			shiftPos(&n.Lparen, from, delta)
+			shiftPos(&n.Rparen, from, delta)
+			if n.Comment != nil {
+				shiftPos(&n.Comment.Offset, from, delta)
+			}
+		case *ast.MacroCallExpr:
+			shiftPos(&n.From, from, delta)
+			shiftPos(&n.To, from, delta)
+			shiftPos(&n.Lparen, from, delta)
+			shiftPos(&n.Rparen, from, delta)
+		case *ast.ParenExpr:
+			shiftPos(&n.Lparen, from, delta)
+			shiftPos(&n.Rparen, from, delta)
+		case *ast.IfStmt, *ast.IfDefStmt, *ast.IfNoDefStmt, *ast.ElseIfStmt:
+			shiftStmt(n.(ast.Stmt), from, delta)
+			return false
+		}
+		return true
+	})
+}
+
+func shiftPos(pos *token.Pos, from, delta token.Pos) {
+	if *pos != token.NoPos && *pos >= from {
+		*pos += delta
+	}
+}
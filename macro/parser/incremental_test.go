@@ -0,0 +1,125 @@
+package parser
+
+import (
+	"dxkite.cn/language/macro/ast"
+	"dxkite.cn/language/macro/scanner"
+	"dxkite.cn/language/macro/token"
+	"io/ioutil"
+	"math/rand"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// 增量解析结果与完整解析一致
+func checkUpdate(t *testing.T, name string, f *File) {
+	t.Helper()
+	want, wantErrs := Parse(f.Src)
+	if !reflect.DeepEqual(ast.Node(f.Node), want) {
+		t.Fatalf("%s: Update() node differs from Parse() of %q", name, f.Src)
+	}
+	if got, want := errorStrings(f.Errors), errorStrings(wantErrs); !reflect.DeepEqual(got, want) {
+		t.Fatalf("%s: Update() errors = %v, want %v", name, got, want)
+	}
+}
+
+func errorStrings(errs scanner.ErrorList) []string {
+	var list []string
+	for _, err := range errs {
+		list = append(list, err.Error())
+	}
+	sort.Strings(list)
+	return list
+}
+
+func TestFile_Update(t *testing.T) {
+	src := "#ifndef GUARD\n#define GUARD\n#if A\nint a;\n#define B 1\n#else\nint b;\n#endif\nx\n#endif\ny\n"
+	pos := func(s string) token.Pos { return token.Pos(strings.Index(src, s)) }
+	tests := []struct {
+		name  string
+		edit  Edit
+		reuse int // 复用的顶层语句下标，-1 为不检查
+	}{
+		{"edit text in nested branch", Edit{pos("a;"), pos("a;") + 1, "aa"}, 1},
+		{"insert define in branch", Edit{pos("int b"), pos("int b"), "#define C\n"}, 1},
+		{"delete line in branch", Edit{pos("int a"), pos("#define B"), ""}, 1},
+		{"edit condition", Edit{pos("A\n"), pos("A\n") + 1, "A && B"}, 1},
+		{"insert endif", Edit{pos("x\n"), pos("x\n"), "#endif\n"}, -1},
+		{"remove else", Edit{pos("#else"), pos("int b"), ""}, 1},
+		{"insert at start", Edit{0, 0, "// head\n"}, -1},
+		{"unterminated", Edit{pos("#endif\ny"), len32(src), ""}, -1},
+		{"append", Edit{len32(src), len32(src), "#define Z\n"}, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := ParseFile([]byte(src))
+			old := append(ast.BlockStmt{}, *f.Node...)
+			f.Update(tt.edit)
+			checkUpdate(t, tt.name, f)
+			if tt.reuse >= 0 && (*f.Node)[tt.reuse] != old[tt.reuse] {
+				t.Errorf("Update() did not reuse statement %d", tt.reuse)
+			}
+		})
+	}
+}
+
+// 错误信息中引用的位置随修改平移
+func TestFile_UpdateErrorRefs(t *testing.T) {
+	src := "x\n#ifdef A\n#else\ny\n#else\n#endif\n#if B\n"
+	tests := []struct {
+		name string
+		edit Edit
+		want []string
+	}{
+		{"insert before", Edit{0, 0, "// head\n"}, []string{
+			"6:0: #else after #else (conditional began at 3:0)",
+			"8:0: unterminated #if, expected #endif before end of file at 9:0",
+		}},
+		{"insert between", Edit{len32("x\n#ifdef A\n#else\n"), len32("x\n#ifdef A\n#else\n"), "z\n"}, []string{
+			"6:0: #else after #else (conditional began at 2:0)",
+			"8:0: unterminated #if, expected #endif before end of file at 9:0",
+		}},
+		{"append", Edit{len32(src), len32(src), "b\n"}, []string{
+			"5:0: #else after #else (conditional began at 2:0)",
+			"7:0: unterminated #if, expected #endif before end of file at 9:0",
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := ParseFile([]byte(src))
+			f.Update(tt.edit)
+			checkUpdate(t, tt.name, f)
+			if got := errorStrings(f.Errors); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Update() errors = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func len32(s string) token.Pos {
+	return token.Pos(len(s))
+}
+
+func TestFile_UpdateRandom(t *testing.T) {
+	snippets := []string{"", "\n", "x", "#", "#if A\n", "#else\n", "#elif B\n", "#endif\n", "#define X 1\n", "\\\n", "/*", "*/", "\"", "  #ifdef Y\n"}
+	files, _ := filepath.Glob("testdata/*.c")
+	r := rand.New(rand.NewSource(1))
+	for _, name := range files {
+		src, err := ioutil.ReadFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f := ParseFile(src)
+		for i := 0; i < 200; i++ {
+			from := token.Pos(r.Intn(len(f.Src) + 1))
+			to := from + token.Pos(r.Intn(8))
+			if int(to) > len(f.Src) {
+				to = token.Pos(len(f.Src))
+			}
+			f.Update(Edit{from, to, snippets[r.Intn(len(snippets))]})
+			checkUpdate(t, name, f)
+		}
+	}
+}
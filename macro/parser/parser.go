@@ -6,11 +6,13 @@
 	"dxkite.cn/language/macro/token"
 	"errors"
 	"fmt"
+	"strings"
 )
 
 type Parser struct {
 	scanner scanner.Scanner   // 扫描器
 	errors  scanner.ErrorList // 错误列表
+	mode    Mode              // 解析模式
 	// 下一个Token
 	pos token.Pos   // Token位置
 	tok token.Token // Token
@@ -29,6 +31,32 @@ func (p *Parser) InitOffset(src []byte, tok token.Pos) {
 	p.next()
 }
 
+// 从行首 offset 处开始解析
+func (p *Parser) initAt(src []byte, offset token.Pos) {
+	p.scanner = scanner.NewScannerAt(src, int(offset))
+	p.errors = scanner.ErrorList{}
+	p.next()
+}
+
+// 初始化指令片段解析
+func (p *Parser) initDirective(src []byte, tok token.Pos, directive token.Token) {
+	p.scanner = scanner.NewDirectiveScanner(src, tok, directive)
+	p.errors = scanner.ErrorList{}
+	p.next()
+}
+
+// 解析模式
+type Mode uint
+
+const (
+	LazyGroups Mode = 1 << iota // 条件分支体只扫描指令嵌套，保存为 ast.RawGroup，由解释器按需解析
+)
+
+// 设置解析模式
+func (p *Parser) SetMode(mode Mode) {
+	p.mode = mode
+}
+
 // 解析宏语句
 func (p *Parser) Parse() ast.Node {
 	return p.parseStmts()
@@ -38,26 +66,27 @@ func (p *Parser) Parse() ast.Node {
 func (p *Parser) parseStmts() ast.Stmt {
 	block := &ast.BlockStmt{}
 	for p.tok != token.EOF {
-		var node ast.Stmt
-		if p.tok == token.MACRO {
-			from := p.pos
-			p.next()
-			p.skipWhitespace()
-			if TokenIn(p.tok, token.IF, token.IFDEF, token.IFNDEF) {
-				node = p.parseMacroLogicStmt(from)
-			} else {
-				node = p.parseMacroStmt(from)
-			}
-		} else {
-			node = p.parseTextStmt()
-		}
-		if node != nil {
+		if node := p.parseStmt(); node != nil {
 			block.Add(node)
 		}
 	}
 	return block
 }
 
+// 解析单条语句
+func (p *Parser) parseStmt() ast.Stmt {
+	if p.tok == token.MACRO {
+		from := p.pos
+		p.next()
+		p.skipWhitespace()
+		if TokenIn(p.tok, token.IF, token.IFDEF, token.IFNDEF) {
+			return p.parseMacroLogicStmt(from)
+		}
+		return p.parseMacroStmt(from)
+	}
+	return p.parseTextStmt()
+}
+
 // 获取当前的宏名
 func (p *Parser) curMacroIs(tok ...token.Token) bool {
 	pp := p.clone()
@@ -70,28 +99,48 @@ func (p *Parser) curMacroIs(tok ...token.Token) bool {
 // 解析体
 func (p *Parser) parseBodyStmts() ast.Stmt {
 	block := &ast.BlockStmt{}
+	for p.tok != token.EOF && !p.atBodyEnd() {
+		if node := p.parseStmt(); node != nil {
+			block.Add(node)
+		}
+	}
+	return block
+}
+
+// 解析条件分支体
+func (p *Parser) parseGroup() ast.Stmt {
+	if p.mode&LazyGroups != 0 {
+		return p.parseRawGroup()
+	}
+	return p.parseBodyStmts()
+}
+
+// 只扫描条件指令的嵌套，内容保存为原始文本
+func (p *Parser) parseRawGroup() ast.Stmt {
+	from := p.pos
+	depth := 0
 	for p.tok != token.EOF {
-		var node ast.Stmt
 		if p.tok == token.MACRO {
-			if p.curMacroIs(p.tok, token.EOF, token.ELSE, token.ELSEIF, token.ENDIF) {
+			if depth == 0 && p.atBodyEnd() {
 				break
 			}
-			from := p.pos
-			p.next()
+			p.next() // #
 			p.skipWhitespace()
-			if TokenIn(p.tok, token.IF, token.IFDEF, token.IFNDEF) {
-				node = p.parseMacroLogicStmt(from)
-			} else {
-				node = p.parseMacroStmt(from)
+			switch p.tok {
+			case token.IF, token.IFDEF, token.IFNDEF:
+				depth++
+			case token.ENDIF:
+				depth--
 			}
-		} else {
-			node = p.parseTextStmt()
-		}
-		if node != nil {
-			block.Add(node)
 		}
+		p.next()
 	}
-	return block
+	return &ast.RawGroup{From: from, To: p.pos, Text: p.scanner.Lit(from, p.pos)}
+}
+
+// 条件分支体结束（#elif #else #endif）
+func (p *Parser) atBodyEnd() bool {
+	return p.tok == token.MACRO && p.curMacroIs(p.tok, token.EOF, token.ELSE, token.ELSEIF, token.ENDIF)
 }
 
 // 解析宏语句
@@ -107,6 +156,11 @@ func (p *Parser) parseMacroStmt(from token.Pos) (node ast.Stmt) {
 		node = p.parseDefine(from)
 	case token.UNDEF:
 		node = p.parseUnDefine(from)
+	case token.ELSE, token.ELSEIF, token.ENDIF:
+		node = p.parseStrayCondStmt(from)
+	case token.NEWLINE, token.EOF:
+		// 空指令，换行作为文本保留
+		return nil
 	default:
 		node = p.parseInvalidStmt(from)
 	}
@@ -115,8 +169,9 @@ func (p *Parser) parseMacroStmt(from token.Pos) (node ast.Stmt) {
 
 // 解析宏语句命令
 func (p *Parser) parseMacroLogicStmt(from token.Pos) (node ast.CondStmt) {
-	_, tok, _ := p.next()
+	_, tok, name := p.next()
 	var cond ast.CondStmt
+	var dirs []*ast.Directive
 	if tok == token.IF {
 		cond = &ast.IfStmt{
 			X: p.parseIfExpr(),
@@ -141,45 +196,101 @@ func (p *Parser) parseMacroLogicStmt(from token.Pos) (node ast.CondStmt) {
 		}
 		p.scanToMacroEnd(true)
 	}
+	dirs = append(dirs, &ast.Directive{Kind: tok, From: from, To: p.pos})
 
 	node = cond
-	cond.SetTrueStmt(p.parseBodyStmts())
+	cond.SetTrueStmt(p.parseGroup())
 
-	for p.tok == token.MACRO && p.curMacroIs(token.ELSEIF) {
+	// #else 之后的分支不会被选中，连同指令保存为 InvalidStmt 附加在 #else 分支之后
+	elseAt := token.NoPos
+	var elseBody ast.Stmt
+	for p.tok == token.MACRO && p.curMacroIs(token.ELSEIF, token.ELSE) {
 		off := p.pos
 		p.next() // #
 		p.skipWhitespace()
-		p.next() // elseif
-		eif := &ast.ElseIfStmt{
-			X: p.parseIfExpr(),
+		_, tok, lit := p.next() // elif/else
+		if elseAt != token.NoPos {
+			if tok == token.ELSEIF {
+				p.parseIfExpr()
+			}
+			p.scanToMacroEnd(true)
+			p.parseGroup()
+			p.condErrorf(off, from, "#%s after #else", lit)
+			// 不包含分支体结尾的换行
+			text := strings.TrimSuffix(p.scanner.Lit(off, p.pos), "\n")
+			elseBody = appendStmt(elseBody, &ast.InvalidStmt{Offset: off, Text: text})
+			cond.SetFalseStmt(elseBody)
+			continue
+		}
+		if tok == token.ELSEIF {
+			eif := &ast.ElseIfStmt{
+				X: p.parseIfExpr(),
+			}
+			p.scanToMacroEnd(true)
+			dirs = append(dirs, &ast.Directive{Kind: tok, From: off, To: p.pos})
+			eif.SetTrueStmt(p.parseGroup())
+			eif.SetFromTO(off, p.pos)
+			cond.SetFalseStmt(eif)
+			cond = eif
+			continue
 		}
-		tt := p.parseBodyStmts()
-		eif.SetTrueStmt(tt)
-		eif.SetFromTO(off, p.pos)
-		cond.SetFalseStmt(eif)
-		cond = eif
-	}
-
-	if p.tok == token.MACRO && p.curMacroIs(token.ELSE) {
-		p.next() // #
-		p.skipWhitespace()
-		p.next() // else
 		p.scanToMacroEnd(true)
-		cond.SetFalseStmt(p.parseBodyStmts())
+		dirs = append(dirs, &ast.Directive{Kind: tok, From: off, To: p.pos})
+		elseAt = off
+		elseBody = p.parseGroup()
+		cond.SetFalseStmt(elseBody)
 	}
 
 	if p.tok == token.MACRO && p.curMacroIs(token.ENDIF) {
+		off := p.pos
 		p.next() // #
 		p.skipWhitespace()
 		p.next() // endif
 		p.scanToMacroEnd(true)
+		dirs = append(dirs, &ast.Directive{Kind: token.ENDIF, From: off, To: p.pos})
 	} else {
-		p.errorf(p.pos, "expected #endif")
+		// 缺少 #endif 时在文件末尾补全
+		p.errorRefs(from, "unterminated #"+name+", expected #endif before end of file at %s", p.pos)
 	}
 	node.SetFromTO(from, p.pos)
+	switch n := node.(type) {
+	case *ast.IfStmt:
+		n.Directives = dirs
+	case *ast.IfDefStmt:
+		n.Directives = dirs
+	case *ast.IfNoDefStmt:
+		n.Directives = dirs
+	}
 	return
 }
 
+// 在分支体之后添加语句
+func appendStmt(body ast.Stmt, stmt ast.Stmt) ast.Stmt {
+	if block, ok := body.(*ast.BlockStmt); ok {
+		block.Add(stmt)
+		return block
+	}
+	return &ast.BlockStmt{body, stmt}
+}
+
+// 无对应 #if 的 #else #elif #endif
+func (p *Parser) parseStrayCondStmt(from token.Pos) ast.Stmt {
+	p.errorf(from, "#%s without #if", p.lit)
+	p.next()
+	to := p.scanToMacroEnd(false)
+	return &ast.InvalidStmt{
+		Offset: from,
+		Text:   p.scanner.Lit(from, to),
+	}
+}
+
+// 条件结构错误
+// 同时指出出错的指令和起始的 #if
+func (p *Parser) condErrorf(pos, open token.Pos, format string, args ...interface{}) {
+	msg := strings.ReplaceAll(fmt.Sprintf(format, args...), "%", "%%")
+	p.errorRefs(pos, msg+" (conditional began at %s)", open)
+}
+
 // 提取表达式
 func (p *Parser) parseIfExpr() ast.MacroLiter {
 	node := &ast.MacroLitArray{}
@@ -221,6 +332,7 @@ func (p *Parser) parseDefinedValue() (node ast.MacroLiter) {
 		p.skipWhitespace()
 		lp, _, _ := p.expected(token.LPAREN)
 		v := p.parseDefinedValue()
+		p.skipWhitespace()
 		rp, _, _ := p.expected(token.RPAREN)
 		return &ast.ParenExpr{
 			Lparen: lp,
@@ -246,6 +358,9 @@ func (p *Parser) parseDefinedValue() (node ast.MacroLiter) {
 func (p *Parser) parseInclude(from token.Pos) ast.Stmt {
 	p.next()
 	p.skipWhitespace()
+	if isIdent(p.tok) {
+		return p.parseIncludeMacro(from)
+	}
 	pos, tok, lit := p.next()
 	var path string
 	typ := ast.IncludeOuter
@@ -276,6 +391,20 @@ func (p *Parser) parseInclude(from token.Pos) ast.Stmt {
 	}
 }
 
+// #include MACRO
+// 文件名由宏展开得到
+func (p *Parser) parseIncludeMacro(from token.Pos) ast.Stmt {
+	name := p.parseMacroTextBody()
+	to := p.pos
+	p.scanToMacroEnd(true)
+	return &ast.IncludeStmt{
+		From: from,
+		To:   to,
+		Type: ast.IncludeMacro,
+		Name: name,
+	}
+}
+
 // #error message
 func (p *Parser) parseCmd(from token.Pos) ast.Stmt {
 	node := &ast.MacroCmdStmt{
@@ -316,7 +445,7 @@ func (p *Parser) parseLine(from token.Pos) ast.Stmt {
 
 // # any NEWLINE
 func (p *Parser) parseInvalidStmt(from token.Pos) ast.Stmt {
-	node := &ast.InvalidStmt{Offset: p.pos}
+	node := &ast.InvalidStmt{Offset: from}
 	p.errorf(p.pos, "invalid preprocessing directive #%s", p.lit)
 	p.next()
 	to := p.scanToMacroEnd(false)
@@ -370,6 +499,7 @@ func (p *Parser) parseDefine(from token.Pos) ast.Stmt {
 		p.skipWhitespace()
 		node.Body = p.parseMacroFuncBody()
 		node.To = p.pos
+		node.Comment = p.parseTrailingComment()
 		p.scanToMacroEnd(true)
 		return node
 	} else {
@@ -377,6 +507,7 @@ func (p *Parser) parseDefine(from token.Pos) ast.Stmt {
 		p.skipWhitespace()
 		node.Body = p.parseMacroTextBody()
 		node.To = p.pos
+		node.Comment = p.parseTrailingComment()
 		p.scanToMacroEnd(true)
 		return node
 	}
@@ -431,7 +562,27 @@ func (p *Parser) parseMacroFuncBody() (node *ast.MacroLitArray) {
 			node.Append(p.parseText())
 		}
 	}
-	return nilIfEmpty(node)
+	return nilIfEmpty(trimTrailingSpace(node))
+}
+
+// 去掉定义体末尾的空白
+func trimTrailingSpace(node *ast.MacroLitArray) *ast.MacroLitArray {
+	for n := len(*node); n > 0; n = len(*node) {
+		t, ok := (*node)[n-1].(*ast.Text)
+		if !ok || t.Kind != token.TEXT || !isEmptyText(t.Text) {
+			break
+		}
+		*node = (*node)[:n-1]
+	}
+	return node
+}
+
+// 宏定义的行尾注释，不属于定义体（-CC 模式展开时保留）
+func (p *Parser) parseTrailingComment() *ast.Text {
+	if p.tok != token.COMMENT {
+		return nil
+	}
+	return p.parseText().(*ast.Text)
 }
 
 // 解析宏定义体
@@ -445,7 +596,7 @@ func (p *Parser) parseMacroTextBody() (node *ast.MacroLitArray) {
 			node.Append(p.parseText())
 		}
 	}
-	return nilIfEmpty(node)
+	return nilIfEmpty(trimTrailingSpace(node))
 }
 
 // 解析文本语句
@@ -672,8 +823,18 @@ func (p *Parser) parseIf() ast.Stmt {
 }
 
 // 解析宏表达式
+// 条件运算 cond ? x : y 优先级最低，右结合
 func (p *Parser) parseExpr() (expr ast.MacroLiter) {
-	return p.parseExprPrecedence(token.LowestPrec)
+	expr = p.parseExprPrecedence(token.LowestPrec)
+	if p.tok != token.QUESTION {
+		return expr
+	}
+	cond := &ast.CondExpr{Cond: expr, Question: p.pos}
+	p.next()
+	cond.X = p.parseExpr()
+	cond.Colon, _, _ = p.expected(token.COLON)
+	cond.Y = p.parseExpr()
+	return cond
 }
 
 // 解析表达式
@@ -885,12 +1046,15 @@ func (p *Parser) scanToMacroEnd(needEmpty bool) (pos token.Pos) {
 		}
 		p.next()
 	}
+	pos = p.pos
+	// 行尾注释属于当前指令
+	if p.tok == token.COMMENT {
+		p.next()
+	}
 	if p.tok == token.NEWLINE {
-		pos = p.pos
 		p.next()
-		return
 	}
-	return p.pos
+	return
 }
 
 // 当前为空
@@ -959,6 +1123,22 @@ func (p *Parser) FilePos() token.FilePos {
 	return p.scanner.GetFilePos()
 }
 
+// 位置，文件末尾位于最后一个字符之后
+func position(src []byte, fp token.FilePos, pos token.Pos) token.Position {
+	if int(pos) < len(src) {
+		return fp.CreatePosition(pos)
+	}
+	at := token.Position{Offset: len(src), Line: 1}
+	for _, b := range src {
+		at.Column++
+		if b == '\n' {
+			at.Line++
+			at.Column = 0
+		}
+	}
+	return at
+}
+
 func (p *Parser) ErrorList() scanner.ErrorList {
 	err := scanner.ErrorList{}
 	err.Merge(p.errors)
@@ -975,9 +1155,30 @@ func (p *Parser) errorf(pos token.Pos, format string, args ...interface{}) {
 	p.error(pos, fmt.Sprintf(format, args...))
 }
 
+// 引用其他位置的错误，format 中的 %s 依次为 refs 的位置
+func (p *Parser) errorRefs(pos token.Pos, format string, refs ...token.Pos) {
+	src, fp := p.scanner.GetSrc(), p.FilePos()
+	p.errors = append(p.errors, &scanner.Error{
+		Pos:    fp.CreatePosition(pos),
+		Msg:    formatRefs(src, fp, format, refs),
+		Format: format,
+		Refs:   refs,
+	})
+}
+
+// 按引用位置生成错误信息
+func formatRefs(src []byte, fp token.FilePos, format string, refs []token.Pos) string {
+	args := make([]interface{}, len(refs))
+	for i, ref := range refs {
+		args[i] = position(src, fp, ref)
+	}
+	return fmt.Sprintf(format, args...)
+}
+
 // 保存状态
 func (p *Parser) clone() *Parser {
 	return &Parser{
+		mode:    p.mode,
 		scanner: p.scanner.CloneWithoutSrc(),
 		pos:     p.pos,
 		tok:     p.tok,
@@ -1001,17 +1202,42 @@ func Parse(src []byte) (ast.Node, scanner.ErrorList) {
 	return p.Parse(), p.ErrorList()
 }
 
+// 按模式解析宏
+func ParseMode(src []byte, mode Mode) (ast.Node, scanner.ErrorList) {
+	p := &Parser{mode: mode}
+	p.Init(src)
+	return p.Parse(), p.ErrorList()
+}
+
+// 解析 LazyGroups 模式下保存的条件分支体
+// 词法错误已在扫描分支体时报告，只返回语法错误，位置按 pos 计算
+func ParseGroup(group *ast.RawGroup, pos token.FilePos, mode Mode) (ast.Node, scanner.ErrorList) {
+	p := &Parser{mode: mode}
+	p.Init([]byte(group.Text))
+	node := p.Parse()
+	shiftStmt(node.(ast.Stmt), 0, group.From)
+	errs := scanner.ErrorList{}
+	for _, err := range p.errors {
+		off := group.To
+		if err.Pos.IsValid() {
+			off = group.From + token.Pos(err.Pos.Offset)
+		}
+		errs.Add(pos.CreatePosition(off), err.Msg)
+	}
+	return node, errs
+}
+
 // 解析表达式
 func ParseExpr(src []byte, off token.Pos) (ast.MacroLiter, scanner.ErrorList) {
 	p := &Parser{}
-	p.InitOffset(src, off)
+	p.initDirective(src, off, token.IF)
 	return p.parseExpr(), p.ErrorList()
 }
 
 // 解析 body
 func ParseBodyLiter(src []byte, off token.Pos) (*ast.MacroLitArray, scanner.ErrorList) {
 	p := &Parser{}
-	p.InitOffset(src, off)
+	p.initDirective(src, off, token.DEFINE)
 	return p.parseMacroFuncBody(), p.ErrorList()
 }
 
@@ -1021,3 +1247,41 @@ func nilIfEmpty(array *ast.MacroLitArray) *ast.MacroLitArray {
 	}
 	return nil
 }
+
+// 解析注释
+// 相邻行的注释合并为一组，代码之后的行尾注释单独成组
+func ParseComments(src []byte) []*ast.CommentGroup {
+	s := scanner.NewScanner(src)
+	var list []*ast.CommentGroup
+	var cur *ast.CommentGroup
+	trailing := false // 当前组为行尾注释
+	code := false     // 当前行已有代码
+	newlines := 0     // 上一个注释之后的换行数
+	for {
+		pos, tok, lit := s.Scan()
+		switch {
+		case tok == token.EOF:
+			return list
+		case tok == token.COMMENT || tok == token.BLOCK_COMMENT:
+			c := &ast.Comment{Offset: pos, Kind: tok, Text: lit}
+			if cur != nil && !trailing && !code && newlines <= 1 {
+				cur.List = append(cur.List, c)
+			} else {
+				cur = &ast.CommentGroup{List: []*ast.Comment{c}}
+				list = append(list, cur)
+				trailing = code
+			}
+			newlines = 0
+		case tok == token.NEWLINE:
+			code = false
+			newlines++
+			if trailing {
+				cur = nil
+			}
+		case tok == token.BACKSLASH_NEWLINE, tok == token.TEXT && isEmptyText(lit):
+		default:
+			code = true
+			cur = nil
+		}
+	}
+}
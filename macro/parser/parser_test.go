@@ -19,6 +19,20 @@ func TestParseSimple(t *testing.T) {
 		src  []byte
 		want ast.Node
 	}{
+		{
+			"parse computed include",
+			[]byte("#include CONFIG_H\n"),
+			&ast.BlockStmt{
+				&ast.IncludeStmt{
+					From: 0,
+					To:   17,
+					Type: ast.IncludeMacro,
+					Name: &ast.MacroLitArray{
+						&ast.Ident{Offset: 9, Name: "CONFIG_H"},
+					},
+				},
+			},
+		},
 		{
 			"parse include",
 			[]byte("#include <stdio.h>\n#include \"log.h\""),
@@ -102,7 +116,7 @@ func TestParseSimple(t *testing.T) {
 					Line: "98", Path: "\"test.c\"",
 				},
 				&ast.InvalidStmt{
-					Offset: 20,
+					Offset: 18,
 					Text:   "# a b c d e",
 				},
 				&ast.MacroCmdStmt{
@@ -178,16 +192,7 @@ func TestParseSimple(t *testing.T) {
 						&ast.Text{
 							Offset: 46,
 							Kind:   token.INT,
-							Text:   "123",
-						},
-						&ast.Text{
-							Offset: 49,
-							Kind:   token.QUOTE,
-							Text:   "'",
-						},
-						&ast.Ident{
-							Offset: 50,
-							Name:   "bb",
+							Text:   "123'bb",
 						},
 					},
 				},
@@ -700,6 +705,40 @@ func TestParseSimple(t *testing.T) {
 				},
 			},
 		},
+		{
+			"parse indented directive",
+			[]byte("  # undef A\n/* c */#undef B"),
+			&ast.BlockStmt{
+				&ast.MacroLitArray{
+					&ast.Text{
+						Offset: 0,
+						Kind:   token.TEXT,
+						Text:   "  ",
+					},
+				},
+				&ast.UnDefineStmt{
+					From: 2, To: 11,
+					Name: &ast.Ident{
+						Offset: 10,
+						Name:   "A",
+					},
+				},
+				&ast.MacroLitArray{
+					&ast.Text{
+						Offset: 12,
+						Kind:   token.BLOCK_COMMENT,
+						Text:   "/* c */",
+					},
+				},
+				&ast.UnDefineStmt{
+					From: 19, To: 27,
+					Name: &ast.Ident{
+						Offset: 26,
+						Name:   "B",
+					},
+				},
+			},
+		},
 	}
 
 	for _, tt := range tests {
@@ -804,7 +843,7 @@ func Test_parser_parseLiteralExpr(t *testing.T) {
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			p := &Parser{}
-			p.Init([]byte(tt.code))
+			p.initDirective([]byte(tt.code), 0, token.IF)
 			if gotExpr := p.parseExpr(); !reflect.DeepEqual(gotExpr, tt.wantExpr) {
 				gotS, _ := json.Marshal(gotExpr)
 				wantS, _ := json.Marshal(tt.wantExpr)
@@ -877,7 +916,7 @@ func Test_parser_parseUnaryExpr(t *testing.T) {
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			p := &Parser{}
-			p.Init([]byte(tt.code))
+			p.initDirective([]byte(tt.code), 0, token.IF)
 			if gotExpr := p.parseExpr(); !reflect.DeepEqual(gotExpr, tt.wantExpr) {
 				gotS, _ := json.Marshal(gotExpr)
 				wantS, _ := json.Marshal(tt.wantExpr)
@@ -933,6 +972,23 @@ func Test_parser_parseExpr(t *testing.T) {
 				},
 			},
 		},
+		{
+			"a?b:c?d:e",
+			"a?b:c?d:e",
+			&ast.CondExpr{
+				Cond:     &ast.Ident{Offset: 0, Name: "a"},
+				Question: 1,
+				X:        &ast.Ident{Offset: 2, Name: "b"},
+				Colon:    3,
+				Y: &ast.CondExpr{
+					Cond:     &ast.Ident{Offset: 4, Name: "c"},
+					Question: 5,
+					X:        &ast.Ident{Offset: 6, Name: "d"},
+					Colon:    7,
+					Y:        &ast.Ident{Offset: 8, Name: "e"},
+				},
+			},
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -991,3 +1047,369 @@ func TestParse(t *testing.T) {
 		t.Error(err)
 	}
 }
+
+func TestParse_condErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		src  string
+		want []string
+	}{
+		{
+			"unterminated if",
+			"#if A\na\n",
+			[]string{"1:0: unterminated #if, expected #endif before end of file at 3:0"},
+		},
+		{
+			"unterminated if without newline",
+			"#if A\na",
+			[]string{"1:0: unterminated #if, expected #endif before end of file at 2:1"},
+		},
+		{
+			"stray endif",
+			"a\n#endif\nb\n",
+			[]string{"2:0: #endif without #if"},
+		},
+		{
+			"else after else",
+			"#ifdef A\na\n#else\nb\n#else\nc\n#endif\n",
+			[]string{"5:0: #else after #else (conditional began at 1:0)"},
+		},
+		{
+			"elif after else",
+			"#ifndef A\n#else\n#elif B\nc\n#endif\n",
+			[]string{"3:0: #elif after #else (conditional began at 1:0)"},
+		},
+		{
+			"nested unterminated",
+			"#if A\n#if B\n#endif\n",
+			[]string{"1:0: unterminated #if, expected #endif before end of file at 4:0"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, errs := Parse([]byte(tt.src))
+			var got []string
+			for _, err := range errs {
+				got = append(got, err.Error())
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Parse() errors = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// 行尾注释及其之前的空白不属于定义体
+func TestParse_defineComment(t *testing.T) {
+	src := "#define BUF 1024 // bytes\n#define F(x) x /* c */ // f\n#define E\t// e\n"
+	node, errs := Parse([]byte(src))
+	if len(errs) > 0 {
+		t.Fatal(errs)
+	}
+	list := *node.(*ast.BlockStmt)
+	tests := []struct {
+		body    *ast.MacroLitArray
+		comment *ast.Text
+		want    []string
+		wantCmt string
+	}{
+		{list[0].(*ast.ValDefineStmt).Body, list[0].(*ast.ValDefineStmt).Comment, []string{"1024"}, "// bytes"},
+		{list[1].(*ast.FuncDefineStmt).Body, list[1].(*ast.FuncDefineStmt).Comment, []string{"x", " ", "/* c */"}, "// f"},
+		{list[2].(*ast.ValDefineStmt).Body, list[2].(*ast.ValDefineStmt).Comment, nil, "// e"},
+	}
+	for i, tt := range tests {
+		var got []string
+		if tt.body != nil {
+			for _, v := range *tt.body {
+				got = append(got, src[v.Pos():v.End()])
+			}
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%d: Body = %q, want %q", i, got, tt.want)
+		}
+		if tt.comment == nil || tt.comment.Text != tt.wantCmt {
+			t.Errorf("%d: Comment = %v, want %q", i, tt.comment, tt.wantCmt)
+		}
+	}
+}
+
+func TestParse_noErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		src  string
+	}{
+		{"null directive", "#\na\n#  \n"},
+		{"defined with spaces", "#if defined ( A ) || defined(B)\n#endif\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, errs := Parse([]byte(tt.src)); len(errs) > 0 {
+				t.Errorf("Parse() errors = %v", errs)
+			}
+		})
+	}
+}
+
+// #elif 的行尾注释与换行属于指令，不属于分支体
+func TestParse_elifLineEnd(t *testing.T) {
+	node, errs := Parse([]byte("#if A\na\n#elif B // c\nb\n#endif\n"))
+	if len(errs) > 0 {
+		t.Fatal(errs)
+	}
+	st := (*node.(*ast.BlockStmt))[0].(*ast.IfStmt)
+	eif, ok := st.Else.(*ast.ElseIfStmt)
+	if !ok {
+		t.Fatalf("Parse() got %#v, want #elif", st.Else)
+	}
+	if pos := eif.Then.Pos(); pos != 21 {
+		t.Errorf("#elif body starts at %d, want 21", pos)
+	}
+}
+
+func TestParse_condRecover(t *testing.T) {
+	node, _ := Parse([]byte("#if A\na\n#else\nb\n#else\nc\n#endif\n#endif\n#define B 1\n"))
+	block := *node.(*ast.BlockStmt)
+	if len(block) != 3 {
+		t.Fatalf("Parse() got %d statements, want 3", len(block))
+	}
+	if st, ok := block[0].(*ast.IfStmt); !ok || st.Else == nil || st.End() != 31 {
+		t.Errorf("Parse() got %#v, want #if with #else", block[0])
+	}
+	if _, ok := block[1].(*ast.InvalidStmt); !ok {
+		t.Errorf("Parse() got %#v, want invalid #endif", block[1])
+	}
+	if _, ok := block[2].(*ast.ValDefineStmt); !ok {
+		t.Errorf("Parse() got %#v, want #define", block[2])
+	}
+}
+
+func TestCommentMap(t *testing.T) {
+	src := []byte(`// Package doc
+
+// A is
+// the answer
+#define A 42 // trailing A
+int a; // code
+#define B 1
+/* F doc */
+#define F(x) x
+#ifndef G // guard
+#include "g.h" /* g */
+#endif // G
+`)
+	node, _ := Parse(src)
+	cmap := ast.NewCommentMap(src, node, ParseComments(src))
+	texts := func(n ast.Node) []string {
+		var s []string
+		for _, g := range cmap[n] {
+			s = append(s, g.Text())
+		}
+		return s
+	}
+	var defA, defB, defF, cond, inc ast.Node
+	ast.Inspect(node, func(n ast.Node) bool {
+		switch v := n.(type) {
+		case *ast.ValDefineStmt:
+			if v.Name.Name == "A" {
+				defA = v
+			} else {
+				defB = v
+			}
+		case *ast.FuncDefineStmt:
+			defF = v
+		case *ast.IfNoDefStmt:
+			cond = v
+		case *ast.IncludeStmt:
+			inc = v
+		}
+		return true
+	})
+	tests := []struct {
+		name string
+		node ast.Node
+		want []string
+	}{
+		{"define A", defA, []string{"A is\nthe answer\n", "trailing A\n"}},
+		{"define B", defB, nil},
+		{"define F", defF, []string{"F doc\n"}},
+		{"ifndef", cond, []string{"guard\n", "G\n"}},
+		{"include", inc, []string{"g\n"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := texts(tt.node); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("CommentMap[%T] = %q, want %q", tt.node, got, tt.want)
+			}
+		})
+	}
+	// 文件注释与代码行尾注释不关联
+	if got := len(cmap.Comments()); got != 6 {
+		t.Errorf("CommentMap.Comments() = %d groups, want 6", got)
+	}
+}
+
+func TestBranches(t *testing.T) {
+	type branch struct {
+		Kind             token.Token
+		From, To         token.Pos
+		BodyFrom, BodyTo token.Pos
+	}
+	tests := []struct {
+		name  string
+		src   string
+		want  []branch
+		endif [2]token.Pos
+	}{
+		{
+			"if elif else",
+			"#if A\na\n#elif B // b\nb\n#else\nc\n#endif\n",
+			[]branch{
+				{token.IF, 0, 6, 6, 8},
+				{token.ELSEIF, 8, 21, 21, 23},
+				{token.ELSE, 23, 29, 29, 31},
+			},
+			[2]token.Pos{31, 38},
+		},
+		{
+			"ifdef",
+			"#ifdef A\n#endif",
+			[]branch{{token.IFDEF, 0, 9, 9, 9}},
+			[2]token.Pos{9, 15},
+		},
+		{
+			"unterminated",
+			"#ifndef A\na\n",
+			[]branch{{token.IFNDEF, 0, 10, 10, 12}},
+			[2]token.Pos{token.NoPos, token.NoPos},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			node, _ := Parse([]byte(tt.src))
+			block := ast.Branches((*node.(*ast.BlockStmt))[0])
+			var got []branch
+			for _, b := range block.Branches {
+				got = append(got, branch{b.Directive.Kind, b.Directive.From, b.Directive.To, b.BodyFrom, b.BodyTo})
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Branches() = %v, want %v", got, tt.want)
+			}
+			endif := [2]token.Pos{token.NoPos, token.NoPos}
+			if block.Endif != nil {
+				endif = [2]token.Pos{block.Endif.From, block.Endif.To}
+			}
+			if endif != tt.endif {
+				t.Errorf("Branches().Endif = %v, want %v", endif, tt.endif)
+			}
+		})
+	}
+}
+
+// 分支对应的条件语句
+func TestBranches_stmt(t *testing.T) {
+	node, _ := Parse([]byte("#if A\n#elif B\n#elif C\n#else\n#endif\n"))
+	st := (*node.(*ast.BlockStmt))[0].(*ast.IfStmt)
+	eif := st.Else.(*ast.ElseIfStmt)
+	want := []ast.CondStmt{st, eif, eif.Else.(*ast.ElseIfStmt), nil}
+	block := ast.Branches(st)
+	if len(block.Branches) != len(want) {
+		t.Fatalf("Branches() got %d branches, want %d", len(block.Branches), len(want))
+	}
+	for i, b := range block.Branches {
+		if b.Stmt != want[i] {
+			t.Errorf("Branches()[%d].Stmt = %#v, want %#v", i, b.Stmt, want[i])
+		}
+	}
+}
+
+func TestIncludeGuard(t *testing.T) {
+	tests := []struct {
+		name string
+		src  string
+		want string
+	}{
+		{"guard", "// a.h\n#ifndef A_H\n#define A_H\nint a;\n#endif\n", "A_H"},
+		{"comment before define", "#ifndef A_H\n/* a */\n#define A_H\n#endif\n", "A_H"},
+		{"other name", "#ifndef A_H\n#define B_H\n#endif\n", ""},
+		{"else", "#ifndef A_H\n#define A_H\n#else\n#endif\n", ""},
+		{"text after", "#ifndef A_H\n#define A_H\n#endif\nint a;\n", ""},
+		{"no guard", "int a;\n", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			node, _ := Parse([]byte(tt.src))
+			got := ""
+			if guard := ast.IncludeGuard(node); guard != nil {
+				got = guard.Name.Name
+			}
+			if got != tt.want {
+				t.Errorf("IncludeGuard() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseMode_lazyGroups(t *testing.T) {
+	src := "#if A\nIt's \"x\n#if B\n#foo\n#endif\n#elif C\n#define F(\n#endif\n"
+	if _, errs := Parse([]byte(src)); len(errs) == 0 {
+		t.Fatal("Parse() want errors in groups")
+	}
+	node, errs := ParseMode([]byte(src), LazyGroups)
+	if len(errs) > 0 {
+		t.Fatal(errs)
+	}
+	block := ast.Branches((*node.(*ast.BlockStmt))[0])
+	var texts []string
+	for _, b := range block.Branches {
+		g, ok := b.Body.(*ast.RawGroup)
+		if !ok || g.From != b.BodyFrom || g.To != b.BodyTo {
+			t.Fatalf("branch body = %#v", b.Body)
+		}
+		texts = append(texts, g.Text)
+	}
+	if want := []string{"It's \"x\n#if B\n#foo\n#endif\n", "#define F(\n"}; !reflect.DeepEqual(texts, want) {
+		t.Errorf("groups = %q, want %q", texts, want)
+	}
+
+	var pos token.FilePos
+	pos.Init([]byte(src))
+	group := block.Branches[1].Body.(*ast.RawGroup)
+	body, errs := ParseGroup(group, pos, LazyGroups)
+	if got := (*body.(*ast.BlockStmt))[0].Pos(); got != group.From {
+		t.Errorf("ParseGroup() stmt at %v, want %v", got, group.From)
+	}
+	if len(errs) != 1 || errs[0].Error() != "7:10: expected [)] token, got \\n" {
+		t.Errorf("ParseGroup() errors = %v", errs)
+	}
+}
+
+// #else 之后的分支保存为 InvalidStmt
+func TestParse_invalidBranch(t *testing.T) {
+	tests := []struct {
+		name string
+		src  string
+		want []string
+	}{
+		{"else after else", "#ifdef A\na\n#else\nb\n#else\nc\n#endif\n", []string{"#else\nc"}},
+		{"elif after else", "#ifndef A\n#else\n#elif B\nc\n#endif\n", []string{"#elif B\nc"}},
+		{"lazy", "#if A\n#else\n#else\n#if B\nb\n#endif\n#elif C\n#endif\n", []string{"#else\n#if B\nb\n#endif", "#elif C"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, mode := range []Mode{0, LazyGroups} {
+				node, _ := ParseMode([]byte(tt.src), mode)
+				block := ast.Branches((*node.(*ast.BlockStmt))[0])
+				var got []string
+				ast.Inspect(block.Branches[len(block.Branches)-1].Body, func(n ast.Node) bool {
+					if s, ok := n.(*ast.InvalidStmt); ok {
+						got = append(got, s.Text)
+					}
+					return true
+				})
+				if !reflect.DeepEqual(got, tt.want) {
+					t.Errorf("mode %d: InvalidStmt = %q, want %q", mode, got, tt.want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,312 @@
+// 存在条件
+// 描述代码在哪些配置下存在的布尔公式，原子为 defined(X) 或含有配置宏的条件表达式
+package presence
+
+import (
+	"sort"
+	"strings"
+)
+
+type op int
+
+const (
+	opFalse op = iota
+	opTrue
+	opAtom
+	opNot
+	opAnd
+	opOr
+)
+
+// 布尔公式，构造时化简常量、重复项及互补项
+type Cond struct {
+	op   op
+	atom string
+	args []*Cond
+	str  string
+}
+
+// 恒真与恒假
+var (
+	True  = &Cond{op: opTrue, str: "1"}
+	False = &Cond{op: opFalse, str: "0"}
+)
+
+// 原子条件，text 为 C 表达式
+func Atom(text string) *Cond {
+	return &Cond{op: opAtom, atom: text, str: text}
+}
+
+// 宏已定义
+func Defined(name string) *Cond {
+	return Atom("defined(" + name + ")")
+}
+
+// 取反
+func Not(c *Cond) *Cond {
+	switch c.op {
+	case opTrue:
+		return False
+	case opFalse:
+		return True
+	case opNot:
+		return c.args[0]
+	}
+	return &Cond{op: opNot, args: []*Cond{c}, str: "!" + c.group(opNot)}
+}
+
+// 合取
+func And(list ...*Cond) *Cond {
+	return join(opAnd, list)
+}
+
+// 析取
+func Or(list ...*Cond) *Cond {
+	return join(opOr, list)
+}
+
+// 合并同类运算，unit 为单位元，zero 为零元
+func join(o op, list []*Cond) *Cond {
+	unit, zero := True, False
+	if o == opOr {
+		unit, zero = False, True
+	}
+	var args []*Cond
+	seen := map[string]bool{}
+	var add func(c *Cond) bool
+	add = func(c *Cond) bool {
+		switch {
+		case c == zero || c.op == zero.op:
+			return false
+		case c == unit || c.op == unit.op:
+			return true
+		case c.op == o:
+			for _, a := range c.args {
+				if !add(a) {
+					return false
+				}
+			}
+			return true
+		}
+		if seen[Not(c).str] {
+			// x && !x 为假，x || !x 为真
+			return false
+		}
+		if !seen[c.str] {
+			seen[c.str] = true
+			args = append(args, c)
+		}
+		return true
+	}
+	for _, c := range list {
+		if !add(c) {
+			return zero
+		}
+	}
+	if reduced, ok := absorb(o, args); ok {
+		return join(o, reduced)
+	}
+	switch len(args) {
+	case 0:
+		return unit
+	case 1:
+		return args[0]
+	}
+	sep := " && "
+	if o == opOr {
+		sep = " || "
+	}
+	texts := make([]string, len(args))
+	for i, a := range args {
+		texts[i] = a.group(o)
+	}
+	return &Cond{op: o, args: args, str: strings.Join(texts, sep)}
+}
+
+// 吸收律 x || (x && y) = x，以及 x || (!x && y) = x || y，合取时对偶
+func absorb(o op, args []*Cond) ([]*Cond, bool) {
+	inner := opAnd
+	if o == opAnd {
+		inner = opOr
+	}
+	seen := map[string]bool{}
+	for _, a := range args {
+		seen[a.str] = true
+	}
+	changed := false
+	var list []*Cond
+	for _, a := range args {
+		if a.op != inner {
+			list = append(list, a)
+			continue
+		}
+		var rest []*Cond
+		absorbed := false
+		for _, b := range a.args {
+			if seen[b.str] {
+				absorbed = true
+				break
+			}
+			if !seen[Not(b).str] {
+				rest = append(rest, b)
+			}
+		}
+		switch {
+		case absorbed:
+			changed = true
+		case len(rest) < len(a.args):
+			changed = true
+			list = append(list, join(inner, rest))
+		default:
+			list = append(list, a)
+		}
+	}
+	return list, changed
+}
+
+// 作为 parent 的运算数时的文本，按需加括号
+func (c *Cond) group(parent op) string {
+	switch c.op {
+	case opAtom:
+		if simpleAtom(c.atom) {
+			return c.str
+		}
+	case opTrue, opFalse, opNot:
+		return c.str
+	case opAnd, opOr:
+		if c.op == parent {
+			return c.str
+		}
+	}
+	return "(" + c.str + ")"
+}
+
+// 标识符或 defined(X)，不需要括号
+func simpleAtom(s string) bool {
+	s = strings.TrimSuffix(strings.TrimPrefix(s, "defined("), ")")
+	for i := 0; i < len(s); i++ {
+		b := s[i]
+		if !(b == '_' || 'a' <= b && b <= 'z' || 'A' <= b && b <= 'Z' || i > 0 && '0' <= b && b <= '9') {
+			return false
+		}
+	}
+	return s != ""
+}
+
+// C 表达式形式
+func (c *Cond) String() string {
+	return c.str
+}
+
+// 编码为 C 表达式文本
+func (c *Cond) MarshalText() ([]byte, error) {
+	return []byte(c.str), nil
+}
+
+// 是否恒真
+func (c *Cond) IsTrue() bool {
+	return c.op == opTrue
+}
+
+// 是否恒假
+func (c *Cond) IsFalse() bool {
+	return c.op == opFalse
+}
+
+// 公式中的原子，按文本排序
+func (c *Cond) Atoms() []string {
+	seen := map[string]bool{}
+	var list []string
+	var walk func(c *Cond)
+	walk = func(c *Cond) {
+		if c.op == opAtom && !seen[c.atom] {
+			seen[c.atom] = true
+			list = append(list, c.atom)
+		}
+		for _, a := range c.args {
+			walk(a)
+		}
+	}
+	walk(c)
+	sort.Strings(list)
+	return list
+}
+
+// 按原子的值求值
+func (c *Cond) Eval(value func(atom string) bool) bool {
+	switch c.op {
+	case opTrue:
+		return true
+	case opAtom:
+		return value(c.atom)
+	case opNot:
+		return !c.args[0].Eval(value)
+	case opAnd:
+		for _, a := range c.args {
+			if !a.Eval(value) {
+				return false
+			}
+		}
+		return true
+	case opOr:
+		for _, a := range c.args {
+			if a.Eval(value) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// 将原子替换为常量后化简
+func (c *Cond) Assign(atom string, v bool) *Cond {
+	switch c.op {
+	case opAtom:
+		if c.atom != atom {
+			return c
+		}
+		if v {
+			return True
+		}
+		return False
+	case opNot:
+		return Not(c.args[0].Assign(atom, v))
+	case opAnd, opOr:
+		args := make([]*Cond, len(c.args))
+		for i, a := range c.args {
+			args[i] = a.Assign(atom, v)
+		}
+		return join(c.op, args)
+	}
+	return c
+}
+
+// 是否可满足
+// 原子之间视为相互独立，依次为原子赋值并化简
+func (c *Cond) Satisfiable() bool {
+	switch c.op {
+	case opTrue:
+		return true
+	case opFalse:
+		return false
+	}
+	atom := c.firstAtom()
+	return c.Assign(atom, true).Satisfiable() || c.Assign(atom, false).Satisfiable()
+}
+
+func (c *Cond) firstAtom() string {
+	if c.op == opAtom {
+		return c.atom
+	}
+	return c.args[0].firstAtom()
+}
+
+// c 成立时 d 一定成立
+func (c *Cond) Implies(d *Cond) bool {
+	return !And(c, Not(d)).Satisfiable()
+}
+
+// 两个公式是否等价
+func (c *Cond) Equal(d *Cond) bool {
+	return c.Implies(d) && d.Implies(c)
+}
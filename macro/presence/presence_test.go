@@ -0,0 +1,92 @@
+package presence
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestCond_String(t *testing.T) {
+	a, b, c := Defined("A"), Defined("B"), Atom("N > 2")
+	tests := []struct {
+		name string
+		cond *Cond
+		want string
+	}{
+		{"atom", a, "defined(A)"},
+		{"not", Not(a), "!defined(A)"},
+		{"double not", Not(Not(a)), "defined(A)"},
+		{"not expr", Not(c), "!(N > 2)"},
+		{"and", And(a, Not(b)), "defined(A) && !defined(B)"},
+		{"flatten", And(a, And(b, c)), "defined(A) && defined(B) && (N > 2)"},
+		{"or of and", Or(And(a, b), c), "(defined(A) && defined(B)) || (N > 2)"},
+		{"not or", Not(Or(a, b)), "!(defined(A) || defined(B))"},
+		{"duplicate", And(a, a, True), "defined(A)"},
+		{"contradiction", And(a, b, Not(a)), "0"},
+		{"tautology", Or(b, a, Not(a)), "1"},
+		{"empty and", And(), "1"},
+		{"empty or", Or(), "0"},
+		{"false and", And(a, False), "0"},
+		{"absorb", Or(a, And(a, b)), "defined(A)"},
+		{"absorb not", Or(a, And(Not(a), b)), "defined(A) || defined(B)"},
+		{"absorb dual", And(Or(Not(a), b), a), "defined(B) && defined(A)"},
+		{"absorb to unit", Or(a, And(Not(a))), "1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.cond.String(); got != tt.want {
+				t.Errorf("String() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCond_Satisfiable(t *testing.T) {
+	a, b := Defined("A"), Defined("B")
+	tests := []struct {
+		name string
+		cond *Cond
+		want bool
+	}{
+		{"atom", a, true},
+		{"and", And(a, Not(b)), true},
+		{"nested contradiction", And(Or(a, b), Not(a), Not(b)), false},
+		{"or", Or(And(a, Not(a)), b), true},
+		{"false", False, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.cond.Satisfiable(); got != tt.want {
+				t.Errorf("Satisfiable() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+	if !And(a, b).Implies(Or(a, b)) || Or(a, b).Implies(And(a, b)) {
+		t.Error("Implies() wrong")
+	}
+	if !Or(And(a, b), And(a, Not(b))).Equal(a) {
+		t.Error("Equal() wrong")
+	}
+}
+
+func TestCond_Eval(t *testing.T) {
+	c := Or(And(Defined("A"), Not(Defined("B"))), Atom("N > 2"))
+	if got, want := c.Atoms(), []string{"N > 2", "defined(A)", "defined(B)"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Atoms() = %q, want %q", got, want)
+	}
+	set := func(atoms ...string) func(string) bool {
+		return func(atom string) bool {
+			for _, a := range atoms {
+				if a == atom {
+					return true
+				}
+			}
+			return false
+		}
+	}
+	if !c.Eval(set("defined(A)")) || c.Eval(set("defined(A)", "defined(B)")) || !c.Eval(set("N > 2")) {
+		t.Error("Eval() wrong")
+	}
+	if got := c.Assign("defined(B)", false).String(); got != "defined(A) || (N > 2)" {
+		t.Errorf("Assign() = %q", got)
+	}
+}
@@ -0,0 +1,392 @@
+package printer
+
+import (
+	"bytes"
+	"dxkite.cn/language/macro/ast"
+	"dxkite.cn/language/macro/token"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strings"
+)
+
+// 输出模式
+type Mode uint
+
+const (
+	SpacePaste      Mode = 1 << iota // ## 两侧添加空格
+	IndentDirective                  // 条件块内的指令在 # 后按嵌套层级缩进
+)
+
+// 输出配置
+type Config struct {
+	Mode   Mode // 输出模式
+	Indent int  // 每层缩进的空格数（IndentDirective）
+}
+
+// 带注释的语法树
+// 输出时在指令行尾保留 Comments 中的行尾注释
+type CommentedNode struct {
+	Node     ast.Node
+	Comments []*ast.CommentGroup // parser.ParseComments 的结果
+}
+
+func (n *CommentedNode) Pos() token.Pos { return n.Node.Pos() }
+func (n *CommentedNode) End() token.Pos { return n.Node.End() }
+
+// 输出语法树
+func (cfg *Config) Fprint(output io.Writer, node ast.Node) error {
+	p := &printer{Config: *cfg}
+	if n, ok := node.(*CommentedNode); ok {
+		p.setComments(n.Node, n.Comments)
+		node = n.Node
+	}
+	if err := p.node(node); err != nil {
+		return err
+	}
+	_, err := output.Write(p.buf.Bytes())
+	return err
+}
+
+// 使用默认配置输出语法树
+func Fprint(output io.Writer, node ast.Node) error {
+	return (&Config{Indent: 1}).Fprint(output, node)
+}
+
+// 输出为字符串
+func Sprint(node ast.Node) string {
+	var b bytes.Buffer
+	_ = Fprint(&b, node)
+	return b.String()
+}
+
+type printer struct {
+	Config
+	buf      bytes.Buffer
+	depth    int            // 条件嵌套层级
+	comments []*ast.Comment // 不在语法树中的注释，即指令的行尾注释
+	starts   []token.Pos    // 语法树节点的起始位置，已排序
+}
+
+// 记录语法树之外的注释
+func (p *printer) setComments(node ast.Node, groups []*ast.CommentGroup) {
+	inTree := map[token.Pos]bool{}
+	ast.Inspect(node, func(n ast.Node) bool {
+		if n != nil {
+			inTree[n.Pos()] = true
+			p.starts = append(p.starts, n.Pos())
+		}
+		return true
+	})
+	sort.Slice(p.starts, func(i, j int) bool { return p.starts[i] < p.starts[j] })
+	for _, g := range groups {
+		for _, c := range g.List {
+			if !inTree[c.Pos()] {
+				p.comments = append(p.comments, c)
+			}
+		}
+	}
+}
+
+// 结束指令行，输出 [from, to) 中的行尾注释
+// 指令末尾的空白不输出
+func (p *printer) lineEnd(from, to token.Pos) {
+	b := p.buf.Bytes()
+	n := len(b)
+	for n > 0 && (b[n-1] == ' ' || b[n-1] == '\t') {
+		n--
+	}
+	p.buf.Truncate(n)
+	if from != token.NoPos {
+		for _, c := range p.comments {
+			if from <= c.Pos() && c.Pos() < to {
+				p.buf.WriteString(" " + c.Text)
+			}
+		}
+	}
+	p.buf.WriteByte('\n')
+}
+
+// 结束指令语句，行尾注释位于语句之后、下一个节点之前
+func (p *printer) stmtEnd(node ast.Node) {
+	if len(p.comments) == 0 {
+		p.lineEnd(token.NoPos, token.NoPos)
+		return
+	}
+	end := node.End()
+	i := sort.Search(len(p.starts), func(i int) bool { return p.starts[i] >= end })
+	to := token.Pos(math.MaxInt32)
+	if i < len(p.starts) {
+		to = p.starts[i]
+	}
+	p.lineEnd(end, to)
+}
+
+// 结束条件指令，手动构造的语法树中没有指令位置
+func (p *printer) directiveEnd(d *ast.Directive) {
+	if d == nil {
+		p.lineEnd(token.NoPos, token.NoPos)
+		return
+	}
+	p.lineEnd(d.From, d.To)
+}
+
+func (p *printer) node(node ast.Node) error {
+	switch n := node.(type) {
+	case nil:
+	case ast.Stmt:
+		p.stmt(n)
+	case ast.MacroLiter:
+		p.buf.WriteString(p.lit(n))
+	default:
+		return fmt.Errorf("printer: unsupported node type %T", node)
+	}
+	return nil
+}
+
+// 输出语句
+func (p *printer) stmt(node ast.Stmt) {
+	switch n := node.(type) {
+	case nil:
+	case *ast.BlockStmt:
+		if n == nil {
+			return
+		}
+		for _, stmt := range *n {
+			p.stmt(stmt)
+		}
+	case *ast.MacroLitArray:
+		p.buf.WriteString(p.lit(n))
+	case *ast.Text:
+		p.buf.WriteString(n.Text)
+	case *ast.RawGroup:
+		p.buf.WriteString(n.Text)
+	case *ast.Comment:
+		p.buf.WriteString(n.Text)
+	case *ast.BadExpr:
+		p.buf.WriteString(n.Lit)
+	case *ast.ValDefineStmt:
+		p.directive("define")
+		p.buf.WriteString(" " + n.Name.Name)
+		if body := p.lit(n.Body); len(body) > 0 {
+			p.buf.WriteString(" " + body)
+		}
+		p.stmtEnd(n)
+	case *ast.FuncDefineStmt:
+		p.directive("define")
+		p.buf.WriteString(" " + n.Name.Name + "(")
+		for i, id := range n.IdentList {
+			if i > 0 {
+				p.buf.WriteString(", ")
+			}
+			p.buf.WriteString(id.Name)
+		}
+		p.buf.WriteString(")")
+		if body := p.lit(n.Body); len(body) > 0 {
+			p.buf.WriteString(" " + body)
+		}
+		p.stmtEnd(n)
+	case *ast.UnDefineStmt:
+		p.directive("undef")
+		p.buf.WriteString(" " + n.Name.Name)
+		p.stmtEnd(n)
+	case *ast.IncludeStmt:
+		p.directive("include")
+		if n.Type == ast.IncludeMacro {
+			p.buf.WriteString(" " + p.lit(n.Name))
+		} else {
+			p.buf.WriteString(" " + n.Path)
+		}
+		p.stmtEnd(n)
+	case *ast.LineStmt:
+		p.directive("line")
+		p.buf.WriteString(" " + n.Line)
+		if len(n.Path) > 0 {
+			p.buf.WriteString(" " + n.Path)
+		}
+		p.stmtEnd(n)
+	case *ast.MacroCmdStmt:
+		p.lineStart()
+		p.buf.WriteString(n.Cmd)
+		p.stmtEnd(n)
+	case *ast.InvalidStmt:
+		p.lineStart()
+		p.buf.WriteString(n.Text)
+		p.stmtEnd(n)
+	case *ast.IfStmt, *ast.IfDefStmt, *ast.IfNoDefStmt:
+		p.condStmt(n)
+	case *ast.ElseIfStmt:
+		p.elseStmt(n)
+	}
+}
+
+// 条件块
+func (p *printer) block(node ast.Stmt) {
+	p.depth++
+	p.stmt(node)
+	p.depth--
+}
+
+// 条件语句
+func (p *printer) condStmt(stmt ast.Stmt) {
+	block := ast.Branches(stmt)
+	for i, b := range block.Branches {
+		switch n := stmt.(type) {
+		case *ast.IfStmt:
+			if i == 0 {
+				p.directive("if")
+				p.buf.WriteString(p.cond(n.X))
+			}
+		case *ast.IfDefStmt:
+			if i == 0 {
+				p.directive("ifdef")
+				p.buf.WriteString(" " + n.Name.Name)
+			}
+		case *ast.IfNoDefStmt:
+			if i == 0 {
+				p.directive("ifndef")
+				p.buf.WriteString(" " + n.Name.Name)
+			}
+		}
+		if i > 0 && b.Cond != nil {
+			p.directive("elif")
+			p.buf.WriteString(p.cond(b.Cond))
+		} else if i > 0 {
+			p.directive("else")
+		}
+		p.directiveEnd(b.Directive)
+		p.block(b.Body)
+	}
+	p.directive("endif")
+	p.directiveEnd(block.Endif)
+}
+
+// #elif #else 分支
+func (p *printer) elseStmt(node ast.Stmt) {
+	switch n := node.(type) {
+	case nil:
+	case *ast.ElseIfStmt:
+		p.directive("elif")
+		p.buf.WriteString(p.cond(n.X))
+		p.lineEnd(token.NoPos, token.NoPos)
+		p.block(n.Then)
+		p.elseStmt(n.Else)
+	default:
+		p.directive("else")
+		p.lineEnd(token.NoPos, token.NoPos)
+		p.block(n)
+	}
+}
+
+// 条件表达式，与指令名之间至少一个空白
+func (p *printer) cond(x ast.MacroLiter) string {
+	s := p.lit(x)
+	if len(s) > 0 && s[0] != ' ' && s[0] != '\t' {
+		return " " + s
+	}
+	return s
+}
+
+// 输出指令名
+func (p *printer) directive(name string) {
+	p.lineStart()
+	p.buf.WriteByte('#')
+	if p.Mode&IndentDirective != 0 {
+		p.buf.WriteString(strings.Repeat(" ", p.depth*p.Indent))
+	}
+	p.buf.WriteString(name)
+}
+
+// 指令必须位于行首
+func (p *printer) lineStart() {
+	b := p.buf.Bytes()
+	for i := len(b) - 1; i >= 0; i-- {
+		switch b[i] {
+		case ' ', '\t':
+		case '\n':
+			return
+		default:
+			p.buf.WriteByte('\n')
+			return
+		}
+	}
+}
+
+// 输出字面量
+func (p *printer) lit(node ast.MacroLiter) string {
+	switch n := node.(type) {
+	case nil:
+	case *ast.Text:
+		return n.Text
+	case *ast.Ident:
+		return n.Name
+	case *ast.LitExpr:
+		return n.Value
+	case *ast.BadExpr:
+		return n.Lit
+	case *ast.MacroLitArray:
+		if n == nil {
+			return ""
+		}
+		var b strings.Builder
+		for _, item := range *n {
+			b.WriteString(p.lit(item))
+		}
+		return b.String()
+	case *ast.MacroCallExpr:
+		return n.Name.Name + "(" + p.args(n.ParamList) + ")"
+	case *ast.ParenExpr:
+		// 宏参数中的括号内容为参数列表
+		if list, ok := n.X.(*ast.MacroLitArray); ok {
+			return "(" + p.args(list) + ")"
+		}
+		return "(" + p.lit(n.X) + ")"
+	case *ast.UnaryExpr:
+		switch n.Op {
+		case token.DEFINED:
+			if _, ok := n.X.(*ast.ParenExpr); ok {
+				return "defined" + p.lit(n.X)
+			}
+			return "defined " + p.lit(n.X)
+		case token.SHARP:
+			return "#" + p.lit(n.X)
+		}
+		return n.Op.String() + p.operand(n.X, token.UnaryPrec)
+	case *ast.BinaryExpr:
+		if n.Op == token.DOUBLE_SHARP {
+			if p.Mode&SpacePaste != 0 {
+				return p.lit(n.X) + " ## " + p.lit(n.Y)
+			}
+			return p.lit(n.X) + "##" + p.lit(n.Y)
+		}
+		prec := n.Op.Precedence()
+		return p.operand(n.X, prec) + " " + n.Op.String() + " " + p.operand(n.Y, prec+1)
+	case *ast.CondExpr:
+		return p.operand(n.Cond, token.LowestPrec+1) + " ? " + p.lit(n.X) + " : " + p.lit(n.Y)
+	}
+	return ""
+}
+
+// 运算数，优先级低于 prec 时添加括号
+func (p *printer) operand(x ast.MacroLiter, prec int) string {
+	if b, ok := x.(*ast.BinaryExpr); ok && b.Op != token.DOUBLE_SHARP && b.Op.Precedence() < prec {
+		return "(" + p.lit(x) + ")"
+	}
+	if _, ok := x.(*ast.CondExpr); ok && prec > token.LowestPrec {
+		return "(" + p.lit(x) + ")"
+	}
+	return p.lit(x)
+}
+
+// 宏调用参数
+func (p *printer) args(list *ast.MacroLitArray) string {
+	if list == nil {
+		return ""
+	}
+	args := make([]string, 0, len(*list))
+	for _, arg := range *list {
+		args = append(args, p.lit(arg))
+	}
+	return strings.Join(args, ",")
+}
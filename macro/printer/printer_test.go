@@ -0,0 +1,208 @@
+package printer
+
+import (
+	"bytes"
+	"dxkite.cn/language/macro/ast"
+	"dxkite.cn/language/macro/parser"
+	"dxkite.cn/language/macro/token"
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestFprint(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  Config
+		src  string
+		want string
+	}{
+		{
+			"define",
+			Config{},
+			"#  define  A   1 + 2\n#define F( a,b )a ## b #a\n#undef A",
+			"#define A 1 + 2\n#define F(a, b) a##b #a\n#undef A\n",
+		},
+		{
+			"else after else",
+			Config{},
+			"#ifdef A\na\n#else\nb\n#else\nc\n#endif\n#ifndef A\n#else\n#elif B\nc\n#endif\n",
+			"#ifdef A\na\n#else\nb\n#else\nc\n#endif\n#ifndef A\n#else\n#elif B\nc\n#endif\n",
+		},
+		{
+			"space paste",
+			Config{Mode: SpacePaste},
+			"#define F(a,b) a##b\n",
+			"#define F(a, b) a ## b\n",
+		},
+		{
+			"conditional",
+			Config{},
+			"#if defined (A) // a\na\n#elif B\nb\n#else\nc\n#endif\n",
+			"#if defined(A)\na\n#elif B\nb\n#else\nc\n#endif\n",
+		},
+		{
+			"indent directive",
+			Config{Mode: IndentDirective, Indent: 2},
+			"#ifdef A\n#ifndef B\n#include <b.h>\n#endif\n#endif\n",
+			"#ifdef A\n#  ifndef B\n#    include <b.h>\n#  endif\n#endif\n",
+		},
+		{
+			"text",
+			Config{},
+			"int a = f (x, (y,z));\n#line 10 \"a.c\"\n",
+			"int a = f(x, (y,z));\n#line 10 \"a.c\"\n",
+		},
+		{
+			"unterminated",
+			Config{},
+			"#if A\na",
+			"#if A\na\n#endif\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			node, _ := parser.Parse([]byte(tt.src))
+			var b bytes.Buffer
+			if err := tt.cfg.Fprint(&b, node); err != nil {
+				t.Fatal(err)
+			}
+			if got := b.String(); got != tt.want {
+				t.Errorf("Fprint() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// 指令的行尾注释
+func TestFprint_comments(t *testing.T) {
+	src := []byte("#if defined (A) // a\na\n#elif B\nb\n#else // c\n// own line\nc\n#endif // end\n" +
+		"#undef A /* u */\n#include <a.h> // i\n#pragma once // p\n#define X 1 // x\n")
+	want := "#if defined(A) // a\na\n#elif B\nb\n#else // c\n// own line\nc\n#endif // end\n" +
+		"#undef A /* u */\n#include <a.h> // i\n#pragma once // p\n#define X 1 // x\n"
+	node, _ := parser.Parse(src)
+	var b bytes.Buffer
+	if err := Fprint(&b, &CommentedNode{Node: node, Comments: parser.ParseComments(src)}); err != nil {
+		t.Fatal(err)
+	}
+	if got := b.String(); got != want {
+		t.Errorf("Fprint() = %q, want %q", got, want)
+	}
+}
+
+func TestFprint_expr(t *testing.T) {
+	tests := []struct {
+		name string
+		node ast.MacroLiter
+		want string
+	}{
+		{
+			"paren",
+			&ast.BinaryExpr{
+				X:  &ast.BinaryExpr{X: &ast.Ident{Name: "a"}, Op: token.ADD, Y: &ast.Ident{Name: "b"}},
+				Op: token.MUL,
+				Y:  &ast.LitExpr{Kind: token.INT, Value: "2"},
+			},
+			"(a + b) * 2",
+		},
+		{
+			"unary",
+			&ast.UnaryExpr{Op: token.LNOT, X: &ast.UnaryExpr{Op: token.DEFINED, X: &ast.Ident{Name: "A"}}},
+			"!defined A",
+		},
+		{
+			"cond",
+			&ast.BinaryExpr{
+				X: &ast.CondExpr{
+					Cond: &ast.CondExpr{Cond: &ast.Ident{Name: "a"}, X: &ast.Ident{Name: "b"}, Y: &ast.Ident{Name: "c"}},
+					X:    &ast.Ident{Name: "d"},
+					Y:    &ast.CondExpr{Cond: &ast.Ident{Name: "e"}, X: &ast.Ident{Name: "f"}, Y: &ast.Ident{Name: "g"}},
+				},
+				Op: token.ADD,
+				Y:  &ast.LitExpr{Kind: token.INT, Value: "1"},
+			},
+			"((a ? b : c) ? d : e ? f : g) + 1",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Sprint(tt.node); got != tt.want {
+				t.Errorf("Sprint() = %q, want %q", got, tt.want)
+			}
+			expr, errs := parser.ParseExpr([]byte(tt.want), 0)
+			if len(errs) > 0 {
+				t.Fatal(errs)
+			}
+			if got := Sprint(expr); got != tt.want {
+				t.Errorf("Sprint(ParseExpr()) = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// 输出后重新解析得到相同的语法树
+func TestFprint_roundTrip(t *testing.T) {
+	files, err := filepath.Glob("../parser/testdata/*.c")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range files {
+		t.Run(filepath.Base(name), func(t *testing.T) {
+			src, err := ioutil.ReadFile(name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, cfg := range []Config{{}, {Mode: SpacePaste | IndentDirective, Indent: 2}} {
+				node, _ := parser.Parse(src)
+				var b bytes.Buffer
+				if err := cfg.Fprint(&b, node); err != nil {
+					t.Fatal(err)
+				}
+				got, errs := parser.Parse(b.Bytes())
+				if len(errs) > 0 {
+					t.Fatal(errs)
+				}
+				if !equal(got, node) {
+					gotS, _ := json.Marshal(clearPos(got))
+					wantS, _ := json.Marshal(clearPos(node))
+					t.Errorf("round trip = \ngot \t%s\nwant\t%s", gotS, wantS)
+				}
+			}
+		})
+	}
+}
+
+func equal(x, y ast.Node) bool {
+	return reflect.DeepEqual(clearPos(x), clearPos(y))
+}
+
+// 清除位置信息
+func clearPos(node ast.Node) ast.Node {
+	clearValue(reflect.ValueOf(node))
+	return node
+}
+
+var posType = reflect.TypeOf(token.Pos(0))
+
+func clearValue(v reflect.Value) {
+	switch v.Kind() {
+	case reflect.Ptr, reflect.Interface:
+		if !v.IsNil() {
+			clearValue(v.Elem())
+		}
+	case reflect.Slice:
+		for i := 0; i < v.Len(); i++ {
+			clearValue(v.Index(i))
+		}
+	case reflect.Struct:
+		for i := 0; i < v.NumField(); i++ {
+			if f := v.Field(i); f.Type() == posType {
+				f.SetInt(0)
+			} else {
+				clearValue(f)
+			}
+		}
+	}
+}
@@ -8,14 +8,27 @@
 
 // 扫描错误
 type Error struct {
-	Pos token.Position
-	Msg string
+	Pos     token.Position
+	Msg     string
+	Warning bool // 警告，不影响处理结果
+	// 信息中引用的位置，Msg 由 Format 按这些位置的 行:列 生成
+	// 增量解析时引用随修改平移后重新生成 Msg
+	Format string
+	Refs   []token.Pos
 }
 
 // 错误信息
 func (e Error) Error() string {
 	if e.Pos.IsValid() {
-		return e.Pos.String() + ": " + e.Msg
+		return e.Pos.String() + ": " + e.Message()
+	}
+	return e.Message()
+}
+
+// 警告带有 warning: 前缀的信息
+func (e Error) Message() string {
+	if e.Warning {
+		return "warning: " + e.Msg
 	}
 	return e.Msg
 }
@@ -25,7 +38,12 @@ func (e Error) Error() string {
 
 // 添加一个错误
 func (p *ErrorList) Add(pos token.Position, msg string) {
-	*p = append(*p, &Error{pos, msg})
+	*p = append(*p, &Error{Pos: pos, Msg: msg})
+}
+
+// 添加一个警告
+func (p *ErrorList) AddWarning(pos token.Position, msg string) {
+	*p = append(*p, &Error{Pos: pos, Msg: msg, Warning: true})
 }
 
 // 合并错误
@@ -20,11 +20,14 @@ type Scanner interface {
 
 // 词法扫描
 type scanner struct {
-	src         []byte // source
-	ch          rune   // current character
-	offset      int    // character offset
-	rdOffset    int    // reading offset (position after current character)
-	isLineStart bool   // line start
+	src         []byte      // source
+	ch          rune        // current character
+	offset      int         // character offset
+	rdOffset    int         // reading offset (position after current character)
+	isLineStart bool        // line start (only whitespace or comments before)
+	directive   token.Token // current directive, token.MACRO when expecting directive name
+	splice      bool        // skip backslash-newline inside tokens (translation phase 2)
+	lastSplice  int         // offset of the backslash-newline skipped before current character, -1 if none
 
 	posInfo token.FilePos // file position
 	err     ErrorList     // error list
@@ -37,18 +40,20 @@ func (s *scanner) init(src []byte) {
 	s.offset = 0
 	s.rdOffset = 0
 	s.err.Reset()
+	s.posInfo.Init(src)
+	s.splice = true
 	s.next()
 	s.isLineStart = true
-	s.posInfo.Init(src)
+	s.directive = token.ILLEGAL
 }
 
 func (s *scanner) next() {
-	s.isLineStart = false
+	s.lastSplice = -1
+	if s.splice {
+		s.skipSplice()
+	}
 	if s.rdOffset < len(s.src) {
 		s.offset = s.rdOffset
-		if s.ch == '\n' {
-			s.isLineStart = true
-		}
 		r, w := rune(s.src[s.rdOffset]), 1
 		switch {
 		case r == 0:
@@ -69,42 +74,65 @@ func (s *scanner) next() {
 }
 
 func (s *scanner) Scan() (offset token.Pos, tok token.Token, lit string) {
+	offset, tok, lit = s.scan()
+	s.unsplice()
+	switch tok {
+	case token.NEWLINE, token.EOF:
+		s.isLineStart = true
+		s.directive = token.ILLEGAL
+		return
+	case token.BLOCK_COMMENT, token.BACKSLASH_NEWLINE:
+		return
+	case token.TEXT:
+		if isSpace(lit) {
+			return
+		}
+	}
+	s.isLineStart = false
+	if s.directive == token.MACRO {
+		s.directive = tok
+	}
+	return
+}
+
+// 标识符类型
+// 关键字只在指令名位置识别，defined 只在 #if/#elif 中识别
+func (s *scanner) identKind(lit string) token.Token {
+	if s.directive == token.MACRO {
+		if tok := token.Lookup(lit); tok != token.DEFINED {
+			return tok
+		}
+	}
+	if lit == "defined" && s.inCondition() {
+		return token.DEFINED
+	}
+	return token.IDENT
+}
+
+// 是否位于 #if #elif 的条件中
+func (s *scanner) inCondition() bool {
+	return s.directive == token.IF || s.directive == token.ELSEIF
+}
+
+// 是否是空白
+func isSpace(lit string) bool {
+	for _, ch := range lit {
+		switch ch {
+		case ' ', '\t', '\v', '\f':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+func (s *scanner) scan() (offset token.Pos, tok token.Token, lit string) {
 	offset = token.Pos(s.offset)
 	switch ch := s.ch; {
 	case isLetter(ch):
-		tok = token.IDENT
 		lit = s.scanIdentifier()
-		switch lit {
-		case "defined":
-			tok = token.DEFINED
-		case "include":
-			tok = token.INCLUDE
-		case "if":
-			tok = token.IF
-		case "ifdef":
-			tok = token.IFDEF
-		case "ifndef":
-			tok = token.IFNDEF
-		case "else":
-			tok = token.ELSE
-		case "elif":
-			tok = token.ELSEIF
-		case "endif":
-			tok = token.ENDIF
-		case "undef":
-			tok = token.UNDEF
-		case "line":
-			tok = token.LINE
-		case "define":
-			tok = token.DEFINE
-		case "error":
-			tok = token.ERROR
-		case "pragma":
-			tok = token.PRAGMA
-		case "warning":
-			tok = token.WARNING
-		}
-	case isDecimal(ch):
+		tok = s.identKind(lit)
+	case isDecimal(ch) || ch == '.' && isDecimal(s.peekRune()):
 		tok, lit = s.scanNumber()
 	case ch == '\'' && s.tryChar():
 		c := s.scanChar()
@@ -118,9 +146,20 @@ func (s *scanner) Scan() (offset token.Pos, tok token.Token, lit string) {
 		tok = token.MACRO
 		lit = "#"
 		s.next()
-	case ch == '\\' && s.tryBackslashNewLine():
+		s.directive = token.MACRO
+	case (ch == '?' || ch == ':') && s.inCondition():
+		// 条件运算符只在 #if #elif 中识别
+		s.next()
+		tok = token.QUESTION
+		if ch == ':' {
+			tok = token.COLON
+		}
+		lit = string(ch)
+	case ch == '\\' && s.isSplice(s.offset):
+		n, _ := s.spliceLen(s.offset)
+		s.rdOffset = s.offset + n
 		s.next()
-		s.scanNewLine()
+		s.unsplice()
 		tok = token.BACKSLASH_NEWLINE
 		lit = string(s.src[offset:s.offset])
 	default:
@@ -226,7 +265,7 @@ func (s *scanner) Scan() (offset token.Pos, tok token.Token, lit string) {
 		case '\r':
 			tok = token.NEWLINE
 			s.scanNewLine()
-			lit = string(s.src[offset:s.offset])
+			lit = s.lit(int(offset))
 		case '\n':
 			tok = token.NEWLINE
 			lit = string(ch)
@@ -248,9 +287,13 @@ func (s *scanner) Scan() (offset token.Pos, tok token.Token, lit string) {
 		case -1:
 			tok = token.EOF
 		default:
+			// 文本在续行符处断开
+			s.unsplice()
+			s.splice = false
 			for s.isEndOfText() == false {
 				s.next()
 			}
+			s.splice = true
 			tok = token.TEXT
 			lit = string(s.src[offset:s.offset])
 		}
@@ -341,7 +384,7 @@ func (s *scanner) scanString() string {
 		}
 	}
 	s.next()
-	return string(s.src[offs:s.offset])
+	return s.lit(offs)
 }
 
 // 尝试解析字符串
@@ -390,7 +433,7 @@ func (s *scanner) scanChar() string {
 		}
 	}
 	s.next()
-	return string(s.src[offs:s.offset])
+	return s.lit(offs)
 }
 
 // 尝试解析字符
@@ -423,7 +466,7 @@ func (s *scanner) scanIdentifier() string {
 	for isLetter(s.ch) || isDigit(s.ch) {
 		s.next()
 	}
-	return string(s.src[offs:s.offset])
+	return s.lit(offs)
 }
 
 // 扫描代码注释
@@ -454,96 +497,106 @@ func (s *scanner) scanComment() (tok token.Token, lit string) {
 		s.next() // /
 	}
 exit:
-	lit = string(s.src[offs:s.offset])
+	lit = s.lit(offs)
 	return
 }
 
 // 扫描数字
+// pp-number =
+//    [ "." ] digit < digit / identifier_nondigit / "'" digit / "'" identifier_nondigit
+//    / ( "e" / "E" / "p" / "P" ) ( "+" / "-" ) / "." > .
+// 只按预处理数字扫描，后缀及数值合法性在求值时检查
 func (s *scanner) scanNumber() (tok token.Token, lit string) {
 	offs := s.offset
-	tok = token.INT
-	u := false
-
-	base := 10 // number base
-
-	if s.ch == '0' {
-		s.next()
-		switch lower(s.ch) {
-		case 'x':
+	for {
+		switch e := lower(s.ch); {
+		case (e == 'e' || e == 'p') && (s.peek() == '+' || s.peek() == '-'):
+			s.next()
+			s.next()
+		case s.ch == '\'' && (isLetter(s.peekRune()) || isDigit(s.peekRune())):
 			s.next()
-			base = 16
-		case 'b':
 			s.next()
-			base = 2
+		case isLetter(s.ch) || isDigit(s.ch) || s.ch == '.':
+			s.next()
 		default:
-			base = 8
+			lit = s.lit(offs)
+			tok = numberKind(lit)
+			return
 		}
 	}
-	s.scanNumberBase(base)
-	if s.ch == '.' {
-		tok = token.FLOAT
-		s.next()
-		s.scanNumberBase(base)
-	}
+}
 
-	if e := lower(s.ch); e == 'e' || e == 'p' {
-		switch {
-		case e == 'e' && base != 10 && base != 8:
-			s.errorf(s.offset, "%q exponent requires decimal mantissa", s.ch)
-		case e == 'p' && base != 16:
-			s.errorf(s.offset, "%q exponent requires hexadecimal mantissa", s.ch)
-		}
-		s.next()
-		tok = token.FLOAT
-		if s.ch == '+' || s.ch == '-' {
-			s.next()
+// 判断预处理数字的类型
+// 前缀数字后出现小数点或指数则为浮点数，否则为整数
+func numberKind(lit string) token.Token {
+	i, base := 0, 10
+	if len(lit) > 1 && lit[0] == '0' {
+		switch lower(rune(lit[1])) {
+		case 'x':
+			i, base = 2, 16
+		case 'b':
+			i, base = 2, 2
 		}
-		s.scanNumberBase(10)
 	}
-
-	for isLetter(s.ch) || isDecimal(s.ch) {
-		if lower(s.ch) == 'u' {
-			u = true
-		}
-		if !u && lower(s.ch) == 'f' {
-			tok = token.FLOAT
+	for i < len(lit) {
+		ch := rune(lit[i])
+		if !(ch == '\'' || base == 16 && isHex(ch) || base != 16 && isDecimal(ch)) {
+			break
 		}
-		s.next()
+		i++
 	}
-	lit = string(s.src[offs:s.offset])
-	return
-}
-
-func (s *scanner) scanNumberBase(base int) {
-	if base <= 10 {
-		for isDecimal(s.ch) {
-			s.next()
-		}
-	} else {
-		for isHex(s.ch) {
-			s.next()
+	if i < len(lit) {
+		switch e := lower(rune(lit[i])); {
+		case e == '.', e == 'p' && base == 16, e == 'e' && base == 10:
+			return token.FLOAT
 		}
 	}
-	return
+	return token.INT
 }
 
 func (s *scanner) isEndOfText() bool {
 	if s.ch < 0 || isLetter(s.ch) || isDecimal(s.ch) || strings.Contains("\\/'\"(),+-*%&|=^~<>!\n\r#", string(s.ch)) {
 		if s.ch == '\\' {
-			return s.tryBackslashNewLine()
+			n, _ := s.spliceLen(s.offset)
+			return n > 0
 		}
 		return true
 	}
-	return false
+	if (s.ch == '?' || s.ch == ':') && s.inCondition() {
+		return true
+	}
+	// .5
+	return s.ch == '.' && isDecimal(s.peekRune())
 }
 
 func (s *scanner) peek() byte {
-	if s.rdOffset < len(s.src) {
-		return s.src[s.rdOffset]
+	if i := s.peekOffset(); i < len(s.src) {
+		return s.src[i]
 	}
 	return 0
 }
 
+func (s *scanner) peekRune() rune {
+	if i := s.peekOffset(); i < len(s.src) {
+		r, _ := utf8.DecodeRune(s.src[i:])
+		return r
+	}
+	return -1
+}
+
+// 下一个字符的位置（跳过续行符）
+func (s *scanner) peekOffset() int {
+	i := s.rdOffset
+	for s.splice {
+		n, _ := s.spliceLen(i)
+		if n == 0 {
+			break
+		}
+		i += n
+	}
+	return i
+}
+
 // 复制一份，除了代码
 func (s *scanner) CloneWithoutSrc() Scanner {
 	return &scanner{
@@ -551,6 +604,9 @@ func (s *scanner) CloneWithoutSrc() Scanner {
 		offset:      s.offset,
 		rdOffset:    s.rdOffset,
 		isLineStart: s.isLineStart,
+		directive:   s.directive,
+		splice:      s.splice,
+		lastSplice:  s.lastSplice,
 		err:         s.err,
 		posInfo:     s.posInfo,
 	}
@@ -581,6 +637,9 @@ func (s *scanner) save() *scanner {
 		offset:      s.offset,
 		rdOffset:    s.rdOffset,
 		isLineStart: s.isLineStart,
+		directive:   s.directive,
+		splice:      s.splice,
+		lastSplice:  s.lastSplice,
 		err:         s.err,
 	}
 }
@@ -599,22 +658,78 @@ func (s *scanner) skipWhitespace() {
 	}
 }
 
-func (s *scanner) tryBackslashNewLine() bool {
-	ss := s.save()
-	defer s.reset(ss)
-	ok := false
-	if s.ch == '\\' {
-		s.next()
-		for s.ch == '\r' {
-			s.next()
-			ok = true
+// 续行符长度
+// "\\" [ " " / "\t" ] < "\r" > [ "\n" ]，spaced 表示反斜杠与换行之间有空白
+func (s *scanner) spliceLen(i int) (n int, spaced bool) {
+	if i >= len(s.src) || s.src[i] != '\\' {
+		return 0, false
+	}
+	j := i + 1
+	for j < len(s.src) && (s.src[j] == ' ' || s.src[j] == '\t') {
+		j++
+	}
+	spaced = j > i+1
+	k := j
+	for k < len(s.src) && s.src[k] == '\r' {
+		k++
+	}
+	if k < len(s.src) && s.src[k] == '\n' {
+		k++
+	}
+	if k == j {
+		return 0, false
+	}
+	return k - i, spaced
+}
+
+// 是否是续行符
+func (s *scanner) isSplice(i int) bool {
+	n, spaced := s.spliceLen(i)
+	if spaced {
+		s.warning(i, "backslash and newline separated by space")
+	}
+	return n > 0
+}
+
+// 跳过读取位置的续行符
+func (s *scanner) skipSplice() {
+	for {
+		n, _ := s.spliceLen(s.rdOffset)
+		if n == 0 {
+			return
 		}
-		if s.ch == '\n' {
-			s.next()
-			ok = true
+		if s.lastSplice < 0 {
+			s.lastSplice = s.rdOffset
+		}
+		s.rdOffset += n
+	}
+}
+
+// token 结束于续行符时回退到续行符，使其作为单独的 token
+func (s *scanner) unsplice() {
+	if s.lastSplice < 0 {
+		return
+	}
+	s.rdOffset = s.lastSplice
+	s.splice = false
+	s.next()
+	s.splice = true
+}
+
+// 获取 token 的拼写（去除续行符）
+func (s *scanner) lit(offs int) string {
+	s.unsplice()
+	src := s.src[offs:s.offset]
+	var b strings.Builder
+	for i := 0; i < len(src); i++ {
+		if s.isSplice(offs + i) {
+			n, _ := s.spliceLen(offs + i)
+			i += n - 1
+			continue
 		}
+		b.WriteByte(src[i])
 	}
-	return ok
+	return b.String()
 }
 
 func (s *scanner) scanNewLine() {
@@ -631,6 +746,11 @@ func (s *scanner) error(offs int, msg string) {
 	s.err.Add(p, msg)
 }
 
+func (s *scanner) warning(offs int, msg string) {
+	p := s.posInfo.CreatePosition(token.Pos(offs))
+	s.err.AddWarning(p, msg)
+}
+
 func (s *scanner) errorf(offs int, format string, args ...interface{}) {
 	s.error(offs, fmt.Sprintf(format, args...))
 }
@@ -641,6 +761,21 @@ func NewScanner(src []byte) Scanner {
 	return s
 }
 
+// 从行首 offset 处开始扫描，位置与错误信息按完整源码计算
+func NewScannerAt(src []byte, offset int) Scanner {
+	s := &scanner{}
+	s.init(src)
+	if offset > 0 {
+		// 与从头扫描一致，行首的续行符作为单独的 token
+		s.rdOffset = offset
+		s.splice = false
+		s.next()
+		s.splice = true
+	}
+	s.isLineStart = true
+	return s
+}
+
 func NewOffsetScanner(src []byte, pos token.Pos) Scanner {
 	s := &offsetScanner{}
 	s.off = pos
@@ -648,6 +783,17 @@ func NewOffsetScanner(src []byte, pos token.Pos) Scanner {
 	return s
 }
 
+// 创建指令内的扫描器
+// 用于单独扫描指令的片段，如 #if 表达式（directive 为 token.IF）或宏定义体（token.DEFINE）
+func NewDirectiveScanner(src []byte, pos token.Pos, directive token.Token) Scanner {
+	s := &offsetScanner{}
+	s.off = pos
+	s.init(src)
+	s.isLineStart = false
+	s.directive = directive
+	return s
+}
+
 type offsetScanner struct {
 	scanner
 	off token.Pos // 子表达式
@@ -666,6 +812,9 @@ func (s *offsetScanner) CloneWithoutSrc() Scanner {
 			offset:      s.offset,
 			rdOffset:    s.rdOffset,
 			isLineStart: s.isLineStart,
+			directive:   s.directive,
+			splice:      s.splice,
+			lastSplice:  s.lastSplice,
 			err:         s.err,
 			posInfo:     s.posInfo,
 		},
@@ -61,35 +61,35 @@ func TestScanner_Scan(t *testing.T) {
 		lit    string
 	}{
 		{0, token.CHAR, "'a'"}, {3, token.TEXT, " "}, {4, token.CHAR, "'\\''"}, {8, token.NEWLINE, "\n"},
-		{9, token.QUOTE, "'"}, {10, token.QUOTE, "'"}, {11, token.CHAR, "'\\''"}, {15, token.SUB, "-"}, {16, token.FLOAT, "1.6e+10"}, {23, token.TEXT, " "}, {24, token.ADD, "+"}, {25, token.FLOAT, "0xbbp-4"}, {32, token.TEXT, " "}, {33, token.FLOAT, "0123p13"}, {40, token.NEWLINE, "\n"},
+		{9, token.QUOTE, "'"}, {10, token.QUOTE, "'"}, {11, token.CHAR, "'\\''"}, {15, token.SUB, "-"}, {16, token.FLOAT, "1.6e+10"}, {23, token.TEXT, " "}, {24, token.ADD, "+"}, {25, token.FLOAT, "0xbbp-4"}, {32, token.TEXT, " "}, {33, token.INT, "0123p13"}, {40, token.NEWLINE, "\n"},
 		{41, token.FLOAT, "123.45"}, {47, token.TEXT, " "}, {48, token.FLOAT, "0xABC.EF"}, {56, token.STRING, "\"dxkite\""}, {64, token.TEXT, " "}, {65, token.STRING, "\"personal.h\""}, {77, token.QUOTE, "'"}, {78, token.INT, "4"}, {79, token.DOUBLE_QUOTE, "\""}, {80, token.INT, "56"}, {82, token.QUOTE, "'"}, {83, token.NEWLINE, "\n"},
 		{84, token.STRING, "\"dxkite\""}, {92, token.TEXT, " "}, {93, token.STRING, "\"personal.h\""}, {105, token.NEWLINE, "\n"},
-		{106, token.INT, "12"}, {108, token.TEXT, " "}, {109, token.QUO, "/"}, {110, token.TEXT, " "}, {111, token.INT, "123"}, {114, token.QUOTE, "'"}, {115, token.INT, "4"}, {116, token.DOUBLE_QUOTE, "\""}, {117, token.INT, "56"}, {119, token.QUOTE, "'"}, {120, token.SHARP, "#"}, {121, token.IDENT, "abc"}, {124, token.DOUBLE_SHARP, "##"}, {126, token.INT, "1234"}, {130, token.NEWLINE, "\n"},
+		{106, token.INT, "12"}, {108, token.TEXT, " "}, {109, token.QUO, "/"}, {110, token.TEXT, " "}, {111, token.INT, "123'4"}, {116, token.DOUBLE_QUOTE, "\""}, {117, token.INT, "56"}, {119, token.QUOTE, "'"}, {120, token.SHARP, "#"}, {121, token.IDENT, "abc"}, {124, token.DOUBLE_SHARP, "##"}, {126, token.INT, "1234"}, {130, token.NEWLINE, "\n"},
 		{131, token.MACRO, "#"}, {132, token.INCLUDE, "include"}, {139, token.TEXT, " "}, {140, token.LSS, "<"}, {141, token.IDENT, "stdio"}, {146, token.TEXT, "."}, {147, token.IDENT, "h"}, {148, token.GTR, ">"}, {149, token.NEWLINE, "\n"},
 		{150, token.MACRO, "#"}, {151, token.TEXT, " "}, {152, token.INCLUDE, "include"}, {159, token.TEXT, " "}, {160, token.STRING, "\"personal.h\""}, {172, token.NEWLINE, "\n"},
-		{173, token.MACRO, "#"}, {174, token.TEXT, "  "}, {176, token.ERROR, "error"}, {181, token.TEXT, " "}, {182, token.IDENT, "something"}, {191, token.TEXT, " "}, {192, token.ERROR, "error"}, {197, token.NEWLINE, "\n"},
+		{173, token.MACRO, "#"}, {174, token.TEXT, "  "}, {176, token.ERROR, "error"}, {181, token.TEXT, " "}, {182, token.IDENT, "something"}, {191, token.TEXT, " "}, {192, token.IDENT, "error"}, {197, token.NEWLINE, "\n"},
 		{198, token.IDENT, "int"}, {201, token.TEXT, " "}, {202, token.IDENT, "main"}, {206, token.LPAREN, "("}, {207, token.RPAREN, ")"}, {208, token.TEXT, " "}, {209, token.DOUBLE_QUOTE, "\""}, {210, token.TEXT, " {      "}, {218, token.COMMENT, "// comment"}, {228, token.NEWLINE, "\n"},
 		{229, token.TEXT, "\t"}, {230, token.IDENT, "MAX"}, {233, token.TEXT, " "}, {234, token.BLOCK_COMMENT, "/*\nblock comment\n*/"}, {253, token.NEWLINE, "\n"},
 		{254, token.TEXT, "\t"}, {255, token.INT, "0b1010102345"}, {267, token.XOR, "^"}, {268, token.INT, "0b124"}, {273, token.NEWLINE, "\n"},
 		{274, token.TEXT, "\t"}, {275, token.NOT, "~"}, {276, token.INT, "22"}, {278, token.NEWLINE, "\n"},
 		{279, token.TEXT, "\t"}, {280, token.BLOCK_COMMENT, "/* some comment */"}, {298, token.IDENT, "printf"}, {304, token.LPAREN, "("}, {305, token.STRING, "\"hello \\\" world\""}, {321, token.COMMA, ","}, {322, token.INT, "12"}, {324, token.TEXT, " "}, {325, token.INT, "342"}, {328, token.COMMA, ","}, {329, token.TEXT, " "}, {330, token.CHAR, "'\\''"}, {334, token.RPAREN, ")"}, {335, token.TEXT, "; "}, {337, token.BLOCK_COMMENT, "/* some comment */"}, {355, token.NEWLINE, "\n"},
 		{356, token.TEXT, "} "}, {358, token.QUOTE, "'"}, {359, token.QUOTE, "'"}, {360, token.NEWLINE, "\n"},
-		{361, token.IDENT, "STR"}, {364, token.LPAREN, "("}, {365, token.IDENT, "a"}, {366, token.TEXT, " "}, {367, token.INT, "123"}, {370, token.TEXT, " "}, {371, token.INT, "41"}, {373, token.QUOTE, "'"}, {374, token.INT, "2"}, {375, token.QUO, "/"}, {376, token.INT, "24"}, {378, token.DOUBLE_QUOTE, "\""}, {379, token.INT, "51"}, {381, token.TEXT, " "}, {382, token.INT, "12"}, {384, token.COMMA, ","}, {385, token.TEXT, " "}, {386, token.CHAR, "'b'"}, {389, token.TEXT, ". "}, {391, token.CHAR, "'\\0'"}, {395, token.COMMA, ","}, {396, token.TEXT, " "}, {397, token.CHAR, "'\\100'"}, {403, token.COMMA, ","}, {404, token.TEXT, " "}, {405, token.CHAR, "'\\''"}, {409, token.RPAREN, ")"}, {410, token.NEWLINE, "\n"},
+		{361, token.IDENT, "STR"}, {364, token.LPAREN, "("}, {365, token.IDENT, "a"}, {366, token.TEXT, " "}, {367, token.INT, "123"}, {370, token.TEXT, " "}, {371, token.INT, "41'2"}, {375, token.QUO, "/"}, {376, token.INT, "24"}, {378, token.DOUBLE_QUOTE, "\""}, {379, token.INT, "51"}, {381, token.TEXT, " "}, {382, token.INT, "12"}, {384, token.COMMA, ","}, {385, token.TEXT, " "}, {386, token.CHAR, "'b'"}, {389, token.TEXT, ". "}, {391, token.CHAR, "'\\0'"}, {395, token.COMMA, ","}, {396, token.TEXT, " "}, {397, token.CHAR, "'\\100'"}, {403, token.COMMA, ","}, {404, token.TEXT, " "}, {405, token.CHAR, "'\\''"}, {409, token.RPAREN, ")"}, {410, token.NEWLINE, "\n"},
 		{411, token.MACRO, "#"}, {412, token.IFNDEF, "ifndef"}, {418, token.TEXT, " "}, {419, token.IDENT, "A"}, {420, token.NEWLINE, "\n"},
 		{421, token.MACRO, "#"}, {422, token.ERROR, "error"}, {427, token.TEXT, " "}, {428, token.IDENT, "missing"}, {435, token.TEXT, " "}, {436, token.IDENT, "a"}, {437, token.TEXT, " "}, {438, token.IDENT, "config"}, {444, token.NEWLINE, "\n"},
 		{445, token.MACRO, "#"}, {446, token.ENDIF, "endif"}, {451, token.NEWLINE, "\n"},
 		{452, token.SHR, ">>"}, {454, token.GEQ, ">="}, {456, token.OR, "|"}, {457, token.LNOT, "!"}, {458, token.TEXT, " "}, {459, token.EQU, "="}, {460, token.TEXT, " "}, {461, token.NEQ, "!="}, {463, token.TEXT, " "}, {464, token.LEQ, "<="}, {466, token.TEXT, " "}, {467, token.SHL, "<<"}, {469, token.TEXT, " "}, {470, token.MUL, "*"}, {471, token.TEXT, " "}, {472, token.REM, "%"}, {473, token.TEXT, " "}, {474, token.LAND, "&&"}, {476, token.TEXT, " "}, {477, token.AND, "&"}, {478, token.TEXT, " "}, {479, token.LOR, "||"}, {481, token.TEXT, " "}, {482, token.OR, "|"}, {483, token.TEXT, "☺"}, {486, token.IDENT, "中文"}, {492, token.TEXT, " "}, {493, token.EQL, "=="}, {495, token.NEWLINE, "\n"},
 		{496, token.MACRO, "#"}, {497, token.IF, "if"}, {499, token.TEXT, " "}, {500, token.LNOT, "!"}, {501, token.DEFINED, "defined"}, {508, token.TEXT, " "}, {509, token.IDENT, "A"}, {510, token.NEWLINE, "\n"},
-		{511, token.MACRO, "#"}, {512, token.ELSEIF, "elif"}, {516, token.TEXT, " "}, {517, token.FLOAT, "1f"}, {519, token.TEXT, " "}, {520, token.ADD, "+"}, {521, token.TEXT, " "}, {522, token.IDENT, "A"}, {523, token.TEXT, "  "}, {525, token.GTR, ">"}, {526, token.TEXT, " "}, {527, token.INT, "2020uL"}, {533, token.NEWLINE, "\n"},
+		{511, token.MACRO, "#"}, {512, token.ELSEIF, "elif"}, {516, token.TEXT, " "}, {517, token.INT, "1f"}, {519, token.TEXT, " "}, {520, token.ADD, "+"}, {521, token.TEXT, " "}, {522, token.IDENT, "A"}, {523, token.TEXT, "  "}, {525, token.GTR, ">"}, {526, token.TEXT, " "}, {527, token.INT, "2020uL"}, {533, token.NEWLINE, "\n"},
 		{534, token.MACRO, "#"}, {535, token.IFDEF, "ifdef"}, {540, token.TEXT, " "}, {541, token.IDENT, "B"}, {542, token.NEWLINE, "\n"},
 		{543, token.MACRO, "#"}, {544, token.ELSE, "else"}, {548, token.NEWLINE, "\n"},
 		{549, token.MACRO, "#"}, {550, token.ELSEIF, "elif"}, {554, token.NEWLINE, "\n"},
 		{555, token.MACRO, "#"}, {556, token.DEFINE, "define"}, {562, token.TEXT, " "}, {563, token.IDENT, "$A"}, {565, token.TEXT, " "}, {566, token.INT, "123"}, {569, token.NEWLINE, "\n"},
 		{570, token.MACRO, "#"}, {571, token.TEXT, " "}, {572, token.IDENT, "hello"}, {577, token.TEXT, " "}, {578, token.IDENT, "world"}, {583, token.NEWLINE, "\n"},
 		{584, token.MACRO, "#"}, {585, token.LINE, "line"}, {589, token.TEXT, " "}, {590, token.INT, "30"}, {592, token.TEXT, " "}, {593, token.STRING, "\"test.c\""}, {601, token.TEXT, " "}, {602, token.INT, "012345678"}, {611, token.NEWLINE, "\n"},
-		{612, token.MACRO, "#"}, {613, token.ERROR, "error"}, {618, token.TEXT, " "}, {619, token.IDENT, "b"}, {620, token.TEXT, " "}, {621, token.IDENT, "is"}, {623, token.TEXT, " "}, {624, token.BACKSLASH_NEWLINE, "\\\n"}, {626, token.TEXT, "\t"}, {627, token.DEFINED, "defined"}, {634, token.NEWLINE, "\n"},
+		{612, token.MACRO, "#"}, {613, token.ERROR, "error"}, {618, token.TEXT, " "}, {619, token.IDENT, "b"}, {620, token.TEXT, " "}, {621, token.IDENT, "is"}, {623, token.TEXT, " "}, {624, token.BACKSLASH_NEWLINE, "\\\n"}, {626, token.TEXT, "\t"}, {627, token.IDENT, "defined"}, {634, token.NEWLINE, "\n"},
 		{635, token.MACRO, "#"}, {636, token.ERROR, "error"}, {641, token.TEXT, " "}, {642, token.IDENT, "b"}, {643, token.TEXT, " "}, {644, token.IDENT, "is"}, {646, token.TEXT, " \\ "}, {649, token.INT, "12"}, {651, token.TEXT, " "}, {652, token.NEWLINE, "\n"},
-		{653, token.TEXT, "\t"}, {654, token.DEFINED, "defined"}, {661, token.NEWLINE, "\n"},
+		{653, token.TEXT, "\t"}, {654, token.IDENT, "defined"}, {661, token.NEWLINE, "\n"},
 		{662, token.MACRO, "#"}, {663, token.ENDIF, "endif"}, {668, token.NEWLINE, "\n"},
 		{669, token.MACRO, "#"}, {670, token.IF, "if"}, {672, token.TEXT, " "}, {673, token.INT, "123BCDE123"}, {683, token.NEWLINE, "\n"},
 		{684, token.IDENT, "int"}, {687, token.TEXT, " "}, {688, token.IDENT, "ch"}, {690, token.TEXT, " "}, {691, token.EQU, "="}, {692, token.TEXT, " "}, {693, token.INT, "123"}, {696, token.TEXT, ";"}, {697, token.NEWLINE, "\n"},
@@ -99,14 +99,12 @@ func TestScanner_Scan(t *testing.T) {
 		{751, token.IDENT, "B"}, {752, token.LPAREN, "("}, {753, token.IDENT, "awd"}, {756, token.RPAREN, ")"}, {757, token.NEWLINE, "\n"},
 		{758, token.INT, "123B"}, {762, token.NEWLINE, "\n"},
 		{763, token.STRING, "\"a\\0a\""}, {769, token.TEXT, " "}, {770, token.STRING, "\"\\xaabbcc\""}, {780, token.TEXT, " "}, {781, token.STRING, "\"\\xFFbbcc\\t\\\"\""}, {795, token.NEWLINE, "\n"},
-		{796, token.MACRO, "#"}, {797, token.UNDEF, "undef"}, {802, token.TEXT, " "}, {803, token.IDENT, "A"}, {804, token.SHARP, "#"}, {805, token.DEFINE, "define"}, {811, token.TEXT, " "}, {812, token.IDENT, "a"}, {813, token.TEXT, " "}, {814, token.NEWLINE, "\r\r\r\r\n"},
-		{819, token.MACRO, "#"}, {820, token.DEFINE, "define"}, {826, token.TEXT, " "}, {827, token.IDENT, "b"}, {828, token.BACKSLASH_NEWLINE, "\\\r\r\r\r\n"}, {834, token.MACRO, "#"}, {835, token.IDENT, "abc"}, {838, token.TEXT, " "}, {839, token.COMMENT, "//aaa"}, {844, token.NEWLINE, "\r\r\r\r\n"},
+		{796, token.MACRO, "#"}, {797, token.UNDEF, "undef"}, {802, token.TEXT, " "}, {803, token.IDENT, "A"}, {804, token.SHARP, "#"}, {805, token.IDENT, "define"}, {811, token.TEXT, " "}, {812, token.IDENT, "a"}, {813, token.TEXT, " "}, {814, token.NEWLINE, "\r\r\r\r\n"},
+		{819, token.MACRO, "#"}, {820, token.DEFINE, "define"}, {826, token.TEXT, " "}, {827, token.IDENT, "b"}, {828, token.BACKSLASH_NEWLINE, "\\\r\r\r\r\n"}, {834, token.SHARP, "#"}, {835, token.IDENT, "abc"}, {838, token.TEXT, " "}, {839, token.COMMENT, "//aaa"}, {844, token.NEWLINE, "\r\r\r\r\n"},
 		{849, token.EOF, ""},
 	}
 
-	errors := ErrorList{
-		&Error{token.Position{37, 2, 28}, "'p' exponent requires hexadecimal mantissa"},
-	}
+	var errors ErrorList
 
 	litCode := ""
 
@@ -178,3 +176,122 @@ func TestTokenName(t *testing.T) {
 		fmt.Printf("&Error{Position{%d,%d,%d},%s},\n", err.Pos.Offset, err.Pos.Line, err.Pos.Column, strconv.QuoteToGraphic(err.Msg))
 	}
 }
+
+func TestScanner_scanNumber(t *testing.T) {
+	tests := []struct {
+		code string
+		tok  token.Token
+		lit  string
+	}{
+		{"1.2.3", token.FLOAT, "1.2.3"},
+		{"0x1p-3", token.FLOAT, "0x1p-3"},
+		{"1e+5f", token.FLOAT, "1e+5f"},
+		{"10'000", token.INT, "10'000"},
+		{"123ull", token.INT, "123ull"},
+		{"1zu", token.INT, "1zu"},
+		{"0b1010u", token.INT, "0b1010u"},
+		{"1.0e", token.FLOAT, "1.0e"},
+		{".5f", token.FLOAT, ".5f"},
+		{"0xe+1", token.INT, "0xe+1"},
+		{"1+2", token.INT, "1"},
+		{"12'a'", token.INT, "12'a"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.code, func(t *testing.T) {
+			s := &scanner{}
+			s.init([]byte(tt.code))
+			_, tok, lit := s.Scan()
+			if tok != tt.tok || lit != tt.lit {
+				t.Errorf("Scan() = %v %q, want %v %q", tok, lit, tt.tok, tt.lit)
+			}
+		})
+	}
+}
+
+func TestScanner_directive(t *testing.T) {
+	tests := []struct {
+		code string
+		want []token.Token
+	}{
+		{"if (x) error = 1", []token.Token{token.IDENT, token.LPAREN, token.IDENT, token.RPAREN, token.IDENT, token.EQU, token.INT}},
+		{"#if defined A", []token.Token{token.MACRO, token.IF, token.DEFINED, token.IDENT}},
+		{"#ifdef defined", []token.Token{token.MACRO, token.IFDEF, token.IDENT}},
+		{"#define if defined", []token.Token{token.MACRO, token.DEFINE, token.IDENT, token.IDENT}},
+		{"  # include <a.h>", []token.Token{token.MACRO, token.INCLUDE, token.LSS, token.IDENT, token.TEXT, token.IDENT, token.GTR}},
+		{"/* c */ #\tdefine A", []token.Token{token.BLOCK_COMMENT, token.MACRO, token.DEFINE, token.IDENT}},
+		{"x # define", []token.Token{token.IDENT, token.SHARP, token.IDENT}},
+		{"#elif defined\nelse defined", []token.Token{token.MACRO, token.ELSEIF, token.DEFINED, token.NEWLINE, token.IDENT, token.IDENT}},
+		{"#define A \\\n#else", []token.Token{token.MACRO, token.DEFINE, token.IDENT, token.BACKSLASH_NEWLINE, token.SHARP, token.IDENT}},
+		{"#if a?b:c", []token.Token{token.MACRO, token.IF, token.IDENT, token.QUESTION, token.IDENT, token.COLON, token.IDENT}},
+		{"#elif a ?: c", []token.Token{token.MACRO, token.ELSEIF, token.IDENT, token.QUESTION, token.COLON, token.IDENT}},
+		{"x = a?b:c", []token.Token{token.IDENT, token.EQU, token.IDENT, token.TEXT, token.IDENT, token.TEXT, token.IDENT}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.code, func(t *testing.T) {
+			s := &scanner{}
+			s.init([]byte(tt.code))
+			var got []token.Token
+			for {
+				_, tok, lit := s.Scan()
+				if tok == token.EOF {
+					break
+				}
+				if tok == token.TEXT && isSpace(lit) {
+					continue
+				}
+				got = append(got, tok)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Scan() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestScanner_splice(t *testing.T) {
+	type tok struct {
+		offset token.Pos
+		tok    token.Token
+		lit    string
+	}
+	tests := []struct {
+		code string
+		want []tok
+		errs int
+	}{
+		{"AB\\\nC", []tok{{0, token.IDENT, "ABC"}}, 0},
+		{"12\\\r\n34", []tok{{0, token.INT, "1234"}}, 0},
+		{"a &\\\n& b", []tok{{0, token.IDENT, "a"}, {1, token.TEXT, " "}, {2, token.LAND, "&&"}, {6, token.TEXT, " "}, {7, token.IDENT, "b"}}, 0},
+		{"// a \\\n b\nc", []tok{{0, token.COMMENT, "// a  b"}, {9, token.NEWLINE, "\n"}, {10, token.IDENT, "c"}}, 0},
+		{"\"a\\\nb\"", []tok{{0, token.STRING, "\"ab\""}}, 0},
+		{"/* a *\\\n/b", []tok{{0, token.BLOCK_COMMENT, "/* a */"}, {9, token.IDENT, "b"}}, 0},
+		{"a\\\n b", []tok{{0, token.IDENT, "a"}, {1, token.BACKSLASH_NEWLINE, "\\\n"}, {3, token.TEXT, " "}, {4, token.IDENT, "b"}}, 0},
+		{"a\\ \nb", []tok{{0, token.IDENT, "ab"}}, 1},
+		{"a \\ \nb", []tok{{0, token.IDENT, "a"}, {1, token.TEXT, " "}, {2, token.BACKSLASH_NEWLINE, "\\ \n"}, {5, token.IDENT, "b"}}, 1},
+	}
+	for _, tt := range tests {
+		t.Run(strconv.Quote(tt.code), func(t *testing.T) {
+			s := &scanner{}
+			s.init([]byte(tt.code))
+			var got []tok
+			for {
+				offset, tk, lit := s.Scan()
+				if tk == token.EOF {
+					break
+				}
+				got = append(got, tok{offset, tk, lit})
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Scan() = %v, want %v", got, tt.want)
+			}
+			if len(s.err) != tt.errs {
+				t.Errorf("Scan() errors = %v, want %d", s.err, tt.errs)
+			}
+			for _, err := range s.err {
+				if !err.Warning || err.Message() != "warning: backslash and newline separated by space" {
+					t.Errorf("Scan() error = %+v, want warning", err)
+				}
+			}
+		})
+	}
+}
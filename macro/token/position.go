@@ -12,7 +12,7 @@ type Position struct {
 }
 
 // 是否可用
-func (pos *Position) IsValid() bool { return pos.Offset > 0 }
+func (pos *Position) IsValid() bool { return pos.Line > 0 }
 
 // 位置打印字符串
 func (pos Position) String() string {
@@ -1,6 +1,7 @@
 package token
 
 import (
+	"errors"
 	"strconv"
 )
 
@@ -65,6 +66,24 @@
 	NEWLINE           // \r*\n
 	BACKSLASH_NEWLINE // \
 	EQU               // =
+	QUESTION          // ?
+	COLON             // :
+
+	// C punctuators (only produced by the preprocessed token stream)
+	ARROW      // ->
+	INC        // ++
+	DEC        // --
+	ELLIPSIS   // ...
+	ADD_ASSIGN // +=
+	SUB_ASSIGN // -=
+	MUL_ASSIGN // *=
+	QUO_ASSIGN // /=
+	REM_ASSIGN // %=
+	AND_ASSIGN // &=
+	OR_ASSIGN  // |=
+	XOR_ASSIGN // ^=
+	SHL_ASSIGN // <<=
+	SHR_ASSIGN // >>=
 
 	operator_end
 
@@ -135,6 +154,23 @@
 	LPAREN:            "(",
 	COMMA:             ",",
 	RPAREN:            ")",
+	QUESTION:          "?",
+	COLON:             ":",
+
+	ARROW:      "->",
+	INC:        "++",
+	DEC:        "--",
+	ELLIPSIS:   "...",
+	ADD_ASSIGN: "+=",
+	SUB_ASSIGN: "-=",
+	MUL_ASSIGN: "*=",
+	QUO_ASSIGN: "/=",
+	REM_ASSIGN: "%=",
+	AND_ASSIGN: "&=",
+	OR_ASSIGN:  "|=",
+	XOR_ASSIGN: "^=",
+	SHL_ASSIGN: "<<=",
+	SHR_ASSIGN: ">>=",
 
 	INCLUDE: "include",
 	IF:      "if",
@@ -167,6 +203,19 @@ func (tok Token) MarshalJSON() ([]byte, error) {
 	return []byte(strconv.QuoteToGraphic(Name(tok).String())), nil
 }
 
+func (tok *Token) UnmarshalJSON(b []byte) error {
+	name, err := strconv.Unquote(string(b))
+	if err != nil {
+		return err
+	}
+	t, ok := names[name]
+	if !ok {
+		return errors.New("unknown token " + name)
+	}
+	*tok = t
+	return nil
+}
+
 // 是否是操作符
 func (tok Token) IsOperator() bool { return operator_beg < tok && tok < operator_end }
 
@@ -215,6 +264,22 @@ func (tok Token) IsKeyword() bool { return keyword_beg < tok && tok < keyword_en
 	LPAREN:            "LPAREN",
 	COMMA:             "COMMA",
 	RPAREN:            "RPAREN",
+	QUESTION:          "QUESTION",
+	COLON:             "COLON",
+	ARROW:             "ARROW",
+	INC:               "INC",
+	DEC:               "DEC",
+	ELLIPSIS:          "ELLIPSIS",
+	ADD_ASSIGN:        "ADD_ASSIGN",
+	SUB_ASSIGN:        "SUB_ASSIGN",
+	MUL_ASSIGN:        "MUL_ASSIGN",
+	QUO_ASSIGN:        "QUO_ASSIGN",
+	REM_ASSIGN:        "REM_ASSIGN",
+	AND_ASSIGN:        "AND_ASSIGN",
+	OR_ASSIGN:         "OR_ASSIGN",
+	XOR_ASSIGN:        "XOR_ASSIGN",
+	SHL_ASSIGN:        "SHL_ASSIGN",
+	SHR_ASSIGN:        "SHR_ASSIGN",
 	INCLUDE:           "INCLUDE",
 	IF:                "IF",
 	IFDEF:             "IFDEF",
@@ -249,11 +314,28 @@ func (tok Name) String() string {
 
 var keywords map[string]Token
 
+// 名称对应的 token
+var names map[string]Token
+
 func init() {
 	keywords = make(map[string]Token)
 	for i := keyword_beg + 1; i < keyword_end; i++ {
 		keywords[tokens[i]] = i
 	}
+	names = make(map[string]Token)
+	for i, name := range tokenName {
+		if name != "" {
+			names[name] = Token(i)
+		}
+	}
+}
+
+// 查找关键字
+func Lookup(ident string) Token {
+	if tok, ok := keywords[ident]; ok {
+		return tok
+	}
+	return IDENT
 }
 
 const (
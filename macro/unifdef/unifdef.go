@@ -0,0 +1,388 @@
+// 部分预处理
+// 按已知定义或未定义的宏化简条件编译，其余内容（包括宏的使用）保持不变
+package unifdef
+
+import (
+	"bytes"
+	"dxkite.cn/language/macro/ast"
+	"dxkite.cn/language/macro/interpreter"
+	"dxkite.cn/language/macro/parser"
+	"dxkite.cn/language/macro/printer"
+	"dxkite.cn/language/macro/scanner"
+	"dxkite.cn/language/macro/token"
+	"fmt"
+	"strings"
+)
+
+// 已知的宏
+type Config struct {
+	Defined   map[string]string // 已定义的宏及其值
+	Undefined map[string]bool   // 已知未定义的宏
+}
+
+// 化简源码中的条件编译，返回改写后的源码
+func (c *Config) Process(src []byte) ([]byte, scanner.ErrorList) {
+	node, errs := parser.Parse(src)
+	u := &unifdef{Config: c, src: src, it: &interpreter.Interpreter{}}
+	if block, ok := node.(*ast.BlockStmt); ok {
+		u.stmts(0, token.Pos(len(src)), *block)
+	}
+	return u.out.Bytes(), errs
+}
+
+type unifdef struct {
+	*Config
+	src []byte
+	it  *interpreter.Interpreter // 计算常量表达式
+	out bytes.Buffer
+}
+
+// 条件的值
+type value int
+
+const (
+	unknown value = iota
+	isFalse
+	isTrue
+)
+
+// 化简后的分支
+type branch struct {
+	*ast.CondBranch
+	cond    string // 化简后的条件，未改变时为空
+	keyword string // 输出的指令名
+}
+
+// 输出 [from, to) 范围的语句
+func (u *unifdef) stmts(from, to token.Pos, list ast.BlockStmt) {
+	for _, stmt := range list {
+		block := ast.Branches(stmt)
+		if block == nil || block.Branches[0].Directive == nil {
+			continue
+		}
+		u.copy(from, block.From)
+		u.condBlock(block)
+		from = block.To
+		if block.Endif != nil {
+			from = block.Endif.To
+		}
+	}
+	u.copy(from, to)
+}
+
+// 化简条件块
+// 指令所在行的缩进由 emit 按需输出
+func (u *unifdef) condBlock(block *ast.CondBlock) {
+	u.trimIndent()
+	var kept []*branch
+	var last *ast.CondBranch // 值为真的分支
+	for _, b := range block.Branches {
+		v, cond := u.branch(b)
+		if v == isFalse {
+			continue
+		}
+		if v == isTrue {
+			last = b
+			break
+		}
+		kb := &branch{CondBranch: b, cond: cond, keyword: "elif"}
+		if len(kept) == 0 {
+			kb.keyword = "if"
+			if cond == "" && b.Directive.Kind != token.ELSEIF {
+				// 首个分支不变时保留 #ifdef #ifndef
+				kb.keyword = ""
+			}
+			if cond == "" && b.Directive.Kind == token.ELSEIF {
+				kb.cond = strings.TrimSpace(printer.Sprint(b.Cond))
+			}
+		}
+		kept = append(kept, kb)
+	}
+	for _, b := range kept {
+		if b.cond == "" && (b.keyword == "" || b.Directive.Kind == keywordKind[b.keyword]) {
+			u.emit(b.Directive, string(u.src[b.Directive.From:b.Directive.To]))
+		} else {
+			u.emit(b.Directive, u.directive(b.Directive, b.keyword, b.cond))
+		}
+		u.body(b.CondBranch)
+	}
+	if last != nil && len(kept) > 0 {
+		if last.Directive.Kind == token.ELSE {
+			u.emit(last.Directive, string(u.src[last.Directive.From:last.Directive.To]))
+		} else {
+			u.emit(last.Directive, u.directive(last.Directive, "else", ""))
+		}
+	}
+	if last != nil {
+		u.body(last)
+	}
+	if len(kept) > 0 && block.Endif != nil {
+		u.emit(block.Endif, string(u.src[block.Endif.From:block.Endif.To]))
+	} else {
+		// 删除的指令所在行只有缩进时去掉缩进
+		u.trimIndent()
+	}
+}
+
+var keywordKind = map[string]token.Token{
+	"if":   token.IF,
+	"elif": token.ELSEIF,
+}
+
+// 输出分支体
+func (u *unifdef) body(b *ast.CondBranch) {
+	list, _ := b.Body.(*ast.BlockStmt)
+	if list == nil {
+		u.copy(b.BodyFrom, b.BodyTo)
+		return
+	}
+	u.stmts(b.BodyFrom, b.BodyTo, *list)
+}
+
+// 改写指令，保留 # 与指令名之间的空白
+func (u *unifdef) directive(d *ast.Directive, keyword, cond string) string {
+	text := string(u.src[d.From:d.To])
+	i := 1
+	for i < len(text) && (text[i] == ' ' || text[i] == '\t') {
+		i++
+	}
+	text = text[:i] + keyword
+	if cond != "" {
+		text += " " + cond
+	}
+	return text + "\n"
+}
+
+// 输出指令，保留指令所在行的缩进
+func (u *unifdef) emit(d *ast.Directive, text string) {
+	if u.trimIndent() {
+		i := d.From
+		for i > 0 && (u.src[i-1] == ' ' || u.src[i-1] == '\t') {
+			i--
+		}
+		u.copy(i, d.From)
+	}
+	u.out.WriteString(text)
+}
+
+// 分支条件的值，未知时返回化简后的条件（未改变时为空）
+func (u *unifdef) branch(b *ast.CondBranch) (value, string) {
+	switch b.Directive.Kind {
+	case token.ELSE:
+		return isTrue, ""
+	case token.IFDEF, token.IFNDEF:
+		id, _ := b.Cond.(*ast.Ident)
+		if id == nil {
+			return unknown, ""
+		}
+		v := u.defined(id.Name)
+		if b.Directive.Kind == token.IFNDEF {
+			v = not(v)
+		}
+		return v, ""
+	}
+	text := printer.Sprint(b.Cond)
+	expr, errs := parser.ParseExpr([]byte(text), 0)
+	if len(errs) > 0 || expr == nil {
+		return unknown, ""
+	}
+	// 不依赖已知宏的常量条件（如 #if 0）保持不变
+	e := u.simplify(expr, true)
+	if e.value != unknown && e.uses {
+		return e.value, ""
+	}
+	if e.value != unknown || !e.changed {
+		return unknown, ""
+	}
+	return unknown, printer.Sprint(e.expr)
+}
+
+// 化简后的表达式
+type expr struct {
+	expr    ast.MacroLiter
+	value   value  // 作为条件的值
+	lit     string // 常量值
+	changed bool   // 表达式是否改变
+	uses    bool   // 是否用到已知的宏
+}
+
+// 化简表达式
+// cond 为 true 时表达式只作为条件使用，&& || 的运算数可以直接替换
+func (u *unifdef) simplify(x ast.MacroLiter, cond bool) expr {
+	switch n := x.(type) {
+	case *ast.LitExpr:
+		return u.constant(x, n.Value)
+	case *ast.Ident:
+		if v, ok := u.Defined[n.Name]; ok {
+			if e := u.constant(x, v); e.value != unknown {
+				e.changed, e.uses = true, true
+				return e
+			}
+		} else if u.Undefined[n.Name] {
+			e := u.constant(x, "0")
+			e.uses = true
+			return e
+		}
+	case *ast.ParenExpr:
+		e := u.simplify(n.X, cond)
+		if e.value != unknown {
+			c := u.constant(x, e.lit)
+			c.uses = e.uses
+			return c
+		}
+		if e.changed {
+			// 化简后不是运算表达式时去掉括号
+			if _, ok := e.expr.(*ast.BinaryExpr); !ok {
+				return e
+			}
+			return expr{expr: &ast.ParenExpr{X: e.expr}, changed: true}
+		}
+	case *ast.UnaryExpr:
+		if n.Op == token.DEFINED {
+			id := definedIdent(n.X)
+			if id == nil {
+				break
+			}
+			v := u.defined(id.Name)
+			if v == unknown {
+				break
+			}
+			e := u.constant(x, "0")
+			if v == isTrue {
+				e = u.constant(x, "1")
+			}
+			e.uses = true
+			return e
+		}
+		e := u.simplify(n.X, n.Op == token.LNOT)
+		if e.value != unknown {
+			c := u.constant(x, n.Op.String()+"("+e.lit+")")
+			c.uses = e.uses
+			return c
+		}
+		if e.changed && n.Op == token.LNOT {
+			return expr{expr: &ast.UnaryExpr{Op: n.Op, X: e.expr}, changed: true}
+		}
+	case *ast.BinaryExpr:
+		logical := n.Op == token.LAND || n.Op == token.LOR
+		ex, ey := u.simplify(n.X, cond && logical), u.simplify(n.Y, cond && logical)
+		if ex.value != unknown && ey.value != unknown {
+			c := u.constant(x, "("+ex.lit+")"+n.Op.String()+"("+ey.lit+")")
+			c.uses = ex.uses || ey.uses
+			return c
+		}
+		if logical {
+			// 短路：0 && y 为 0，1 || y 为 1
+			stop, pass := isFalse, isTrue
+			if n.Op == token.LOR {
+				stop, pass = isTrue, isFalse
+			}
+			if ex.value == stop && ex.uses || ey.value == stop && ey.uses {
+				c := u.constant(x, "0")
+				if stop == isTrue {
+					c = u.constant(x, "1")
+				}
+				c.uses = true
+				return c
+			}
+			if cond && ex.value == pass && ex.uses {
+				ey.changed = true
+				return ey
+			}
+			if cond && ey.value == pass && ey.uses {
+				ex.changed = true
+				return ex
+			}
+		}
+		// 只化简逻辑运算，其他运算保持原样
+		if logical && (ex.changed || ey.changed) {
+			return expr{expr: &ast.BinaryExpr{X: ex.expr, Op: n.Op, Y: ey.expr}, changed: true}
+		}
+	}
+	return expr{expr: x}
+}
+
+// 常量表达式的值，不是常量时为未知
+func (u *unifdef) constant(x ast.MacroLiter, s string) expr {
+	v, ok := u.it.EvalConst(s)
+	if !ok {
+		return expr{expr: x}
+	}
+	e := expr{lit: fmt.Sprint(v), value: isFalse}
+	switch n := v.(type) {
+	case int64:
+		e.value = truth(n != 0)
+	case uint64:
+		e.lit += "u"
+		e.value = truth(n != 0)
+	case uint8:
+		e.value = truth(n != 0)
+	case float64:
+		e.value = truth(n != 0)
+	}
+	e.expr = &ast.LitExpr{Kind: token.INT, Value: e.lit}
+	return e
+}
+
+// 宏是否定义
+func (u *unifdef) defined(name string) value {
+	if _, ok := u.Defined[name]; ok {
+		return isTrue
+	}
+	if u.Undefined[name] {
+		return isFalse
+	}
+	return unknown
+}
+
+// defined X 或 defined(X) 中的标识符
+func definedIdent(x ast.MacroLiter) *ast.Ident {
+	for {
+		switch n := x.(type) {
+		case *ast.Ident:
+			return n
+		case *ast.ParenExpr:
+			x = n.X
+		default:
+			return nil
+		}
+	}
+}
+
+// 复制原文
+func (u *unifdef) copy(from, to token.Pos) {
+	if from < to {
+		u.out.Write(u.src[from:to])
+	}
+}
+
+// 输出位于行首时去掉行尾的缩进
+func (u *unifdef) trimIndent() bool {
+	b := u.out.Bytes()
+	i := len(b)
+	for i > 0 && (b[i-1] == ' ' || b[i-1] == '\t') {
+		i--
+	}
+	if i == 0 || b[i-1] == '\n' {
+		u.out.Truncate(i)
+		return true
+	}
+	return false
+}
+
+func not(v value) value {
+	switch v {
+	case isTrue:
+		return isFalse
+	case isFalse:
+		return isTrue
+	}
+	return unknown
+}
+
+func truth(b bool) value {
+	if b {
+		return isTrue
+	}
+	return isFalse
+}
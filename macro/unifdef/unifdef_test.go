@@ -0,0 +1,96 @@
+package unifdef
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func TestConfig_Process(t *testing.T) {
+	c := &Config{
+		Defined:   map[string]string{"A": "1", "B": "2", "F": "FOO", "E": ""},
+		Undefined: map[string]bool{"U": true},
+	}
+	tests := []struct {
+		name string
+		src  string
+		want string
+	}{
+		{"ifdef defined", "#ifdef A\na\n#else\nb\n#endif\nc\n", "a\nc\n"},
+		{"ifndef defined", "#ifndef A\na\n#else\nb\n#endif\n", "b\n"},
+		{"remove indented", "x\n  #ifdef U\n  a\n  #endif\ny\n", "x\ny\n"},
+		{"keep indented body", "  #ifdef A\n  a\n  #endif\ny\n", "  a\ny\n"},
+		{"unknown", "#ifdef X\nx\n#elif Y\ny\n#endif\n", "#ifdef X\nx\n#elif Y\ny\n#endif\n"},
+		{"true elif becomes else", "#if X\nx\n#elif A\na\n#else\nb\n#endif\n", "#if X\nx\n#else\na\n#endif\n"},
+		{"false if promotes elif", "#if U\nu\n#elif X\nx\n#elif B > 1\na\n#endif\n", "#if X\nx\n#else\na\n#endif\n"},
+		{"indented elif", "#if U\nu\n#  elif X\nx\n#endif\n", "#  if X\nx\n#endif\n"},
+		{"partial and", "#if defined(A) && X > 2\nx\n#endif\n", "#if X > 2\nx\n#endif\n"},
+		{"partial or", "#if (U || X) && Y\nx\n#endif\n", "#if X && Y\nx\n#endif\n"},
+		{"short circuit", "#if !defined(U) || X\nx\n#endif\n", "x\n"},
+		{"not partial and", "#if !(A && X)\nx\n#endif\n", "#if !X\nx\n#endif\n"},
+		{"not partial or", "#if !(U || X)\nx\n#endif\n", "#if !X\nx\n#endif\n"},
+		{"complement partial and", "#if ~(A && X)\nx\n#endif\n", "#if ~(A && X)\nx\n#endif\n"},
+		{"complement partial or", "#if ~(U || X)\nx\n#endif\n", "#if ~(U || X)\nx\n#endif\n"},
+		{"all false", "#if U && X\nx\n#elif !defined(A)\ny\n#endif\nz\n", "z\n"},
+		{"constant untouched", "#if 0\nx\n#elif 1 || X\ny\n#endif\n", "#if 0\nx\n#elif 1 || X\ny\n#endif\n"},
+		{"constant kept after false", "#if U\nu\n#elif 0\nx\n#endif\n", "#if 0\nx\n#endif\n"},
+		{"macro value", "#if B == 2\nb\n#endif\n", "b\n"},
+		{"non constant value", "#if F\nx\n#endif\n", "#if F\nx\n#endif\n"},
+		{"division by zero untouched", "#if 1/0\nx\n#endif\n", "#if 1/0\nx\n#endif\n"},
+		{"macro division by zero untouched", "#if A/0\nx\n#elif B % (A - 1)\ny\n#endif\n", "#if A/0\nx\n#elif B % (A - 1)\ny\n#endif\n"},
+		{"arithmetic untouched", "#if A + X\nx\n#endif\n", "#if A + X\nx\n#endif\n"},
+		{"nested", "#ifdef X\n#if A\nq\n#endif\n#endif\n", "#ifdef X\nq\n#endif\n"},
+		{"uses untouched", "#define G A\nint a = A + B;\n", "#define G A\nint a = A + B;\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, errs := c.Process([]byte(tt.src))
+			if len(errs) > 0 {
+				t.Fatal(errs)
+			}
+			if string(got) != tt.want {
+				t.Errorf("Process() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// 没有已知的宏时源码不变
+func TestConfig_ProcessUnchanged(t *testing.T) {
+	files, _ := filepath.Glob("../parser/testdata/*.c")
+	for _, name := range files {
+		src, err := ioutil.ReadFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, _ := (&Config{}).Process(src); !bytes.Equal(got, src) {
+			t.Errorf("Process(%s) changed the source", name)
+		}
+	}
+}
+
+// #else 之后的分支保留在源码中
+func TestConfig_ProcessInvalidBranch(t *testing.T) {
+	src := "#ifdef A\na\n#else\nb\n#else\nc\n#endif\nd\n"
+	tests := []struct {
+		name string
+		c    *Config
+		want string
+	}{
+		{"unknown", &Config{}, src},
+		{"defined", &Config{Defined: map[string]string{"A": "1"}}, "a\nd\n"},
+		{"undefined", &Config{Undefined: map[string]bool{"A": true}}, "b\n#else\nc\nd\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, errs := tt.c.Process([]byte(src))
+			if len(errs) != 1 {
+				t.Errorf("Process() errors = %v", errs)
+			}
+			if string(got) != tt.want {
+				t.Errorf("Process() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}